@@ -7,4 +7,8 @@ type Auth interface {
 	IsAdmin(userID int64) bool
 	ListAllowedUsers() map[int64]string
 	ListAdmins() map[int64]string
+	// Load restores the allowed users when the bot starts and Save persists
+	// them when the bot stops.
+	Load() error
+	Save() error
 }
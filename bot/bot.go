@@ -3,14 +3,18 @@ package bot
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -42,29 +46,90 @@ func init() {
 	}))
 }
 
+// BotConfig struct contains the configuration of the bot. The APIURL and the
+// HTTPClient used to reach the telegram api can be replaced, for example to
+// use a fake api in tests, by default they are DefaultAPIURL and
+// http.DefaultClient. By default, the bot polls the telegram api to get the
+// updates. If a WebhookURL is provided, the
+// bot registers it as webhook instead and listens for the updates in the
+// WebhookListenAddr, checking that the requests include the WebhookSecret. If
+// no secret is provided, a random one is generated. The callbacks of menus and
+// replies expire after CallbackTTL and at most MaxCallbacks of each kind are
+// kept, by default DefaultCallbackTTL and DefaultMaxCallbacks. The sessions
+// and the conversations of each chat are saved in the Store shortly after
+// every update that changes them, and every chat is checked every
+// SnapshotInterval, by default DefaultSnapshotInterval. If no Store is
+// provided, they are saved in a SnapshotStore in the SnapshotPath that keeps
+// the last SnapshotRetention snapshots, by default DefaultSnapshotRetention.
+// The bot closes the store when it is stopped. If an EventLogPath is
+// provided, the changes of the session data that implements EventData are
+// also appended to the event log of their chat in that directory as they
+// happen, and replayed when the bot starts, so they are not lost between
+// saves. If a Cipher is provided, the records of the store and the entries
+// of the event logs are encrypted with it, and the records that are in
+// plaintext or encrypted with a previous key are encrypted again with the
+// current one when the bot starts.
 type BotConfig struct {
-	Token          string
-	SnapshotPath   string
-	ExpirationDays int
-	AuthManager    Auth
+	Token             string
+	Store             Store
+	EventLogPath      string
+	Cipher            *Cipher
+	SnapshotPath      string
+	SnapshotInterval  time.Duration
+	SnapshotRetention int
+	ExpirationDays    int
+	AuthManager       Auth
+	WebhookURL        string
+	WebhookListenAddr string
+	WebhookSecret     string
+	APIURL            string
+	HTTPClient        *http.Client
+	CallbackTTL       time.Duration
+	MaxCallbacks      int
 }
 
 type Bot struct {
 	// auth manager
 	Auth Auth
 	// config
-	token        string
-	snapshotPath string
+	apiURL        string
+	client        *http.Client
+	token         string
+	webhookURL    string
+	webhookAddr   string
+	webhookSecret string
 	// handlers
 	handlers       map[string]CmdHandler
 	adminHandlers  map[string]CmdHandler
-	menuCallbacks  map[int64]MenuCallback
-	replyCallbacks map[int64]ReplyCallback
-	// context and sessions
-	ctx      context.Context
-	cancel   context.CancelFunc
-	wg       sync.WaitGroup
-	sessions *sessions
+	menuCallbacks  *callbackRegistry[MenuCallback]
+	replyCallbacks *callbackRegistry[ReplyCallback]
+	// lastMenuKey is the last key used to register the callback of a new
+	// menu, whose message id is unknown until it is sent
+	lastMenuKey atomic.Int64
+	// registering is read-locked while a message is sent and its callback is
+	// registered, so updates that answer to it wait until it is done
+	registering sync.RWMutex
+	// context, sessions and conversations
+	ctx           context.Context
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+	sessions      *sessions
+	conversations *conversations
+	// store of the sessions and the conversations of every chat, the chats
+	// changed since the last save and the hash of the last record saved of
+	// each chat, to write only the chats that change
+	store        Store
+	saveInterval time.Duration
+	changes      chan struct{}
+	dirty        map[int64]bool
+	dirtyMtx     sync.Mutex
+	saved        map[int64][sha256.Size]byte
+	saveMtx      sync.Mutex
+	// event logs of the chats, if they are enabled
+	eventLogPath string
+	events       *eventLogs
+	// cipher of the data at rest, if it is encrypted
+	cipher *Cipher
 	// third party apis
 	updates    chan *Update
 	lastUpdate int64
@@ -78,18 +143,65 @@ func New(ctx context.Context, config BotConfig) *Bot {
 	logger.Info("bot started", "admins", config.AuthManager.ListAdmins())
 	// create a new context for the bot and initialize it
 	botCtx, cancel := context.WithCancel(ctx)
+	webhookSecret := config.WebhookSecret
+	if config.WebhookURL != "" && webhookSecret == "" {
+		webhookSecret = randomSecret()
+	}
+	apiURL := strings.TrimSuffix(config.APIURL, "/")
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+	client := config.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	callbackTTL := config.CallbackTTL
+	if callbackTTL <= 0 {
+		callbackTTL = DefaultCallbackTTL
+	}
+	maxCallbacks := config.MaxCallbacks
+	if maxCallbacks <= 0 {
+		maxCallbacks = DefaultMaxCallbacks
+	}
+	snapshotInterval := config.SnapshotInterval
+	if snapshotInterval <= 0 {
+		snapshotInterval = DefaultSnapshotInterval
+	}
+	store := config.Store
+	if store == nil {
+		snapshotRetention := config.SnapshotRetention
+		if snapshotRetention <= 0 {
+			snapshotRetention = DefaultSnapshotRetention
+		}
+		store = NewSnapshotStore(config.SnapshotPath, snapshotRetention)
+	}
+	if config.Cipher != nil {
+		store = NewEncryptedStore(store, config.Cipher)
+	}
 	return &Bot{
 		Auth:           config.AuthManager,
+		apiURL:         apiURL,
+		client:         client,
 		token:          config.Token,
-		snapshotPath:   config.SnapshotPath,
+		webhookURL:     config.WebhookURL,
+		webhookAddr:    config.WebhookListenAddr,
+		webhookSecret:  webhookSecret,
 		handlers:       make(map[string]CmdHandler),
 		adminHandlers:  make(map[string]CmdHandler),
-		menuCallbacks:  make(map[int64]MenuCallback),
-		replyCallbacks: make(map[int64]ReplyCallback),
+		menuCallbacks:  newCallbackRegistry[MenuCallback](callbackTTL, maxCallbacks),
+		replyCallbacks: newCallbackRegistry[ReplyCallback](callbackTTL, maxCallbacks),
 		ctx:            botCtx,
 		cancel:         cancel,
 		wg:             sync.WaitGroup{},
 		sessions:       initSessions(config.ExpirationDays),
+		conversations:  initConversations(),
+		store:          store,
+		saveInterval:   snapshotInterval,
+		changes:        make(chan struct{}, 1),
+		dirty:          make(map[int64]bool),
+		saved:          make(map[int64][sha256.Size]byte),
+		eventLogPath:   config.EventLogPath,
+		cipher:         config.Cipher,
 		updates:        make(chan *Update),
 		lastUpdate:     0,
 	}
@@ -120,12 +232,44 @@ func (b *Bot) AddSessionImporter(importer DataImporter) {
 // It starts a goroutine that listens to the updates from the bot and executes
 // the corresponding handler only if the user is allowed to use it.
 func (b *Bot) Start() error {
-	// try to load the snapshot
-	if err := b.tryToLoadSnapshot(); err != nil {
-		return fmt.Errorf("error loading snapshot: %v", err)
+	// encrypt again the chats that are not encrypted with the current key
+	if store, ok := b.store.(*EncryptedStore); ok {
+		rotated, err := store.Rotate()
+		if err != nil {
+			return fmt.Errorf("error encrypting chats: %v", err)
+		}
+		if rotated > 0 {
+			logger.Info("chats encrypted with the current key", "chats", rotated)
+		}
+	}
+	// load the chats of the store
+	if err := b.loadChats(); err != nil {
+		return fmt.Errorf("error loading chats: %v", err)
+	}
+	// replay the events appended after the last save
+	if b.eventLogPath != "" {
+		events, err := newEventLogs(b.eventLogPath, b.cipher)
+		if err != nil {
+			return fmt.Errorf("error opening event logs: %v", err)
+		}
+		b.events = events
+		if err := b.replayEvents(); err != nil {
+			return fmt.Errorf("error replaying events: %v", err)
+		}
+	}
+	// load the allowed users
+	if err := b.Auth.Load(); err != nil {
+		return fmt.Errorf("error loading allowed users: %v", err)
+	}
+	// get updates from the bot in background, from the webhook if it is
+	// configured or polling the api otherwise
+	if b.webhookURL != "" {
+		if err := b.listenForWebhook(); err != nil {
+			return fmt.Errorf("error setting webhook: %v", err)
+		}
+	} else {
+		b.listenForUpdates()
 	}
-	// get updates from the bot in background
-	b.listenForUpdates()
 	b.wg.Add(1)
 	go func() {
 		defer b.wg.Done()
@@ -134,14 +278,41 @@ func (b *Bot) Start() error {
 			case <-b.ctx.Done():
 				return
 			case update := <-b.updates:
-				switch {
-				case update.IsReply():
-					go b.handleReply(update)
-				case update.IsCallback():
-					go b.handleCallback(update)
-				case update.IsCommand():
-					go b.handleCommand(update)
-				}
+				go func() {
+					// the update can change the session or the
+					// conversations of its chat, so it is saved after it
+					defer b.notifyChange(update.chatID())
+					switch {
+					case update.IsReply():
+						b.handleReply(update)
+					case update.IsCallback():
+						b.handleCallback(update)
+					case update.IsCommand():
+						b.handleCommand(update)
+					case update.Message != nil:
+						// other messages can be the input of a conversation
+						b.handleConversationMessage(update)
+					}
+				}()
+			}
+		}
+	}()
+	// save the chats in background
+	b.saveInBackground(b.saveInterval)
+	// clean expired conversations and callbacks in background
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.ctx.Done():
+				return
+			case <-ticker.C:
+				b.cleanExpiredConversations()
+				b.menuCallbacks.cleanExpired()
+				b.replyCallbacks.cleanExpired()
 			}
 		}
 	}()
@@ -160,6 +331,15 @@ func (b *Bot) Start() error {
 			case <-ticker.C:
 				deleted := b.sessions.cleanExpired()
 				if len(deleted) > 0 {
+					b.notifyChange(deleted...)
+					for _, id := range deleted {
+						if b.events == nil {
+							continue
+						}
+						if err := b.events.archive(id); err != nil {
+							logger.Error("error archiving event log", "chatID", id, "error", err)
+						}
+					}
 					logger.Info("expired sessions cleaned",
 						"expiredSessions", len(deleted))
 					for _, id := range deleted {
@@ -178,9 +358,19 @@ func (b *Bot) Start() error {
 func (b *Bot) Stop() {
 	b.cancel()
 	b.wg.Wait()
-	// save the snapshot
-	if err := b.saveSnapshot(); err != nil {
-		logger.Error("error saving snapshot", "error", err)
+	// save every chat and close the store
+	if err := b.saveChats(true); err != nil {
+		logger.Error("error saving chats", "error", err)
+	}
+	if err := b.store.Close(); err != nil {
+		logger.Error("error closing store", "error", err)
+	}
+	if b.events != nil {
+		b.events.close()
+	}
+	// save the allowed users
+	if err := b.Auth.Save(); err != nil {
+		logger.Error("error saving allowed users", "error", err)
 	}
 }
 
@@ -191,6 +381,55 @@ func (b *Bot) GetSession(update *Update, initial Data) any {
 	return b.sessions.getOrCreate(update.Message.Chat.ID, initial)
 }
 
+// GetChatSession method returns the session data for the given chat id. If the
+// session does not exist, it creates a new one using the initial data
+// provided.
+func (b *Bot) GetChatSession(chatID int64, initial Data) any {
+	return b.sessions.getOrCreate(chatID, initial)
+}
+
+// AddLedger method creates a ledger with the name and the initial data
+// provided in the session of the given chat id and makes it the active one,
+// so GetSession and GetChatSession return its data from now on. It returns
+// ErrLedgerExists if the chat already has a ledger with that name.
+func (b *Bot) AddLedger(chatID int64, name string, initial Data) error {
+	return b.sessions.addLedger(chatID, name, initial)
+}
+
+// SwitchLedger method makes the ledger with the name provided the active one
+// of the session of the given chat id. It returns ErrLedgerNotFound if the
+// chat has no ledger with that name.
+func (b *Bot) SwitchLedger(chatID int64, name string) error {
+	return b.sessions.switchLedger(chatID, name)
+}
+
+// ListLedgers method returns the names of the ledgers of the session of the
+// given chat id, sorted, and the name of the active one.
+func (b *Bot) ListLedgers(chatID int64) ([]string, string) {
+	return b.sessions.listLedgers(chatID)
+}
+
+// CloseLedger method removes the ledger with the name provided, and its
+// data, from the session of the given chat id. If it was the active one, the
+// first of the remaining ledgers becomes active, or a new default one is
+// created the next time the session is requested if there is none left. It
+// returns the name of the active ledger after closing it.
+func (b *Bot) CloseLedger(chatID int64, name string) (string, error) {
+	data, _ := b.sessions.ledger(chatID, name)
+	active, err := b.sessions.closeLedger(chatID, name)
+	if err != nil || b.events == nil {
+		return active, err
+	}
+	// the events of the ledger closed are not replayed anymore
+	if recorder, ok := data.(EventData); ok {
+		recorder.SetEventLog(nil)
+	}
+	if err := b.events.append(chatID, &eventLogEntry{Ledger: name, Closed: true}); err != nil {
+		logger.Error("error appending event", "chatID", chatID, "ledger", name, "error", err)
+	}
+	return active, nil
+}
+
 // SendMessage method sends a message to the given chat id. If messageID is 0
 // then it is a new message, otherwise it is an edit.
 func (b *Bot) SendMessage(chatID, messageID int64, text string) (int64, error) {
@@ -211,6 +450,14 @@ func (b *Bot) SendMessage(chatID, messageID int64, text string) (int64, error) {
 // receives a matrix of labels and values to create the menu. The callback
 // function is executed when the user selects an option from the menu.
 func (b *Bot) InlineMenu(chatID, messageID int64, text string, labels, values [][]string, callback MenuCallback) (int64, error) {
+	// the callbacks of edited menus are registered by their message id, but
+	// the id of new menus is unknown until they are sent, so they get a
+	// unique negative key; the keys start again after a restart, so the
+	// callbacks are only run for the message that they were registered for
+	key := messageID
+	if key == 0 {
+		key = -b.lastMenuKey.Add(1)
+	}
 	// create the inline keyboard
 	var keyboard [][]map[string]string
 	for i, labelsRow := range labels {
@@ -221,7 +468,7 @@ func (b *Bot) InlineMenu(chatID, messageID int64, text string, labels, values []
 		for j, label := range labelsRow {
 			row = append(row, map[string]string{
 				"text":          label,
-				"callback_data": encodeCallback(messageID, values[i][j]),
+				"callback_data": encodeCallback(key, values[i][j]),
 			})
 		}
 		keyboard = append(keyboard, row)
@@ -239,13 +486,18 @@ func (b *Bot) InlineMenu(chatID, messageID int64, text string, labels, values []
 		method = editMessageTextMethod
 		params["message_id"] = messageID
 	}
+	b.registering.RLock()
+	defer b.registering.RUnlock()
 	menuMessageID, err := b.sendRequest(method, params)
 	if err != nil {
 		return menuMessageID, err
 	}
 	// add the callback handler
 	if callback != nil {
-		b.menuCallbacks[messageID] = callback
+		if messageID > 0 {
+			menuMessageID = messageID
+		}
+		b.menuCallbacks.set(chatID, key, menuMessageID, callback)
 	}
 	return menuMessageID, nil
 }
@@ -254,6 +506,8 @@ func (b *Bot) InlineMenu(chatID, messageID int64, text string, labels, values []
 // reply input field. If the user replies to the message, the callback function
 // is executed. It also receives a placeholder for the input field.
 func (b *Bot) SendMessageToReply(chatID int64, text, placeholder string, callback ReplyCallback) error {
+	b.registering.RLock()
+	defer b.registering.RUnlock()
 	replyID, err := b.sendRequest(sendMessageMethod, map[string]any{
 		"chat_id": chatID,
 		"text":    text,
@@ -268,7 +522,7 @@ func (b *Bot) SendMessageToReply(chatID int64, text, placeholder string, callbac
 	}
 	// add the callback handler
 	if callback != nil {
-		b.replyCallbacks[replyID] = callback
+		b.replyCallbacks.set(chatID, replyID, replyID, callback)
 	}
 	return nil
 }
@@ -281,8 +535,9 @@ func (c *Bot) RemoveMessage(chatID, messageID int64) error {
 	}); err != nil {
 		return err
 	}
-	// delete the callback id from the map
-	delete(c.menuCallbacks, messageID)
+	// delete the callbacks of the message
+	c.menuCallbacks.removeMessage(chatID, messageID)
+	c.replyCallbacks.removeMessage(chatID, messageID)
 	return nil
 }
 
@@ -329,15 +584,14 @@ func (b *Bot) SendDocument(chatID int64, filename, content string) error {
 	// close the multipart form
 	w.Close()
 	// create the request
-	endpoint := fmt.Sprintf(baseEndpointTemplate, b.token, sendDocumentMethod)
+	endpoint := fmt.Sprintf(baseEndpointTemplate, b.apiURL, b.token, sendDocumentMethod)
 	req, err := http.NewRequest("POST", endpoint, &buffer)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", w.FormDataContentType())
-	// create a new client and execute the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	// execute the request with the client of the bot
+	resp, err := b.client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -353,9 +607,9 @@ func (b *Bot) SendDocument(chatID int64, filename, content string) error {
 // content as a byte array. It returns an error if something goes wrong.
 func (b *Bot) DownloadFile(id string) ([]byte, error) {
 	// create the request to get the file path
-	filepathEndpoint := fmt.Sprintf(baseEndpointTemplate, b.token, getFileMethod)
-	filepathEndpoint += fmt.Sprintf("?file_id=%s", id)
-	filepathReq, err := http.Get(filepathEndpoint)
+	filepathEndpoint := fmt.Sprintf(baseEndpointTemplate, b.apiURL, b.token, getFileMethod)
+	filepathEndpoint += fmt.Sprintf("?file_id=%s", url.QueryEscape(id))
+	filepathReq, err := b.client.Get(filepathEndpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -378,8 +632,8 @@ func (b *Bot) DownloadFile(id string) ([]byte, error) {
 		return nil, fmt.Errorf("error downloading file")
 	}
 	// create the request to download the file
-	fileEndpoint := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", b.token, response.Result.FilePath)
-	fileReq, err := http.Get(fileEndpoint)
+	fileEndpoint := fmt.Sprintf(fileEndpointTemplate, b.apiURL, b.token, response.Result.FilePath)
+	fileReq, err := b.client.Get(fileEndpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,216 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testAPI is a fake telegram api that records the methods requested and
+// fails the ones provided. The messages sent get consecutive ids.
+type testAPI struct {
+	*httptest.Server
+	mtx           sync.Mutex
+	methods       []string
+	failing       map[string]bool
+	lastMessageID int64
+}
+
+func newTestAPI(t *testing.T, failing ...string) *testAPI {
+	t.Helper()
+	api := &testAPI{failing: make(map[string]bool)}
+	for _, method := range failing {
+		api.failing[method] = true
+	}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		api.mtx.Lock()
+		defer api.mtx.Unlock()
+		api.methods = append(api.methods, method)
+		if api.failing[method] {
+			_, _ = w.Write([]byte(`{"ok":false}`))
+			return
+		}
+		if method == sendMessageMethod {
+			api.lastMessageID++
+			_, _ = fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d}}`, api.lastMessageID)
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func (api *testAPI) requested(method string) bool {
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+	return slices.Contains(api.methods, method)
+}
+
+// newWebhookTestBot returns a bot that listens for the updates of the
+// telegram api provided in the webhook address provided.
+func newWebhookTestBot(api *testAPI, addr string) *Bot {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Bot{
+		apiURL:        api.URL,
+		client:        api.Client(),
+		token:         "test",
+		webhookURL:    "https://example.com/webhook",
+		webhookAddr:   addr,
+		webhookSecret: "secret",
+		ctx:           ctx,
+		cancel:        cancel,
+		updates:       make(chan *Update, 1),
+	}
+}
+
+// freeAddr returns a local address that is not in use.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestHandleWebhook(t *testing.T) {
+	b := newWebhookTestBot(newTestAPI(t), "")
+	defer b.cancel()
+	update := `{"update_id":1,"message":{"message_id":2,"chat":{"id":3},"text":"/start"}}`
+	cases := []struct {
+		name     string
+		method   string
+		secret   string
+		body     string
+		expected int
+	}{
+		{"not a post", http.MethodGet, "secret", update, http.StatusMethodNotAllowed},
+		{"no secret", http.MethodPost, "", update, http.StatusUnauthorized},
+		{"wrong secret", http.MethodPost, "other", update, http.StatusUnauthorized},
+		{"invalid body", http.MethodPost, "secret", `{"update_id":`, http.StatusBadRequest},
+		{"not an update", http.MethodPost, "secret", `[1,2,3]`, http.StatusBadRequest},
+		{"too large body", http.MethodPost, "secret", `"` + strings.Repeat("a", maxWebhookBodySize) + `"`, http.StatusBadRequest},
+		{"valid update", http.MethodPost, "secret", update, http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, "/", strings.NewReader(c.body))
+			if c.secret != "" {
+				req.Header.Set(webhookSecretHeader, c.secret)
+			}
+			rec := httptest.NewRecorder()
+			b.handleWebhook(rec, req)
+			if rec.Code != c.expected {
+				t.Errorf("expected status %d, got %d", c.expected, rec.Code)
+			}
+			if c.expected != http.StatusOK {
+				if len(b.updates) != 0 {
+					t.Errorf("expected no update, got %d", len(b.updates))
+				}
+				return
+			}
+			select {
+			case received := <-b.updates:
+				if received.UpdateID != 1 || received.chatID() != 3 {
+					t.Errorf("unexpected update %+v", received)
+				}
+			default:
+				t.Errorf("expected the update to be sent")
+			}
+		})
+	}
+	// the updates received after the bot stops are not accepted
+	b.cancel()
+	b.updates = make(chan *Update)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(update))
+	req.Header.Set(webhookSecretHeader, "secret")
+	rec := httptest.NewRecorder()
+	b.handleWebhook(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+}
+
+func TestListenForWebhook(t *testing.T) {
+	t.Run("address in use", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		api := newTestAPI(t)
+		b := newWebhookTestBot(api, ln.Addr().String())
+		defer b.cancel()
+		if err := b.listenForWebhook(); err == nil {
+			t.Errorf("expected an error listening in an address in use")
+		}
+		if api.requested(setWebhookMethod) {
+			t.Errorf("expected the webhook not to be registered")
+		}
+	})
+
+	t.Run("webhook not registered", func(t *testing.T) {
+		addr := freeAddr(t)
+		b := newWebhookTestBot(newTestAPI(t, setWebhookMethod), addr)
+		defer b.cancel()
+		if err := b.listenForWebhook(); err == nil {
+			t.Errorf("expected an error registering the webhook")
+		}
+		// the address is not listened anymore
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("expected the address to be released, got %v", err)
+		}
+		ln.Close()
+	})
+
+	t.Run("serving updates", func(t *testing.T) {
+		addr := freeAddr(t)
+		api := newTestAPI(t)
+		b := newWebhookTestBot(api, addr)
+		if err := b.listenForWebhook(); err != nil {
+			t.Fatal(err)
+		}
+		if !api.requested(setWebhookMethod) {
+			t.Errorf("expected the webhook to be registered")
+		}
+		body := `{"update_id":1,"message":{"message_id":2,"chat":{"id":3},"text":"/start"}}`
+		req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(webhookSecretHeader, "secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		select {
+		case update := <-b.updates:
+			if update.UpdateID != 1 {
+				t.Errorf("unexpected update %+v", update)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("expected the update to be sent")
+		}
+		// the webhook is deleted when the bot stops
+		b.cancel()
+		b.wg.Wait()
+		if !api.requested(deleteWebhookMethod) {
+			t.Errorf("expected the webhook to be deleted")
+		}
+	})
+}
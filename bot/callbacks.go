@@ -0,0 +1,146 @@
+package bot
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCallbackTTL is the time that the callbacks of menus and replies
+	// are kept if the config does not define other
+	DefaultCallbackTTL = 24 * time.Hour
+	// DefaultMaxCallbacks is the maximum number of callbacks of each kind that
+	// are kept if the config does not define other
+	DefaultMaxCallbacks = 1000
+)
+
+// callbackKey struct identifies a callback by the chat of its message and
+// its key, because the ids of the messages are only unique in their chat.
+type callbackKey struct {
+	chatID int64
+	key    int64
+}
+
+type callbackEntry[T any] struct {
+	messageID int64
+	callback  T
+	expire    time.Time
+}
+
+// callbackRegistry struct stores the callbacks of menus or replies by chat
+// and key safely for concurrent use. Each callback expires after the ttl of
+// the registry, and when the registry is full, the callback that expires
+// first is evicted to make room for the new one.
+type callbackRegistry[T any] struct {
+	ttl     time.Duration
+	maxSize int
+	entries map[callbackKey]*callbackEntry[T]
+	mtx     sync.Mutex
+}
+
+func newCallbackRegistry[T any](ttl time.Duration, maxSize int) *callbackRegistry[T] {
+	return &callbackRegistry[T]{
+		ttl:     ttl,
+		maxSize: maxSize,
+		entries: make(map[callbackKey]*callbackEntry[T]),
+		mtx:     sync.Mutex{},
+	}
+}
+
+// set registers the callback with the chat and the key provided, associated
+// to the message provided, replacing any previous callback with the same
+// chat and key.
+func (r *callbackRegistry[T]) set(chatID, key, messageID int64, callback T) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	id := callbackKey{chatID, key}
+	if _, exists := r.entries[id]; !exists && len(r.entries) >= r.maxSize {
+		r.removeExpired()
+		if len(r.entries) >= r.maxSize {
+			r.evictFirst()
+		}
+	}
+	r.entries[id] = &callbackEntry[T]{
+		messageID: messageID,
+		callback:  callback,
+		expire:    time.Now().Add(r.ttl),
+	}
+}
+
+// get returns the callback registered with the chat and the key provided for
+// the message provided. It returns false if there is no callback, it has
+// expired or it belongs to other message, for example, because the key was
+// reused after a restart.
+func (r *callbackRegistry[T]) get(chatID, key, messageID int64) (T, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	id := callbackKey{chatID, key}
+	entry, ok := r.entries[id]
+	if !ok || entry.messageID != messageID {
+		var empty T
+		return empty, false
+	}
+	if entry.expire.Before(time.Now()) {
+		delete(r.entries, id)
+		var empty T
+		return empty, false
+	}
+	return entry.callback, true
+}
+
+// removeMessage deletes the callbacks associated to the message provided of
+// the chat provided.
+func (r *callbackRegistry[T]) removeMessage(chatID, messageID int64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for key, entry := range r.entries {
+		if key.chatID == chatID && entry.messageID == messageID {
+			delete(r.entries, key)
+		}
+	}
+}
+
+// cleanExpired deletes the expired callbacks and returns how many were
+// deleted.
+func (r *callbackRegistry[T]) cleanExpired() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.removeExpired()
+}
+
+// len returns the number of callbacks registered, including the expired ones
+// that are not cleaned yet.
+func (r *callbackRegistry[T]) len() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return len(r.entries)
+}
+
+// removeExpired deletes the expired callbacks. It must be called with the
+// mutex locked.
+func (r *callbackRegistry[T]) removeExpired() int {
+	now := time.Now()
+	removed := 0
+	for key, entry := range r.entries {
+		if entry.expire.Before(now) {
+			delete(r.entries, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// evictFirst deletes the callback that expires first. It must be called with
+// the mutex locked.
+func (r *callbackRegistry[T]) evictFirst() {
+	var firstKey callbackKey
+	var first *callbackEntry[T]
+	for key, entry := range r.entries {
+		if first == nil || entry.expire.Before(first.expire) {
+			firstKey, first = key, entry
+		}
+	}
+	if first != nil {
+		delete(r.entries, firstKey)
+	}
+}
@@ -0,0 +1,126 @@
+package bot
+
+import (
+	"testing"
+	"time"
+)
+
+// newMenuTestBot returns a bot that sends the menus to the telegram api
+// provided.
+func newMenuTestBot(api *testAPI) *Bot {
+	b := newWebhookTestBot(api, "")
+	b.menuCallbacks = newCallbackRegistry[MenuCallback](time.Hour, 10)
+	b.conversations = initConversations()
+	return b
+}
+
+func TestStaleMenuAfterRestart(t *testing.T) {
+	api := newTestAPI(t)
+	pressed := map[int64]string{}
+	menu := func(b *Bot, chatID, messageID int64) int64 {
+		t.Helper()
+		id, err := b.InlineMenu(chatID, messageID, "menu", [][]string{{"Remove"}}, [][]string{{"remove"}}, func(messageID int64, data string) {
+			pressed[messageID] = data
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	press := func(b *Bot, chatID, messageID, key int64) {
+		b.handleCallback(&Update{CallbackQuery: &CallbackQuery{
+			Data:    encodeCallback(key, "remove"),
+			Message: Message{ID: messageID, Chat: &Chat{ID: chatID}},
+		}})
+	}
+
+	before := newMenuTestBot(api)
+	stale := menu(before, 1, 0)
+	before.cancel()
+
+	// after the restart the keys start again, so the new menus of any chat
+	// reuse the key of the menu sent before
+	restarted := newMenuTestBot(api)
+	defer restarted.cancel()
+	current := menu(restarted, 1, 0)
+	press(restarted, 1, stale, -1)
+	if len(pressed) != 0 {
+		t.Errorf("expected the stale menu not to run any callback, got %v", pressed)
+	}
+	press(restarted, 1, current, -1)
+	if pressed[current] != "remove" {
+		t.Errorf("expected the current menu callback, got %v", pressed)
+	}
+
+	// the edited menus are registered by their message id, that is only
+	// unique in their chat
+	clear(pressed)
+	menu(restarted, 2, current)
+	press(restarted, 1, current, current)
+	press(restarted, 3, current, current)
+	if len(pressed) != 0 {
+		t.Errorf("expected the menu of other chat not to run, got %v", pressed)
+	}
+	press(restarted, 2, current, current)
+	if pressed[current] != "remove" {
+		t.Errorf("expected the edited menu callback, got %v", pressed)
+	}
+}
+
+func TestCallbackRegistry(t *testing.T) {
+	registry := newCallbackRegistry[string](time.Hour, 2)
+	registry.set(1, -1, 10, "first")
+	registry.set(1, -2, 20, "second")
+	if callback, ok := registry.get(1, -1, 10); !ok || callback != "first" {
+		t.Fatalf("expected first callback, got '%s' (%t)", callback, ok)
+	}
+	// the registry is full, so the callback that expires first is evicted
+	registry.set(1, -3, 30, "third")
+	if registry.len() != 2 {
+		t.Fatalf("expected 2 callbacks, got %d", registry.len())
+	}
+	if _, ok := registry.get(1, -1, 10); ok {
+		t.Error("expected first callback to be evicted")
+	}
+	// replacing a callback does not evict any other
+	registry.set(1, -3, 30, "third again")
+	if callback, ok := registry.get(1, -3, 30); !ok || callback != "third again" {
+		t.Errorf("expected replaced callback, got '%s' (%t)", callback, ok)
+	}
+	if _, ok := registry.get(1, -2, 20); !ok {
+		t.Error("expected second callback to be kept")
+	}
+	// the callbacks of other chats or messages are not returned
+	if _, ok := registry.get(2, -3, 30); ok {
+		t.Error("expected no callback of other chat")
+	}
+	if _, ok := registry.get(1, -3, 31); ok {
+		t.Error("expected no callback of other message")
+	}
+	// removing a message removes its callbacks
+	registry.removeMessage(1, 20)
+	if _, ok := registry.get(1, -2, 20); ok {
+		t.Error("expected second callback to be removed")
+	}
+	// the same key in other chat is other callback
+	registry.set(2, -3, 30, "other chat")
+	if callback, ok := registry.get(1, -3, 30); !ok || callback != "third again" {
+		t.Errorf("expected the callback of the first chat kept, got '%s' (%t)", callback, ok)
+	}
+	registry.removeMessage(2, 30)
+	if _, ok := registry.get(1, -3, 30); !ok {
+		t.Error("expected the callback of the first chat not to be removed")
+	}
+
+	expiring := newCallbackRegistry[string](time.Millisecond, 10)
+	expiring.set(1, 1, 1, "expired")
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := expiring.get(1, 1, 1); ok {
+		t.Error("expected callback to be expired")
+	}
+	expiring.set(1, 2, 2, "expired")
+	time.Sleep(5 * time.Millisecond)
+	if removed := expiring.cleanExpired(); removed != 1 {
+		t.Errorf("expected 1 expired callback cleaned, got %d", removed)
+	}
+}
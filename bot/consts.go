@@ -1,8 +1,12 @@
 package bot
 
+// DefaultAPIURL is the base url of the telegram bot api
+const DefaultAPIURL = "https://api.telegram.org"
+
 const (
-	updatesEndpointTemplate = "https://api.telegram.org/bot%s/getUpdates?offset=%d"
-	baseEndpointTemplate    = "https://api.telegram.org/bot%s/%s"
+	updatesEndpointTemplate = "%s/bot%s/getUpdates?offset=%d"
+	baseEndpointTemplate    = "%s/bot%s/%s"
+	fileEndpointTemplate    = "%s/file/bot%s/%s"
 )
 
 const (
@@ -12,4 +16,13 @@ const (
 	removeMessageMethod          = "deleteMessage"
 	sendDocumentMethod           = "sendDocument"
 	getFileMethod                = "getFile"
+	setWebhookMethod             = "setWebhook"
+	deleteWebhookMethod          = "deleteWebhook"
+	answerCallbackQueryMethod    = "answerCallbackQuery"
 )
+
+// expiredMenuMessage is the answer to the buttons of menus that are not
+// available anymore
+const expiredMenuMessage = "This menu has expired."
+
+const webhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
@@ -0,0 +1,717 @@
+package bot
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InputType type defines the kind of input that a conversation step expects
+// from the user.
+type InputType int
+
+const (
+	// InputText steps ask the user to reply to the prompt with a text.
+	InputText InputType = iota
+	// InputChoice steps ask the user to press a button of an inline menu.
+	InputChoice
+	// InputKeypad steps show an inline keypad that composes the input
+	// pressing its keys until the KeypadDone key is pressed.
+	InputKeypad
+	// InputDocument steps ask the user to reply to the prompt with a file.
+	InputDocument
+	// InputMultiChoice steps ask the user to select any number of options of
+	// an inline menu, pressing them to select or unselect them, until the
+	// MultiChoiceDone option is pressed. The input is the values of the
+	// selected options in the order of the menu, separated by
+	// MultiChoiceSeparator.
+	InputMultiChoice
+)
+
+// Reserved values of the keys of keypad steps, the rest of keys append their
+// value to the input.
+const (
+	KeypadDelete = "del"
+	KeypadDone   = "done"
+	KeypadCancel = "cancel"
+)
+
+// Reserved values of the options of multi choice steps, the rest of options
+// are selected or unselected when they are pressed. MultiChoiceAll selects
+// every option of the rows above its own, or unselects them if all of them
+// are selected, so the menu can have options that are not selected with it
+// in its last rows.
+const (
+	MultiChoiceAll  = "all"
+	MultiChoiceDone = "done"
+)
+
+// MultiChoiceSeparator separates the values of the selected options in the
+// input of multi choice steps.
+const MultiChoiceSeparator = "\n"
+
+// ConversationEnd is the state returned by the Next function of the last step
+// of a flow.
+const ConversationEnd = ""
+
+// DefaultConversationTimeout is the time that a conversation waits for the
+// input of the user if its flow does not define other timeout.
+const DefaultConversationTimeout = 10 * time.Minute
+
+const (
+	// conversationCallbackPrefix identifies the callback data of the menus of
+	// conversations
+	conversationCallbackPrefix = "c:"
+	// keypadEmptyInput is shown in keypads while the input is empty
+	keypadEmptyInput = "0"
+	// answeredPromptTemplate is the text of the prompts of choice and keypad
+	// steps once they are answered
+	answeredPromptTemplate = "%s\n➡️ %s"
+	// privateChatType is the type of the chats between the bot and a user
+	privateChatType = "private"
+	// selectedOptionTemplate is the label of the selected options of multi
+	// choice steps
+	selectedOptionTemplate = "✅ %s"
+)
+
+// Input struct contains the input of the user to a conversation step. Text
+// contains the text of the message, the value of the pressed button, the
+// composed keypad input or the selected values of a multi choice menu, and
+// Label the label of the pressed or selected buttons. Document
+// contains the file of InputDocument steps. Message contains the whole
+// message of InputText and InputDocument steps, for example, to get its
+// entities.
+type Input struct {
+	Text     string
+	Label    string
+	Document *Document
+	Message  *Message
+}
+
+// Step struct defines a state of a conversation flow: the prompt sent to the
+// user, the type of input expected, the options of the menu or keypad for
+// InputChoice, InputKeypad and InputMultiChoice steps, the validator of the
+// input and the next state. If Validate is nil, the input text is stored in
+// the values of the conversation with the state name as key. If it returns an
+// error, its message is sent to the user and the step is prompted again. If
+// Next is nil, the conversation ends after this step. If Skip returns true,
+// the step is not prompted and the conversation goes to the next state, for
+// example, because its value was provided when the conversation started.
+type Step struct {
+	Input       InputType
+	Prompt      func(*Bot, *Conversation) string
+	Placeholder string
+	Options     func(*Bot, *Conversation) ([][]string, [][]string, error)
+	Validate    func(*Bot, *Conversation, Input) error
+	Next        func(*Bot, *Conversation) string
+	Skip        func(*Bot, *Conversation) bool
+}
+
+// Flow struct defines a conversation as a set of named steps, the initial one
+// and the function executed with the collected values when it ends.
+type Flow struct {
+	Name    string
+	Start   string
+	Steps   map[string]*Step
+	Timeout time.Duration
+	Done    func(*Bot, *Conversation) error
+}
+
+// Conversation struct contains the state of a conversation between the bot
+// and a user in a chat: the flow and the current state, the values collected
+// so far, the current input of keypads and multi choice menus and the id of
+// the message that prompts the current step. It is saved with the sessions,
+// so conversations survive restarts.
+type Conversation struct {
+	Flow      string            `json:"flow"`
+	ChatID    int64             `json:"chatID"`
+	UserID    int64             `json:"userID"`
+	Username  string            `json:"username"`
+	FirstName string            `json:"firstName,omitempty"`
+	State     string            `json:"state"`
+	Values    map[string]string `json:"values"`
+	Buffer    string            `json:"buffer,omitempty"`
+	MessageID int64             `json:"messageID"`
+	Expire    time.Time         `json:"expire"`
+	mtx       sync.Mutex
+}
+
+// Get method returns the value stored with the key provided.
+func (c *Conversation) Get(key string) string {
+	return c.Values[key]
+}
+
+// Set method stores the value provided with the key provided.
+func (c *Conversation) Set(key, value string) {
+	c.Values[key] = value
+}
+
+type conversationKey struct {
+	chatID int64
+	userID int64
+}
+
+type conversations struct {
+	flows map[string]*Flow
+	list  map[conversationKey]*Conversation
+	mtx   sync.Mutex
+}
+
+func initConversations() *conversations {
+	return &conversations{
+		flows: make(map[string]*Flow),
+		list:  make(map[conversationKey]*Conversation),
+		mtx:   sync.Mutex{},
+	}
+}
+
+func (cs *conversations) get(chatID, userID int64) (*Conversation, bool) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	c, ok := cs.list[conversationKey{chatID, userID}]
+	return c, ok
+}
+
+func (cs *conversations) set(c *Conversation) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	cs.list[conversationKey{c.ChatID, c.UserID}] = c
+}
+
+// remove deletes the conversation provided only if it is still the current
+// conversation of its chat and user.
+func (cs *conversations) remove(c *Conversation) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	key := conversationKey{c.ChatID, c.UserID}
+	if cs.list[key] == c {
+		delete(cs.list, key)
+	}
+}
+
+func (cs *conversations) popExpired() []*Conversation {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	expired := []*Conversation{}
+	for key, c := range cs.list {
+		if c.Expire.Before(time.Now()) {
+			expired = append(expired, c)
+			delete(cs.list, key)
+		}
+	}
+	return expired
+}
+
+// export returns a copy of the current conversations to be saved.
+func (cs *conversations) export() []*Conversation {
+	cs.mtx.Lock()
+	list := make([]*Conversation, 0, len(cs.list))
+	for _, c := range cs.list {
+		list = append(list, c)
+	}
+	cs.mtx.Unlock()
+	result := make([]*Conversation, 0, len(list))
+	for _, c := range list {
+		c.mtx.Lock()
+		values := make(map[string]string, len(c.Values))
+		for key, value := range c.Values {
+			values[key] = value
+		}
+		result = append(result, &Conversation{
+			Flow:      c.Flow,
+			ChatID:    c.ChatID,
+			UserID:    c.UserID,
+			Username:  c.Username,
+			FirstName: c.FirstName,
+			State:     c.State,
+			Values:    values,
+			Buffer:    c.Buffer,
+			MessageID: c.MessageID,
+			Expire:    c.Expire,
+		})
+		c.mtx.Unlock()
+	}
+	return result
+}
+
+// load restores the conversations provided, ignoring the expired ones and the
+// ones of unknown flows or states.
+func (cs *conversations) load(list []*Conversation) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	for _, c := range list {
+		flow, ok := cs.flows[c.Flow]
+		if !ok || c.Expire.Before(time.Now()) {
+			continue
+		}
+		if _, ok := flow.Steps[c.State]; !ok {
+			continue
+		}
+		if c.Values == nil {
+			c.Values = make(map[string]string)
+		}
+		cs.list[conversationKey{c.ChatID, c.UserID}] = c
+	}
+}
+
+// AddFlow method registers a conversation flow in the bot, so conversations
+// can be started with its name.
+func (b *Bot) AddFlow(flow *Flow) {
+	b.conversations.flows[flow.Name] = flow
+}
+
+// StartConversation method starts a conversation of the flow provided with
+// the user that sent the update, in the chat of the update, replacing any
+// other conversation of the same user in the chat. The values provided are
+// stored in the conversation before prompting the first step that is not
+// skipped. If every step is skipped, the flow ends without prompting.
+func (b *Bot) StartConversation(update *Update, flowName string, values map[string]string) error {
+	flow, ok := b.conversations.flows[flowName]
+	if !ok {
+		return fmt.Errorf("unknown flow %s", flowName)
+	}
+	if values == nil {
+		values = make(map[string]string)
+	}
+	c := &Conversation{
+		Flow:      flow.Name,
+		ChatID:    update.Message.Chat.ID,
+		UserID:    update.Message.From.ID,
+		Username:  update.Message.From.Username,
+		FirstName: update.Message.From.FirstName,
+		State:     flow.Start,
+		Values:    values,
+	}
+	// lock the conversation until it is prompted, so the answers to the
+	// prompt wait until it is ready
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	current, ok := b.conversations.get(c.ChatID, c.UserID)
+	if ok {
+		current.mtx.Lock()
+		b.closePrompt(current, "")
+		current.mtx.Unlock()
+	}
+	if c.State = b.skipSteps(flow, c, flow.Start); c.State == ConversationEnd {
+		if ok {
+			b.conversations.remove(current)
+		}
+		if flow.Done != nil {
+			return flow.Done(b, c)
+		}
+		return nil
+	}
+	b.conversations.set(c)
+	if err := b.prompt(flow, c); err != nil {
+		b.conversations.remove(c)
+		return err
+	}
+	return nil
+}
+
+// CancelConversation method cancels the current conversation of the user that
+// sent the update in its chat. It returns false if there is no conversation.
+func (b *Bot) CancelConversation(update *Update) bool {
+	c, ok := b.conversations.get(update.Message.Chat.ID, update.Message.From.ID)
+	if !ok {
+		return false
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	b.conversations.remove(c)
+	b.closePrompt(c, "")
+	return true
+}
+
+// prompt method sends the prompt of the current step of the conversation. It
+// must be called with the conversation locked.
+func (b *Bot) prompt(flow *Flow, c *Conversation) error {
+	step, ok := flow.Steps[c.State]
+	if !ok {
+		return fmt.Errorf("unknown state %s of flow %s", c.State, flow.Name)
+	}
+	timeout := flow.Timeout
+	if timeout == 0 {
+		timeout = DefaultConversationTimeout
+	}
+	c.Expire = time.Now().Add(timeout)
+	text := step.Prompt(b, c)
+	params := map[string]any{
+		"chat_id": c.ChatID,
+		"text":    text,
+	}
+	switch step.Input {
+	case InputText, InputDocument:
+		params["reply_markup"] = map[string]any{
+			"force_reply":             true,
+			"input_field_placeholder": step.Placeholder,
+			"selective":               true,
+		}
+	case InputChoice, InputKeypad, InputMultiChoice:
+		keyboard, err := b.conversationKeyboard(step, c)
+		if err != nil {
+			return err
+		}
+		if step.Input == InputKeypad {
+			params["text"] = keypadText(text, c.Buffer)
+		}
+		params["reply_markup"] = map[string]any{"inline_keyboard": keyboard}
+	}
+	messageID, err := b.sendRequest(sendMessageMethod, params)
+	if err != nil {
+		return err
+	}
+	c.MessageID = messageID
+	return nil
+}
+
+// conversationKeyboard method composes the inline keyboard of the options of
+// the step provided. The selected options of multi choice steps are marked.
+func (b *Bot) conversationKeyboard(step *Step, c *Conversation) ([][]map[string]string, error) {
+	if step.Options == nil {
+		return nil, fmt.Errorf("step without options")
+	}
+	labels, values, err := step.Options(b, c)
+	if err != nil {
+		return nil, err
+	}
+	selected := map[string]bool{}
+	if step.Input == InputMultiChoice {
+		for _, value := range strings.Split(c.Buffer, MultiChoiceSeparator) {
+			selected[value] = value != ""
+		}
+	}
+	var keyboard [][]map[string]string
+	for i, labelsRow := range labels {
+		if len(labelsRow) != len(values[i]) {
+			return nil, fmt.Errorf("labels and values must have the same length")
+		}
+		row := []map[string]string{}
+		for j, label := range labelsRow {
+			if selected[values[i][j]] {
+				label = fmt.Sprintf(selectedOptionTemplate, label)
+			}
+			row = append(row, map[string]string{
+				"text":          label,
+				"callback_data": conversationCallbackPrefix + hex.EncodeToString([]byte(values[i][j])),
+			})
+		}
+		keyboard = append(keyboard, row)
+	}
+	return keyboard, nil
+}
+
+// closePrompt method removes the inline keyboard of the current prompt of the
+// conversation, if it has one, showing the answer provided. If no answer is
+// provided, the prompt is removed.
+func (b *Bot) closePrompt(c *Conversation, answer string) {
+	flow, ok := b.conversations.flows[c.Flow]
+	if !ok {
+		return
+	}
+	step, ok := flow.Steps[c.State]
+	if !ok || (step.Input != InputChoice && step.Input != InputKeypad && step.Input != InputMultiChoice) || c.MessageID == 0 {
+		return
+	}
+	if answer == "" {
+		if err := b.RemoveMessage(c.ChatID, c.MessageID); err != nil {
+			logger.Error("error removing conversation prompt", "error", err)
+		}
+		return
+	}
+	text := fmt.Sprintf(answeredPromptTemplate, step.Prompt(b, c), answer)
+	if _, err := b.SendMessage(c.ChatID, c.MessageID, text); err != nil {
+		logger.Error("error closing conversation prompt", "error", err)
+	}
+}
+
+// handleConversationMessage method handles the message of the update as the
+// input of the current step of the conversation of its user in its chat. It
+// returns false if the user has no conversation or the message is not an
+// input for it, for example, if it replies to other message.
+func (b *Bot) handleConversationMessage(update *Update) bool {
+	if update.Message == nil || update.Message.From == nil || update.Message.Chat == nil {
+		return false
+	}
+	c, ok := b.conversations.get(update.Message.Chat.ID, update.Message.From.ID)
+	if !ok {
+		return false
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	flow := b.conversations.flows[c.Flow]
+	step := flow.Steps[c.State]
+	if step.Input != InputText && step.Input != InputDocument {
+		return false
+	}
+	// in groups, only the replies to the prompt are inputs, in private chats
+	// any message is
+	if reply := update.Message.ReplyToMessage; reply != nil {
+		if reply.MessageID != c.MessageID {
+			return false
+		}
+	} else if update.Message.Chat.Type != privateChatType {
+		return false
+	}
+	input := Input{
+		Text:     strings.TrimSpace(update.Message.Text),
+		Document: update.Message.Document,
+		Message:  update.Message,
+	}
+	b.processInput(flow, step, c, input)
+	return true
+}
+
+// handleConversationCallback method handles the callback of the update as the
+// input of the current step of the conversation of the user that pressed the
+// button. It returns false if the callback is not from a conversation menu.
+func (b *Bot) handleConversationCallback(update *Update) bool {
+	encoded, ok := strings.CutPrefix(update.CallbackQuery.Data, conversationCallbackPrefix)
+	if !ok {
+		return false
+	}
+	query := update.CallbackQuery
+	if query.From == nil || query.Message.Chat == nil {
+		b.answerCallback(query, expiredMenuMessage)
+		return true
+	}
+	data, err := hex.DecodeString(encoded)
+	if err != nil {
+		logger.Error("error decoding conversation callback", "error", err)
+		b.answerCallback(query, expiredMenuMessage)
+		return true
+	}
+	c, ok := b.conversations.get(query.Message.Chat.ID, query.From.ID)
+	if !ok {
+		logger.Debug("conversation not found", "chatID", query.Message.Chat.ID, "userID", query.From.ID)
+		b.answerCallback(query, expiredMenuMessage)
+		return true
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	// the buttons of previous prompts are not valid anymore
+	if query.Message.ID != c.MessageID {
+		b.answerCallback(query, expiredMenuMessage)
+		return true
+	}
+	b.answerCallback(query, "")
+	flow := b.conversations.flows[c.Flow]
+	step := flow.Steps[c.State]
+	value := string(data)
+	switch step.Input {
+	case InputChoice:
+		b.processInput(flow, step, c, Input{Text: value, Label: buttonLabel(query.Message, encoded)})
+	case InputKeypad:
+		switch value {
+		case KeypadCancel:
+			b.conversations.remove(c)
+			b.closePrompt(c, "")
+		case KeypadDone:
+			b.processInput(flow, step, c, Input{Text: c.Buffer, Label: c.Buffer})
+		default:
+			if value == KeypadDelete {
+				if len(c.Buffer) > 0 {
+					c.Buffer = c.Buffer[:len(c.Buffer)-1]
+				}
+			} else {
+				c.Buffer += value
+			}
+			b.updateMenu(step, c)
+		}
+	case InputMultiChoice:
+		labels, values, allValues, err := b.multiChoiceOptions(step, c)
+		if err != nil {
+			logger.Error("error getting multi choice options", "error", err)
+			return true
+		}
+		selected := map[string]bool{}
+		for _, value := range strings.Split(c.Buffer, MultiChoiceSeparator) {
+			selected[value] = value != ""
+		}
+		switch value {
+		case MultiChoiceDone:
+			selectedLabels := []string{}
+			for _, value := range values {
+				if selected[value] {
+					selectedLabels = append(selectedLabels, labels[value])
+				}
+			}
+			b.processInput(flow, step, c, Input{Text: c.Buffer, Label: strings.Join(selectedLabels, ", ")})
+			return true
+		case MultiChoiceAll:
+			all := true
+			for _, value := range allValues {
+				all = all && selected[value]
+			}
+			for _, value := range allValues {
+				selected[value] = !all
+			}
+		default:
+			selected[value] = !selected[value]
+		}
+		// keep the selected values in the order of the menu
+		buffer := []string{}
+		for _, value := range values {
+			if selected[value] {
+				buffer = append(buffer, value)
+			}
+		}
+		c.Buffer = strings.Join(buffer, MultiChoiceSeparator)
+		b.updateMenu(step, c)
+	}
+	return true
+}
+
+// multiChoiceOptions method returns the label of each option of the multi
+// choice step provided by its value, the values in the order of the menu
+// without the reserved ones and the values selected by the MultiChoiceAll
+// option.
+func (b *Bot) multiChoiceOptions(step *Step, c *Conversation) (map[string]string, []string, []string, error) {
+	if step.Options == nil {
+		return nil, nil, nil, fmt.Errorf("step without options")
+	}
+	labelsRows, valuesRows, err := step.Options(b, c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	labels := map[string]string{}
+	values, allValues := []string{}, []string{}
+	for i, row := range valuesRows {
+		if slices.Contains(row, MultiChoiceAll) {
+			allValues = append([]string{}, values...)
+		}
+		for j, value := range row {
+			if value == MultiChoiceAll || value == MultiChoiceDone || i >= len(labelsRows) || j >= len(labelsRows[i]) {
+				continue
+			}
+			labels[value] = labelsRows[i][j]
+			values = append(values, value)
+		}
+	}
+	return labels, values, allValues, nil
+}
+
+// updateMenu method edits the prompt of the keypad or multi choice step to
+// show the current input. It must be called with the conversation locked.
+func (b *Bot) updateMenu(step *Step, c *Conversation) {
+	keyboard, err := b.conversationKeyboard(step, c)
+	if err != nil {
+		logger.Error("error composing menu", "error", err)
+		return
+	}
+	text := step.Prompt(b, c)
+	if step.Input == InputKeypad {
+		text = keypadText(text, c.Buffer)
+	}
+	if _, err := b.sendRequest(editMessageTextMethod, map[string]any{
+		"chat_id":      c.ChatID,
+		"message_id":   c.MessageID,
+		"text":         text,
+		"reply_markup": map[string]any{"inline_keyboard": keyboard},
+	}); err != nil {
+		logger.Error("error updating menu", "error", err)
+	}
+}
+
+// processInput method validates the input of the current step of the
+// conversation and moves it to the next state, prompting it or ending the
+// conversation. If the input is not valid, it sends the error to the user and
+// prompts the step again. It must be called with the conversation locked.
+func (b *Bot) processInput(flow *Flow, step *Step, c *Conversation, input Input) {
+	if c.Expire.Before(time.Now()) {
+		b.conversations.remove(c)
+		b.closePrompt(c, "")
+		return
+	}
+	if step.Validate != nil {
+		if err := step.Validate(b, c, input); err != nil {
+			if _, err := b.SendMessage(c.ChatID, 0, err.Error()); err != nil {
+				logger.Error("error sending validation error", "error", err)
+			}
+			// menus are still valid, but text prompts must be sent again
+			if step.Input == InputText || step.Input == InputDocument {
+				if err := b.prompt(flow, c); err != nil {
+					logger.Error("error prompting conversation step", "error", err)
+				}
+			}
+			return
+		}
+	} else {
+		c.Set(c.State, input.Text)
+	}
+	b.closePrompt(c, input.Label)
+	next := ConversationEnd
+	if step.Next != nil {
+		next = b.skipSteps(flow, c, step.Next(b, c))
+	}
+	if next == ConversationEnd {
+		b.conversations.remove(c)
+		if flow.Done != nil {
+			if err := flow.Done(b, c); err != nil {
+				logger.Error("error ending conversation", "flow", flow.Name, "error", err)
+			}
+		}
+		return
+	}
+	c.State = next
+	c.Buffer = ""
+	if err := b.prompt(flow, c); err != nil {
+		logger.Error("error prompting conversation step", "error", err)
+		b.conversations.remove(c)
+	}
+}
+
+// skipSteps method returns the first state from the one provided whose step
+// is not skipped, following the next state of the skipped ones, or
+// ConversationEnd if the conversation ends before it.
+func (b *Bot) skipSteps(flow *Flow, c *Conversation, state string) string {
+	for state != ConversationEnd {
+		step, ok := flow.Steps[state]
+		if !ok || step.Skip == nil || !step.Skip(b, c) {
+			return state
+		}
+		if step.Next == nil {
+			return ConversationEnd
+		}
+		state = step.Next(b, c)
+	}
+	return state
+}
+
+// cleanExpiredConversations method removes the expired conversations and the
+// menus of their prompts.
+func (b *Bot) cleanExpiredConversations() {
+	for _, c := range b.conversations.popExpired() {
+		c.mtx.Lock()
+		b.closePrompt(c, "")
+		c.mtx.Unlock()
+		b.notifyChange(c.ChatID)
+	}
+}
+
+// keypadText returns the text of a keypad prompt with its current input.
+func keypadText(prompt, input string) string {
+	if input == "" {
+		input = keypadEmptyInput
+	}
+	return prompt + "\n" + input
+}
+
+// buttonLabel returns the label of the button of the message with the
+// conversation callback data provided, or the data if it is not found.
+func buttonLabel(msg Message, encoded string) string {
+	if msg.ReplyMarkup != nil {
+		for _, row := range msg.ReplyMarkup.InlineKeyboard {
+			for _, button := range row {
+				if button["callback_data"] == conversationCallbackPrefix+encoded {
+					return button["text"]
+				}
+			}
+		}
+	}
+	data, _ := hex.DecodeString(encoded)
+	return string(data)
+}
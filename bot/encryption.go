@@ -0,0 +1,290 @@
+package bot
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// EncryptionKeySize is the size of the keys of a Cipher, that uses
+	// AES-256-GCM
+	EncryptionKeySize = 32
+	// encryptedMagic is the prefix of the data encrypted by a Cipher, that
+	// tells it apart from plaintext
+	encryptedMagic = "EXB\x01"
+	// encryptedKeyIDSize is the size of the id of the key that encrypted the
+	// data, after the prefix
+	encryptedKeyIDSize = 4
+)
+
+var (
+	// ErrInvalidKey is returned when an encryption key is not valid.
+	ErrInvalidKey = fmt.Errorf("invalid encryption key")
+	// ErrUnknownKey is returned when the data was encrypted with a key that
+	// the Cipher does not have.
+	ErrUnknownKey = fmt.Errorf("data encrypted with an unknown key")
+	// ErrMissingKey is returned when the data is encrypted but no Cipher is
+	// configured.
+	ErrMissingKey = fmt.Errorf("data encrypted but no encryption key provided")
+	// ErrDecrypt is returned when the encrypted data is corrupt or it was
+	// tampered with.
+	ErrDecrypt = fmt.Errorf("error decrypting data")
+)
+
+// IsEncrypted function returns if the data provided was encrypted by a
+// Cipher.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedMagic))
+}
+
+// Cipher struct encrypts and authenticates the data that the bot saves at
+// rest with AES-256-GCM. It has a current key, that encrypts the data, and
+// the previous ones, that only decrypt the data encrypted before a key
+// rotation. The encrypted data starts with a prefix and the id of its key,
+// so the plaintext data is detected and returned as it is, to migrate it.
+type Cipher struct {
+	current []byte
+	keys    map[string]cipher.AEAD
+}
+
+// NewCipher function returns a Cipher with the keys provided, of
+// EncryptionKeySize bytes. The first one is the current key and the rest are
+// the previous ones.
+func NewCipher(keys ...[]byte) (*Cipher, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no keys provided", ErrInvalidKey)
+	}
+	c := &Cipher{keys: make(map[string]cipher.AEAD, len(keys))}
+	for i, key := range keys {
+		if len(key) != EncryptionKeySize {
+			return nil, fmt.Errorf("%w: key %d has %d bytes, expected %d", ErrInvalidKey, i+1, len(key), EncryptionKeySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+		}
+		id := sha256.Sum256(key)
+		if _, exists := c.keys[string(id[:encryptedKeyIDSize])]; exists {
+			return nil, fmt.Errorf("%w: key %d is repeated", ErrInvalidKey, i+1)
+		}
+		c.keys[string(id[:encryptedKeyIDSize])] = aead
+		if i == 0 {
+			c.current = id[:encryptedKeyIDSize]
+		}
+	}
+	return c, nil
+}
+
+// ParseEncryptionKeys function decodes the keys of the text provided,
+// encoded in base64 and separated by commas or new lines, ignoring the empty
+// lines and the ones that start with #.
+func ParseEncryptionKeys(text string) ([][]byte, error) {
+	keys := [][]byte{}
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, encoded := range strings.Split(line, ",") {
+			key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// LoadCipher function returns a Cipher with the keys provided, as
+// ParseEncryptionKeys expects them, or if there are none, with the keys of
+// the file provided. It returns nil if neither the keys nor the file are
+// provided, so the data is not encrypted.
+func LoadCipher(keys, keyFile string) (*Cipher, error) {
+	if keys == "" && keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = string(content)
+	}
+	if keys == "" {
+		return nil, nil
+	}
+	parsed, err := ParseEncryptionKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	return NewCipher(parsed...)
+}
+
+// Encrypt method encrypts the data provided with the current key,
+// authenticating it together with the additional data provided, that must
+// be the same to decrypt it.
+func (c *Cipher) Encrypt(data, additional []byte) ([]byte, error) {
+	aead := c.keys[string(c.current)]
+	header := append([]byte(encryptedMagic), c.current...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	encrypted := append(header, nonce...)
+	return aead.Seal(encrypted, nonce, data, additional), nil
+}
+
+// Decrypt method decrypts the data provided, encrypted with any key of the
+// cipher and the additional data provided. If the data is not encrypted, it
+// is returned as it is.
+func (c *Cipher) Decrypt(data, additional []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	header := len(encryptedMagic) + encryptedKeyIDSize
+	if len(data) < header {
+		return nil, ErrDecrypt
+	}
+	aead, ok := c.keys[string(data[len(encryptedMagic):header])]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if len(data) < header+aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce := data[header : header+aead.NonceSize()]
+	decrypted, err := aead.Open(nil, nonce, data[header+aead.NonceSize():], additional)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecrypt, err)
+	}
+	return decrypted, nil
+}
+
+// isCurrent method returns if the data provided is encrypted with the
+// current key.
+func (c *Cipher) isCurrent(data []byte) bool {
+	return IsEncrypted(data) && bytes.HasPrefix(data[len(encryptedMagic):], c.current)
+}
+
+// chatAdditionalData function returns the additional data that authenticates
+// the encrypted data of the chat provided, so it can not be moved to other
+// chat.
+func chatAdditionalData(chatID int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(chatID))
+}
+
+// encryptedTx struct is a StoreTx that encrypts the records that it puts and
+// decrypts the ones that it gets.
+type encryptedTx struct {
+	tx     StoreTx
+	cipher *Cipher
+}
+
+func (tx *encryptedTx) Get(chatID int64) ([]byte, error) {
+	record, err := tx.tx.Get(chatID)
+	if err != nil {
+		return nil, err
+	}
+	return tx.cipher.Decrypt(record, chatAdditionalData(chatID))
+}
+
+func (tx *encryptedTx) Put(chatID int64, record []byte) error {
+	encrypted, err := tx.cipher.Encrypt(record, chatAdditionalData(chatID))
+	if err != nil {
+		return err
+	}
+	return tx.tx.Put(chatID, encrypted)
+}
+
+func (tx *encryptedTx) Delete(chatID int64) error {
+	return tx.tx.Delete(chatID)
+}
+
+func (tx *encryptedTx) List() ([]int64, error) {
+	return tx.tx.List()
+}
+
+// EncryptedStore struct is a Store that encrypts the records of the chats
+// with a Cipher before saving them in other store, of any kind, so they are
+// encrypted at rest. The ids of the chats are not encrypted. The records in
+// plaintext or encrypted with a previous key are read as well, and Rotate
+// encrypts them again with the current key.
+type EncryptedStore struct {
+	store  Store
+	cipher *Cipher
+}
+
+// NewEncryptedStore function returns an EncryptedStore that saves the
+// records in the store provided encrypted with the cipher provided.
+func NewEncryptedStore(store Store, cipher *Cipher) *EncryptedStore {
+	return &EncryptedStore{store: store, cipher: cipher}
+}
+
+func (s *EncryptedStore) Get(chatID int64) ([]byte, error) {
+	return (&encryptedTx{s.store, s.cipher}).Get(chatID)
+}
+
+func (s *EncryptedStore) Put(chatID int64, record []byte) error {
+	return (&encryptedTx{s.store, s.cipher}).Put(chatID, record)
+}
+
+func (s *EncryptedStore) Delete(chatID int64) error {
+	return s.store.Delete(chatID)
+}
+
+func (s *EncryptedStore) List() ([]int64, error) {
+	return s.store.List()
+}
+
+func (s *EncryptedStore) Update(fn func(tx StoreTx) error) error {
+	return s.store.Update(func(tx StoreTx) error {
+		return fn(&encryptedTx{tx, s.cipher})
+	})
+}
+
+func (s *EncryptedStore) Close() error {
+	return s.store.Close()
+}
+
+// Rotate method encrypts again with the current key the records that are in
+// plaintext or encrypted with a previous key, in a single transaction, and
+// returns how many were rewritten. After it, the previous keys are not
+// needed to read the store.
+func (s *EncryptedStore) Rotate() (int, error) {
+	rotated := 0
+	err := s.store.Update(func(tx StoreTx) error {
+		rotated = 0
+		ids, err := tx.List()
+		if err != nil {
+			return err
+		}
+		encrypter := &encryptedTx{tx, s.cipher}
+		for _, id := range ids {
+			record, err := tx.Get(id)
+			if err != nil {
+				return err
+			}
+			if s.cipher.isCurrent(record) {
+				continue
+			}
+			if record, err = s.cipher.Decrypt(record, chatAdditionalData(id)); err != nil {
+				return fmt.Errorf("chat %d: %w", id, err)
+			}
+			if err := encrypter.Put(id, record); err != nil {
+				return err
+			}
+			rotated++
+		}
+		return nil
+	})
+	return rotated, err
+}
@@ -0,0 +1,220 @@
+package bot
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestKey returns a random encryption key.
+func newTestKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, EncryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestCipher(t *testing.T) {
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	if _, err := NewCipher(oldKey[:16]); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey for a short key, got %v", err)
+	}
+	if _, err := NewCipher(oldKey, oldKey); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey for a repeated key, got %v", err)
+	}
+	old, err := NewCipher(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, chat := []byte(`{"session":"secret"}`), chatAdditionalData(1)
+	encrypted, err := old.Encrypt(data, chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(encrypted) || bytes.Contains(encrypted, []byte("secret")) {
+		t.Errorf("expected the data encrypted, got %q", encrypted)
+	}
+	if decrypted, err := old.Decrypt(encrypted, chat); err != nil || !bytes.Equal(decrypted, data) {
+		t.Errorf("expected the data decrypted, got %q (%v)", decrypted, err)
+	}
+	// the plaintext data is returned as it is
+	if decrypted, err := old.Decrypt(data, chat); err != nil || !bytes.Equal(decrypted, data) {
+		t.Errorf("expected the plaintext data, got %q (%v)", decrypted, err)
+	}
+	// the data of a chat can not be read as the data of other chat, nor
+	// tampered with
+	if _, err := old.Decrypt(encrypted, chatAdditionalData(2)); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("expected ErrDecrypt with other chat, got %v", err)
+	}
+	tampered := bytes.Clone(encrypted)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err := old.Decrypt(tampered, chat); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("expected ErrDecrypt with tampered data, got %v", err)
+	}
+
+	// after a rotation, the previous key only decrypts
+	rotated, err := NewCipher(newKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted, err := rotated.Decrypt(encrypted, chat); err != nil || !bytes.Equal(decrypted, data) {
+		t.Errorf("expected the data decrypted with the previous key, got %q (%v)", decrypted, err)
+	}
+	if rotated.isCurrent(encrypted) {
+		t.Errorf("expected the data not to be encrypted with the current key")
+	}
+	reencrypted, err := rotated.Encrypt(data, chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rotated.isCurrent(reencrypted) {
+		t.Errorf("expected the data to be encrypted with the current key")
+	}
+	if _, err := old.Decrypt(reencrypted, chat); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestLoadCipher(t *testing.T) {
+	if c, err := LoadCipher("", ""); c != nil || err != nil {
+		t.Errorf("expected no cipher, got %v (%v)", c, err)
+	}
+	newKey, oldKey := newTestKey(t), newTestKey(t)
+	keys := base64.StdEncoding.EncodeToString(newKey) + "," + base64.StdEncoding.EncodeToString(oldKey)
+	fromEnv, err := LoadCipher(keys, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	content := "# current key\n" + base64.StdEncoding.EncodeToString(newKey) + "\n\n" + base64.StdEncoding.EncodeToString(oldKey) + "\n"
+	if err := os.WriteFile(keyFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fromFile, err := LoadCipher("", keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fromEnv.current, fromFile.current) || len(fromFile.keys) != 2 {
+		t.Errorf("expected the same keys from the env and the file")
+	}
+	if _, err := LoadCipher("not a key", ""); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey, got %v", err)
+	}
+}
+
+func TestEncryptedStores(t *testing.T) {
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	for kind, open := range testStores() {
+		t.Run(kind, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the records saved before enabling the encryption are read
+			if err := store.Put(1, []byte(`{"plaintext":true}`)); err != nil {
+				t.Fatal(err)
+			}
+			old, err := NewCipher(oldKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encrypted := NewEncryptedStore(store, old)
+			if record, err := encrypted.Get(1); err != nil || string(record) != `{"plaintext":true}` {
+				t.Errorf("expected the plaintext record, got '%s' (%v)", record, err)
+			}
+			if err := encrypted.Put(2, []byte(`{"secret":true}`)); err != nil {
+				t.Fatal(err)
+			}
+			if rotated, err := encrypted.Rotate(); err != nil || rotated != 1 {
+				t.Errorf("expected the plaintext record encrypted, got %d (%v)", rotated, err)
+			}
+			for _, id := range []int64{1, 2} {
+				if record, err := store.Get(id); err != nil || !IsEncrypted(record) {
+					t.Errorf("expected record %d encrypted at rest, got '%s' (%v)", id, record, err)
+				}
+			}
+
+			// a bot without the key does not start
+			b := newStoreTestBot(store)
+			if err := b.loadChats(); !errors.Is(err, ErrMissingKey) {
+				t.Errorf("expected ErrMissingKey, got %v", err)
+			}
+
+			// after rotating the key, the previous one is not needed anymore
+			if err := encrypted.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if store, err = open(dir); err != nil {
+				t.Fatal(err)
+			}
+			rotatedCipher, err := NewCipher(newKey, oldKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rotated, err := NewEncryptedStore(store, rotatedCipher).Rotate(); err != nil || rotated != 2 {
+				t.Errorf("expected both records encrypted again, got %d (%v)", rotated, err)
+			}
+			current, err := NewCipher(newKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encrypted = NewEncryptedStore(store, current)
+			defer encrypted.Close()
+			for id, expected := range map[int64]string{1: `{"plaintext":true}`, 2: `{"secret":true}`} {
+				if record, err := encrypted.Get(id); err != nil || string(record) != expected {
+					t.Errorf("expected record '%s' of chat %d, got '%s' (%v)", expected, id, record, err)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptedEventLogs(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewCipher(newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the entries appended before enabling the encryption are read too
+	plain, err := newEventLogs(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.append(1, &eventLogEntry{Ledger: "main", Event: []byte(`"plaintext"`)}); err != nil {
+		t.Fatal(err)
+	}
+	plain.close()
+	logs, err := newEventLogs(dir, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logs.append(1, &eventLogEntry{Ledger: "main", Event: []byte(`"secret"`)}); err != nil {
+		t.Fatal(err)
+	}
+	logs.close()
+	content, err := os.ReadFile(logs.path(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(content, []byte("secret")) {
+		t.Errorf("expected the entry encrypted, got:\n%s", content)
+	}
+	entries, err := logs.load(1)
+	if err != nil || len(entries) != 2 || string(entries[1].Event) != `"secret"` {
+		t.Errorf("expected both entries, got %v (%v)", entries, err)
+	}
+	// the encrypted entries are not discarded as partial without the key
+	if _, err := plain.load(1); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("expected ErrMissingKey, got %v", err)
+	}
+	if after, err := os.ReadFile(logs.path(1)); err != nil || !bytes.Equal(after, content) {
+		t.Errorf("expected the log unchanged, got %d bytes (%v)", len(after), err)
+	}
+}
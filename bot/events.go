@@ -0,0 +1,553 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// eventLogCompactEntries is the number of entries appended to the event log
+// of a chat since its last checkpoint that makes the bot compact it
+const eventLogCompactEntries = 1000
+
+// ErrEventLogDisabled is returned when the events of a chat are requested
+// but the bot has no event log.
+var ErrEventLogDisabled = errors.New("event log disabled")
+
+// EventData interface is implemented by the session data that records each
+// of its changes as an event, so the bot can append them to the event log of
+// its chat as they happen and replay them when it starts, and the data can
+// be rebuilt at any point in time. The events must be encoded as JSON.
+type EventData interface {
+	Data
+	// SetEventLog sets the function that the data calls with each change,
+	// or removes it if it is nil
+	SetEventLog(appendEvent func(event []byte) error)
+	// ApplyEvent applies an event of the log to the data, ignoring the ones
+	// that it already includes
+	ApplyEvent(event []byte) error
+	// CheckpointEvent returns an event with the whole data, that replaces
+	// the events before it in the log
+	CheckpointEvent() ([]byte, error)
+}
+
+// eventLogEntry struct is a line of the event log of a chat: an event of the
+// data of a ledger, or the mark of a ledger closed, or of every ledger if the
+// name is empty because the session expired.
+type eventLogEntry struct {
+	Ledger string          `json:"ledger"`
+	Event  json.RawMessage `json:"event,omitempty"`
+	Closed bool            `json:"closed,omitempty"`
+}
+
+// eventLog struct is the current segment of the event log of a chat, opened
+// to append the events, and the number of entries since its last checkpoint.
+type eventLog struct {
+	mtx     sync.Mutex
+	file    *os.File
+	entries int
+}
+
+// closeFile method syncs and closes the file of the log, if it is opened,
+// because a sync of an entry in progress fails once it is closed. It must be
+// called with the log locked.
+func (log *eventLog) closeFile() {
+	if log.file == nil {
+		return
+	}
+	if err := log.file.Sync(); err != nil {
+		logger.Error("error syncing event log", "error", err)
+	}
+	log.file.Close()
+	log.file = nil
+}
+
+// eventLogs struct keeps the event log of every chat in a directory, a line
+// of JSON per entry. The current segment of the log of a chat is
+// <chatID>.log, and the previous ones, that are kept as an audit trail when
+// the log is compacted or the session expires, are <chatID>.<n>.log.
+type eventLogs struct {
+	dir            string
+	mtx            sync.Mutex
+	logs           map[int64]*eventLog
+	compactEntries int
+	cipher         *Cipher
+}
+
+// newEventLogs function returns the event logs of the directory provided,
+// creating it if it does not exist. If a cipher is provided, the entries are
+// encrypted with it.
+func newEventLogs(dir string, cipher *Cipher) (*eventLogs, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &eventLogs{
+		dir:            dir,
+		logs:           make(map[int64]*eventLog),
+		compactEntries: eventLogCompactEntries,
+		cipher:         cipher,
+	}, nil
+}
+
+// encode method returns the line of the entry provided of the log of the
+// chat provided, without the line break: its JSON or, if the logs are
+// encrypted, the entry encrypted and encoded in base64.
+func (ls *eventLogs) encode(id int64, entry *eventLogEntry) ([]byte, error) {
+	line, err := json.Marshal(entry)
+	if err != nil || ls.cipher == nil {
+		return line, err
+	}
+	encrypted, err := ls.cipher.Encrypt(line, chatAdditionalData(id))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(encrypted)), nil
+}
+
+// parse method returns the entries of the content of the log of the chat
+// provided and the length of the content that they take. It stops at the
+// first line that is not complete or valid, for example, because of a crash
+// while it was written. The lines in plaintext are read even if the logs are
+// encrypted, but it returns an error if a line is encrypted and the logs are
+// not, or if it was encrypted with an unknown key.
+func (ls *eventLogs) parse(id int64, content []byte) ([]*eventLogEntry, int, error) {
+	entries := []*eventLogEntry{}
+	offset := 0
+	for {
+		end := bytes.IndexByte(content[offset:], '\n')
+		if end < 0 {
+			return entries, offset, nil
+		}
+		line := content[offset : offset+end]
+		if !bytes.HasPrefix(line, []byte("{")) {
+			if ls.cipher == nil {
+				return nil, 0, ErrMissingKey
+			}
+			encrypted, err := base64.StdEncoding.DecodeString(string(line))
+			if err != nil {
+				return entries, offset, nil
+			}
+			if line, err = ls.cipher.Decrypt(encrypted, chatAdditionalData(id)); errors.Is(err, ErrUnknownKey) {
+				return nil, 0, err
+			} else if err != nil {
+				return entries, offset, nil
+			}
+		}
+		entry := &eventLogEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			return entries, offset, nil
+		}
+		entries = append(entries, entry)
+		offset += end + 1
+	}
+}
+
+// path method returns the path of the current segment of the log of the chat
+// provided.
+func (ls *eventLogs) path(id int64) string {
+	return filepath.Join(ls.dir, strconv.FormatInt(id, 10)+".log")
+}
+
+// get method returns the current segment of the log of the chat provided.
+func (ls *eventLogs) get(id int64) *eventLog {
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+
+	log, exist := ls.logs[id]
+	if !exist {
+		log = &eventLog{}
+		ls.logs[id] = log
+	}
+	return log
+}
+
+// chats method returns the ids of the chats that have a current segment,
+// sorted.
+func (ls *eventLogs) chats() ([]int64, error) {
+	entries, err := os.ReadDir(ls.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int64{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".log")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if id, err := strconv.ParseInt(name, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// archives method returns the paths of the previous segments of the log of
+// the chat provided, from the oldest to the newest.
+func (ls *eventLogs) archives(id int64) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(ls.dir, fmt.Sprintf("%d.*.log", id)))
+	if err != nil {
+		return nil, err
+	}
+	numbers := []int{}
+	for _, path := range paths {
+		number := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), fmt.Sprintf("%d.", id)), ".log")
+		if n, err := strconv.Atoi(number); err == nil {
+			numbers = append(numbers, n)
+		}
+	}
+	slices.Sort(numbers)
+	paths = paths[:0]
+	for _, n := range numbers {
+		paths = append(paths, filepath.Join(ls.dir, fmt.Sprintf("%d.%d.log", id, n)))
+	}
+	return paths, nil
+}
+
+// nextArchive method returns the path of the next previous segment of the
+// log of the chat provided.
+func (ls *eventLogs) nextArchive(id int64) (string, error) {
+	paths, err := ls.archives(id)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(ls.dir, fmt.Sprintf("%d.%d.log", id, len(paths)+1)), nil
+}
+
+// load method returns the entries of the current segment of the log of the
+// chat provided. If it ends with a partial entry, for example, because of a
+// crash while it was written, it is discarded from the file.
+func (ls *eventLogs) load(id int64) ([]*eventLogEntry, error) {
+	log := ls.get(id)
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+
+	content, err := os.ReadFile(ls.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	entries, size, err := ls.parse(id, content)
+	if err != nil {
+		return nil, err
+	}
+	if size < len(content) {
+		logger.Warn("discarding partial entry of the event log",
+			"chatID", id, "bytes", len(content)-size)
+		if err := os.Truncate(ls.path(id), int64(size)); err != nil {
+			return nil, err
+		}
+	}
+	log.entries = len(entries)
+	return entries, nil
+}
+
+// readAll method returns the entries of every segment of the log of the chat
+// provided, from the oldest to the newest.
+func (ls *eventLogs) readAll(id int64) ([]*eventLogEntry, error) {
+	paths, err := ls.archives(id)
+	if err != nil {
+		return nil, err
+	}
+	log := ls.get(id)
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+
+	entries := []*eventLogEntry{}
+	for _, path := range append(paths, ls.path(id)) {
+		content, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		segment, _, err := ls.parse(id, content)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, segment...)
+	}
+	return entries, nil
+}
+
+// append method appends the entry provided to the log of the chat provided
+// and syncs it to disk before returning. The file is synced without the log
+// locked, so the entries appended meanwhile do not wait for the disk. If the
+// write fails, the partial entry is removed from the file.
+func (ls *eventLogs) append(id int64, entry *eventLogEntry) error {
+	line, err := ls.encode(id, entry)
+	if err != nil {
+		return err
+	}
+	file, err := ls.write(id, line)
+	if err != nil {
+		return err
+	}
+	// a file closed meanwhile was synced before closing it
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// write method writes the line provided to the current segment of the log
+// of the chat provided, opening it if it is needed, and returns its file.
+func (ls *eventLogs) write(id int64, line []byte) (*os.File, error) {
+	log := ls.get(id)
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+
+	var err error
+	if log.file == nil {
+		if log.file, err = os.OpenFile(ls.path(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return nil, err
+		}
+	}
+	info, err := log.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := log.file.Write(append(line, '\n')); err != nil {
+		if truncErr := log.file.Truncate(info.Size()); truncErr != nil {
+			logger.Error("error discarding partial event", "chatID", id, "error", truncErr)
+		}
+		return nil, err
+	}
+	log.entries++
+	return log.file, nil
+}
+
+// compact method replaces the current segment of the log of the chat
+// provided by the checkpoints that the function provided returns, followed
+// by the entries appended while they were taken, and keeps the replaced
+// segment as a previous one.
+func (ls *eventLogs) compact(id int64, checkpoints func() ([]*eventLogEntry, error)) error {
+	log := ls.get(id)
+	log.mtx.Lock()
+	info, err := os.Stat(ls.path(id))
+	log.mtx.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	entries, err := checkpoints()
+	if err != nil {
+		return err
+	}
+
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+	content, err := os.ReadFile(ls.path(id))
+	if err != nil {
+		return err
+	}
+	tail := content[info.Size():]
+	var compacted bytes.Buffer
+	for _, entry := range entries {
+		line, err := ls.encode(id, entry)
+		if err != nil {
+			return err
+		}
+		compacted.Write(append(line, '\n'))
+	}
+	compacted.Write(tail)
+	// the previous segment is written before replacing the current one, so
+	// a crash between them duplicates entries, that are ignored when they
+	// are replayed, instead of losing them
+	archive, err := ls.nextArchive(id)
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(archive, content); err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(ls.path(id), compacted.Bytes()); err != nil {
+		return err
+	}
+	// reopen the new segment to append the next entries
+	log.closeFile()
+	log.entries = bytes.Count(tail, []byte{'\n'})
+	return nil
+}
+
+// archive method marks every ledger of the log of the chat provided as
+// closed and keeps the current segment as a previous one, so the log starts
+// again, for example, when the session expires.
+func (ls *eventLogs) archive(id int64) error {
+	if err := ls.append(id, &eventLogEntry{Closed: true}); err != nil {
+		return err
+	}
+	archive, err := ls.nextArchive(id)
+	if err != nil {
+		return err
+	}
+	log := ls.get(id)
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+
+	log.closeFile()
+	log.entries = 0
+	if err := os.Rename(ls.path(id), archive); err != nil {
+		return err
+	}
+	return syncDir(ls.dir)
+}
+
+// close method syncs and closes the current segments opened.
+func (ls *eventLogs) close() {
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+
+	for _, log := range ls.logs {
+		log.mtx.Lock()
+		log.closeFile()
+		log.mtx.Unlock()
+	}
+}
+
+// attachEventLog method sets the function that appends the events of the
+// data provided, if it records them, to the log of its chat and ledger.
+func (b *Bot) attachEventLog(id int64, ledger string, data Data) {
+	recorder, ok := data.(EventData)
+	if !ok {
+		return
+	}
+	recorder.SetEventLog(func(event []byte) error {
+		err := b.events.append(id, &eventLogEntry{Ledger: ledger, Event: event})
+		if err != nil {
+			logger.Error("error appending event", "chatID", id, "ledger", ledger, "error", err)
+		}
+		return err
+	})
+}
+
+// replayEvents method applies the events of the current segment of the log
+// of every chat to the data of its ledgers, creating the ledgers that are
+// not in the store yet and removing the closed ones, and then attaches the
+// event log to every ledger. The ledgers whose events can not be applied are
+// logged and keep the data restored until the failed event.
+func (b *Bot) replayEvents() error {
+	ids, err := b.events.chats()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		entries, err := b.events.load(id)
+		if err != nil {
+			return fmt.Errorf("chat %d: %w", id, err)
+		}
+		failed := map[string]bool{}
+		for _, entry := range entries {
+			if entry.Closed {
+				for name := range b.sessions.ledgers(id) {
+					if entry.Ledger == "" || entry.Ledger == name {
+						b.sessions.closeLedger(id, name)
+					}
+				}
+				delete(failed, entry.Ledger)
+				continue
+			}
+			if failed[entry.Ledger] {
+				continue
+			}
+			data, exist := b.sessions.ledger(id, entry.Ledger)
+			if !exist && b.sessions.importer != nil {
+				if data, err = b.sessions.importer(nil); err != nil {
+					return err
+				}
+				b.sessions.restoreLedger(id, entry.Ledger, data)
+			}
+			recorder, ok := data.(EventData)
+			if !ok {
+				continue
+			}
+			if err := recorder.ApplyEvent(entry.Event); err != nil {
+				logger.Error("error replaying event", "chatID", id, "ledger", entry.Ledger, "error", err)
+				failed[entry.Ledger] = true
+			}
+		}
+		if len(entries) > 0 {
+			b.notifyChange(id)
+		}
+	}
+	b.sessions.attachAll(b.attachEventLog)
+	return nil
+}
+
+// compactEventLogs method compacts the logs of the chats with many entries
+// since their last checkpoint, replacing them by a checkpoint of each ledger.
+func (b *Bot) compactEventLogs() {
+	ids, err := b.events.chats()
+	if err != nil {
+		logger.Error("error listing event logs", "error", err)
+		return
+	}
+	for _, id := range ids {
+		log := b.events.get(id)
+		log.mtx.Lock()
+		entries := log.entries
+		log.mtx.Unlock()
+		if entries < b.events.compactEntries {
+			continue
+		}
+		err := b.events.compact(id, func() ([]*eventLogEntry, error) {
+			ledgers := b.sessions.ledgers(id)
+			names := make([]string, 0, len(ledgers))
+			for name := range ledgers {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			checkpoints := []*eventLogEntry{}
+			for _, name := range names {
+				recorder, ok := ledgers[name].(EventData)
+				if !ok {
+					continue
+				}
+				event, err := recorder.CheckpointEvent()
+				if err != nil {
+					return nil, err
+				}
+				checkpoints = append(checkpoints, &eventLogEntry{Ledger: name, Event: event})
+			}
+			return checkpoints, nil
+		})
+		if err != nil {
+			logger.Error("error compacting event log", "chatID", id, "error", err)
+		}
+	}
+}
+
+// LedgerEvents method returns the events of the ledger with the name
+// provided of the chat provided, from the oldest to the newest, including
+// the ones of the compacted segments of its event log, since the ledger was
+// created for the last time. It returns ErrEventLogDisabled if the bot has
+// no event log.
+func (b *Bot) LedgerEvents(chatID int64, ledger string) ([][]byte, error) {
+	if b.events == nil {
+		return nil, ErrEventLogDisabled
+	}
+	entries, err := b.events.readAll(chatID)
+	if err != nil {
+		return nil, err
+	}
+	events := [][]byte{}
+	for _, entry := range entries {
+		switch {
+		case entry.Closed && (entry.Ledger == "" || entry.Ledger == ledger):
+			events = events[:0]
+		case !entry.Closed && entry.Ledger == ledger:
+			events = append(events, entry.Event)
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,185 @@
+package bot
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// testLedger is a session data that records the values added to it as
+// events
+type testLedger struct {
+	mtx         sync.Mutex
+	Values      []string `json:"values"`
+	Seq         int      `json:"seq"`
+	appendEvent func([]byte) error
+}
+
+// testLedgerEvent is an event of a testLedger: a value added or, if it is a
+// checkpoint, every value
+type testLedgerEvent struct {
+	Seq        int      `json:"seq"`
+	Value      string   `json:"value,omitempty"`
+	Checkpoint bool     `json:"checkpoint,omitempty"`
+	Values     []string `json:"values,omitempty"`
+}
+
+func (l *testLedger) Export() ([]byte, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return json.Marshal(l)
+}
+
+func (l *testLedger) SetEventLog(appendEvent func([]byte) error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.appendEvent = appendEvent
+}
+
+func (l *testLedger) ApplyEvent(data []byte) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	event := &testLedgerEvent{}
+	if err := json.Unmarshal(data, event); err != nil {
+		return err
+	}
+	if event.Seq <= l.Seq {
+		return nil
+	}
+	if event.Checkpoint {
+		l.Values = event.Values
+	} else {
+		l.Values = append(l.Values, event.Value)
+	}
+	l.Seq = event.Seq
+	return nil
+}
+
+func (l *testLedger) CheckpointEvent() ([]byte, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return json.Marshal(&testLedgerEvent{Seq: l.Seq, Checkpoint: true, Values: l.Values})
+}
+
+func (l *testLedger) add(t *testing.T, value string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.Values = append(l.Values, value)
+	l.Seq++
+	event, err := json.Marshal(&testLedgerEvent{Seq: l.Seq, Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.appendEvent(event); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEventLogs(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(filepath.Join(dir, "chats"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestBot := func() *Bot {
+		b := newStoreTestBot(store)
+		b.sessions.importer = func(encoded []byte) (Data, error) {
+			ledger := &testLedger{}
+			if len(encoded) > 0 {
+				return ledger, json.Unmarshal(encoded, ledger)
+			}
+			return ledger, nil
+		}
+		if err := b.loadChats(); err != nil {
+			t.Fatal(err)
+		}
+		if b.events, err = newEventLogs(filepath.Join(dir, "events"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.replayEvents(); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	ledgerValues := func(b *Bot, name string) []string {
+		data, ok := b.sessions.ledger(1, name)
+		if !ok {
+			return nil
+		}
+		return data.(*testLedger).Values
+	}
+
+	b := newTestBot()
+	main := b.sessions.getOrCreate(1, &testLedger{}).(*testLedger)
+	main.add(t, "a")
+	if err := b.saveChats(true); err != nil {
+		t.Fatal(err)
+	}
+	// the changes after the last save are only in the event log
+	main.add(t, "b")
+	trip := &testLedger{}
+	if err := b.AddLedger(1, "trip", trip); err != nil {
+		t.Fatal(err)
+	}
+	trip.add(t, "x")
+	old := &testLedger{}
+	if err := b.AddLedger(1, "old", old); err != nil {
+		t.Fatal(err)
+	}
+	old.add(t, "y")
+	if _, err := b.CloseLedger(1, "old"); err != nil {
+		t.Fatal(err)
+	}
+	main.add(t, "c")
+	// a crash while appending an event leaves a partial line
+	file, err := os.OpenFile(b.events.path(1), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(`{"ledger":"main","event":{"seq":4,`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	b.events.close()
+
+	// the events are replayed over the chats of the store
+	restored := newTestBot()
+	for name, expected := range map[string][]string{"main": {"a", "b", "c"}, "trip": {"x"}, "old": nil} {
+		if values := ledgerValues(restored, name); !slices.Equal(values, expected) {
+			t.Errorf("expected ledger %s to be %v, got %v", name, expected, values)
+		}
+	}
+	// the restored ledgers keep appending their events
+	restored.sessions.getOrCreate(1, nil).(*testLedger).add(t, "d")
+	events, err := restored.LedgerEvents(1, "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 4 {
+		t.Errorf("expected 4 events of the main ledger, got %d", len(events))
+	}
+
+	// the compaction replaces the events by checkpoints, keeping the
+	// previous ones as an archive
+	restored.events.compactEntries = 1
+	restored.compactEventLogs()
+	entries, err := restored.events.load(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected a checkpoint of each ledger, got %d entries", len(entries))
+	}
+	if events, err := restored.LedgerEvents(1, "main"); err != nil || len(events) != 5 {
+		t.Errorf("expected the 4 events and the checkpoint of the main ledger, got %d (%v)", len(events), err)
+	}
+	restored.events.close()
+	compacted := newTestBot()
+	if values := ledgerValues(compacted, "main"); !slices.Equal(values, []string{"a", "b", "c", "d"}) {
+		t.Errorf("expected the main ledger to be restored from its checkpoint, got %v", values)
+	}
+	compacted.events.close()
+}
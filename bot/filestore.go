@@ -0,0 +1,131 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fileStoreExt is the extension of the files of the records of a FileStore
+const fileStoreExt = ".chat"
+
+// FileStore struct is a Store that keeps the record of each chat in its own
+// file of a directory, named by the chat id, so saving a chat only writes its
+// file. Each file is replaced atomically, so a crash never leaves a partial
+// record, but a transaction that changes several chats is not atomic as a
+// whole: a crash in the middle of it can leave some chats saved and the
+// others not.
+type FileStore struct {
+	dir string
+	mtx sync.Mutex
+}
+
+// NewFileStore function returns a FileStore of the directory provided,
+// creating it if it does not exist.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// path method returns the path of the file of the chat provided.
+func (s *FileStore) path(chatID int64) string {
+	return filepath.Join(s.dir, strconv.FormatInt(chatID, 10)+fileStoreExt)
+}
+
+func (s *FileStore) Get(chatID int64) ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.get(chatID)
+}
+
+func (s *FileStore) get(chatID int64) ([]byte, error) {
+	record, err := os.ReadFile(s.path(chatID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrRecordNotFound
+	}
+	return record, err
+}
+
+func (s *FileStore) Put(chatID int64, record []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return WriteFileAtomic(s.path(chatID), record)
+}
+
+func (s *FileStore) Delete(chatID int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.delete(chatID)
+}
+
+func (s *FileStore) delete(chatID int64) error {
+	if err := os.Remove(s.path(chatID)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+func (s *FileStore) List() ([]int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.list()
+}
+
+func (s *FileStore) list() ([]int64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int64{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), fileStoreExt)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		id, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// Update method runs the function provided in a transaction and, if it
+// succeeds, writes the files of the chats that it changes, one by one.
+func (s *FileStore) Update(fn func(tx StoreTx) error) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	tx := newStagedTx(s.get, s.list)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for _, id := range tx.changedIDs() {
+		var err error
+		if record, ok := tx.puts[id]; ok {
+			err = WriteFileAtomic(s.path(id), record)
+		} else {
+			err = s.delete(id)
+		}
+		if err != nil {
+			return fmt.Errorf("chat %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// Close method does nothing, every transaction is already saved.
+func (s *FileStore) Close() error {
+	return nil
+}
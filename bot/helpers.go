@@ -6,35 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
-func (b *Bot) tryToLoadSnapshot() error {
-	// check if the snapshot file exists
-	if _, err := os.Stat(b.snapshotPath); err != nil {
-		if strings.Contains(err.Error(), "no such file or directory") {
-			// create the file if it does not exist and return
-			_, err := os.Create(b.snapshotPath)
-			return err
-		}
-		return err
-	}
-	// load the snapshot file
-	data, err := os.ReadFile(b.snapshotPath)
-	if err != nil {
-		return err
-	}
-	if len(data) == 0 {
-		return nil
-	}
-	b.sessions.importSnapshot(data)
-	return nil
-}
-
 func (b *Bot) listenForUpdates() {
 	b.wg.Add(1)
 	go func() {
@@ -53,8 +29,8 @@ func (b *Bot) listenForUpdates() {
 			}
 			// compose the url to get updates from the telegram api and make the
 			// request
-			url := fmt.Sprintf(updatesEndpointTemplate, b.token, b.lastUpdate)
-			resp, err := http.Get(url)
+			url := fmt.Sprintf(updatesEndpointTemplate, b.apiURL, b.token, b.lastUpdate)
+			resp, err := b.client.Get(url)
 			// if something fails, log the error and retry after 5 seconds
 			if err != nil {
 				logger.Error("error getting updates, retrying in 5 seconds...",
@@ -63,8 +39,8 @@ func (b *Bot) listenForUpdates() {
 				continue
 			}
 			// read and parse the response body
-			defer resp.Body.Close()
 			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
 			if err != nil {
 				logger.Error("error reading update response body", "error", err)
 				continue
@@ -101,7 +77,11 @@ func (b *Bot) listenForUpdates() {
 					continue
 				}
 				b.lastUpdate = update.UpdateID + 1
-				b.updates <- update
+				select {
+				case b.updates <- update:
+				case <-b.ctx.Done():
+					return
+				}
 			}
 		}
 	}()
@@ -163,57 +143,87 @@ func decodeCallback(encodedData string) (int64, string, error) {
 }
 
 func (b *Bot) handleCallback(update *Update) {
+	// conversation menus are handled by their conversations
+	if b.handleConversationCallback(update) {
+		return
+	}
 	// decode the callback data
-	messageID, data, err := decodeCallback(update.CallbackQuery.Data)
+	key, data, err := decodeCallback(update.CallbackQuery.Data)
 	if err != nil {
 		logger.Error("error decoding callback", "error", err)
+		b.answerCallback(update.CallbackQuery, expiredMenuMessage)
 		return
 	}
-	// check if the callback id is registered
-	if callback, ok := b.menuCallbacks[messageID]; ok {
-		// if the callback id is registered, execute the callback
-		callback(update.CallbackQuery.Message.ID, data)
+	// check if the callback is registered, waiting for the callbacks that
+	// are being registered
+	b.registering.Lock()
+	b.registering.Unlock()
+	query := update.CallbackQuery
+	if query.Message.Chat == nil {
+		b.answerCallback(query, expiredMenuMessage)
 		return
 	}
-	logger.Error("callback not found", "messageID", messageID)
+	callback, ok := b.menuCallbacks.get(query.Message.Chat.ID, key, query.Message.ID)
+	if !ok {
+		// the menu has expired or it was sent before a restart
+		logger.Debug("menu callback expired", "key", key)
+		b.answerCallback(update.CallbackQuery, expiredMenuMessage)
+		return
+	}
+	// if the callback is registered, execute it
+	b.answerCallback(update.CallbackQuery, "")
+	callback(update.CallbackQuery.Message.ID, data)
 }
 
 func (b *Bot) handleReply(update *Update) {
+	// replies to conversation prompts are handled by their conversations
+	if b.handleConversationMessage(update) {
+		return
+	}
 	// get the original message id
 	messageID := update.Message.ReplyToMessage.MessageID
-	// check if the callback id is registered
-	if callback, ok := b.replyCallbacks[messageID]; ok {
-		// if the callback id is registered, execute the callback
-		callback(messageID, update)
+	// check if the callback id is registered, waiting for the callbacks that
+	// are being registered
+	b.registering.Lock()
+	b.registering.Unlock()
+	if update.Message.Chat == nil {
+		return
+	}
+	callback, ok := b.replyCallbacks.get(update.Message.Chat.ID, messageID, messageID)
+	if !ok {
+		logger.Debug("reply callback not found", "messageID", messageID)
 		return
 	}
-	logger.Error("callback not found", "messageID", messageID)
+	// if the callback id is registered, execute the callback
+	callback(messageID, update)
 }
 
-func (b *Bot) saveSnapshot() error {
-	snapshot, err := b.sessions.exportSnapshot()
-	if err != nil {
-		return err
+// answerCallback method answers the callback query provided, so the client
+// stops waiting for it, showing the text provided to the user if it is not
+// empty.
+func (b *Bot) answerCallback(query *CallbackQuery, text string) {
+	if query.ID == "" {
+		return
 	}
-	// overwrite the snapshot file if it is not empty
-	if len(snapshot) > 0 {
-		if err := os.WriteFile(b.snapshotPath, snapshot, 0644); err != nil {
-			return err
-		}
+	params := map[string]any{"callback_query_id": query.ID}
+	if text != "" {
+		params["text"] = text
+	}
+	if _, err := b.sendRequest(answerCallbackQueryMethod, params); err != nil {
+		logger.Error("error answering callback query", "error", err)
 	}
-	return nil
 }
 
 func (b *Bot) sendRequest(method string, req map[string]any) (int64, error) {
 	// compose the url to send a message to the telegram api and encode the
 	// request body
-	url := fmt.Sprintf(baseEndpointTemplate, b.token, method)
+	url := fmt.Sprintf(baseEndpointTemplate, b.apiURL, b.token, method)
 	requestBody, err := json.Marshal(req)
 	if err != nil {
 		return 0, err
 	}
 	// make the request and check if the response
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(requestBody))
+	resp, err := b.client.Post(url, "application/json", bytes.NewBuffer(requestBody))
 	if err != nil {
 		return 0, err
 	}
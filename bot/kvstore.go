@@ -0,0 +1,372 @@
+package bot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+const (
+	// kvPut, kvDelete and kvCommit are the operations of the entries of a
+	// KVStore file: a put or a delete of the record of a chat, or the commit
+	// of the entries of a transaction
+	kvPut    byte = 1
+	kvDelete byte = 2
+	kvCommit byte = 3
+	// kvHeaderSize is the size of the header of every entry: the checksum of
+	// the rest of the entry, the operation, the chat id and the size of the
+	// record
+	kvHeaderSize = 4 + 1 + 8 + 4
+	// kvCompactMinSize is the minimum size of the file of a KVStore to
+	// compact it
+	kvCompactMinSize = 1 << 20
+)
+
+// errKVCorrupt is returned when an entry of a KVStore file is not valid
+var errKVCorrupt = fmt.Errorf("corrupt entry")
+
+// kvLocation struct is the position of a record in the file of a KVStore.
+type kvLocation struct {
+	offset int64
+	size   int
+}
+
+// kvEntry struct is an entry of the file of a KVStore.
+type kvEntry struct {
+	op     byte
+	chatID int64
+	record []byte
+}
+
+// encode method returns the entry encoded as it is written in the file, with
+// the checksum first.
+func (e *kvEntry) encode() []byte {
+	buf := make([]byte, kvHeaderSize+len(e.record))
+	buf[4] = e.op
+	binary.BigEndian.PutUint64(buf[5:13], uint64(e.chatID))
+	binary.BigEndian.PutUint32(buf[13:17], uint32(len(e.record)))
+	copy(buf[kvHeaderSize:], e.record)
+	binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// readKVEntry function reads the next entry from the reader provided, that
+// has the number of bytes provided left. It returns io.EOF if there are no
+// more entries, or an error if the entry is partial or corrupt.
+func readKVEntry(r io.Reader, left int64) (*kvEntry, error) {
+	header := make([]byte, kvHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[13:17]))
+	if size > left-kvHeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	record := make([]byte, size)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, err
+	}
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[4:])
+	checksum.Write(record)
+	if checksum.Sum32() != binary.BigEndian.Uint32(header[0:4]) {
+		return nil, errKVCorrupt
+	}
+	return &kvEntry{
+		op:     header[4],
+		chatID: int64(binary.BigEndian.Uint64(header[5:13])),
+		record: record,
+	}, nil
+}
+
+// hasKVCommit function reports whether the content provided contains a valid
+// commit entry at any position, so the entries before it were committed.
+func hasKVCommit(content []byte) bool {
+	for i := 0; i+kvHeaderSize <= len(content); i++ {
+		header := content[i : i+kvHeaderSize]
+		if header[4] == kvCommit && binary.BigEndian.Uint32(header[13:17]) == 0 &&
+			crc32.ChecksumIEEE(header[4:]) == binary.BigEndian.Uint32(header[0:4]) {
+			return true
+		}
+	}
+	return false
+}
+
+// KVStore struct is a Store that keeps the records of every chat in a
+// single append-only file, embedded in the bot without external
+// dependencies. Every transaction appends an entry for each record that it
+// puts or deletes, followed by a commit entry, and syncs the file, so saving
+// a chat only writes its record. The position of the current record of each
+// chat is kept in memory. When the file is opened, the entries that are not
+// followed by a commit, for example, because of a crash while writing them,
+// are discarded, so a transaction is saved completely or not at all, but a
+// corrupt entry followed by a commit is an error, because the entries of a
+// committed transaction can not be discarded silently. When
+// most of the file is outdated records, it is compacted rewriting only the
+// current ones.
+type KVStore struct {
+	path        string
+	mtx         sync.Mutex
+	file        *os.File
+	index       map[int64]kvLocation
+	size        int64
+	live        int64
+	compactSize int64
+}
+
+// NewKVStore function opens the KVStore of the file of the path provided,
+// creating it if it does not exist. It returns an error if a committed entry
+// of the file is corrupt.
+func NewKVStore(path string) (*KVStore, error) {
+	s := &KVStore{path: path, compactSize: kvCompactMinSize}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open method opens the file of the store and indexes the records of its
+// committed transactions, truncating the entries after the last commit. If
+// an entry can not be read but there is a commit after it, the file is left
+// untouched and an error is returned.
+func (s *KVStore) open() error {
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	index := map[int64]kvLocation{}
+	live := int64(0)
+	pending := []*kvEntry{}
+	offsets := []int64{}
+	reader := bufio.NewReader(file)
+	offset, committed := int64(0), int64(0)
+	for {
+		entry, err := readKVEntry(reader, info.Size()-offset)
+		if err != nil {
+			break
+		}
+		size := int64(kvHeaderSize + len(entry.record))
+		if entry.op == kvCommit {
+			// the commit entry stores the number of entries of the
+			// transaction in the chat id
+			if entry.chatID != int64(len(pending)) {
+				break
+			}
+			for i, pendingEntry := range pending {
+				if old, ok := index[pendingEntry.chatID]; ok {
+					live -= int64(kvHeaderSize + old.size)
+					delete(index, pendingEntry.chatID)
+				}
+				if pendingEntry.op == kvPut {
+					index[pendingEntry.chatID] = kvLocation{offsets[i] + kvHeaderSize, len(pendingEntry.record)}
+					live += int64(kvHeaderSize + len(pendingEntry.record))
+				}
+			}
+			pending, offsets = pending[:0], offsets[:0]
+			committed = offset + size
+		} else if entry.op == kvPut || entry.op == kvDelete {
+			pending = append(pending, entry)
+			offsets = append(offsets, offset)
+		} else {
+			break
+		}
+		offset += size
+	}
+	if committed < info.Size() {
+		// a crash while writing a transaction only leaves entries without
+		// commit at the end of the file, so a commit after the entry that
+		// can not be read means that a committed entry is corrupt
+		tail := make([]byte, info.Size()-offset)
+		if _, err := file.ReadAt(tail, offset); err != nil {
+			file.Close()
+			return err
+		}
+		if hasKVCommit(tail) {
+			file.Close()
+			return fmt.Errorf("%w at offset %d of %s", errKVCorrupt, offset, s.path)
+		}
+		logger.Warn("discarding uncommitted entries of the kv store",
+			"path", s.path, "bytes", info.Size()-committed)
+		if err := file.Truncate(committed); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	s.file = file
+	s.index = index
+	s.size = committed
+	s.live = live
+	return nil
+}
+
+func (s *KVStore) Get(chatID int64) ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.get(chatID)
+}
+
+func (s *KVStore) get(chatID int64) ([]byte, error) {
+	location, ok := s.index[chatID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	record := make([]byte, location.size)
+	if _, err := s.file.ReadAt(record, location.offset); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (s *KVStore) Put(chatID int64, record []byte) error {
+	return s.Update(func(tx StoreTx) error {
+		return tx.Put(chatID, record)
+	})
+}
+
+func (s *KVStore) Delete(chatID int64) error {
+	return s.Update(func(tx StoreTx) error {
+		return tx.Delete(chatID)
+	})
+}
+
+func (s *KVStore) List() ([]int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.list()
+}
+
+func (s *KVStore) list() ([]int64, error) {
+	ids := make([]int64, 0, len(s.index))
+	for id := range s.index {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// Update method runs the function provided in a transaction and, if it
+// succeeds, appends its changes to the file followed by a commit entry.
+func (s *KVStore) Update(fn func(tx StoreTx) error) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	tx := newStagedTx(s.get, s.list)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	ids := tx.changedIDs()
+	if len(ids) == 0 {
+		return nil
+	}
+	var batch bytes.Buffer
+	locations := map[int64]kvLocation{}
+	for _, id := range ids {
+		entry := &kvEntry{op: kvDelete, chatID: id}
+		if record, ok := tx.puts[id]; ok {
+			entry = &kvEntry{op: kvPut, chatID: id, record: record}
+			locations[id] = kvLocation{s.size + int64(batch.Len()) + kvHeaderSize, len(record)}
+		}
+		batch.Write(entry.encode())
+	}
+	batch.Write((&kvEntry{op: kvCommit, chatID: int64(len(ids))}).encode())
+	if err := s.append(batch.Bytes()); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if old, ok := s.index[id]; ok {
+			s.live -= int64(kvHeaderSize + old.size)
+			delete(s.index, id)
+		}
+		if location, ok := locations[id]; ok {
+			s.index[id] = location
+			s.live += int64(kvHeaderSize + location.size)
+		}
+	}
+	if s.size >= s.compactSize && s.size > 2*s.live {
+		if err := s.compact(); err != nil {
+			logger.Error("error compacting kv store", "path", s.path, "error", err)
+		}
+	}
+	return nil
+}
+
+// append method writes the entries provided at the end of the committed
+// entries of the file and syncs it. If it fails, the file is truncated to
+// discard them.
+func (s *KVStore) append(entries []byte) error {
+	_, err := s.file.WriteAt(entries, s.size)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		if truncErr := s.file.Truncate(s.size); truncErr != nil {
+			logger.Error("error discarding kv store entries", "path", s.path, "error", truncErr)
+		}
+		return err
+	}
+	s.size += int64(len(entries))
+	return nil
+}
+
+// compact method rewrites the file of the store with only the current
+// records of every chat in a single transaction and replaces the current
+// file atomically. The new file is opened before replacing the current one,
+// so the store keeps using the current one if anything fails.
+func (s *KVStore) compact() error {
+	ids, _ := s.list()
+	var content bytes.Buffer
+	index := map[int64]kvLocation{}
+	for _, id := range ids {
+		record, err := s.get(id)
+		if err != nil {
+			return err
+		}
+		index[id] = kvLocation{int64(content.Len()) + kvHeaderSize, len(record)}
+		content.Write((&kvEntry{op: kvPut, chatID: id, record: record}).encode())
+	}
+	live := int64(content.Len())
+	content.Write((&kvEntry{op: kvCommit, chatID: int64(len(ids))}).encode())
+	tmp, err := writeTempFile(s.path, content.Bytes())
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(tmp, os.O_RDWR, 0644)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	s.index = index
+	s.size = int64(content.Len())
+	s.live = live
+	// sync the directory to persist the rename
+	return syncDir(filepath.Dir(s.path))
+}
+
+// Close method closes the file of the store.
+func (s *KVStore) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.file.Close()
+}
@@ -3,7 +3,9 @@ package bot
 import (
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
@@ -14,19 +16,103 @@ type Data interface {
 
 type DataImporter func(encoded []byte) (Data, error)
 
+// DefaultLedger is the name of the ledger that sessions get when their data
+// is created without a name, and the one of the data of legacy snapshots.
+const DefaultLedger = "main"
+
+// sessionSchemaVersion is the version of the format of the saved sessions.
+// The sessions saved by the previous versions are upgraded when they are
+// decoded, see sessionMigrations.
+const sessionSchemaVersion = 1
+
+var (
+	ErrLedgerExists   = errors.New("ledger already exists")
+	ErrLedgerNotFound = errors.New("ledger not found")
+	// ErrUnsupportedVersion is returned when a session or a snapshot was
+	// saved by a newer version of the bot, whose format is not known. The
+	// importers return it too if the data of a ledger was saved by a newer
+	// version.
+	ErrUnsupportedVersion = errors.New("unsupported schema version")
+)
+
+// sessionMigrations are the functions that upgrade an encoded session of
+// each version, by position, to the next one.
+var sessionMigrations = []func(data json.RawMessage) (json.RawMessage, error){
+	// version 0 was the hex encoded data of a single ledger, that gets the
+	// default name
+	func(data json.RawMessage) (json.RawMessage, error) {
+		var legacy string
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]any{
+			"active":  DefaultLedger,
+			"ledgers": map[string]string{DefaultLedger: legacy},
+		})
+	},
+}
+
+// session struct contains the data of a chat, that can be split in several
+// named ledgers, and the name of the active one, which is used by default.
 type session struct {
-	id     int64
-	data   Data
-	expire time.Time
+	id      int64
+	ledgers map[string]Data
+	active  string
+	expire  time.Time
+}
+
+// sessionData struct is the snapshot of a session: the version of its
+// format, the name of its active ledger and the hex encoded data of every
+// ledger.
+type sessionData struct {
+	Version int               `json:"version"`
+	Active  string            `json:"active"`
+	Ledgers map[string]string `json:"ledgers"`
+}
+
+// UnmarshalJSON method decodes the snapshot of a session, upgrading it from
+// the version that saved it to the current one. The legacy snapshots, where
+// the session is the hex encoded data of a single ledger, are version 0, and
+// the first ones with ledgers, that did not include the version, are version
+// 1.
+func (sd *sessionData) UnmarshalJSON(data []byte) error {
+	version := 0
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err == nil {
+		version = 1
+		if raw, ok := fields["version"]; ok {
+			if err := json.Unmarshal(raw, &version); err != nil {
+				return fmt.Errorf("invalid session version: %w", err)
+			}
+		}
+	}
+	if version < 0 || version > sessionSchemaVersion {
+		return fmt.Errorf("%w: %d, expected up to %d", ErrUnsupportedVersion, version, sessionSchemaVersion)
+	}
+	for ; version < sessionSchemaVersion; version++ {
+		var err error
+		if data, err = sessionMigrations[version](data); err != nil {
+			return fmt.Errorf("error migrating session version %d: %w", version, err)
+		}
+	}
+	type plain sessionData
+	if err := json.Unmarshal(data, (*plain)(sd)); err != nil {
+		return err
+	}
+	sd.Version = sessionSchemaVersion
+	return nil
 }
 
-type sessionDump map[int64]string
+type sessionDump map[int64]*sessionData
 
 type sessions struct {
 	daysToExpire int
 	list         map[int64]*session
 	mtx          sync.RWMutex
 	importer     DataImporter
+	// attach is called with every data added to a session, if it is set,
+	// without the sessions locked
+	attach func(id int64, ledger string, data Data)
 }
 
 func initSessions(daysToExpire int) *sessions {
@@ -37,20 +123,184 @@ func initSessions(daysToExpire int) *sessions {
 	}
 }
 
+// get method returns the session of the chat provided, creating an empty one
+// if it does not exist, and extends its expiration. It must be called with
+// the sessions locked.
+func (s *sessions) get(id int64) *session {
+	current, exist := s.list[id]
+	if !exist {
+		current = &session{
+			id:      id,
+			ledgers: make(map[string]Data),
+		}
+		s.list[id] = current
+	}
+	current.expire = time.Now().AddDate(0, 0, s.daysToExpire)
+	return current
+}
+
+// getOrCreate method returns the data of the active ledger of the session of
+// the chat provided. If the session has no active ledger, it creates the
+// default one using the initial data provided.
 func (s *sessions) getOrCreate(id int64, initial Data) any {
+	s.mtx.Lock()
+	current := s.get(id)
+	if data, exist := current.ledgers[current.active]; exist {
+		s.mtx.Unlock()
+		return data
+	}
+	current.active = DefaultLedger
+	data, exist := current.ledgers[current.active]
+	if !exist {
+		current.ledgers[current.active] = initial
+		data = initial
+	}
+	attach := s.attach
+	s.mtx.Unlock()
+
+	// attach the data without blocking the other chats, see addLedger
+	if !exist && attach != nil {
+		attach(id, DefaultLedger, initial)
+	}
+	return data
+}
+
+// addLedger method creates a ledger with the name and the initial data
+// provided in the session of the chat provided and makes it the active one.
+func (s *sessions) addLedger(id int64, name string, initial Data) error {
+	s.mtx.Lock()
+	current := s.get(id)
+	if _, exist := current.ledgers[name]; exist {
+		s.mtx.Unlock()
+		return fmt.Errorf("%w: %s", ErrLedgerExists, name)
+	}
+	current.ledgers[name] = initial
+	current.active = name
+	attach := s.attach
+	s.mtx.Unlock()
+
+	// attaching the data can write to disk, so it is done without the
+	// sessions locked; the changes made to the data before it is attached
+	// are included in its first checkpoint
+	if attach != nil {
+		attach(id, name, initial)
+	}
+	return nil
+}
+
+// switchLedger method makes the ledger with the name provided the active one
+// of the session of the chat provided.
+func (s *sessions) switchLedger(id int64, name string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	current := s.get(id)
+	if _, exist := current.ledgers[name]; !exist {
+		return fmt.Errorf("%w: %s", ErrLedgerNotFound, name)
+	}
+	current.active = name
+	return nil
+}
+
+// listLedgers method returns the names of the ledgers of the session of the
+// chat provided, sorted, and the name of the active one.
+func (s *sessions) listLedgers(id int64) ([]string, string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	current := s.get(id)
+	names := []string{}
+	for name := range current.ledgers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, current.active
+}
+
+// closeLedger method removes the ledger with the name provided from the
+// session of the chat provided. If it was the active one, the first of the
+// remaining ledgers becomes the active one. It returns the name of the
+// active ledger after closing it, which is empty if there is no ledger left.
+func (s *sessions) closeLedger(id int64, name string) (string, error) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
+
+	current := s.get(id)
+	if _, exist := current.ledgers[name]; !exist {
+		return current.active, fmt.Errorf("%w: %s", ErrLedgerNotFound, name)
+	}
+	delete(current.ledgers, name)
+	if current.active == name {
+		current.active = ""
+		names := []string{}
+		for name := range current.ledgers {
+			names = append(names, name)
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			current.active = names[0]
+		}
+	}
+	return current.active, nil
+}
+
+// ledger method returns the data of the ledger with the name provided of the
+// session of the chat provided, if it exists, without extending its
+// expiration.
+func (s *sessions) ledger(id int64, name string) (Data, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	current, exist := s.list[id]
+	if !exist {
+		return nil, false
+	}
+	data, exist := current.ledgers[name]
+	return data, exist
+}
+
+// ledgers method returns a copy of the ledgers of the session of the chat
+// provided, without extending its expiration.
+func (s *sessions) ledgers(id int64) map[string]Data {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	ledgers := map[string]Data{}
 	if current, exist := s.list[id]; exist {
-		s.list[id].expire = time.Now().AddDate(0, 0, s.daysToExpire)
-		return current.data
+		for name, data := range current.ledgers {
+			ledgers[name] = data
+		}
+	}
+	return ledgers
+}
+
+// restoreLedger method adds the ledger with the name and the data provided
+// to the session of the chat provided, creating the session if it does not
+// exist. It becomes the active one if the session has no active ledger.
+func (s *sessions) restoreLedger(id int64, name string, data Data) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	current := s.get(id)
+	current.ledgers[name] = data
+	if _, exist := current.ledgers[current.active]; !exist {
+		current.active = name
 	}
-	newSession := &session{
-		id:     id,
-		data:   initial,
-		expire: time.Now().AddDate(0, 0, s.daysToExpire),
+}
+
+// attachAll method calls the function provided with every ledger of every
+// session and sets it as the function called with the data added from now
+// on.
+func (s *sessions) attachAll(attach func(id int64, ledger string, data Data)) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.attach = attach
+	for id, current := range s.list {
+		for name, data := range current.ledgers {
+			attach(id, name, data)
+		}
 	}
-	s.list[id] = newSession
-	return newSession.data
 }
 
 func (s *sessions) cleanExpired() []int64 {
@@ -68,17 +318,16 @@ func (s *sessions) cleanExpired() []int64 {
 	return toDelete
 }
 
-func (s *sessions) importSnapshot(snapshot []byte) error {
+// importSession method adds the session of the chat provided from its
+// snapshot, replacing the current one, if any.
+func (s *sessions) importSession(id int64, sessionData *sessionData) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 	if s.importer == nil {
 		return fmt.Errorf("no importer set")
 	}
-	sessionsData := sessionDump{}
-	if err := json.Unmarshal(snapshot, &sessionsData); err != nil {
-		return err
-	}
-	for id, encData := range sessionsData {
+	ledgers := make(map[string]Data, len(sessionData.Ledgers))
+	for name, encData := range sessionData.Ledgers {
 		bData, err := hex.DecodeString(encData)
 		if err != nil {
 			return err
@@ -87,33 +336,107 @@ func (s *sessions) importSnapshot(snapshot []byte) error {
 		if err != nil {
 			return err
 		}
-		s.list[id] = &session{
-			id:     id,
-			data:   data,
-			expire: time.Now().AddDate(0, 0, s.daysToExpire),
-		}
+		ledgers[name] = data
+	}
+	s.list[id] = &session{
+		id:      id,
+		ledgers: ledgers,
+		active:  sessionData.Active,
+		expire:  time.Now().AddDate(0, 0, s.daysToExpire),
 	}
-
 	return nil
 }
 
-func (s *sessions) exportSnapshot() ([]byte, error) {
+// exportSession method returns the snapshot of the session of the chat
+// provided, or nil if it has no session.
+func (s *sessions) exportSession(id int64) (*sessionData, error) {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 
-	sessionsData := sessionDump{}
-	for id, session := range s.list {
-		encData, err := session.data.Export()
+	session, exist := s.list[id]
+	if !exist {
+		return nil, nil
+	}
+	ledgers := make(map[string]string, len(session.ledgers))
+	for name, data := range session.ledgers {
+		encData, err := data.Export()
 		if err != nil {
 			return nil, err
 		}
-		sessionsData[id] = hex.EncodeToString(encData)
+		ledgers[name] = hex.EncodeToString(encData)
 	}
+	return &sessionData{
+		Version: sessionSchemaVersion,
+		Active:  session.active,
+		Ledgers: ledgers,
+	}, nil
+}
 
-	snapshot, err := json.Marshal(sessionsData)
-	if err != nil {
-		return nil, err
+// ids method returns the ids of the chats that have a session.
+func (s *sessions) ids() []int64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	ids := make([]int64, 0, len(s.list))
+	for id := range s.list {
+		ids = append(ids, id)
 	}
+	return ids
+}
 
-	return snapshot, nil
+// legacySnapshotVersion is the version of the format of the snapshot files
+// of the previous versions of the bot, that did not include it. The newer
+// formats must include the version, see checkSnapshotVersion.
+const legacySnapshotVersion = 0
+
+// snapshot struct is the content of the snapshot file, it contains the
+// version of its format, the sessions data and the conversations in
+// progress.
+type snapshot struct {
+	Version       int             `json:"version,omitempty"`
+	Sessions      sessionDump     `json:"sessions"`
+	Conversations []*Conversation `json:"conversations,omitempty"`
+}
+
+// checkSnapshotVersion function returns ErrUnsupportedVersion if the version
+// of the fields of the snapshot provided is newer than the supported one.
+// The snapshots without version are supported.
+func checkSnapshotVersion(fields map[string]json.RawMessage, supported int) error {
+	raw, ok := fields["version"]
+	if !ok {
+		return nil
+	}
+	version := 0
+	if err := json.Unmarshal(raw, &version); err != nil {
+		return fmt.Errorf("invalid snapshot version: %w", err)
+	}
+	if version < 0 || version > supported {
+		return fmt.Errorf("%w: snapshot version %d, expected up to %d", ErrUnsupportedVersion, version, supported)
+	}
+	return nil
+}
+
+// decodeSnapshot function decodes the content of a snapshot file. It also
+// supports the legacy snapshots, that only contain the sessions data. It
+// returns ErrUnsupportedVersion if the snapshot has a newer version.
+func decodeSnapshot(data []byte) (*snapshot, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if err := checkSnapshotVersion(fields, legacySnapshotVersion); err != nil {
+		return nil, err
+	}
+	result := &snapshot{}
+	if _, ok := fields["sessions"]; !ok {
+		result.Sessions = sessionDump{}
+		if err := json.Unmarshal(data, &result.Sessions); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
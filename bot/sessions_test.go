@@ -0,0 +1,169 @@
+package bot
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testData is a session data that exports itself as it is
+type testData string
+
+func (d testData) Export() ([]byte, error) {
+	return []byte(d), nil
+}
+
+func TestSessionLedgers(t *testing.T) {
+	s := initSessions(1)
+	s.importer = func(encoded []byte) (Data, error) {
+		return testData(encoded), nil
+	}
+	chatID := int64(1)
+	if data := s.getOrCreate(chatID, testData("flat")); data != testData("flat") {
+		t.Fatalf("expected the initial data, got %v", data)
+	}
+	if err := s.addLedger(chatID, "Lisbon trip", testData("lisbon")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.addLedger(chatID, "Lisbon trip", testData("other")); !errors.Is(err, ErrLedgerExists) {
+		t.Errorf("expected ErrLedgerExists, got %v", err)
+	}
+	// the new ledger is the active one
+	if data := s.getOrCreate(chatID, testData("unused")); data != testData("lisbon") {
+		t.Errorf("expected the new ledger data, got %v", data)
+	}
+	if err := s.switchLedger(chatID, "unknown"); !errors.Is(err, ErrLedgerNotFound) {
+		t.Errorf("expected ErrLedgerNotFound, got %v", err)
+	}
+	if err := s.switchLedger(chatID, DefaultLedger); err != nil {
+		t.Fatal(err)
+	}
+	names, active := s.listLedgers(chatID)
+	if len(names) != 2 || names[0] != "Lisbon trip" || names[1] != DefaultLedger || active != DefaultLedger {
+		t.Errorf("unexpected ledgers %v, active %s", names, active)
+	}
+
+	// the ledgers and the active one are kept in the snapshot
+	dump, err := s.exportSession(chatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &sessionData{}
+	if err := json.Unmarshal(encoded, decoded); err != nil {
+		t.Fatal(err)
+	}
+	restored := initSessions(1)
+	restored.importer = s.importer
+	if err := restored.importSession(chatID, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if data := restored.getOrCreate(chatID, testData("unused")); data != testData("flat") {
+		t.Errorf("expected the active ledger restored, got %v", data)
+	}
+
+	// closing the active ledger activates the first remaining one
+	active, err = restored.closeLedger(chatID, DefaultLedger)
+	if err != nil || active != "Lisbon trip" {
+		t.Errorf("expected the remaining ledger to be active, got '%s' (%v)", active, err)
+	}
+	if active, err = restored.closeLedger(chatID, "Lisbon trip"); err != nil || active != "" {
+		t.Errorf("expected no active ledger, got '%s' (%v)", active, err)
+	}
+	if data := restored.getOrCreate(chatID, testData("new")); data != testData("new") {
+		t.Errorf("expected a new default ledger, got %v", data)
+	}
+
+	// the data is attached without the sessions locked, so attaching it can
+	// read them
+	attached := []string{}
+	restored.attach = func(id int64, ledger string, _ Data) {
+		if _, exist := restored.ledger(id, ledger); exist {
+			attached = append(attached, ledger)
+		}
+	}
+	if err := restored.addLedger(chatID, "Porto trip", testData("porto")); err != nil {
+		t.Fatal(err)
+	}
+	restored.getOrCreate(chatID+1, testData("other chat"))
+	restored.getOrCreate(chatID+1, testData("unused"))
+	if !slices.Equal(attached, []string{"Porto trip", DefaultLedger}) {
+		t.Errorf("expected the new ledgers attached once, got %v", attached)
+	}
+}
+
+func TestLegacySessionSnapshot(t *testing.T) {
+	legacy := map[int64]string{1: hex.EncodeToString([]byte("flat"))}
+	encoded, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := decodeSnapshot(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := initSessions(1)
+	s.importer = func(encoded []byte) (Data, error) {
+		return testData(encoded), nil
+	}
+	if err := s.importSession(1, content.Sessions[1]); err != nil {
+		t.Fatal(err)
+	}
+	names, active := s.listLedgers(1)
+	if len(names) != 1 || active != DefaultLedger {
+		t.Errorf("expected the default ledger, got %v, active %s", names, active)
+	}
+	if data := s.getOrCreate(1, testData("unused")); data != testData("flat") {
+		t.Errorf("expected the legacy data, got %v", data)
+	}
+}
+
+func TestSessionSchema(t *testing.T) {
+	flat := hex.EncodeToString([]byte("flat"))
+	for name, encoded := range map[string]string{
+		// version 0, the hex encoded data of a single ledger
+		"version 0": `"` + flat + `"`,
+		// version 1 without the version, the first one with ledgers
+		"version 1 unversioned": `{"active":"main","ledgers":{"main":"` + flat + `"}}`,
+		"version 1":             `{"version":1,"active":"main","ledgers":{"main":"` + flat + `"}}`,
+	} {
+		decoded := &sessionData{}
+		if err := json.Unmarshal([]byte(encoded), decoded); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if decoded.Version != sessionSchemaVersion || decoded.Active != DefaultLedger || decoded.Ledgers[DefaultLedger] != flat {
+			t.Errorf("%s: expected the session upgraded, got %+v", name, decoded)
+		}
+	}
+	// the sessions are saved with the current version
+	s := initSessions(1)
+	s.getOrCreate(1, testData("flat"))
+	dump, err := s.exportSession(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded, err := json.Marshal(dump); err != nil || !strings.Contains(string(encoded), `"version":1`) {
+		t.Errorf("expected the version in the session, got %s (%v)", encoded, err)
+	}
+	// the versions after the current one are not supported
+	future := []byte(`{"session":{"version":2,"active":"main","ledgers":{}}}`)
+	if err := json.Unmarshal(future, &chatRecord{}); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion, got %v", err)
+	}
+	// and the bot does not start with them, so they are not overwritten
+	store := NewSnapshotStore(filepath.Join(t.TempDir(), "snapshot.json"), 1)
+	if err := store.Put(1, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := newStoreTestBot(store).loadChats(); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected the bot not to load the chats, got %v", err)
+	}
+}
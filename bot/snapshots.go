@@ -0,0 +1,295 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSnapshotInterval is the time between the periodic saves of every
+	// chat if the config does not define other
+	DefaultSnapshotInterval = 5 * time.Minute
+	// DefaultSnapshotRetention is the number of snapshots kept, the current
+	// one and the previous ones, if the config does not define other
+	DefaultSnapshotRetention = 5
+)
+
+// snapshotter struct saves the snapshots of the bot to its path safely: each
+// snapshot is written to a temporary file that replaces the current one once
+// it is synced to disk, so a crash never leaves a partial snapshot, and the
+// previous snapshots are kept rotating them as path.1, path.2, etc. It skips
+// the snapshots whose content has not changed since the last one.
+type snapshotter struct {
+	path      string
+	retention int
+	mtx       sync.Mutex
+	last      []byte
+}
+
+// newSnapshotter function returns a snapshotter of the path provided that
+// keeps the number of snapshots provided, at least one.
+func newSnapshotter(path string, retention int) *snapshotter {
+	return &snapshotter{path: path, retention: max(retention, 1)}
+}
+
+// paths method returns the paths of the snapshots kept, from the newest to
+// the oldest.
+func (s *snapshotter) paths() []string {
+	paths := []string{s.path}
+	for i := 1; i < s.retention; i++ {
+		paths = append(paths, fmt.Sprintf("%s.%d", s.path, i))
+	}
+	return paths
+}
+
+// save method writes the content provided as the new snapshot, rotating the
+// previous ones and removing the oldest one. It does nothing if the content
+// is the same as the one of the last snapshot saved or loaded.
+func (s *snapshotter) save(content []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if bytes.Equal(content, s.last) {
+		return nil
+	}
+	// write the content to a temporary file of the same directory, so it can
+	// be renamed atomically
+	tmp, err := writeTempFile(s.path, content)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	// move every snapshot to the next position, the oldest one is replaced
+	paths := s.paths()
+	for i := len(paths) - 1; i > 0; i-- {
+		if err := os.Rename(paths[i-1], paths[i]); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	// sync the directory to persist the renames
+	if err := syncDir(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+	s.last = content
+	return nil
+}
+
+// load method returns the content of the newest snapshot that the decode
+// function provided accepts, trying the previous ones if it fails, and the
+// path it was read from. The missing and empty snapshots are skipped. It
+// returns no content if there is no snapshot, or an error if there are
+// snapshots but none of them is valid. A snapshot saved by a newer version
+// of the bot is not skipped but returns ErrUnsupportedVersion, so the chats
+// are not restored from an older one and overwritten.
+func (s *snapshotter) load(decode func([]byte) error) ([]byte, string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var errs []error
+	for _, path := range s.paths() {
+		content, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) || (err == nil && len(content) == 0) {
+			continue
+		}
+		if err == nil {
+			err = decode(content)
+		}
+		if errors.Is(err, ErrUnsupportedVersion) {
+			return nil, "", fmt.Errorf("%s: %w", path, err)
+		} else if err != nil {
+			logger.Error("error loading snapshot", "path", path, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		s.last = content
+		return content, path, nil
+	}
+	if len(errs) > 0 {
+		return nil, "", fmt.Errorf("no valid snapshot: %w", errors.Join(errs...))
+	}
+	return nil, "", nil
+}
+
+// snapshotFileVersion is the version of the format of the snapshots of a
+// SnapshotStore. The first ones did not include the version, and the ones of
+// the previous versions of the bot, without the records of the chats, are
+// version 0, see decodeSnapshot.
+const snapshotFileVersion = 1
+
+// snapshotFile struct is the content of the snapshots of a SnapshotStore:
+// the version of its format and the record of every chat.
+type snapshotFile struct {
+	Version int              `json:"version"`
+	Chats   map[int64][]byte `json:"chats"`
+}
+
+// decodeSnapshotFile function returns the records of the chats of the
+// content of a snapshot. It also supports the snapshots of the previous
+// versions, with the sessions and the conversations of every chat together,
+// converting them to records. It returns ErrUnsupportedVersion if the
+// snapshot was saved by a newer version of the bot.
+func decodeSnapshotFile(content []byte) (map[int64][]byte, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return nil, err
+	}
+	if err := checkSnapshotVersion(fields, snapshotFileVersion); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["chats"]; !ok {
+		legacy, err := decodeSnapshot(content)
+		if err != nil {
+			return nil, err
+		}
+		return snapshotRecords(legacy)
+	}
+	file := &snapshotFile{}
+	if err := json.Unmarshal(content, file); err != nil {
+		return nil, err
+	}
+	if file.Chats == nil {
+		file.Chats = map[int64][]byte{}
+	}
+	return file.Chats, nil
+}
+
+// SnapshotStore struct is a Store that keeps the records of every chat in a
+// single snapshot file, the format of the previous versions of the bot.
+// Every transaction writes a new snapshot safely, rotating the previous ones
+// as path.1, path.2, etc., and if the newest one is corrupt when it is
+// loaded, it falls back to the previous ones. It also reads the snapshots of
+// the previous versions, so the chats can be migrated to other store with
+// CopyStore.
+type SnapshotStore struct {
+	snapshots *snapshotter
+	mtx       sync.Mutex
+	records   map[int64][]byte
+}
+
+// NewSnapshotStore function returns a SnapshotStore of the path provided
+// that keeps the number of snapshots provided, at least one. The snapshots
+// are loaded the first time that the store is used.
+func NewSnapshotStore(path string, retention int) *SnapshotStore {
+	return &SnapshotStore{snapshots: newSnapshotter(path, retention)}
+}
+
+// load method loads the records of the newest valid snapshot, if they are
+// not loaded yet. It must be called with the store locked.
+func (s *SnapshotStore) load() error {
+	if s.records != nil {
+		return nil
+	}
+	records := map[int64][]byte{}
+	_, path, err := s.snapshots.load(func(content []byte) error {
+		decoded, err := decodeSnapshotFile(content)
+		if err != nil {
+			return err
+		}
+		records = decoded
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if path != "" && path != s.snapshots.path {
+		logger.Warn("snapshot recovered from a previous one", "path", path)
+	}
+	s.records = records
+	return nil
+}
+
+func (s *SnapshotStore) Get(chatID int64) ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.get(chatID)
+}
+
+func (s *SnapshotStore) get(chatID int64) ([]byte, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	record, ok := s.records[chatID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return bytes.Clone(record), nil
+}
+
+func (s *SnapshotStore) Put(chatID int64, record []byte) error {
+	return s.Update(func(tx StoreTx) error {
+		return tx.Put(chatID, record)
+	})
+}
+
+func (s *SnapshotStore) Delete(chatID int64) error {
+	return s.Update(func(tx StoreTx) error {
+		return tx.Delete(chatID)
+	})
+}
+
+func (s *SnapshotStore) List() ([]int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.list()
+}
+
+func (s *SnapshotStore) list() ([]int64, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(s.records))
+	for id := range s.records {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// Update method runs the function provided in a transaction and, if it
+// succeeds, writes a new snapshot with its changes.
+func (s *SnapshotStore) Update(fn func(tx StoreTx) error) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	tx := newStagedTx(s.get, s.list)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.changedIDs()) == 0 {
+		return nil
+	}
+	records := maps.Clone(s.records)
+	for id, record := range tx.puts {
+		records[id] = record
+	}
+	for id := range tx.deletes {
+		delete(records, id)
+	}
+	content, err := json.Marshal(&snapshotFile{Version: snapshotFileVersion, Chats: records})
+	if err != nil {
+		return err
+	}
+	if err := s.snapshots.save(content); err != nil {
+		return err
+	}
+	s.records = records
+	return nil
+}
+
+// Close method does nothing, every transaction is already saved.
+func (s *SnapshotStore) Close() error {
+	return nil
+}
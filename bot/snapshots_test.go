@@ -0,0 +1,141 @@
+package bot
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "snapshot.json")
+	s := newSnapshotter(path, 3)
+	for _, content := range []string{"1", "2", "3", "4", "4"} {
+		if err := s.save([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the last three different snapshots are kept, from the newest
+	for i, expected := range []string{"4", "3", "2"} {
+		content, err := os.ReadFile(s.paths()[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Errorf("expected snapshot %d to be '%s', got '%s'", i, expected, content)
+		}
+	}
+	// neither older snapshots nor temporary files are left
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("expected 3 files, got %v", names)
+	}
+}
+
+func TestSnapshotRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	newTestBot := func() *Bot {
+		return newStoreTestBot(NewSnapshotStore(path, 3))
+	}
+	// without snapshots the bot starts empty
+	b := newTestBot()
+	if err := b.loadChats(); err != nil {
+		t.Fatal(err)
+	}
+	b.sessions.getOrCreate(1, testData("flat"))
+	if err := b.saveChats(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// a corrupt newest snapshot, for example, written by a previous version
+	// that crashed while writing it, falls back to the previous one
+	if err := newSnapshotter(path, 3).save([]byte(`{"chats": {"1": `)); err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestBot()
+	if err := restored.loadChats(); err != nil {
+		t.Fatal(err)
+	}
+	if data := restored.sessions.getOrCreate(1, testData("unused")); data != testData("flat") {
+		t.Errorf("expected the data of the previous snapshot, got %v", data)
+	}
+
+	// if no snapshot is valid, the bot does not start
+	if err := os.WriteFile(path+".1", []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestBot().loadChats(); err == nil {
+		t.Error("expected an error without valid snapshots")
+	}
+}
+
+func TestSnapshotVersions(t *testing.T) {
+	flat := hex.EncodeToString([]byte("flat"))
+	session := `{"version":1,"active":"main","ledgers":{"main":"` + flat + `"}}`
+	record, err := encodeChatRecord(&sessionData{Version: 1, Active: DefaultLedger, Ledgers: map[string]string{DefaultLedger: flat}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chats, err := json.Marshal(map[int64][]byte{1: record})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		// version 0, the sessions of the previous versions of the bot
+		"version 0 sessions": `{"1":"` + flat + `"}`,
+		"version 0 snapshot": `{"sessions":{"1":` + session + `}}`,
+		"version 0":          `{"version":0,"sessions":{"1":` + session + `}}`,
+		// version 1 without the version, the first one with records
+		"version 1 unversioned": `{"chats":` + string(chats) + `}`,
+		"version 1":             `{"version":1,"chats":` + string(chats) + `}`,
+	} {
+		records, err := decodeSnapshotFile([]byte(content))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		decoded := &chatRecord{}
+		if err := json.Unmarshal(records[1], decoded); err != nil || decoded.Session == nil || decoded.Session.Ledgers[DefaultLedger] != flat {
+			t.Errorf("%s: expected the session of chat 1, got %s (%v)", name, records[1], err)
+		}
+	}
+	// the versions after the supported ones are not decoded as other format
+	for name, content := range map[string]string{
+		"version 2":                 `{"version":2,"chats":` + string(chats) + `}`,
+		"version 1 without records": `{"version":1,"sessions":{"1":` + session + `}}`,
+		"version 2 without records": `{"version":2}`,
+	} {
+		if _, err := decodeSnapshotFile([]byte(content)); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("%s: expected ErrUnsupportedVersion, got %v", name, err)
+		}
+	}
+
+	// the snapshots are saved with the current version
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	store := NewSnapshotStore(path, 3)
+	if err := store.Put(1, record); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(path); err != nil || !strings.Contains(string(content), `"version":1`) {
+		t.Errorf("expected the version in the snapshot, got %s (%v)", content, err)
+	}
+	// a newer snapshot does not fall back to the previous one, so the bot
+	// does not start instead of overwriting it
+	if err := newSnapshotter(path, 3).save([]byte(`{"version":2,"chats":{}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := newStoreTestBot(NewSnapshotStore(path, 3)).loadChats(); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
@@ -0,0 +1,449 @@
+package bot
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// ErrRecordNotFound is returned by the stores when the chat requested has no
+// record.
+var ErrRecordNotFound = fmt.Errorf("record not found")
+
+const (
+	// SnapshotStoreKind is the kind of the store that keeps every chat in a
+	// single snapshot file, see NewSnapshotStore
+	SnapshotStoreKind = "snapshot"
+	// FileStoreKind is the kind of the store that keeps a file per chat, see
+	// NewFileStore
+	FileStoreKind = "files"
+	// KVStoreKind is the kind of the store that keeps every chat in an
+	// append-only key-value file, see NewKVStore
+	KVStoreKind = "kv"
+	// saveDelay is the time that the bot waits after a change before saving
+	// the chats, so the changes of consecutive updates are saved together
+	saveDelay = time.Second
+)
+
+// StoreTx interface defines the operations over the records of the chats,
+// the encoded sessions and conversations of each chat, that a Store
+// supports, also inside a transaction. Deleting a record that does not exist
+// does nothing.
+type StoreTx interface {
+	Get(chatID int64) ([]byte, error)
+	Put(chatID int64, record []byte) error
+	Delete(chatID int64) error
+	List() ([]int64, error)
+}
+
+// Store interface defines where the bot saves the record of each chat, so it
+// only writes the chats that change. Update runs the function provided in a
+// transaction: its changes are applied only if the function returns no
+// error.
+type Store interface {
+	StoreTx
+	Update(fn func(tx StoreTx) error) error
+	Close() error
+}
+
+// OpenStore function returns a store of the kind provided in the path
+// provided: a SnapshotStore that keeps the default number of snapshots, a
+// FileStore or a KVStore.
+func OpenStore(kind, path string) (Store, error) {
+	switch kind {
+	case SnapshotStoreKind:
+		return NewSnapshotStore(path, DefaultSnapshotRetention), nil
+	case FileStoreKind:
+		return NewFileStore(path)
+	case KVStoreKind:
+		return NewKVStore(path)
+	default:
+		return nil, fmt.Errorf("unknown store kind '%s'", kind)
+	}
+}
+
+// CopyStore function copies every record of the src store to the dst store
+// in a single transaction and returns the number of records copied. It can
+// be used to migrate the chats from a snapshot file, also in the legacy
+// formats, to other store.
+func CopyStore(dst, src Store) (int, error) {
+	ids, err := src.List()
+	if err != nil {
+		return 0, err
+	}
+	records := make(map[int64][]byte, len(ids))
+	for _, id := range ids {
+		record, err := src.Get(id)
+		if err != nil {
+			return 0, fmt.Errorf("chat %d: %w", id, err)
+		}
+		records[id] = record
+	}
+	err = dst.Update(func(tx StoreTx) error {
+		for _, id := range ids {
+			if err := tx.Put(id, records[id]); err != nil {
+				return fmt.Errorf("chat %d: %w", id, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// stagedTx struct is a transaction that keeps its changes in memory over
+// the records of a store, that it reads with the get and list functions, so
+// the store applies them only if the transaction succeeds.
+type stagedTx struct {
+	get     func(int64) ([]byte, error)
+	list    func() ([]int64, error)
+	puts    map[int64][]byte
+	deletes map[int64]bool
+}
+
+func newStagedTx(get func(int64) ([]byte, error), list func() ([]int64, error)) *stagedTx {
+	return &stagedTx{
+		get:     get,
+		list:    list,
+		puts:    make(map[int64][]byte),
+		deletes: make(map[int64]bool),
+	}
+}
+
+func (tx *stagedTx) Get(chatID int64) ([]byte, error) {
+	if tx.deletes[chatID] {
+		return nil, ErrRecordNotFound
+	}
+	if record, ok := tx.puts[chatID]; ok {
+		return bytes.Clone(record), nil
+	}
+	return tx.get(chatID)
+}
+
+func (tx *stagedTx) Put(chatID int64, record []byte) error {
+	delete(tx.deletes, chatID)
+	tx.puts[chatID] = bytes.Clone(record)
+	return nil
+}
+
+func (tx *stagedTx) Delete(chatID int64) error {
+	delete(tx.puts, chatID)
+	tx.deletes[chatID] = true
+	return nil
+}
+
+func (tx *stagedTx) List() ([]int64, error) {
+	ids, err := tx.list()
+	if err != nil {
+		return nil, err
+	}
+	result := []int64{}
+	for _, id := range ids {
+		if _, ok := tx.puts[id]; !ok && !tx.deletes[id] {
+			result = append(result, id)
+		}
+	}
+	for id := range tx.puts {
+		result = append(result, id)
+	}
+	slices.Sort(result)
+	return result, nil
+}
+
+// changedIDs method returns the ids of the chats changed by the transaction,
+// sorted.
+func (tx *stagedTx) changedIDs() []int64 {
+	ids := make([]int64, 0, len(tx.puts)+len(tx.deletes))
+	for id := range tx.puts {
+		ids = append(ids, id)
+	}
+	for id := range tx.deletes {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// chatRecord struct is the content of the record of a chat in the store: its
+// session and its conversations in progress.
+type chatRecord struct {
+	Session       *sessionData    `json:"session,omitempty"`
+	Conversations []*Conversation `json:"conversations,omitempty"`
+}
+
+// encodeChatRecord function returns the record of the chat with the session
+// and the conversations provided, sorted by user so the same chat is always
+// encoded the same way.
+func encodeChatRecord(session *sessionData, conversations []*Conversation) ([]byte, error) {
+	slices.SortFunc(conversations, func(a, b *Conversation) int {
+		return cmp.Compare(a.UserID, b.UserID)
+	})
+	return json.Marshal(&chatRecord{Session: session, Conversations: conversations})
+}
+
+// snapshotRecords function returns the records of the chats of the snapshot
+// provided.
+func snapshotRecords(s *snapshot) (map[int64][]byte, error) {
+	conversations := map[int64][]*Conversation{}
+	for _, c := range s.Conversations {
+		conversations[c.ChatID] = append(conversations[c.ChatID], c)
+	}
+	records := map[int64][]byte{}
+	for id, session := range s.Sessions {
+		record, err := encodeChatRecord(session, conversations[id])
+		if err != nil {
+			return nil, err
+		}
+		records[id] = record
+	}
+	for id, list := range conversations {
+		if _, ok := records[id]; ok {
+			continue
+		}
+		record, err := encodeChatRecord(nil, list)
+		if err != nil {
+			return nil, err
+		}
+		records[id] = record
+	}
+	return records, nil
+}
+
+// writeTempFile function writes the content provided to a new temporary file
+// in the directory of the path provided, synced to disk, and returns its
+// name, so it can replace the path atomically renaming it.
+func writeTempFile(path string, content []byte) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// WriteFileAtomic function replaces the file of the path provided with the
+// content provided, so a crash leaves either the previous content or the new
+// one, never a partial file. The content is written to a temporary file in
+// the same directory, synced to disk and renamed over the path.
+func WriteFileAtomic(path string, content []byte) error {
+	tmp, err := writeTempFile(path, content)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// sync the directory to persist the rename
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir function flushes the entries of the directory provided to disk.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// loadChats method restores the sessions and the conversations of every
+// chat of the store. The chats whose record can not be imported are logged
+// and skipped, so a corrupt chat does not prevent the others from working.
+func (b *Bot) loadChats() error {
+	ids, err := b.store.List()
+	if err != nil {
+		return err
+	}
+	b.saveMtx.Lock()
+	defer b.saveMtx.Unlock()
+	for _, id := range ids {
+		content, err := b.store.Get(id)
+		if err != nil {
+			return fmt.Errorf("chat %d: %w", id, err)
+		}
+		// an encrypted store can not be read without its keys
+		if IsEncrypted(content) {
+			return fmt.Errorf("chat %d: %w", id, ErrMissingKey)
+		}
+		record := &chatRecord{}
+		err = json.Unmarshal(content, record)
+		if err == nil && record.Session != nil {
+			err = b.sessions.importSession(id, record.Session)
+		}
+		// a chat saved by a newer version stops the bot, instead of being
+		// overwritten when it is saved again
+		if errors.Is(err, ErrUnsupportedVersion) {
+			return fmt.Errorf("chat %d: %w", id, err)
+		} else if err != nil {
+			logger.Error("error loading chat", "chatID", id, "error", err)
+			continue
+		}
+		b.conversations.load(record.Conversations)
+		b.saved[id] = sha256.Sum256(content)
+	}
+	return nil
+}
+
+// saveChats method saves the records of the chats changed since the last
+// save in a single transaction of the store, or of every chat if all is
+// true. The chats that did not change are not written, and the ones without
+// session nor conversations are deleted.
+func (b *Bot) saveChats(all bool) error {
+	b.saveMtx.Lock()
+	defer b.saveMtx.Unlock()
+
+	b.dirtyMtx.Lock()
+	dirty := b.dirty
+	b.dirty = make(map[int64]bool)
+	b.dirtyMtx.Unlock()
+
+	conversations := map[int64][]*Conversation{}
+	for _, c := range b.conversations.export() {
+		conversations[c.ChatID] = append(conversations[c.ChatID], c)
+	}
+	ids := map[int64]bool{}
+	for id := range dirty {
+		ids[id] = true
+	}
+	if all {
+		for id := range b.saved {
+			ids[id] = true
+		}
+		for _, id := range b.sessions.ids() {
+			ids[id] = true
+		}
+		for id := range conversations {
+			ids[id] = true
+		}
+	}
+	puts := map[int64][]byte{}
+	deletes := []int64{}
+	for id := range ids {
+		session, err := b.sessions.exportSession(id)
+		if err != nil {
+			logger.Error("error exporting chat", "chatID", id, "error", err)
+			continue
+		}
+		if session == nil && len(conversations[id]) == 0 {
+			if _, ok := b.saved[id]; ok {
+				deletes = append(deletes, id)
+			}
+			continue
+		}
+		record, err := encodeChatRecord(session, conversations[id])
+		if err != nil {
+			logger.Error("error encoding chat", "chatID", id, "error", err)
+			continue
+		}
+		if hash, ok := b.saved[id]; !ok || hash != sha256.Sum256(record) {
+			puts[id] = record
+		}
+	}
+	if len(puts) == 0 && len(deletes) == 0 {
+		return nil
+	}
+	err := b.store.Update(func(tx StoreTx) error {
+		for id, record := range puts {
+			if err := tx.Put(id, record); err != nil {
+				return err
+			}
+		}
+		for _, id := range deletes {
+			if err := tx.Delete(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// keep the chats changed to retry them in the next save
+		b.dirtyMtx.Lock()
+		for id := range dirty {
+			b.dirty[id] = true
+		}
+		b.dirtyMtx.Unlock()
+		return err
+	}
+	for id, record := range puts {
+		b.saved[id] = sha256.Sum256(record)
+	}
+	for _, id := range deletes {
+		delete(b.saved, id)
+	}
+	return nil
+}
+
+// notifyChange method tells the bot that the sessions or the conversations
+// of the chats provided may have changed, so it saves them soon.
+func (b *Bot) notifyChange(chatIDs ...int64) {
+	b.dirtyMtx.Lock()
+	for _, id := range chatIDs {
+		b.dirty[id] = true
+	}
+	b.dirtyMtx.Unlock()
+	select {
+	case b.changes <- struct{}{}:
+	default:
+	}
+}
+
+// saveInBackground method saves the chats changed shortly after every change
+// notified, and checks every chat every interval, until the bot is stopped.
+func (b *Bot) saveInBackground(interval time.Duration) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			all := false
+			select {
+			case <-b.ctx.Done():
+				return
+			case <-b.changes:
+				// wait for the changes of the updates in progress
+				select {
+				case <-b.ctx.Done():
+					return
+				case <-time.After(saveDelay):
+				}
+			case <-ticker.C:
+				all = true
+				if b.events != nil {
+					b.compactEventLogs()
+				}
+			}
+			if err := b.saveChats(all); err != nil {
+				logger.Error("error saving chats", "error", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,316 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newStoreTestBot returns a bot with the store provided that imports the
+// sessions as testData.
+func newStoreTestBot(store Store) *Bot {
+	b := &Bot{
+		sessions:      initSessions(1),
+		conversations: initConversations(),
+		store:         store,
+		changes:       make(chan struct{}, 1),
+		dirty:         make(map[int64]bool),
+		saved:         make(map[int64][32]byte),
+	}
+	b.sessions.importer = func(encoded []byte) (Data, error) {
+		return testData(encoded), nil
+	}
+	return b
+}
+
+// testStores returns a function for each kind of store that opens the store
+// of the path provided.
+func testStores() map[string]func(string) (Store, error) {
+	return map[string]func(string) (Store, error){
+		SnapshotStoreKind: func(path string) (Store, error) {
+			return NewSnapshotStore(filepath.Join(path, "snapshot.json"), 2), nil
+		},
+		FileStoreKind: func(path string) (Store, error) {
+			return NewFileStore(filepath.Join(path, "chats"))
+		},
+		KVStoreKind: func(path string) (Store, error) {
+			return NewKVStore(filepath.Join(path, "chats.db"))
+		},
+	}
+}
+
+func TestStores(t *testing.T) {
+	for kind, open := range testStores() {
+		t.Run(kind, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Get(1); !errors.Is(err, ErrRecordNotFound) {
+				t.Errorf("expected ErrRecordNotFound, got %v", err)
+			}
+			for id, record := range map[int64]string{1: "one", 2: "two", -3: "group"} {
+				if err := store.Put(id, []byte(record)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.Put(2, []byte("two updated")); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Delete(1); err != nil {
+				t.Fatal(err)
+			}
+			// deleting a missing record does nothing
+			if err := store.Delete(4); err != nil {
+				t.Fatal(err)
+			}
+			expected := map[int64]string{-3: "group", 2: "two updated"}
+			checkRecords := func(store Store, expected map[int64]string) {
+				t.Helper()
+				ids, err := store.List()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.IsSorted(ids) || len(ids) != len(expected) {
+					t.Errorf("expected the ids of %v sorted, got %v", expected, ids)
+				}
+				for id, record := range expected {
+					if got, err := store.Get(id); err != nil || string(got) != record {
+						t.Errorf("expected record '%s' of chat %d, got '%s' (%v)", record, id, got, err)
+					}
+				}
+			}
+			checkRecords(store, expected)
+
+			// a failed transaction does not change anything, although its
+			// changes are visible inside it
+			failure := errors.New("failure")
+			err = store.Update(func(tx StoreTx) error {
+				if err := tx.Put(5, []byte("five")); err != nil {
+					return err
+				}
+				if err := tx.Delete(2); err != nil {
+					return err
+				}
+				if ids, err := tx.List(); err != nil || !slices.Equal(ids, []int64{-3, 5}) {
+					t.Errorf("expected the ids of the transaction, got %v (%v)", ids, err)
+				}
+				if _, err := tx.Get(2); !errors.Is(err, ErrRecordNotFound) {
+					t.Errorf("expected the deleted record to be missing, got %v", err)
+				}
+				return failure
+			})
+			if !errors.Is(err, failure) {
+				t.Errorf("expected the error of the transaction, got %v", err)
+			}
+			checkRecords(store, expected)
+
+			// a successful transaction applies every change
+			err = store.Update(func(tx StoreTx) error {
+				if err := tx.Put(5, []byte("five")); err != nil {
+					return err
+				}
+				return tx.Delete(-3)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected = map[int64]string{2: "two updated", 5: "five"}
+			checkRecords(store, expected)
+
+			// the records are kept after reopening the store
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+			reopened, err := open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+			checkRecords(reopened, expected)
+		})
+	}
+}
+
+func TestKVStoreRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chats.db")
+	store, err := NewKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(1, []byte("saved")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// simulate a crash while writing a transaction: a complete entry without
+	// its commit and a partial one
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := (&kvEntry{op: kvPut, chatID: 1, record: []byte("uncommitted")}).encode()
+	if _, err := file.Write(append(entry, entry[:10]...)); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	store, err = NewKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record, err := store.Get(1); err != nil || string(record) != "saved" {
+		t.Errorf("expected the committed record, got '%s' (%v)", record, err)
+	}
+	// the store keeps working after discarding the partial transaction
+	if err := store.Put(2, []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	store, err = NewKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if ids, err := store.List(); err != nil || !slices.Equal(ids, []int64{1, 2}) {
+		t.Errorf("expected chats 1 and 2, got %v (%v)", ids, err)
+	}
+
+	// a corrupt committed entry is an error and the file is not truncated
+	store.Close()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[len(content)-kvHeaderSize-2] ^= 0xff
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKVStore(path); !errors.Is(err, errKVCorrupt) {
+		t.Errorf("expected a corrupt entry error, got %v", err)
+	}
+	if stored, err := os.ReadFile(path); err != nil || !bytes.Equal(stored, content) {
+		t.Errorf("expected the file untouched, got %d bytes (%v)", len(stored), err)
+	}
+
+	// a corrupt entry without commit at the end of the file is discarded
+	content[len(content)-kvHeaderSize-2] ^= 0xff
+	corrupt := (&kvEntry{op: kvPut, chatID: 3, record: []byte("uncommitted")}).encode()
+	corrupt[len(corrupt)-1] ^= 0xff
+	if err := os.WriteFile(path, append(content, corrupt...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if ids, err := store.List(); err != nil || !slices.Equal(ids, []int64{1, 2}) {
+		t.Errorf("expected chats 1 and 2, got %v (%v)", ids, err)
+	}
+}
+
+func TestKVStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chats.db")
+	store, err := NewKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.compactSize = 1024
+	for i := 0; i < 100; i++ {
+		if err := store.Put(int64(i%3), []byte(time.Duration(i).String())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 2*store.compactSize {
+		t.Errorf("expected the file to be compacted, got %d bytes", info.Size())
+	}
+	store.Close()
+	store, err = NewKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for id, expected := range map[int64]string{0: "99ns", 1: "97ns", 2: "98ns"} {
+		if record, err := store.Get(id); err != nil || string(record) != expected {
+			t.Errorf("expected record '%s' of chat %d, got '%s' (%v)", expected, id, record, err)
+		}
+	}
+}
+
+func TestMigrateSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	// a snapshot of the previous versions, with the sessions of every chat and
+	// the conversations in progress together
+	legacy, err := json.Marshal(map[string]any{
+		"sessions": map[string]any{
+			"1": map[string]any{
+				"active":  DefaultLedger,
+				"ledgers": map[string]string{DefaultLedger: hex.EncodeToString([]byte("flat"))},
+			},
+		},
+		"conversations": []*Conversation{{
+			Flow:   "test",
+			ChatID: 2,
+			UserID: 7,
+			State:  "start",
+			Values: map[string]string{"key": "value"},
+			Expire: time.Now().Add(time.Hour),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotPath := filepath.Join(dir, "snapshot.json")
+	if err := os.WriteFile(snapshotPath, legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for kind, open := range testStores() {
+		if kind == SnapshotStoreKind {
+			continue
+		}
+		t.Run(kind, func(t *testing.T) {
+			dst, err := open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dst.Close()
+			copied, err := CopyStore(dst, NewSnapshotStore(snapshotPath, 1))
+			if err != nil || copied != 2 {
+				t.Fatalf("expected 2 chats copied, got %d (%v)", copied, err)
+			}
+			b := newStoreTestBot(dst)
+			b.AddFlow(&Flow{Name: "test", Start: "start", Steps: map[string]*Step{"start": {}}})
+			if err := b.loadChats(); err != nil {
+				t.Fatal(err)
+			}
+			if data := b.sessions.getOrCreate(1, testData("unused")); data != testData("flat") {
+				t.Errorf("expected the session of the snapshot, got %v", data)
+			}
+			if c, ok := b.conversations.get(2, 7); !ok || c.Get("key") != "value" {
+				t.Errorf("expected the conversation of the snapshot, got %v", c)
+			}
+			// only the chats that change are written
+			b.sessions.getOrCreate(3, testData("new"))
+			b.notifyChange(3)
+			if err := b.saveChats(false); err != nil {
+				t.Fatal(err)
+			}
+			if ids, err := dst.List(); err != nil || !slices.Equal(ids, []int64{1, 2, 3}) {
+				t.Errorf("expected chats 1, 2 and 3, got %v (%v)", ids, err)
+			}
+		})
+	}
+}
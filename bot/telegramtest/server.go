@@ -0,0 +1,440 @@
+// Package telegramtest provides a fake telegram bot api server to test bots
+// without network access. It records the messages and documents sent by the
+// bot, serves scripted updates through getUpdates and hosts files to be
+// downloaded, so tests can simulate users sending commands, replying to
+// messages, pressing inline buttons or uploading files.
+package telegramtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/lucasmenendez/expensesbot/bot"
+)
+
+// pollTimeout is the maximum time that a getUpdates request waits for new
+// updates before returning an empty list
+const pollTimeout = 100 * time.Millisecond
+
+// Button struct represents a button of an inline keyboard sent by the bot.
+type Button struct {
+	Text string `json:"text"`
+	Data string `json:"callback_data"`
+}
+
+// Document struct represents a file sent by the bot.
+type Document struct {
+	Name    string
+	Content []byte
+}
+
+// Message struct represents a message sent by the bot, with its current
+// state after any edit or deletion.
+type Message struct {
+	ID         int64
+	ChatID     int64
+	Text       string
+	Buttons    [][]Button
+	ForceReply bool
+	Deleted    bool
+	Document   *Document
+}
+
+// Server struct is a fake telegram bot api server. Use its URL as the APIURL
+// of the bot config and its Client as the HTTPClient.
+type Server struct {
+	*httptest.Server
+	mtx           sync.Mutex
+	changed       chan struct{}
+	updates       []*bot.Update
+	lastUpdateID  int64
+	lastMessageID int64
+	// lastCallbackID is the id of the last callback query
+	lastCallbackID int64
+	messages       []*Message
+	answers        map[string]string
+	files          map[string][]byte
+}
+
+// NewServer function starts a new fake telegram bot api server. It must be
+// closed when it is not needed anymore.
+func NewServer() *Server {
+	s := &Server{
+		changed: make(chan struct{}),
+		answers: make(map[string]string),
+		files:   make(map[string][]byte),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// SendCommand method enqueues an update with a message from the user provided
+// to the chat provided that starts with a command, such as "/add".
+func (s *Server) SendCommand(chatID int64, from *bot.User, text string) {
+	cmd, _, _ := strings.Cut(text, " ")
+	s.enqueue(&bot.Update{Message: &bot.Message{
+		Text: text,
+		From: from,
+		Chat: &bot.Chat{ID: chatID},
+		Entities: []*bot.Entity{
+			{Offset: 0, Length: int64(len(cmd)), Type: "bot_command"},
+		},
+	}})
+}
+
+// SendCommandMentioning method enqueues an update like SendCommand, that also
+// mentions the users provided without their usernames, with a text_mention
+// entity for the first appearance of the first name of each one in the text.
+func (s *Server) SendCommandMentioning(chatID int64, from *bot.User, text string, mentioned ...*bot.User) {
+	cmd, _, _ := strings.Cut(text, " ")
+	entities := []*bot.Entity{
+		{Offset: 0, Length: int64(len(cmd)), Type: "bot_command"},
+	}
+	for _, user := range mentioned {
+		if before, _, found := strings.Cut(text, user.FirstName); found {
+			entities = append(entities, &bot.Entity{
+				Offset: int64(len(utf16.Encode([]rune(before)))),
+				Length: int64(len(utf16.Encode([]rune(user.FirstName)))),
+				Type:   "text_mention",
+				User:   user,
+			})
+		}
+	}
+	s.enqueue(&bot.Update{Message: &bot.Message{
+		Text:     text,
+		From:     from,
+		Chat:     &bot.Chat{ID: chatID},
+		Entities: entities,
+	}})
+}
+
+// SendReply method enqueues an update with a message from the user provided
+// to the chat provided that replies to the message with the provided id.
+func (s *Server) SendReply(chatID int64, from *bot.User, replyTo int64, text string) {
+	s.enqueue(&bot.Update{Message: &bot.Message{
+		Text:           text,
+		From:           from,
+		Chat:           &bot.Chat{ID: chatID},
+		ReplyToMessage: &bot.ReplyToMessage{MessageID: replyTo},
+	}})
+}
+
+// SendDocumentReply method hosts a file with the name and content provided
+// and enqueues an update with a message from the user provided to the chat
+// provided that includes the file and replies to the message with the
+// provided id.
+func (s *Server) SendDocumentReply(chatID int64, from *bot.User, replyTo int64, name string, content []byte) {
+	fileID := s.AddFile(content)
+	s.enqueue(&bot.Update{Message: &bot.Message{
+		From:           from,
+		Chat:           &bot.Chat{ID: chatID},
+		ReplyToMessage: &bot.ReplyToMessage{MessageID: replyTo},
+		Document:       &bot.Document{ID: fileID, Name: name, Type: "text/csv"},
+	}})
+}
+
+// PressButton method enqueues an update with a callback query as if the user
+// provided pressed the button with the text provided of the inline keyboard of
+// the message provided. It returns an error if the message has no such button.
+func (s *Server) PressButton(chatID int64, from *bot.User, messageID int64, text string) error {
+	s.mtx.Lock()
+	var data string
+	for _, msg := range s.messages {
+		if msg.ChatID != chatID || msg.ID != messageID || msg.Deleted {
+			continue
+		}
+		for _, row := range msg.Buttons {
+			for _, button := range row {
+				if button.Text == text {
+					data = button.Data
+				}
+			}
+		}
+	}
+	s.mtx.Unlock()
+	if data == "" {
+		return fmt.Errorf("button '%s' not found in message %d", text, messageID)
+	}
+	s.mtx.Lock()
+	s.lastCallbackID++
+	callbackID := strconv.FormatInt(s.lastCallbackID, 10)
+	s.mtx.Unlock()
+	s.enqueue(&bot.Update{CallbackQuery: &bot.CallbackQuery{
+		ID:   callbackID,
+		From: from,
+		Data: data,
+		Message: bot.Message{
+			ID:   messageID,
+			Chat: &bot.Chat{ID: chatID},
+		},
+	}})
+	return nil
+}
+
+// AddFile method hosts the content provided as a file and returns its id.
+func (s *Server) AddFile(content []byte) string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	fileID := fmt.Sprintf("file-%d", len(s.files)+1)
+	s.files[fileID] = content
+	return fileID
+}
+
+// Messages method returns a copy of the messages sent by the bot to the chat
+// provided, in the order they were sent.
+func (s *Server) Messages(chatID int64) []Message {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	messages := []Message{}
+	for _, msg := range s.messages {
+		if msg.ChatID == chatID {
+			messages = append(messages, *msg)
+		}
+	}
+	return messages
+}
+
+// WaitForMessage method waits until the bot sends or edits a message that
+// matches the function provided and returns a copy of it. It returns an error
+// if no message matches before the timeout.
+func (s *Server) WaitForMessage(timeout time.Duration, match func(Message) bool) (Message, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mtx.Lock()
+		changed := s.changed
+		for _, msg := range s.messages {
+			if match(*msg) {
+				s.mtx.Unlock()
+				return *msg, nil
+			}
+		}
+		s.mtx.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			return Message{}, fmt.Errorf("no matching message after %s", timeout)
+		}
+	}
+}
+
+// WaitForAnswer method waits until the bot answers a callback query with the
+// text provided. It returns an error if no callback query is answered with the
+// text before the timeout.
+func (s *Server) WaitForAnswer(timeout time.Duration, text string) error {
+	deadline := time.After(timeout)
+	for {
+		s.mtx.Lock()
+		changed := s.changed
+		for _, answer := range s.answers {
+			if answer == text {
+				s.mtx.Unlock()
+				return nil
+			}
+		}
+		s.mtx.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			return fmt.Errorf("no callback query answered with '%s' after %s", text, timeout)
+		}
+	}
+}
+
+// notify method wakes up everyone that waits for a change. It must be called
+// with the mutex locked.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) enqueue(update *bot.Update) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.lastUpdateID++
+	update.UpdateID = s.lastUpdateID
+	if update.Message != nil {
+		s.lastMessageID++
+		update.Message.ID = s.lastMessageID
+	}
+	s.updates = append(s.updates, update)
+	s.notify()
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	// files are served under /file/bot<token>/<path>
+	if path, ok := strings.CutPrefix(r.URL.Path, "/file/"); ok {
+		_, fileID, _ := strings.Cut(path, "/")
+		s.mtx.Lock()
+		content, ok := s.files[fileID]
+		s.mtx.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(content)
+		return
+	}
+	// methods are served under /bot<token>/<method>
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	var result any
+	var err error
+	switch method {
+	case "getUpdates":
+		result = s.getUpdates(r)
+	case "sendMessage", "editMessageText", "deleteMessage":
+		result, err = s.handleMessage(method, r)
+	case "sendDocument":
+		result, err = s.handleDocument(r)
+	case "getFile":
+		result, err = s.getFile(r)
+	case "answerCallbackQuery":
+		result, err = s.answerCallbackQuery(r)
+	default:
+		result = true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": false, "description": err.Error()})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": result})
+}
+
+func (s *Server) getUpdates(r *http.Request) []*bot.Update {
+	offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	deadline := time.After(pollTimeout)
+	for {
+		s.mtx.Lock()
+		// forget the updates confirmed by the offset
+		pending := []*bot.Update{}
+		for _, update := range s.updates {
+			if update.UpdateID >= offset {
+				pending = append(pending, update)
+			}
+		}
+		s.updates = pending
+		changed := s.changed
+		s.mtx.Unlock()
+		if len(pending) > 0 {
+			return pending
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return pending
+		case <-r.Context().Done():
+			return pending
+		}
+	}
+}
+
+type messageRequest struct {
+	ChatID      int64  `json:"chat_id"`
+	MessageID   int64  `json:"message_id"`
+	Text        string `json:"text"`
+	ReplyMarkup *struct {
+		InlineKeyboard [][]Button `json:"inline_keyboard"`
+		ForceReply     bool       `json:"force_reply"`
+	} `json:"reply_markup"`
+}
+
+func (s *Server) handleMessage(method string, r *http.Request) (any, error) {
+	req := &messageRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return nil, err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	defer s.notify()
+	if method == "sendMessage" {
+		s.lastMessageID++
+		msg := &Message{ID: s.lastMessageID, ChatID: req.ChatID, Text: req.Text}
+		if req.ReplyMarkup != nil {
+			msg.Buttons = req.ReplyMarkup.InlineKeyboard
+			msg.ForceReply = req.ReplyMarkup.ForceReply
+		}
+		s.messages = append(s.messages, msg)
+		return map[string]any{"message_id": msg.ID, "chat": map[string]any{"id": msg.ChatID}, "text": msg.Text}, nil
+	}
+	for _, msg := range s.messages {
+		if msg.ChatID != req.ChatID || msg.ID != req.MessageID || msg.Deleted {
+			continue
+		}
+		if method == "deleteMessage" {
+			msg.Deleted = true
+			return true, nil
+		}
+		// editing the text of a message without reply markup removes its
+		// inline keyboard
+		msg.Text = req.Text
+		msg.Buttons = nil
+		if req.ReplyMarkup != nil {
+			msg.Buttons = req.ReplyMarkup.InlineKeyboard
+		}
+		return map[string]any{"message_id": msg.ID, "chat": map[string]any{"id": msg.ChatID}, "text": msg.Text}, nil
+	}
+	return nil, fmt.Errorf("message %d not found", req.MessageID)
+}
+
+func (s *Server) handleDocument(r *http.Request) (any, error) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		return nil, err
+	}
+	chatID, err := strconv.ParseInt(r.FormValue("chat_id"), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	file, header, err := r.FormFile("document")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	defer s.notify()
+	s.lastMessageID++
+	s.messages = append(s.messages, &Message{
+		ID:       s.lastMessageID,
+		ChatID:   chatID,
+		Document: &Document{Name: header.Filename, Content: content},
+	})
+	return map[string]any{"message_id": s.lastMessageID, "chat": map[string]any{"id": chatID}}, nil
+}
+
+func (s *Server) answerCallbackQuery(r *http.Request) (any, error) {
+	req := &struct {
+		ID   string `json:"callback_query_id"`
+		Text string `json:"text"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return nil, err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	defer s.notify()
+	s.answers[req.ID] = req.Text
+	return true, nil
+}
+
+func (s *Server) getFile(r *http.Request) (any, error) {
+	fileID := r.URL.Query().Get("file_id")
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.files[fileID]; !ok {
+		return nil, fmt.Errorf("file %s not found", fileID)
+	}
+	return map[string]any{"file_id": fileID, "file_path": fileID}, nil
+}
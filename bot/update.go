@@ -1,13 +1,16 @@
 package bot
 
 import (
+	"sort"
 	"strings"
+	"unicode/utf16"
 )
 
 const (
-	botEntity = "bot_command"
-	cmdPrefix = "/"
-	argsSep   = " "
+	botEntity         = "bot_command"
+	textMentionEntity = "text_mention"
+	cmdPrefix         = "/"
+	argsSep           = " "
 )
 
 type User struct {
@@ -25,10 +28,15 @@ type Chat struct {
 	Type      string `json:"type"`
 }
 
+// Entity struct represents a special part of the text of a message, such as
+// a command or a mention. Its offset and length are measured in UTF-16 code
+// units. User contains the mentioned user of text_mention entities, which
+// mention users without username.
 type Entity struct {
 	Offset int64  `json:"offset"`
 	Length int64  `json:"length"`
 	Type   string `json:"type"`
+	User   *User  `json:"user,omitempty"`
 }
 
 type ReplyToMessage struct {
@@ -62,6 +70,8 @@ type ReplyMarkup struct {
 }
 
 type CallbackQuery struct {
+	ID      string  `json:"id"`
+	From    *User   `json:"from"`
 	Data    string  `json:"data"`
 	Message Message `json:"message"`
 }
@@ -93,6 +103,19 @@ func (u *Update) IsReply() bool {
 	return u.Message.ReplyToMessage != nil
 }
 
+// chatID method returns the id of the chat of the update, the one of its
+// message or the one of the message of its callback, or 0 if it has none.
+func (u *Update) chatID() int64 {
+	switch {
+	case u.Message != nil && u.Message.Chat != nil:
+		return u.Message.Chat.ID
+	case u.CallbackQuery != nil && u.CallbackQuery.Message.Chat != nil:
+		return u.CallbackQuery.Message.Chat.ID
+	default:
+		return 0
+	}
+}
+
 func (u *Update) Command() string {
 	if !u.IsCommand() {
 		return ""
@@ -114,3 +137,36 @@ func (u *Update) CommandArgs() []string {
 	}
 	return args
 }
+
+// ReplaceTextMentions method returns the text of the message with the text of
+// each text_mention entity replaced by the result of the function provided
+// for the mentioned user. The rest of the text is kept as it is.
+func (m *Message) ReplaceTextMentions(replace func(*User) string) string {
+	mentions := []*Entity{}
+	for _, entity := range m.Entities {
+		if entity.Type == textMentionEntity && entity.User != nil {
+			mentions = append(mentions, entity)
+		}
+	}
+	if len(mentions) == 0 {
+		return m.Text
+	}
+	sort.Slice(mentions, func(i, j int) bool {
+		return mentions[i].Offset < mentions[j].Offset
+	})
+	// the offsets of the entities are measured in UTF-16 code units
+	units := utf16.Encode([]rune(m.Text))
+	result := strings.Builder{}
+	last := int64(0)
+	for _, mention := range mentions {
+		end := mention.Offset + mention.Length
+		if mention.Offset < last || end > int64(len(units)) {
+			continue
+		}
+		result.WriteString(string(utf16.Decode(units[last:mention.Offset])))
+		result.WriteString(replace(mention.User))
+		last = end
+	}
+	result.WriteString(string(utf16.Decode(units[last:])))
+	return result.String()
+}
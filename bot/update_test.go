@@ -0,0 +1,31 @@
+package bot
+
+import "testing"
+
+func TestReplaceTextMentions(t *testing.T) {
+	carol := &User{ID: 3, FirstName: "Carol Ann"}
+	dave := &User{ID: 4, FirstName: "Dave"}
+	// the emoji takes two UTF-16 code units, so the offsets of the mentions
+	// are not the byte offsets
+	msg := &Message{
+		Text: "/paid 🍕 Carol Ann and Dave",
+		Entities: []*Entity{
+			{Offset: 0, Length: 5, Type: botEntity},
+			{Offset: 23, Length: 4, Type: textMentionEntity, User: dave},
+			{Offset: 9, Length: 9, Type: textMentionEntity, User: carol},
+			{Offset: 9, Length: 4, Type: "bold"},
+		},
+	}
+	names := map[int64]string{3: "Carol_Ann", 4: "Dave_4"}
+	result := msg.ReplaceTextMentions(func(user *User) string {
+		return names[user.ID]
+	})
+	if expected := "/paid 🍕 Carol_Ann and Dave_4"; result != expected {
+		t.Errorf("expected '%s', got '%s'", expected, result)
+	}
+	// without text mentions the text is kept
+	msg.Entities = msg.Entities[:1]
+	if result := msg.ReplaceTextMentions(nil); result != msg.Text {
+		t.Errorf("expected the same text, got '%s'", result)
+	}
+}
@@ -0,0 +1,107 @@
+package bot
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// maxWebhookBodySize is the maximum size of the body of a webhook request
+const maxWebhookBodySize = 1 << 20
+
+// randomSecret returns a random hex string to be used as webhook secret token
+// when no one is provided.
+func randomSecret() string {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(secret)
+}
+
+// listenForWebhook method listens in the webhook address of the bot,
+// registers its webhook url in the telegram api and starts an http server
+// that receives the updates and sends them to the updates channel. The
+// address is listened before registering the webhook, so an error listening
+// is returned and no update is sent to a webhook that is not served. The
+// server is shut down and the webhook is deleted when the context of the bot
+// is done.
+func (b *Bot) listenForWebhook() error {
+	ln, err := net.Listen("tcp", b.webhookAddr)
+	if err != nil {
+		return err
+	}
+	if _, err := b.sendRequest(setWebhookMethod, map[string]any{
+		"url":             b.webhookURL,
+		"secret_token":    b.webhookSecret,
+		"allowed_updates": []string{"message", "callback_query"},
+	}); err != nil {
+		ln.Close()
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", b.handleWebhook)
+	server := &http.Server{
+		Addr:              b.webhookAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	// start the server in background
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		logger.Info("listening for webhook updates", "addr", ln.Addr().String())
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("error serving webhook", "error", err)
+		}
+	}()
+	// shut down the server and delete the webhook when the bot stops
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		<-b.ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Error("error shutting down webhook server", "error", err)
+		}
+		if _, err := b.sendRequest(deleteWebhookMethod, map[string]any{}); err != nil {
+			logger.Error("error deleting webhook", "error", err)
+		}
+	}()
+	return nil
+}
+
+// handleWebhook method handles the requests of the telegram api to the
+// webhook. It checks the secret token header, decodes the update and sends
+// it to the updates channel.
+func (b *Bot) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	secret := r.Header.Get(webhookSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(b.webhookSecret)) != 1 {
+		logger.Warn("webhook request with invalid secret token", "remoteAddr", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	update := &Update{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebhookBodySize)).Decode(update); err != nil {
+		logger.Error("error decoding webhook update", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	select {
+	case b.updates <- update:
+		w.WriteHeader(http.StatusOK)
+	case <-b.ctx.Done():
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
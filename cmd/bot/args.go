@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/lucasmenendez/expensesbot/settler"
+)
+
+// argError struct is the error of an argument of a command that can not be
+// parsed, with its position in the arguments, starting from 1, and the reason.
+type argError struct {
+	token    string
+	position int
+	reason   string
+}
+
+func (e *argError) Error() string {
+	return fmt.Sprintf("argument %d '%s': %s", e.position, e.token, e.reason)
+}
+
+// argToken struct is an argument of a command: a word or a quoted text.
+type argToken struct {
+	text   string
+	quoted bool
+}
+
+// isOpeningQuote returns if the character provided opens a quoted argument,
+// straight or curly double quotes, as some keyboards replace the straight
+// ones.
+func isOpeningQuote(r rune) bool {
+	return r == '"' || r == '“' || r == '«'
+}
+
+// isClosingQuote returns if the character provided closes a quoted argument.
+func isClosingQuote(r rune) bool {
+	return r == '"' || r == '”' || r == '»'
+}
+
+// tokenizeArgs splits the text provided into the words separated by spaces,
+// keeping the texts between double quotes as a single argument without them.
+// It returns an error if a quote is not closed.
+func tokenizeArgs(text string) ([]argToken, error) {
+	tokens := []argToken{}
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+		end := i + 1
+		if isOpeningQuote(runes[i]) {
+			for end < len(runes) && !isClosingQuote(runes[end]) {
+				end++
+			}
+			if end == len(runes) {
+				return nil, &argError{token: string(runes[i:]), position: len(tokens) + 1, reason: ArgUnclosedQuote}
+			}
+			tokens = append(tokens, argToken{text: string(runes[i+1 : end]), quoted: true})
+			i = end + 1
+			continue
+		}
+		for end < len(runes) && !unicode.IsSpace(runes[end]) {
+			end++
+		}
+		tokens = append(tokens, argToken{text: string(runes[i:end])})
+		i = end
+	}
+	return tokens, nil
+}
+
+// parseAddArgs parses the arguments of /add and /addfor and returns the values
+// of the add expense flows that they provide. Each argument is identified by
+// its shape, so they can be in any order:
+//   - the quoted text is the description
+//   - the argument that starts with a split mode and a colon is the split,
+//     with a value per participant separated by commas, e.g. shares:1,2;
+//     other text before a colon is part of a name, e.g. bob:alice, unless
+//     a value follows the colon, that is an unknown split mode
+//   - the argument that starts with a digit is the amount, optionally
+//     followed by its currency code
+//   - the rest are names separated by commas or spaces: the participants or,
+//     if withPayer is true, the payer and then the participants
+//
+// The names are resolved in the directory of the settler. If the payer, if
+// it is expected, the participants and the amount are provided, the values of
+// the optional arguments that are missing are set to their defaults, so the
+// flow does not ask for them. It returns an argError with the argument that
+// can not be parsed.
+func parseAddArgs(s *settler.Settler, text string, withPayer bool) (map[string]string, error) {
+	tokens, err := tokenizeArgs(text)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	participants := []string{}
+	splitPosition := 0
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		fail := func(reason string) error {
+			return &argError{token: token.text, position: i + 1, reason: reason}
+		}
+		rawMode, rawValues, hasColon := strings.Cut(token.text, ":")
+		mode, modeErr := settler.ParseSplitMode(strings.ToLower(rawMode))
+		isSplit := hasColon && modeErr == nil
+		switch {
+		case token.quoted:
+			description := strings.TrimSpace(token.text)
+			if _, ok := values[descriptionState]; ok {
+				return nil, fail(ArgRepeatedDescription)
+			}
+			if description == "" || len([]rune(description)) > maxDescriptionLength {
+				return nil, fail(fmt.Sprintf(ArgInvalidDescriptionTemplate, maxDescriptionLength))
+			}
+			values[descriptionState] = description
+		case isSplit:
+			if _, ok := values[splitState]; ok {
+				return nil, fail(ArgRepeatedSplit)
+			}
+			if mode == settler.SplitEqual && rawValues != "" {
+				return nil, fail(ArgEqualSplitValues)
+			}
+			values[splitState] = string(mode)
+			if mode != settler.SplitEqual {
+				values[splitValuesState] = strings.ReplaceAll(rawValues, ",", " ")
+				splitPosition = i + 1
+			}
+		case hasColon && isAmountArg(rawValues):
+			return nil, fail(ArgUnknownSplitMode)
+		case isAmountArg(token.text):
+			if _, ok := values[amountState]; ok {
+				return nil, fail(ArgRepeatedAmount)
+			}
+			amount, err := settler.ParseMoney(token.text)
+			if err != nil || amount.Units <= 0 {
+				return nil, fail(ArgInvalidAmount)
+			}
+			values[amountState] = token.text
+			// the currency can follow the amount
+			if i+1 < len(tokens) {
+				if currency, ok := argCurrency(s, tokens[i+1]); ok {
+					values[currencyState] = currency
+					i++
+				}
+			}
+		default:
+			for _, name := range strings.Split(token.text, ",") {
+				if name == "" {
+					continue
+				}
+				name = s.ResolveParticipant(name)
+				if _, ok := values[payerState]; withPayer && !ok {
+					values[payerState] = name
+					continue
+				}
+				if slices.Contains(participants, name) {
+					return nil, fail(fmt.Sprintf(ArgRepeatedParticipantTemplate, name))
+				}
+				participants = append(participants, name)
+			}
+		}
+	}
+	if len(participants) > 0 {
+		values[participantState] = strings.Join(participants, " ")
+	}
+	// the values of the split must match the participants
+	if splitPosition > 0 {
+		token := tokens[splitPosition-1]
+		if len(participants) == 0 {
+			return nil, &argError{token: token.text, position: splitPosition, reason: ArgSplitWithoutParticipants}
+		}
+		mode := settler.SplitMode(values[splitState])
+		if _, err := parseSplitValues(mode, participants, values[splitValuesState]); err != nil {
+			return nil, &argError{token: token.text, position: splitPosition, reason: err.Error()}
+		}
+	}
+	// the expense is complete without the optional arguments
+	_, hasPayer := values[payerState]
+	_, hasAmount := values[amountState]
+	if (hasPayer || !withPayer) && len(participants) > 0 && hasAmount {
+		defaults := map[string]string{
+			currencyState:    "",
+			descriptionState: "",
+			categoryState:    noCategory,
+			splitState:       string(settler.SplitEqual),
+		}
+		for state, value := range defaults {
+			if _, ok := values[state]; !ok {
+				values[state] = value
+			}
+		}
+	}
+	return values, nil
+}
+
+// isAmountArg returns if the argument provided looks like an amount: it
+// starts with a digit, optionally after a sign or a decimal separator.
+func isAmountArg(text string) bool {
+	runes := []rune(strings.TrimLeft(text, "+-.,"))
+	return len(runes) > 0 && unicode.IsDigit(runes[0]) && len(text)-len(string(runes)) <= 1
+}
+
+// argCurrency returns the currency code of the argument provided if it is a
+// currency of the settler, in any case, or an upper case valid code.
+func argCurrency(s *settler.Settler, token argToken) (string, bool) {
+	if token.quoted {
+		return "", false
+	}
+	currency, err := settler.ParseCurrency(token.text)
+	if err != nil {
+		return "", false
+	}
+	return currency, token.text == currency || slices.Contains(s.Currencies(), currency)
+}
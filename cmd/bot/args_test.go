@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/lucasmenendez/expensesbot/settler"
+)
+
+func TestParseAddArgs(t *testing.T) {
+	s := settler.NewSettler()
+	if _, err := s.AddExpense(&settler.Transaction{
+		Payer:        "@alice",
+		Participants: []string{"@alice", "@bob"},
+		Amount:       settler.NewMoney(1000, "EUR"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	complete := func(values map[string]string) map[string]string {
+		defaults := map[string]string{
+			currencyState:    "",
+			descriptionState: "",
+			categoryState:    noCategory,
+			splitState:       string(settler.SplitEqual),
+		}
+		for state, value := range values {
+			defaults[state] = value
+		}
+		return defaults
+	}
+	tests := []struct {
+		name      string
+		text      string
+		withPayer bool
+		values    map[string]string
+		err       *argError
+	}{
+		{name: "empty", text: "", values: map[string]string{}},
+		{
+			name:   "participants and amount",
+			text:   "@alice,@bob 12.5",
+			values: complete(map[string]string{participantState: "@alice @bob", amountState: "12.5"}),
+		},
+		{
+			name: "every argument in any order",
+			text: `“Team lunch” shares:1,2 ALICE, bob 12,5 USD`,
+			values: complete(map[string]string{
+				participantState: "@alice @bob",
+				amountState:      "12,5",
+				currencyState:    "USD",
+				descriptionState: "Team lunch",
+				splitState:       string(settler.SplitShares),
+				splitValuesState: "1 2",
+			}),
+		},
+		{
+			name:      "payer",
+			text:      "@bob @alice @carol 30 percentage:60%,40%",
+			withPayer: true,
+			values: complete(map[string]string{
+				payerState:       "@bob",
+				participantState: "@alice @carol",
+				amountState:      "30",
+				splitState:       string(settler.SplitPercentage),
+				splitValuesState: "60% 40%",
+			}),
+		},
+		{
+			name:   "missing amount",
+			text:   `@alice "Taxi"`,
+			values: map[string]string{participantState: "@alice", descriptionState: "Taxi"},
+		},
+		{
+			name:      "missing participants",
+			text:      "@bob 10",
+			withPayer: true,
+			values:    map[string]string{payerState: "@bob", amountState: "10"},
+		},
+		{
+			name: "lowercase currency is a name",
+			text: "@alice 10 gbp",
+			values: complete(map[string]string{
+				participantState: "@alice gbp",
+				amountState:      "10",
+			}),
+		},
+		{
+			name: "names with a colon",
+			text: "@bob: 10 bob:alice",
+			values: complete(map[string]string{
+				participantState: "@bob: bob:alice",
+				amountState:      "10",
+			}),
+		},
+		{
+			name: "invalid amount",
+			text: "@alice 12.5.3",
+			err:  &argError{token: "12.5.3", position: 2, reason: ArgInvalidAmount},
+		},
+		{
+			name: "negative amount",
+			text: "@alice -5",
+			err:  &argError{token: "-5", position: 2, reason: ArgInvalidAmount},
+		},
+		{
+			name: "repeated amount",
+			text: "@alice 5 6",
+			err:  &argError{token: "6", position: 3, reason: ArgRepeatedAmount},
+		},
+		{
+			name: "unclosed quote",
+			text: `@alice 5 "Taxi`,
+			err:  &argError{token: `"Taxi`, position: 3, reason: ArgUnclosedQuote},
+		},
+		{
+			name: "unknown split mode",
+			text: "@alice 5 thirds:1",
+			err:  &argError{token: "thirds:1", position: 3, reason: ArgUnknownSplitMode},
+		},
+		{
+			name: "split without participants",
+			text: "5 shares:1,2",
+			err:  &argError{token: "shares:1,2", position: 2, reason: ArgSplitWithoutParticipants},
+		},
+		{
+			name: "split values do not match",
+			text: "@alice,@bob 5 exact:5",
+			err:  &argError{token: "exact:5", position: 3, reason: "expected 2 values, got 1"},
+		},
+		{
+			name: "repeated participant",
+			text: "@alice,Alice 5",
+			err:  &argError{token: "@alice,Alice", position: 1, reason: "@alice is repeated"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := parseAddArgs(s, test.text, test.withPayer)
+			if test.err != nil {
+				var argErr *argError
+				if !errors.As(err, &argErr) || *argErr != *test.err {
+					t.Fatalf("expected error %v, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, test.values) {
+				t.Errorf("expected %v, got %v", test.values, values)
+			}
+		})
+	}
+}
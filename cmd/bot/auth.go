@@ -1,19 +1,29 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"os"
 	"sync"
+
+	"github.com/lucasmenendez/expensesbot/bot"
 )
 
 type Auth struct {
 	admins       map[int64]string
 	allowedUsers sync.Map
+	path         string
+	fileMtx      sync.Mutex
 }
 
-func InitAuth(admins map[int64]string) *Auth {
+func InitAuth(admins map[int64]string, path string) *Auth {
 	auth := &Auth{
 		admins:       admins,
 		allowedUsers: sync.Map{},
+		path:         path,
+		fileMtx:      sync.Mutex{},
 	}
 	for id, alias := range admins {
 		auth.allowedUsers.Store(id, alias)
@@ -21,11 +31,54 @@ func InitAuth(admins map[int64]string) *Auth {
 	return auth
 }
 
+// Load method loads the allowed users from the file of the auth manager, if
+// it exists, keeping the admins as allowed users.
+func (a *Auth) Load() error {
+	a.fileMtx.Lock()
+	defer a.fileMtx.Unlock()
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	users := map[int64]string{}
+	if err := json.Unmarshal(data, &users); err != nil {
+		return err
+	}
+	for userID, alias := range users {
+		a.allowedUsers.Store(userID, alias)
+	}
+	return nil
+}
+
+// Save method writes the current allowed users to the file of the auth
+// manager atomically, so a crash while saving does not lose the users
+// allowed before.
+func (a *Auth) Save() error {
+	a.fileMtx.Lock()
+	defer a.fileMtx.Unlock()
+	data, err := json.Marshal(a.ListAllowedUsers())
+	if err != nil {
+		return err
+	}
+	return bot.WriteFileAtomic(a.path, data)
+}
+
 func (a *Auth) AddAllowedUser(userID int64, alias string) error {
 	if _, exists := a.allowedUsers.Load(userID); exists {
 		return fmt.Errorf("user %d already added", userID)
 	}
 	a.allowedUsers.Store(userID, alias)
+	// persist the change right away, undoing it if it fails
+	if err := a.Save(); err != nil {
+		a.allowedUsers.Delete(userID)
+		return fmt.Errorf("error saving allowed users: %w", err)
+	}
 	return nil
 }
 
@@ -34,6 +87,9 @@ func (a *Auth) RemoveAllowedUser(userID int64) bool {
 		return false
 	}
 	a.allowedUsers.Delete(userID)
+	if err := a.Save(); err != nil {
+		log.Printf("error saving allowed users: %s", err)
+	}
 	return true
 }
 
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthPersistence(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "auth.json")
+	admins := map[int64]string{testAlice.ID: testAlice.Username}
+	auth := InitAuth(admins, path)
+	if err := auth.AddAllowedUser(testBob.ID, testBob.Username); err != nil {
+		t.Fatal(err)
+	}
+	// the user added is still allowed after reloading the file
+	reloaded := InitAuth(admins, path)
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.IsAllowed(testBob.ID) || !reloaded.IsAllowed(testAlice.ID) {
+		t.Errorf("expected bob and alice allowed, got %v", reloaded.ListAllowedUsers())
+	}
+	// the file is replaced, so no temporary file is left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "auth.json" {
+		t.Errorf("expected only the auth file, got %v", entries)
+	}
+	// the user removed is not allowed after reloading the file
+	if !reloaded.RemoveAllowedUser(testBob.ID) {
+		t.Fatalf("expected bob to be removed")
+	}
+	reloaded = InitAuth(admins, path)
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.IsAllowed(testBob.ID) {
+		t.Errorf("expected bob not allowed, got %v", reloaded.ListAllowedUsers())
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"encoding/csv"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/lucasmenendez/expensesbot/bot"
 	"github.com/lucasmenendez/expensesbot/settler"
@@ -20,6 +22,20 @@ var publicCommands = []string{
 	SUMMARY_CMD,
 	IMPORT_CMD,
 	EXPORT_CMD,
+	CURRENCY_CMD,
+	RATE_CMD,
+	PAID_CMD,
+	CANCEL_CMD,
+	EDIT_CMD,
+	UNDO_CMD,
+	REDO_CMD,
+	HISTORY_CMD,
+	LEDGER_CMD,
+	STRATEGY_CMD,
+	CONSTRAINTS_CMD,
+	PARTICIPANTS_CMD,
+	MERGE_CMD,
+	ASOF_CMD,
 }
 
 var commandsDescriptions = map[string]string{
@@ -30,6 +46,20 @@ var commandsDescriptions = map[string]string{
 	SUMMARY_CMD:         SUMMARY_DESC,
 	IMPORT_CMD:          IMPORT_DESC,
 	EXPORT_CMD:          EXPORT_DESC,
+	CURRENCY_CMD:        CURRENCY_DESC,
+	RATE_CMD:            RATE_DESC,
+	PAID_CMD:            PAID_DESC,
+	CANCEL_CMD:          CANCEL_DESC,
+	EDIT_CMD:            EDIT_DESC,
+	UNDO_CMD:            UNDO_DESC,
+	REDO_CMD:            REDO_DESC,
+	HISTORY_CMD:         HISTORY_DESC,
+	LEDGER_CMD:          LEDGER_DESC,
+	STRATEGY_CMD:        STRATEGY_DESC,
+	CONSTRAINTS_CMD:     CONSTRAINTS_DESC,
+	PARTICIPANTS_CMD:    PARTICIPANTS_DESC,
+	MERGE_CMD:           MERGE_DESC,
+	ASOF_CMD:            ASOF_DESC,
 }
 
 // format: /start
@@ -48,92 +78,95 @@ func handleHelp(b *bot.Bot, update *bot.Update) error {
 	return err
 }
 
-// format: /add
+// format: /add [@participant1,@participant2] [12.5 [USD]] ["description"] [shares:1,2]
 func handleAddExpense(b *bot.Bot, update *bot.Update) error {
-	from := update.Message.From.Username
-	payer := fmt.Sprintf("@%s", update.Message.From.Username)
-	// answer for the participants
-	return b.SendMessageToReply(update.Message.Chat.ID,
-		fmt.Sprintf(RequestParticipantsTemplate, from), RequestParticipantsPrompt,
-		func(messageID int64, update *bot.Update) {
-			// validate the participants
-			participants := strings.Split(update.Message.Text, " ")
-			if len(participants) == 0 {
-				if _, err := b.SendMessage(update.Message.Chat.ID, 0, ErrAddInvalidArguments); err != nil {
-					log.Printf("error sending message: %s\n", err)
-				}
-				return
-			}
-			// answer for the amount
-			if err := requestAmount(b, update.Message.Chat.ID, RequestAmountMessage, func(amount float64) {
-				// get the settler of the chat and add the expense
-				iSettler := b.GetSession(update, settler.NewSettler())
-				settler, ok := iSettler.(*settler.Settler)
-				if !ok {
-					log.Println("error getting settler")
-				}
-				settler.AddExpense(payer, participants, amount)
-				// send the message
-				msg := fmt.Sprintf(AddSuccessTemplate, payer, amount, strings.Join(participants, ", "))
-				if _, err := b.SendMessage(update.Message.Chat.ID, 0, msg); err != nil {
-					log.Printf("error sending message: %s\n", err)
-				}
-			}); err != nil {
-				log.Println(err)
-			}
-		},
-	)
+	return startAddExpense(b, update, addExpenseFlow, ErrAddArgumentTemplate)
 }
 
-// format: /addfor
+// format: /addfor [@payer] [@participant1,@participant2] [12.5 [USD]] ["description"] [shares:1,2]
 func handleAddForExpense(b *bot.Bot, update *bot.Update) error {
-	from := update.Message.From.Username
-	// answer for the payer
-	return b.SendMessageToReply(update.Message.Chat.ID,
-		fmt.Sprintf(RequestPayerTemplate, from), RequestPayerPrompt,
-		func(messageID int64, update *bot.Update) {
-			payer := update.Message.Text
-			// answer for the participants
-			if err := b.SendMessageToReply(update.Message.Chat.ID,
-				fmt.Sprintf(RequestParticipantsTemplate, from), RequestParticipantsPrompt,
-				func(messageID int64, update *bot.Update) {
-					// validate the participants
-					participants := strings.Split(update.Message.Text, " ")
-					if len(participants) == 0 {
-						if _, err := b.SendMessage(update.Message.Chat.ID, 0, ErrAddInvalidArguments); err != nil {
-							log.Printf("error sending message: %s\n", err)
-						}
-						return
-					}
-					// answer for the amount
-					if err := requestAmount(b, update.Message.Chat.ID, RequestAmountMessage, func(amount float64) {
-						// get the settler of the chat and add the expense
-						iSettler := b.GetSession(update, settler.NewSettler())
-						settler, ok := iSettler.(*settler.Settler)
-						if !ok {
-							log.Println("error getting settler")
-						}
-						settler.AddExpense(payer, participants, amount)
-						// send the message
-						msg := fmt.Sprintf(AddSuccessTemplate, payer, amount, strings.Join(participants, ", "))
-						if _, err := b.SendMessage(update.Message.Chat.ID, 0, msg); err != nil {
-							log.Printf("error sending message: %s\n", err)
-						}
-					}); err != nil {
-						log.Println(err)
-					}
-				},
-			); err != nil {
-				log.Println(err)
-			}
-		},
-	)
+	return startAddExpense(b, update, addForExpenseFlow, ErrAddForArgumentTemplate)
+}
+
+// startAddExpense starts the add expense flow provided with the values of
+// the arguments of the command, so it only asks for the missing ones, or adds
+// the expense if none is missing. If an argument is not valid, it sends the
+// error template provided with it.
+func startAddExpense(b *bot.Bot, update *bot.Update, flow, errTemplate string) error {
+	s, err := chatSettler(b, update.Message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	values, err := parseAddArgs(s, commandText(s, update), flow == addForExpenseFlow)
+	var argErr *argError
+	if errors.As(err, &argErr) {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0,
+			fmt.Sprintf(errTemplate, argErr.token, argErr.position, argErr.reason))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return b.StartConversation(update, flow, values)
+}
+
+// format: /edit
+func handleEdit(b *bot.Bot, update *bot.Update) error {
+	s, err := chatSettler(b, update.Message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	if _, ids := s.ListExpenses(); len(ids) == 0 {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrNoExpenses)
+		return err
+	}
+	return b.StartConversation(update, editFlow, nil)
+}
+
+// format: /undo
+func handleUndo(b *bot.Bot, update *bot.Update) error {
+	s, err := chatSettler(b, update.Message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	entry, err := s.Undo()
+	if err != nil {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrNothingToUndo)
+		return err
+	}
+	_, err = b.SendMessage(update.Message.Chat.ID, 0, fmt.Sprintf(UndoSuccessTemplate, formatJournalEntry(entry)))
+	return err
+}
+
+// format: /redo
+func handleRedo(b *bot.Bot, update *bot.Update) error {
+	s, err := chatSettler(b, update.Message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	entry, err := s.Redo()
+	if err != nil {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrNothingToRedo)
+		return err
+	}
+	_, err = b.SendMessage(update.Message.Chat.ID, 0, fmt.Sprintf(RedoSuccessTemplate, formatJournalEntry(entry)))
+	return err
+}
+
+// format: /cancel
+func handleCancel(b *bot.Bot, update *bot.Update) error {
+	msg := NothingToCancelMessage
+	if b.CancelConversation(update) {
+		msg = CancelledMessage
+	}
+	_, err := b.SendMessage(update.Message.Chat.ID, 0, msg)
+	return err
 }
 
 // format: /expenses
 func handleListExpenses(b *bot.Bot, update *bot.Update) error {
 	// get the settler of the chat and list the expenses
-	iSettler := b.GetSession(update, settler.NewSettler())
+	iSettler := b.GetSession(update, newSettler())
 	settler, ok := iSettler.(*settler.Settler)
 	if !ok {
 		return nil
@@ -150,12 +183,16 @@ func handleListExpenses(b *bot.Bot, update *bot.Update) error {
 	texts := []string{ListExpensesHeader}
 	currentRow := 0
 	for i, expense := range expenses {
-		texts = append(texts, fmt.Sprintf(ExpenseItemTemplate,
+		text := fmt.Sprintf(ExpenseItemTemplate,
 			ids[i],
 			expense.Payer,
 			expense.Amount,
-			strings.Join(expense.Participants, ", "),
-		))
+			formatParticipants(expense),
+		)
+		if details := formatExpenseDetails(expense); details != "" {
+			text += fmt.Sprintf(ExpenseDetailsTemplate, details)
+		}
+		texts = append(texts, text)
 		if len(labels[currentRow]) == buttonsPerRow {
 			currentRow++
 		}
@@ -198,183 +235,422 @@ func handleListExpenses(b *bot.Bot, update *bot.Update) error {
 	})
 }
 
-// format: /summary
+// format: /summary [label]
 func handleSummary(b *bot.Bot, update *bot.Update) error {
 	// get the settler of the chat, the balances of the participants and the
 	// list of transactions to settle the expenses
-	iSettler := b.GetSession(update, settler.NewSettler())
+	iSettler := b.GetSession(update, newSettler())
 	settler, ok := iSettler.(*settler.Settler)
 	if !ok {
 		return nil
 	}
-	balances := settler.ListBalances()
-	transactions := settler.Settle(false)
+	text, transactions, err := composeSummary(settler)
+	if err != nil {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, summaryErrorMessage(err))
+		return err
+	}
 	// if there are no transactions, send an error message
 	if len(transactions) == 0 {
 		_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrNoExpenses)
 		return err
 	}
-	// compose and send the message
-	texts := []string{BalancesHeader}
-	for participant, balance := range balances {
-		texts = append(texts, fmt.Sprintf(BalanceItemTemplate, participant, balance))
-	}
-	texts = append(texts, SummaryHeader)
-	for _, transaction := range transactions {
-		texts = append(texts, fmt.Sprintf(SummaryItemTemplate,
-			transaction.Payer,
-			transaction.Amount,
-			transaction.Participants[0],
-		))
-	}
-	if _, err := b.SendMessage(update.Message.Chat.ID, 0, strings.Join(texts, "\n")); err != nil {
+	if err := sendSummary(b, update.Message.Chat.ID, 0, settler, text, transactions); err != nil {
 		_, err := b.SendMessage(update.Message.Chat.ID, 0, fmt.Sprintf(ErrProcesingRequestTemplate, err))
 		return err
 	}
 
-	return confirm(b, update.Message.Chat.ID, ConfirmClearExpensesMessage, func(clear bool) {
-		if clear {
-			settler.Clean()
-			if _, err := b.SendMessage(update.Message.Chat.ID, 0, ExpensesClearedMessage); err != nil {
+	// the label of the period is optional
+	label := strings.Join(update.CommandArgs(), " ")
+	return confirm(b, update.Message.Chat.ID, ConfirmClosePeriodMessage, func(close bool) {
+		if close {
+			period, err := settler.ClosePeriod(label, time.Now())
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if _, err := b.SendMessage(update.Message.Chat.ID, 0, fmt.Sprintf(PeriodClosedTemplate, period.Label)); err != nil {
 				log.Println(err)
 			}
-			return
 		}
 	})
 }
 
+// format: /paid @participant 25
+func handlePaid(b *bot.Bot, update *bot.Update) error {
+	s, err := chatSettler(b, update.Message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	args := commandFields(s, update)
+	if len(args) < 2 {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrPaidInvalidArguments)
+		return err
+	}
+	// the amount can include the currency, such as "25 USD"
+	amount, err := settler.ParseMoney(strings.Join(args[1:], " "))
+	if err != nil {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrPaidInvalidArguments)
+		return err
+	}
+	if amount.Currency == "" {
+		amount.Currency = s.Currency
+	}
+	payer := userParticipant(s, update.Message.From)
+	receiver := s.ResolveParticipant(args[0])
+	if _, err := s.AddPayment(&settler.Transaction{
+		Payer:        payer,
+		Participants: []string{receiver},
+		Amount:       amount,
+		Date:         time.Now(),
+		CreatedBy:    payer,
+	}); err != nil {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, fmt.Sprintf(ErrInvalidPaymentTemplate, err))
+		return err
+	}
+	msg := fmt.Sprintf(PaidSuccessTemplate, payer, amount, receiver)
+	_, err = b.SendMessage(update.Message.Chat.ID, 0, msg)
+	return err
+}
+
 // format: /import
 func handleImport(b *bot.Bot, update *bot.Update) error {
-	from := update.Message.From.Username
-	text := fmt.Sprintf(ImportFileTemplate, from)
-	return b.SendMessageToReply(update.Message.Chat.ID, text, ImportFilePrompt,
-		func(messageID int64, update *bot.Update) {
-			if update.Message.Document == nil {
-				if _, err := b.SendMessage(update.Message.Chat.ID, 0, ErrInvalidImportFile); err != nil {
-					log.Printf("error sending message: %s\n", err)
-				}
-				return
-			}
-			// download the file
-			fileContent, err := b.DownloadFile(update.Message.Document.ID)
-			if err != nil {
-				if _, err := b.SendMessage(update.Message.Chat.ID, 0, ErrInvalidImportFile); err != nil {
-					log.Printf("error sending message: %s\n", err)
-				}
-				return
-			}
-			// parse the file
-			buffer := bytes.NewBuffer(fileContent)
-			csvReader := csv.NewReader(buffer)
-			records, err := csvReader.ReadAll()
-			if err != nil {
-				log.Println(err)
-				if _, err := b.SendMessage(update.Message.Chat.ID, 0, ErrInvalidImportFile); err != nil {
-					log.Printf("error sending message: %s\n", err)
-				}
-				return
-			}
-			// validate the records
-			expenses := []*settler.Transaction{}
-			for _, record := range records {
-				if len(record) != 3 {
-					if _, err := b.SendMessage(update.Message.Chat.ID, 0, ErrInvalidImportFile); err != nil {
-						log.Printf("error sending message: %s\n", err)
-					}
-					return
-				}
-				payer, rawParticipants, rawAmount := record[0], record[1], record[2]
-				participants := strings.Split(rawParticipants, ";")
-				amount, err := strconv.ParseFloat(rawAmount, 64)
-				if err != nil {
-					log.Println(err)
-					if _, err := b.SendMessage(update.Message.Chat.ID, 0, ErrInvalidImportFile); err != nil {
-						log.Printf("error sending message: %s\n", err)
-					}
-					return
-				}
-				expenses = append(expenses, &settler.Transaction{
-					Payer:        payer,
-					Participants: participants,
-					Amount:       amount,
-				})
-			}
-			// get the settler of the chat and add the expense
-			iSettler := b.GetSession(update, settler.NewSettler())
-			settler, ok := iSettler.(*settler.Settler)
-			if !ok {
-				log.Println("error getting settler")
-			}
-			// if there are no expenses, add them without confirmation
-			if _, ids := settler.ListExpenses(); len(ids) == 0 {
-				for _, expense := range expenses {
-					settler.AddExpense(expense.Payer, expense.Participants, expense.Amount)
-				}
-				// send the message
-				msg := fmt.Sprintf(ImportDoneTemplate, len(expenses))
-				if _, err := b.SendMessage(update.Message.Chat.ID, 0, msg); err != nil {
-					log.Printf("error sending message: %s\n", err)
-				}
-				return
-			}
-			// if there are expenses, ask for confirmation and add them if confirmed
-			if err := confirm(b, update.Message.Chat.ID, ImportAlertMessage, func(continueImport bool) {
-				if continueImport {
-					settler.Clean()
-					for _, expense := range expenses {
-						settler.AddExpense(expense.Payer, expense.Participants, expense.Amount)
-					}
-					// send the message
-					msg := fmt.Sprintf(ImportDoneTemplate, len(expenses))
-					if _, err := b.SendMessage(update.Message.Chat.ID, 0, msg); err != nil {
-						log.Printf("error sending message: %s\n", err)
-					}
-					return
-				}
-			}); err != nil {
-				log.Println(err)
-			}
-		})
+	return b.StartConversation(update, importFlow, nil)
 }
 
 // format: /export
 func handleExport(b *bot.Bot, update *bot.Update) error {
-	// get the settler of the chat, the balances of the participants and the
-	// list of transactions to settle the expenses
-	iSettler := b.GetSession(update, settler.NewSettler())
-	settler, ok := iSettler.(*settler.Settler)
+	// get the settler of the chat and the expenses and payments to export,
+	// the current ones or the ones of the archived period requested
+	s, err := chatSettler(b, update.Message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	expenses, _ := s.ListExpenses()
+	payments, _ := s.ListPayments()
+	filename := "expenses.csv"
+	if args := update.CommandArgs(); len(args) > 0 {
+		number, err := strconv.Atoi(args[0])
+		if err != nil || len(args) > 1 {
+			_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrExportInvalidArguments)
+			return err
+		}
+		period, err := s.GetPeriod(number)
+		if err != nil {
+			_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrPeriodNotFound)
+			return err
+		}
+		expenses, _ = period.ListExpenses()
+		payments, _ = period.ListPayments()
+		filename = fmt.Sprintf("period-%d.csv", number)
+	}
+
+	content, err := settler.EncodeCSV(append(expenses, payments...))
+	if err != nil {
+		log.Println(err)
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrInternalProcess)
+		return err
+	}
+	if _, err := b.SendMessage(update.Message.Chat.ID, 0, ExportFileMessage); err != nil {
+		if _, err := b.SendMessage(update.Message.Chat.ID, 0, ErrInternalProcess); err != nil {
+			return err
+		}
+	}
+	return b.SendDocument(update.Message.Chat.ID, filename, string(content))
+}
+
+// format: /history [period]
+func handleHistory(b *bot.Bot, update *bot.Update) error {
+	s, err := chatSettler(b, update.Message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	// show the details of the period requested
+	if args := update.CommandArgs(); len(args) > 0 {
+		number, err := strconv.Atoi(args[0])
+		if err != nil || len(args) > 1 {
+			_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrHistoryInvalidArguments)
+			return err
+		}
+		period, err := s.GetPeriod(number)
+		if err != nil {
+			_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrPeriodNotFound)
+			return err
+		}
+		_, err = b.SendMessage(update.Message.Chat.ID, 0, formatPeriod(number, period))
+		return err
+	}
+	periods := s.ListPeriods()
+	if len(periods) == 0 {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrNoHistory)
+		return err
+	}
+	// list the periods and send a menu to see the details of any of them
+	buttonsPerRow := 5
+	texts := []string{HistoryHeader}
+	labels := [][]string{}
+	for i, period := range periods {
+		number := i + 1
+		texts = append(texts, fmt.Sprintf(HistoryItemTemplate, number, period.Label,
+			period.ClosedAt.Format(time.DateOnly), len(period.Expenses), len(period.Payments)))
+		if i%buttonsPerRow == 0 {
+			labels = append(labels, []string{})
+		}
+		labels[len(labels)-1] = append(labels[len(labels)-1], strconv.Itoa(number))
+	}
+	if _, err := b.SendMessage(update.Message.Chat.ID, 0, strings.Join(texts, "\n")); err != nil {
+		return err
+	}
+	_, err = b.InlineMenu(update.Message.Chat.ID, 0, SelectPeriodMessage, labels, labels, func(_ int64, data string) {
+		number, err := strconv.Atoi(data)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		period, err := s.GetPeriod(number)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if _, err := b.SendMessage(update.Message.Chat.ID, 0, formatPeriod(number, period)); err != nil {
+			log.Println(err)
+		}
+	})
+	return err
+}
+
+// format: /currency EUR
+func handleCurrency(b *bot.Bot, update *bot.Update) error {
+	iSettler := b.GetSession(update, newSettler())
+	s, ok := iSettler.(*settler.Settler)
 	if !ok {
 		return nil
 	}
-	expenses, _ := settler.ListExpenses()
+	args := update.CommandArgs()
+	// if no currency is provided, show the current one
+	if len(args) == 0 {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, fmt.Sprintf(CurrentCurrencyTemplate, s.Currency))
+		return err
+	}
+	if len(args) != 1 {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrCurrencyInvalidArguments)
+		return err
+	}
+	if err := s.SetCurrency(args[0]); err != nil {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrCurrencyInvalidArguments)
+		return err
+	}
+	_, err := b.SendMessage(update.Message.Chat.ID, 0, fmt.Sprintf(CurrencySetTemplate, s.Currency))
+	return err
+}
 
-	strBuffer := strings.Builder{}
-	csvWriter := csv.NewWriter(&strBuffer)
-	for _, expense := range expenses {
-		if err := csvWriter.Write([]string{
-			expense.Payer,
-			strings.Join(expense.Participants, ";"),
-			fmt.Sprintf("%.2f", expense.Amount),
-		}); err != nil {
-			log.Println(err)
-			if _, err := b.SendMessage(update.Message.Chat.ID, 0, ErrInternalProcess); err != nil {
-				return err
-			}
+// format: /strategy [greedy|exact]
+func handleStrategy(b *bot.Bot, update *bot.Update) error {
+	s, err := chatSettler(b, update.Message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	args := update.CommandArgs()
+	// if no strategy is provided, show the current one
+	if len(args) == 0 {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, fmt.Sprintf(CurrentStrategyTemplate, s.Strategy))
+		return err
+	}
+	if len(args) != 1 {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrStrategyInvalidArguments)
+		return err
+	}
+	if err := s.SetStrategy(strings.ToLower(args[0])); err != nil {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrStrategyInvalidArguments)
+		return err
+	}
+	_, err = b.SendMessage(update.Message.Chat.ID, 0, fmt.Sprintf(StrategySetTemplate, s.Strategy))
+	return err
+}
+
+// format: /constraints [forbid|via|household|remove|clear] [args]
+func handleConstraints(b *bot.Bot, update *bot.Update) error {
+	chatID := update.Message.Chat.ID
+	s, err := chatSettler(b, chatID)
+	if err != nil {
+		return err
+	}
+	args := commandFields(s, update)
+	// if no action is provided, list the current constraints
+	if len(args) == 0 {
+		constraints := s.ListConstraints()
+		if len(constraints) == 0 {
+			_, err := b.SendMessage(chatID, 0, ErrNoConstraints)
+			return err
+		}
+		texts := []string{ConstraintsHeader}
+		for i, constraint := range constraints {
+			texts = append(texts, fmt.Sprintf(ConstraintItemTemplate, i+1, formatConstraint(constraint)))
 		}
+		_, err := b.SendMessage(chatID, 0, strings.Join(texts, "\n"))
+		return err
 	}
-	csvWriter.Flush()
-	if err := csvWriter.Error(); err != nil {
-		log.Println(err)
-		if _, err := b.SendMessage(update.Message.Chat.ID, 0, ErrInternalProcess); err != nil {
+	action, persons := strings.ToLower(args[0]), args[1:]
+	if action != "remove" {
+		persons = resolveParticipants(s, persons)
+	}
+	var constraint *settler.Constraint
+	switch {
+	case action == "forbid" && len(persons) == 2:
+		constraint = &settler.Constraint{
+			Kind:     settler.ConstraintForbidden,
+			Payer:    persons[0],
+			Receiver: persons[1],
+		}
+	case action == "via" && len(persons) == 3:
+		constraint = &settler.Constraint{
+			Kind:         settler.ConstraintIntermediary,
+			Payer:        persons[0],
+			Receiver:     persons[1],
+			Intermediary: persons[2],
+		}
+	case action == "household" && len(persons) >= 2:
+		constraint = &settler.Constraint{
+			Kind:    settler.ConstraintHousehold,
+			Members: persons,
+		}
+	case action == "remove" && len(persons) == 1:
+		// the constraints are listed starting from 1
+		number, err := strconv.Atoi(persons[0])
+		if err != nil {
+			_, err := b.SendMessage(chatID, 0, ErrConstraintsInvalidArguments)
+			return err
+		}
+		if err := s.RemoveConstraint(number - 1); err != nil {
+			_, err := b.SendMessage(chatID, 0, ErrConstraintNotFound)
 			return err
 		}
+		_, err = b.SendMessage(chatID, 0, fmt.Sprintf(ConstraintRemovedTemplate, number))
+		return err
+	case action == "clear" && len(persons) == 0:
+		s.ClearConstraints()
+		_, err := b.SendMessage(chatID, 0, ConstraintsClearedMessage)
+		return err
+	default:
+		_, err := b.SendMessage(chatID, 0, ErrConstraintsInvalidArguments)
+		return err
 	}
-	if _, err := b.SendMessage(update.Message.Chat.ID, 0, ExportFileMessage); err != nil {
-		if _, err := b.SendMessage(update.Message.Chat.ID, 0, ErrInternalProcess); err != nil {
+	if err := s.AddConstraint(constraint); err != nil {
+		_, err := b.SendMessage(chatID, 0, fmt.Sprintf(ErrInvalidConstraintTemplate, err))
+		return err
+	}
+	_, err = b.SendMessage(chatID, 0, fmt.Sprintf(ConstraintAddedTemplate, formatConstraint(constraint)))
+	return err
+}
+
+// format: /participants [alias @participant alias]
+func handleParticipants(b *bot.Bot, update *bot.Update) error {
+	chatID := update.Message.Chat.ID
+	s, err := chatSettler(b, chatID)
+	if err != nil {
+		return err
+	}
+	userParticipant(s, update.Message.From)
+	args := commandFields(s, update)
+	// if no action is provided, list the participants
+	if len(args) == 0 {
+		participants := s.ListParticipants()
+		if len(participants) == 0 {
+			_, err := b.SendMessage(chatID, 0, ErrNoParticipants)
 			return err
 		}
+		texts := []string{ParticipantsHeader}
+		for _, participant := range participants {
+			texts = append(texts, fmt.Sprintf(ParticipantItemTemplate, formatParticipant(participant)))
+		}
+		_, err := b.SendMessage(chatID, 0, strings.Join(texts, "\n"))
+		return err
 	}
-	return b.SendDocument(update.Message.Chat.ID, "expenses.csv", strBuffer.String())
+	if len(args) != 3 || strings.ToLower(args[0]) != "alias" {
+		_, err := b.SendMessage(chatID, 0, ErrParticipantsInvalidArguments)
+		return err
+	}
+	name := s.ResolveParticipant(args[1])
+	if err := s.AddAlias(name, args[2]); err != nil {
+		_, err := b.SendMessage(chatID, 0, fmt.Sprintf(ErrAliasTemplate, err))
+		return err
+	}
+	_, err = b.SendMessage(chatID, 0, fmt.Sprintf(AliasAddedTemplate, name, args[2]))
+	return err
+}
+
+// format: /merge @from @into
+func handleMerge(b *bot.Bot, update *bot.Update) error {
+	chatID := update.Message.Chat.ID
+	s, err := chatSettler(b, chatID)
+	if err != nil {
+		return err
+	}
+	args := commandFields(s, update)
+	if len(args) != 2 {
+		_, err := b.SendMessage(chatID, 0, ErrMergeInvalidArguments)
+		return err
+	}
+	from, into := s.ResolveParticipant(args[0]), s.ResolveParticipant(args[1])
+	changed, err := s.MergeParticipants(from, into)
+	if err != nil {
+		_, err := b.SendMessage(chatID, 0, fmt.Sprintf(ErrMergeTemplate, err))
+		return err
+	}
+	_, err = b.SendMessage(chatID, 0, fmt.Sprintf(MergeSuccessTemplate, from, into, changed))
+	return err
+}
+
+// format: /rate USD 0.92 or /rate USD GBP 0.79
+func handleRate(b *bot.Bot, update *bot.Update) error {
+	iSettler := b.GetSession(update, newSettler())
+	s, ok := iSettler.(*settler.Settler)
+	if !ok {
+		return nil
+	}
+	args := update.CommandArgs()
+	// if no rate is provided, list the current ones
+	if len(args) == 0 {
+		rates := s.ListRates()
+		if len(rates) == 0 {
+			_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrNoRates)
+			return err
+		}
+		pairs := []string{}
+		for pair := range rates {
+			pairs = append(pairs, pair)
+		}
+		sort.Strings(pairs)
+		texts := []string{RatesHeader}
+		for _, pair := range pairs {
+			from, to, _ := strings.Cut(pair, "/")
+			texts = append(texts, fmt.Sprintf(RateItemTemplate, from, rates[pair], to))
+		}
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, strings.Join(texts, "\n"))
+		return err
+	}
+	// the target currency is optional, by default it is the base currency
+	from, to, rawRate := "", s.Currency, ""
+	switch len(args) {
+	case 2:
+		from, rawRate = args[0], args[1]
+	case 3:
+		from, to, rawRate = args[0], args[1], args[2]
+	default:
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrRateInvalidArguments)
+		return err
+	}
+	rate, err := settler.ParseRate(rawRate)
+	if err != nil {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrRateInvalidArguments)
+		return err
+	}
+	if err := s.SetRate(from, to, rate); err != nil {
+		_, err := b.SendMessage(update.Message.Chat.ID, 0, ErrRateInvalidArguments)
+		return err
+	}
+	msg := fmt.Sprintf(RateSetTemplate, strings.ToUpper(from), rate, strings.ToUpper(to))
+	_, err = b.SendMessage(update.Message.Chat.ID, 0, msg)
+	return err
 }
 
 // format: /adduser 123456789 alias
@@ -430,3 +706,163 @@ func handleListUsers(b *bot.Bot, update *bot.Update) error {
 	_, err := b.SendMessage(update.Message.Chat.ID, 0, strings.Join(texts, "\n"))
 	return err
 }
+
+// format: /ledger [new|switch|list|close] [name]
+func handleLedger(b *bot.Bot, update *bot.Update) error {
+	chatID := update.Message.Chat.ID
+	// the chat always has an active ledger, the default one if it has no
+	// other
+	current, err := chatSettler(b, chatID)
+	if err != nil {
+		return err
+	}
+	args := update.CommandArgs()
+	action := "list"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	name := ""
+	if len(args) > 1 {
+		name = strings.Join(args[1:], " ")
+	}
+	names, active := b.ListLedgers(chatID)
+	switch action {
+	case "list":
+		texts := []string{LedgersHeader}
+		for _, ledger := range names {
+			template := LedgerItemTemplate
+			if ledger == active {
+				template = ActiveLedgerItemTemplate
+			}
+			texts = append(texts, fmt.Sprintf(template, ledger))
+		}
+		_, err := b.SendMessage(chatID, 0, strings.Join(texts, "\n"))
+		return err
+	case "new":
+		if name == "" || len([]rune(name)) > maxLedgerNameLength {
+			_, err := b.SendMessage(chatID, 0, fmt.Sprintf(ErrInvalidLedgerNameTemplate, maxLedgerNameLength))
+			return err
+		}
+		// the new ledger knows the participants of the current one
+		ledger := newSettler()
+		ledger.SetParticipants(current.ListParticipants())
+		if err := b.AddLedger(chatID, name, ledger); err != nil {
+			_, err := b.SendMessage(chatID, 0, fmt.Sprintf(ErrLedgerExistsTemplate, name))
+			return err
+		}
+		_, err := b.SendMessage(chatID, 0, fmt.Sprintf(LedgerCreatedTemplate, name))
+		return err
+	case "switch":
+		if name != "" {
+			if err := b.SwitchLedger(chatID, name); err != nil {
+				_, err := b.SendMessage(chatID, 0, fmt.Sprintf(ErrLedgerNotFoundTemplate, name))
+				return err
+			}
+			_, err := b.SendMessage(chatID, 0, fmt.Sprintf(LedgerSwitchedTemplate, name))
+			return err
+		}
+		// if no name is provided, ask for the ledger with a menu, using the
+		// positions of the ledgers as values to keep the data of the buttons
+		// short
+		labels, values := [][]string{}, [][]string{}
+		for i, ledger := range names {
+			labels = append(labels, []string{ledger})
+			values = append(values, []string{strconv.Itoa(i)})
+		}
+		_, err := b.InlineMenu(chatID, 0, SelectLedgerMessage, labels, values, func(messageID int64, data string) {
+			i, err := strconv.Atoi(data)
+			if err != nil || i < 0 || i >= len(names) {
+				log.Println("invalid ledger", data)
+				return
+			}
+			msg := fmt.Sprintf(LedgerSwitchedTemplate, names[i])
+			if err := b.SwitchLedger(chatID, names[i]); err != nil {
+				msg = fmt.Sprintf(ErrLedgerNotFoundTemplate, names[i])
+			}
+			if _, err := b.SendMessage(chatID, messageID, msg); err != nil {
+				log.Println(err)
+			}
+		})
+		return err
+	case "close":
+		if name == "" {
+			name = active
+		}
+		if !slices.Contains(names, name) {
+			_, err := b.SendMessage(chatID, 0, fmt.Sprintf(ErrLedgerNotFoundTemplate, name))
+			return err
+		}
+		return confirm(b, chatID, fmt.Sprintf(ConfirmCloseLedgerTemplate, name), func(close bool) {
+			if !close {
+				return
+			}
+			if _, err := b.CloseLedger(chatID, name); err != nil {
+				log.Println(err)
+				return
+			}
+			if _, err := b.SendMessage(chatID, 0, fmt.Sprintf(LedgerClosedTemplate, name)); err != nil {
+				log.Println(err)
+			}
+		})
+	}
+	_, err = b.SendMessage(chatID, 0, ErrLedgerInvalidArguments)
+	return err
+}
+
+// asOfLayouts are the formats of the date and time of /asof, a date alone
+// means the end of that day
+var asOfLayouts = []string{"2006-01-02 15:04", "2006-01-02"}
+
+// format: /asof 2024-03-03 [18:30]
+func handleAsOf(b *bot.Bot, update *bot.Update) error {
+	chatID := update.Message.Chat.ID
+	arg := strings.Join(update.CommandArgs(), " ")
+	var until time.Time
+	for _, layout := range asOfLayouts {
+		parsed, err := time.ParseInLocation(layout, arg, time.Local)
+		if err != nil {
+			continue
+		}
+		until = parsed.Add(time.Minute - time.Nanosecond)
+		if layout == "2006-01-02" {
+			until = parsed.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		break
+	}
+	if until.IsZero() {
+		_, err := b.SendMessage(chatID, 0, ErrAsOfInvalidArguments)
+		return err
+	}
+	// rebuild the active ledger replaying its events until that time
+	_, active := b.ListLedgers(chatID)
+	encodedEvents, err := b.LedgerEvents(chatID, active)
+	if errors.Is(err, bot.ErrEventLogDisabled) {
+		_, err := b.SendMessage(chatID, 0, ErrAsOfDisabled)
+		return err
+	} else if err != nil {
+		return err
+	}
+	events := make([]*settler.Event, 0, len(encodedEvents))
+	for _, encoded := range encodedEvents {
+		event, err := settler.DecodeEvent(encoded)
+		if err != nil {
+			return err
+		}
+		events = append(events, event)
+	}
+	past, err := settler.ReplayEvents(events, until)
+	if err != nil {
+		return err
+	}
+	if expenses, _ := past.ListExpenses(); len(expenses) == 0 {
+		_, err := b.SendMessage(chatID, 0, fmt.Sprintf(ErrAsOfNoExpensesTemplate, arg))
+		return err
+	}
+	text, _, err := composeSummary(configureSettler(past))
+	if err != nil {
+		_, err := b.SendMessage(chatID, 0, summaryErrorMessage(err))
+		return err
+	}
+	_, err = b.SendMessage(chatID, 0, fmt.Sprintf(AsOfHeaderTemplate, arg)+text)
+	return err
+}
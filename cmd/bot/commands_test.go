@@ -0,0 +1,729 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasmenendez/expensesbot/bot"
+	"github.com/lucasmenendez/expensesbot/bot/telegramtest"
+	"github.com/lucasmenendez/expensesbot/settler"
+)
+
+const testTimeout = 5 * time.Second
+
+var (
+	testAlice = &bot.User{ID: 1, Username: "alice"}
+	testBob   = &bot.User{ID: 2, Username: "bob"}
+)
+
+// startTestBot starts a bot with every command registered against a fake
+// telegram api, with alice as admin and bob as allowed user. Both are stopped
+// when the test finishes.
+func startTestBot(t *testing.T) *telegramtest.Server {
+	t.Helper()
+	server := telegramtest.NewServer()
+	dir := t.TempDir()
+	auth := InitAuth(map[int64]string{testAlice.ID: testAlice.Username}, filepath.Join(dir, "auth.json"))
+	if err := auth.AddAllowedUser(testBob.ID, testBob.Username); err != nil {
+		t.Fatal(err)
+	}
+	b := bot.New(context.Background(), bot.BotConfig{
+		Token:          "test-token",
+		SnapshotPath:   filepath.Join(dir, "snapshot.json"),
+		EventLogPath:   filepath.Join(dir, "events"),
+		ExpirationDays: 1,
+		AuthManager:    auth,
+		APIURL:         server.URL,
+		HTTPClient:     server.Client(),
+	})
+	registerCommands(b)
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		b.Stop()
+		server.Close()
+	})
+	return server
+}
+
+// waitForText waits until the bot sends a message to the chat that contains
+// the text provided.
+func waitForText(t *testing.T, server *telegramtest.Server, chatID int64, text string) telegramtest.Message {
+	t.Helper()
+	msg, err := server.WaitForMessage(testTimeout, func(msg telegramtest.Message) bool {
+		return msg.ChatID == chatID && !msg.Deleted && strings.Contains(msg.Text, text)
+	})
+	if err != nil {
+		t.Fatalf("waiting for '%s': %v", text, err)
+	}
+	return msg
+}
+
+// waitForMenu waits until the bot sends a message with an inline keyboard to
+// the chat that contains the text provided.
+func waitForMenu(t *testing.T, server *telegramtest.Server, chatID int64, text string) telegramtest.Message {
+	t.Helper()
+	msg, err := server.WaitForMessage(testTimeout, func(msg telegramtest.Message) bool {
+		return msg.ChatID == chatID && !msg.Deleted && len(msg.Buttons) > 0 && strings.Contains(msg.Text, text)
+	})
+	if err != nil {
+		t.Fatalf("waiting for menu '%s': %v", text, err)
+	}
+	return msg
+}
+
+// pressButton presses the button of the message as the user provided and
+// fails if it does not exist.
+func pressButton(t *testing.T, server *telegramtest.Server, from *bot.User, msg telegramtest.Message, text string) {
+	t.Helper()
+	if err := server.PressButton(msg.ChatID, from, msg.ID, text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// typeAmount types the amount in the numpad of the amount prompt provided as
+// the user provided, waiting for each key to be processed before pressing the
+// next one.
+func typeAmount(t *testing.T, server *telegramtest.Server, from *bot.User, menu telegramtest.Message, amount string) {
+	t.Helper()
+	waitForNumpad := func(text string) {
+		t.Helper()
+		if _, err := server.WaitForMessage(testTimeout, func(msg telegramtest.Message) bool {
+			return msg.ID == menu.ID && msg.Text == RequestAmountMessage+"\n"+text && len(msg.Buttons) > 1
+		}); err != nil {
+			t.Fatalf("waiting for numpad with '%s': %v", text, err)
+		}
+	}
+	for i, key := range amount {
+		pressButton(t, server, from, menu, string(key))
+		waitForNumpad(amount[:i+1])
+	}
+	pressButton(t, server, from, menu, "Done")
+}
+
+// waitForSelected waits until the option of the menu provided is marked as
+// selected.
+func waitForSelected(t *testing.T, server *telegramtest.Server, menu telegramtest.Message, label string) {
+	t.Helper()
+	if _, err := server.WaitForMessage(testTimeout, func(msg telegramtest.Message) bool {
+		if msg.ID != menu.ID {
+			return false
+		}
+		for _, row := range msg.Buttons {
+			for _, button := range row {
+				if button.Text == "✅ "+label {
+					return true
+				}
+			}
+		}
+		return false
+	}); err != nil {
+		t.Fatalf("waiting for '%s' to be selected: %v", label, err)
+	}
+}
+
+// pickParticipants selects the participants provided in the participant
+// picker of the expense that the user provided is adding, waiting for each
+// one to be selected before pressing the next one, and types the others
+// provided, if any.
+func pickParticipants(t *testing.T, server *telegramtest.Server, from *bot.User, chatID int64, names []string, others string) {
+	t.Helper()
+	menu := waitForMenu(t, server, chatID, fmt.Sprintf(RequestParticipantsTemplate, from.Username))
+	for _, name := range names {
+		pressButton(t, server, from, menu, name)
+		waitForSelected(t, server, menu, name)
+	}
+	if others != "" {
+		pressButton(t, server, from, menu, OtherParticipantsButton)
+		waitForSelected(t, server, menu, OtherParticipantsButton)
+	}
+	pressButton(t, server, from, menu, DoneParticipantsButton)
+	if others != "" {
+		prompt := waitForText(t, server, chatID, fmt.Sprintf(RequestOtherParticipantsTemplate, from.Username))
+		server.SendReply(chatID, from, prompt.ID, others)
+	}
+}
+
+// describeExpense answers the description and the category prompts of the
+// expense that the user provided is adding.
+func describeExpense(t *testing.T, server *telegramtest.Server, from *bot.User, chatID int64, description, category string) {
+	t.Helper()
+	prompt := waitForText(t, server, chatID, fmt.Sprintf(RequestDescriptionTemplate, from.Username))
+	server.SendReply(chatID, from, prompt.ID, description)
+	pressButton(t, server, from, waitForMenu(t, server, chatID, RequestCategoryMessage), category)
+}
+
+func TestAddAndSummary(t *testing.T) {
+	server := startTestBot(t)
+	chatID := int64(100)
+
+	server.SendCommand(chatID, testAlice, "/add")
+	pickParticipants(t, server, testAlice, chatID, []string{"@alice"}, "@bob")
+	typeAmount(t, server, testAlice, waitForMenu(t, server, chatID, RequestAmountMessage), "12.5")
+	describeExpense(t, server, testAlice, chatID, "Lunch", categoryLabels["food"])
+	pressButton(t, server, testAlice, waitForMenu(t, server, chatID, RequestSplitMessage), SplitEqualButton)
+	waitForText(t, server, chatID, "Ok, so @alice paid 12.50 EUR for @alice, @bob.")
+
+	// bob knows alice from the previous expense, so he selects everyone
+	server.SendCommand(chatID, testBob, "/add")
+	picker := waitForMenu(t, server, chatID, fmt.Sprintf(RequestParticipantsTemplate, testBob.Username))
+	if picker.Buttons[0][0].Text != "@bob" || picker.Buttons[0][1].Text != "@alice" {
+		t.Errorf("expected the sender first and then the known persons, got %v", picker.Buttons[0])
+	}
+	pressButton(t, server, testBob, picker, AllParticipantsButton)
+	waitForSelected(t, server, picker, "@alice")
+	pressButton(t, server, testBob, picker, DoneParticipantsButton)
+	typeAmount(t, server, testBob, waitForMenu(t, server, chatID, RequestAmountMessage), "30")
+	describeExpense(t, server, testBob, chatID, "Taxi", NoCategoryButton)
+	pressButton(t, server, testBob, waitForMenu(t, server, chatID, RequestSplitMessage), SplitPercentageButton)
+	prompt := waitForText(t, server, chatID, "percentage of each participant")
+	server.SendReply(chatID, testBob, prompt.ID, "50% 50%")
+	waitForText(t, server, chatID, "Ok, so @bob paid 30.00 EUR for @bob (15.00 EUR), @alice (15.00 EUR).")
+
+	// alice: +12.50 - 6.25 - 15.00, bob: +30.00 - 6.25 - 15.00
+	server.SendCommand(chatID, testAlice, "/summary")
+	waitForText(t, server, chatID, " - @alice must pay 8.75 EUR to @bob")
+
+	// the expenses are listed with their details
+	server.SendCommand(chatID, testAlice, "/expenses")
+	list := waitForText(t, server, chatID, ListExpensesHeader)
+	for _, details := range []string{"Lunch · " + categoryLabels["food"], "Taxi · "} {
+		if !strings.Contains(list.Text, details) {
+			t.Errorf("expected '%s' in the list of expenses, got:\n%s", details, list.Text)
+		}
+	}
+	if !strings.Contains(list.Text, "by @bob") {
+		t.Errorf("expected the creator in the list of expenses, got:\n%s", list.Text)
+	}
+}
+
+func TestImportAndExport(t *testing.T) {
+	server := startTestBot(t)
+	chatID := int64(200)
+
+	content := "@alice,@alice;@bob,10.00 EUR,,,Dinner,2026-10-01T20:00:00Z,food,@alice\n" +
+		"@bob,@alice;@bob,30.00 EUR,percentage,25.00;75.00,,,,\n"
+	server.SendCommand(chatID, testAlice, "/import")
+	prompt := waitForText(t, server, chatID, fmt.Sprintf(ImportFileTemplate, testAlice.Username))
+	server.SendDocumentReply(chatID, testAlice, prompt.ID, "expenses.csv", []byte(content))
+	waitForText(t, server, chatID, fmt.Sprintf(ImportDoneTemplate, 2))
+
+	// alice: +10.00 - 5.00 - 7.50, bob: +30.00 - 5.00 - 22.50
+	server.SendCommand(chatID, testAlice, "/summary")
+	waitForText(t, server, chatID, " - @alice must pay 2.50 EUR to @bob")
+
+	server.SendCommand(chatID, testAlice, "/export")
+	msg, err := server.WaitForMessage(testTimeout, func(msg telegramtest.Message) bool {
+		return msg.ChatID == chatID && msg.Document != nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expenses, err := settler.DecodeCSV(msg.Document.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expenses) != 2 {
+		t.Fatalf("expected 2 exported expenses, got %d", len(expenses))
+	}
+	if string(msg.Document.Content) != content {
+		t.Errorf("expected exported content:\n%s\ngot:\n%s", content, msg.Document.Content)
+	}
+}
+
+func TestImportConfirmation(t *testing.T) {
+	server := startTestBot(t)
+	chatID := int64(201)
+
+	// a chat with payments but no expenses is not overwritten without asking
+	server.SendCommand(chatID, testAlice, "/paid @bob 10")
+	waitForText(t, server, chatID, "Ok, so @alice paid 10.00 EUR to @bob.")
+	server.SendCommand(chatID, testAlice, "/import")
+	prompt := waitForText(t, server, chatID, fmt.Sprintf(ImportFileTemplate, testAlice.Username))
+	server.SendDocumentReply(chatID, testAlice, prompt.ID, "expenses.csv", []byte("@alice,@alice;@bob,10.00 EUR,,,,,,\n"))
+	pressButton(t, server, testAlice, waitForMenu(t, server, chatID, ImportAlertMessage), ConfirmNoButton)
+
+	server.SendCommand(chatID, testAlice, "/summary")
+	waitForText(t, server, chatID, " - @bob must pay 10.00 EUR to @alice")
+}
+
+func TestInvalidImport(t *testing.T) {
+	server := startTestBot(t)
+	chatID := int64(300)
+
+	server.SendCommand(chatID, testAlice, "/import")
+	prompt := waitForText(t, server, chatID, fmt.Sprintf(ImportFileTemplate, testAlice.Username))
+	server.SendDocumentReply(chatID, testAlice, prompt.ID, "expenses.csv", []byte("@alice,@bob,ten euros\n"))
+	waitForText(t, server, chatID, ErrInvalidImportFile)
+}
+
+func TestCancelConversation(t *testing.T) {
+	server := startTestBot(t)
+	chatID := int64(400)
+
+	server.SendCommand(chatID, testAlice, "/add")
+	// the participants are required, the picker stays open until one is
+	// selected and the typed ones are asked again if they are empty
+	picker := waitForMenu(t, server, chatID, fmt.Sprintf(RequestParticipantsTemplate, testAlice.Username))
+	pressButton(t, server, testAlice, picker, DoneParticipantsButton)
+	waitForText(t, server, chatID, ErrNoParticipantsSelected)
+	pressButton(t, server, testAlice, picker, OtherParticipantsButton)
+	waitForSelected(t, server, picker, OtherParticipantsButton)
+	pressButton(t, server, testAlice, picker, DoneParticipantsButton)
+	prompt := waitForText(t, server, chatID, fmt.Sprintf(RequestOtherParticipantsTemplate, testAlice.Username))
+	server.SendReply(chatID, testAlice, prompt.ID, " ")
+	waitForText(t, server, chatID, ErrInvalidParticipants)
+	prompt, err := server.WaitForMessage(testTimeout, func(msg telegramtest.Message) bool {
+		return msg.ChatID == chatID && msg.ID > prompt.ID && msg.ForceReply
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SendReply(chatID, testAlice, prompt.ID, "@alice @bob")
+	menu := waitForMenu(t, server, chatID, RequestAmountMessage)
+	// other users can not answer the conversation of alice
+	pressButton(t, server, testBob, menu, "1")
+	if err := server.WaitForAnswer(testTimeout, "This menu has expired."); err != nil {
+		t.Fatal(err)
+	}
+	server.SendCommand(chatID, testAlice, "/cancel")
+	waitForText(t, server, chatID, CancelledMessage)
+	if _, err := server.WaitForMessage(testTimeout, func(msg telegramtest.Message) bool {
+		return msg.ID == menu.ID && msg.Deleted
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range server.Messages(chatID) {
+		if msg.ID == menu.ID && msg.Text != RequestAmountMessage+"\n0" {
+			t.Errorf("unexpected numpad input: %s", msg.Text)
+		}
+	}
+	server.SendCommand(chatID, testAlice, "/cancel")
+	waitForText(t, server, chatID, NothingToCancelMessage)
+}
+
+func TestPaid(t *testing.T) {
+	server := startTestBot(t)
+	chatID := int64(500)
+
+	server.SendCommand(chatID, testAlice, "/import")
+	prompt := waitForText(t, server, chatID, fmt.Sprintf(ImportFileTemplate, testAlice.Username))
+	server.SendDocumentReply(chatID, testAlice, prompt.ID, "expenses.csv", []byte("@alice,@alice;@bob,10.00 EUR\n"))
+	waitForText(t, server, chatID, fmt.Sprintf(ImportDoneTemplate, 1))
+
+	// bob pays back part of his debt
+	server.SendCommand(chatID, testBob, "/paid @alice 2")
+	waitForText(t, server, chatID, "Ok, so @bob paid 2.00 EUR to @alice.")
+
+	// only the rest of the debt is suggested, and marking it as paid settles
+	// every debt
+	server.SendCommand(chatID, testBob, "/summary")
+	summary := waitForMenu(t, server, chatID, " - @bob must pay 3.00 EUR to @alice")
+	if !strings.Contains(summary.Text, " - @bob paid 2.00 EUR to @alice") {
+		t.Errorf("expected the payment in the summary, got:\n%s", summary.Text)
+	}
+	pressButton(t, server, testBob, summary, fmt.Sprintf(MarkAsPaidButtonTemplate, "@bob", "@alice"))
+	waitForText(t, server, chatID, "Ok, so @bob paid 3.00 EUR to @alice.")
+	waitForText(t, server, chatID, AllSettledMessage)
+
+	// the payments are exported with the expenses
+	server.SendCommand(chatID, testAlice, "/export")
+	msg, err := server.WaitForMessage(testTimeout, func(msg telegramtest.Message) bool {
+		return msg.ChatID == chatID && msg.Document != nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := settler.DecodeCSV(msg.Document.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 3 || !exported[1].IsPayment() || !exported[2].IsPayment() {
+		t.Fatalf("expected an expense and 2 payments, got:\n%s", msg.Document.Content)
+	}
+	if exported[1].Amount.String() != "2.00 EUR" || exported[2].Amount.String() != "3.00 EUR" {
+		t.Errorf("unexpected exported payments:\n%s", msg.Document.Content)
+	}
+}
+
+func TestEdit(t *testing.T) {
+	server := startTestBot(t)
+	chatID := int64(106)
+
+	server.SendCommand(chatID, testAlice, "/edit")
+	waitForText(t, server, chatID, ErrNoExpenses)
+
+	server.SendCommand(chatID, testAlice, "/add")
+	pickParticipants(t, server, testAlice, chatID, []string{"@alice"}, "@bob")
+	typeAmount(t, server, testAlice, waitForMenu(t, server, chatID, RequestAmountMessage), "30")
+	describeExpense(t, server, testAlice, chatID, "Dinner", NoCategoryButton)
+	pressButton(t, server, testAlice, waitForMenu(t, server, chatID, RequestSplitMessage), SplitExactButton)
+	prompt := waitForText(t, server, chatID, "exact amount of each participant")
+	server.SendReply(chatID, testAlice, prompt.ID, "10 20")
+	waitForText(t, server, chatID, "Ok, so @alice paid 30.00 EUR")
+
+	// changing the amount resets the exact split
+	server.SendCommand(chatID, testBob, "/edit")
+	pressButton(t, server, testBob, waitForMenu(t, server, chatID, SelectEditExpenseMessage), "1. Dinner (30.00 EUR)")
+	pressButton(t, server, testBob, waitForMenu(t, server, chatID, SelectEditFieldMessage), EditAmountButton)
+	typeAmount(t, server, testBob, waitForMenu(t, server, chatID, RequestAmountMessage), "45")
+	msg := waitForText(t, server, chatID, fmt.Sprintf(EditSuccessTemplate, testBob.Username, 1))
+	for _, line := range []string{
+		fmt.Sprintf(EditDiffItemTemplate, EditAmountButton, "30.00 EUR", "45.00 EUR"),
+		fmt.Sprintf(EditDiffItemTemplate, EditSplitLabel, SplitExactButton, SplitEqualButton),
+		EditSplitResetMessage,
+	} {
+		if !strings.Contains(msg.Text, line) {
+			t.Errorf("expected '%s' in the edit message, got '%s'", line, msg.Text)
+		}
+	}
+
+	server.SendCommand(chatID, testBob, "/edit")
+	pressButton(t, server, testBob, waitForMenu(t, server, chatID, SelectEditExpenseMessage), "1. Dinner (45.00 EUR)")
+	pressButton(t, server, testBob, waitForMenu(t, server, chatID, SelectEditFieldMessage), EditPayerButton)
+	prompt = waitForText(t, server, chatID, fmt.Sprintf(RequestPayerTemplate, testBob.Username))
+	server.SendReply(chatID, testBob, prompt.ID, "@bob")
+	waitForText(t, server, chatID, fmt.Sprintf(EditDiffItemTemplate, EditPayerButton, "@alice", "@bob"))
+
+	// alice owes half of the new amount to the new payer
+	server.SendCommand(chatID, testAlice, "/summary")
+	waitForText(t, server, chatID, "@alice must pay 22.50 EUR to @bob")
+
+	// changing the participants resets the shares split
+	chatID = int64(115)
+	server.SendCommand(chatID, testAlice, "/add")
+	pickParticipants(t, server, testAlice, chatID, []string{"@alice"}, "@bob")
+	typeAmount(t, server, testAlice, waitForMenu(t, server, chatID, RequestAmountMessage), "30")
+	describeExpense(t, server, testAlice, chatID, "Hotel", NoCategoryButton)
+	pressButton(t, server, testAlice, waitForMenu(t, server, chatID, RequestSplitMessage), SplitSharesButton)
+	prompt = waitForText(t, server, chatID, "shares of each participant")
+	server.SendReply(chatID, testAlice, prompt.ID, "1 2")
+	added := waitForText(t, server, chatID, "Ok, so @alice paid 30.00 EUR")
+
+	server.SendCommand(chatID, testAlice, "/edit")
+	pressButton(t, server, testAlice, waitForMenu(t, server, chatID, SelectEditExpenseMessage), "1. Hotel (30.00 EUR)")
+	pressButton(t, server, testAlice, waitForMenu(t, server, chatID, SelectEditFieldMessage), EditParticipantsButton)
+	// the picker of the expense added asks the same, so wait for the prompt
+	// sent after it
+	prompt, err := server.WaitForMessage(testTimeout, func(msg telegramtest.Message) bool {
+		return msg.ChatID == chatID && msg.ID > added.ID && msg.ForceReply && strings.Contains(msg.Text, fmt.Sprintf(RequestParticipantsTemplate, testAlice.Username))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SendReply(chatID, testAlice, prompt.ID, "@alice @bob @carol")
+	msg = waitForText(t, server, chatID, fmt.Sprintf(EditSuccessTemplate, testAlice.Username, 1))
+	for _, line := range []string{
+		fmt.Sprintf(EditDiffItemTemplate, EditSplitLabel, SplitSharesButton, SplitEqualButton),
+		EditSplitResetMessage,
+	} {
+		if !strings.Contains(msg.Text, line) {
+			t.Errorf("expected '%s' in the edit message, got '%s'", line, msg.Text)
+		}
+	}
+	// other changes keep the equal split without warning again
+	server.SendCommand(chatID, testAlice, "/edit")
+	pressButton(t, server, testAlice, waitForMenu(t, server, chatID, SelectEditExpenseMessage), "1. Hotel (30.00 EUR)")
+	pressButton(t, server, testAlice, waitForMenu(t, server, chatID, SelectEditFieldMessage), EditDescriptionButton)
+	prompt, err = server.WaitForMessage(testTimeout, func(m telegramtest.Message) bool {
+		return m.ChatID == chatID && m.ID > msg.ID && m.ForceReply && strings.Contains(m.Text, fmt.Sprintf(RequestDescriptionTemplate, testAlice.Username))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SendReply(chatID, testAlice, prompt.ID, "Hostel")
+	msg = waitForText(t, server, chatID, fmt.Sprintf(EditDiffItemTemplate, EditDescriptionButton, "Hotel", "Hostel"))
+	if strings.Contains(msg.Text, EditSplitResetMessage) {
+		t.Errorf("expected no split reset warning, got '%s'", msg.Text)
+	}
+}
+
+func TestUndoRedo(t *testing.T) {
+	server := startTestBot(t)
+	chatID := int64(107)
+
+	server.SendCommand(chatID, testAlice, "/undo")
+	waitForText(t, server, chatID, ErrNothingToUndo)
+
+	server.SendCommand(chatID, testAlice, "/paid @bob 10")
+	waitForText(t, server, chatID, "Ok, so @alice paid 10.00 EUR to @bob.")
+
+	// closing the period after the summary can be undone
+	server.SendCommand(chatID, testAlice, "/summary")
+	waitForText(t, server, chatID, " - @bob must pay 10.00 EUR to @alice")
+	pressButton(t, server, testAlice, waitForMenu(t, server, chatID, ConfirmClosePeriodMessage), ConfirmYesButton)
+	waitForText(t, server, chatID, fmt.Sprintf(PeriodClosedTemplate, "Period 1"))
+	server.SendCommand(chatID, testAlice, "/undo")
+	waitForText(t, server, chatID, fmt.Sprintf(UndoSuccessTemplate, fmt.Sprintf(CloseOperationTemplate, "Period 1")))
+
+	server.SendCommand(chatID, testBob, "/undo")
+	waitForText(t, server, chatID, fmt.Sprintf(UndoSuccessTemplate, fmt.Sprintf(AddOperationTemplate, "payment", 1)))
+	server.SendCommand(chatID, testBob, "/summary")
+	waitForText(t, server, chatID, ErrNoExpenses)
+
+	server.SendCommand(chatID, testBob, "/redo")
+	waitForText(t, server, chatID, fmt.Sprintf(RedoSuccessTemplate, fmt.Sprintf(AddOperationTemplate, "payment", 1)))
+	server.SendCommand(chatID, testBob, "/summary")
+	waitForText(t, server, chatID, " - @bob must pay 10.00 EUR to @alice")
+}
+
+func TestHistory(t *testing.T) {
+	server := startTestBot(t)
+	chatID := int64(108)
+
+	server.SendCommand(chatID, testAlice, "/history")
+	waitForText(t, server, chatID, ErrNoHistory)
+
+	server.SendCommand(chatID, testAlice, "/paid @bob 10")
+	waitForText(t, server, chatID, "Ok, so @alice paid 10.00 EUR to @bob.")
+	server.SendCommand(chatID, testAlice, "/summary Trip to Rome")
+	waitForText(t, server, chatID, " - @bob must pay 10.00 EUR to @alice")
+	pressButton(t, server, testAlice, waitForMenu(t, server, chatID, ConfirmClosePeriodMessage), ConfirmYesButton)
+	waitForText(t, server, chatID, fmt.Sprintf(PeriodClosedTemplate, "Trip to Rome"))
+	server.SendCommand(chatID, testAlice, "/summary")
+	waitForText(t, server, chatID, ErrNoExpenses)
+
+	// the period is listed and its details can be browsed
+	server.SendCommand(chatID, testBob, "/history")
+	waitForText(t, server, chatID, "1. Trip to Rome, closed on ")
+	pressButton(t, server, testBob, waitForMenu(t, server, chatID, SelectPeriodMessage), "1")
+	details := waitForText(t, server, chatID, "🗄️ Trip to Rome")
+	for _, line := range []string{
+		fmt.Sprintf(PaymentItemTemplate, "@alice", "10.00 EUR", "@bob"),
+		fmt.Sprintf(BalanceItemTemplate, "@alice", "10.00 EUR"),
+		fmt.Sprintf(SummaryItemTemplate, "@bob", "10.00 EUR", "@alice"),
+		fmt.Sprintf(PeriodExportTemplate, 1),
+	} {
+		if !strings.Contains(details.Text, line) {
+			t.Errorf("expected '%s' in the period details, got:\n%s", line, details.Text)
+		}
+	}
+	server.SendCommand(chatID, testBob, "/history 2")
+	waitForText(t, server, chatID, ErrPeriodNotFound)
+
+	// the archived period can be exported
+	server.SendCommand(chatID, testBob, "/export 1")
+	msg, err := server.WaitForMessage(testTimeout, func(msg telegramtest.Message) bool {
+		return msg.ChatID == chatID && msg.Document != nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Document.Name != "period-1.csv" {
+		t.Errorf("expected period-1.csv, got %s", msg.Document.Name)
+	}
+	exported, err := settler.DecodeCSV(msg.Document.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 1 || !exported[0].IsPayment() {
+		t.Errorf("expected the archived payment, got:\n%s", msg.Document.Content)
+	}
+}
+
+func TestLedgers(t *testing.T) {
+	server := startTestBot(t)
+	chatID := int64(109)
+
+	server.SendCommand(chatID, testAlice, "/paid @bob 10")
+	waitForText(t, server, chatID, "Ok, so @alice paid 10.00 EUR to @bob.")
+
+	// a new ledger is empty and becomes the active one
+	server.SendCommand(chatID, testAlice, "/ledger new Lisbon trip")
+	waitForText(t, server, chatID, fmt.Sprintf(LedgerCreatedTemplate, "Lisbon trip"))
+	server.SendCommand(chatID, testAlice, "/ledger new Lisbon trip")
+	waitForText(t, server, chatID, fmt.Sprintf(ErrLedgerExistsTemplate, "Lisbon trip"))
+	server.SendCommand(chatID, testAlice, "/summary")
+	waitForText(t, server, chatID, ErrNoExpenses)
+	server.SendCommand(chatID, testBob, "/paid @alice 20")
+	waitForText(t, server, chatID, "Ok, so @bob paid 20.00 EUR to @alice.")
+
+	server.SendCommand(chatID, testBob, "/ledger list")
+	list := waitForText(t, server, chatID, LedgersHeader)
+	for _, line := range []string{
+		fmt.Sprintf(ActiveLedgerItemTemplate, "Lisbon trip"),
+		fmt.Sprintf(LedgerItemTemplate, bot.DefaultLedger),
+	} {
+		if !strings.Contains(list.Text, line) {
+			t.Errorf("expected '%s' in the list of ledgers, got:\n%s", line, list.Text)
+		}
+	}
+
+	// the commands run against the ledger selected
+	server.SendCommand(chatID, testBob, "/ledger switch")
+	pressButton(t, server, testBob, waitForMenu(t, server, chatID, SelectLedgerMessage), bot.DefaultLedger)
+	waitForText(t, server, chatID, fmt.Sprintf(LedgerSwitchedTemplate, bot.DefaultLedger))
+	server.SendCommand(chatID, testBob, "/summary")
+	waitForText(t, server, chatID, " - @bob must pay 10.00 EUR to @alice")
+
+	server.SendCommand(chatID, testAlice, "/ledger close Lisbon trip")
+	pressButton(t, server, testAlice, waitForMenu(t, server, chatID, fmt.Sprintf(ConfirmCloseLedgerTemplate, "Lisbon trip")), ConfirmYesButton)
+	waitForText(t, server, chatID, fmt.Sprintf(LedgerClosedTemplate, "Lisbon trip"))
+	server.SendCommand(chatID, testAlice, "/ledger switch Lisbon trip")
+	waitForText(t, server, chatID, fmt.Sprintf(ErrLedgerNotFoundTemplate, "Lisbon trip"))
+}
+
+func TestStrategy(t *testing.T) {
+	server := startTestBot(t)
+	chatID := int64(110)
+
+	server.SendCommand(chatID, testAlice, "/strategy")
+	waitForText(t, server, chatID, fmt.Sprintf(CurrentStrategyTemplate, settler.StrategyGreedy))
+	server.SendCommand(chatID, testAlice, "/strategy fastest")
+	waitForText(t, server, chatID, ErrStrategyInvalidArguments)
+	server.SendCommand(chatID, testAlice, "/strategy Exact")
+	waitForText(t, server, chatID, fmt.Sprintf(StrategySetTemplate, settler.StrategyExact))
+
+	// alice: +10, bob: -10, the exact strategy settles it with a transfer
+	server.SendCommand(chatID, testAlice, "/paid @bob 10")
+	waitForText(t, server, chatID, "Ok, so @alice paid 10.00 EUR to @bob.")
+	server.SendCommand(chatID, testAlice, "/summary")
+	waitForText(t, server, chatID, " - @bob must pay 10.00 EUR to @alice")
+}
+
+func TestConstraints(t *testing.T) {
+	server := startTestBot(t)
+	chatID := int64(111)
+
+	server.SendCommand(chatID, testAlice, "/constraints")
+	waitForText(t, server, chatID, ErrNoConstraints)
+	server.SendCommand(chatID, testAlice, "/constraints forbid @bob")
+	waitForText(t, server, chatID, ErrConstraintsInvalidArguments)
+	server.SendCommand(chatID, testAlice, "/constraints forbid @bob @alice")
+	waitForText(t, server, chatID, "🚧 Ok, from now on @bob can't pay @alice directly.")
+
+	// alice: +10, bob: -10, bob can't pay alice and there is no one else
+	server.SendCommand(chatID, testAlice, "/paid @bob 10")
+	waitForText(t, server, chatID, "Ok, so @alice paid 10.00 EUR to @bob.")
+	server.SendCommand(chatID, testAlice, "/summary")
+	waitForText(t, server, chatID, fmt.Sprintf(ErrUnsatisfiableConstraintsTemplate,
+		"the constraints cannot be satisfied: @bob cannot pay @alice"))
+
+	// the transfer is made through the intermediary
+	server.SendCommand(chatID, testAlice, "/constraints remove 1")
+	waitForText(t, server, chatID, fmt.Sprintf(ConstraintRemovedTemplate, 1))
+	server.SendCommand(chatID, testAlice, "/constraints via @bob @alice @carol")
+	waitForText(t, server, chatID, "🚧 Ok, from now on @bob pays @alice through @carol.")
+	server.SendCommand(chatID, testAlice, "/constraints")
+	waitForText(t, server, chatID, ConstraintsHeader+"\n 1. @bob pays @alice through @carol")
+	server.SendCommand(chatID, testAlice, "/summary")
+	// the balances are listed by name
+	waitForText(t, server, chatID, strings.Join([]string{
+		BalancesHeader,
+		fmt.Sprintf(BalanceItemTemplate, "@alice", "10.00 EUR"),
+		fmt.Sprintf(BalanceItemTemplate, "@bob", "-10.00 EUR"),
+	}, "\n"))
+	waitForText(t, server, chatID, " - @bob must pay 10.00 EUR to @carol")
+	waitForText(t, server, chatID, " - @carol must pay 10.00 EUR to @alice")
+
+	server.SendCommand(chatID, testAlice, "/constraints household @alice @alice")
+	waitForText(t, server, chatID, fmt.Sprintf(ErrInvalidConstraintTemplate,
+		"invalid constraint: @alice is repeated"))
+	server.SendCommand(chatID, testAlice, "/constraints remove 5")
+	waitForText(t, server, chatID, ErrConstraintNotFound)
+	server.SendCommand(chatID, testAlice, "/constraints clear")
+	waitForText(t, server, chatID, ConstraintsClearedMessage)
+}
+
+func TestParticipants(t *testing.T) {
+	server := startTestBot(t)
+	chatID := int64(112)
+	carol := &bot.User{ID: 3, FirstName: "Carol Ann"}
+
+	server.SendCommand(chatID, testAlice, "/participants")
+	waitForText(t, server, chatID, ParticipantsHeader+"\n - @alice")
+	// bob is the same person that alice mentioned before
+	server.SendCommand(chatID, testAlice, "/paid Bob 10")
+	waitForText(t, server, chatID, "Ok, so @alice paid 10.00 EUR to Bob.")
+	server.SendCommand(chatID, testBob, "/paid ALICE 4")
+	waitForText(t, server, chatID, "Ok, so Bob paid 4.00 EUR to @alice.")
+	// carol has no username, she is mentioned by her name
+	server.SendCommandMentioning(chatID, testAlice, "/paid Carol Ann 5", carol)
+	waitForText(t, server, chatID, "Ok, so @alice paid 5.00 EUR to Carol_Ann.")
+	server.SendCommand(chatID, testAlice, "/paid carl 3")
+	waitForText(t, server, chatID, "Ok, so @alice paid 3.00 EUR to carl.")
+
+	// the duplicated participants are merged
+	server.SendCommand(chatID, testAlice, "/merge carl")
+	waitForText(t, server, chatID, ErrMergeInvalidArguments)
+	server.SendCommand(chatID, testAlice, "/merge bob @Bob")
+	waitForText(t, server, chatID, "the participants are the same")
+	server.SendCommand(chatID, testAlice, "/merge carl Carol_Ann")
+	waitForText(t, server, chatID, fmt.Sprintf(MergeSuccessTemplate, "carl", "Carol_Ann", 1))
+	server.SendCommand(chatID, testAlice, "/summary")
+	waitForText(t, server, chatID, fmt.Sprintf(BalanceItemTemplate, "Carol_Ann", "-8.00 EUR"))
+	server.SendCommand(chatID, testAlice, "/undo")
+	waitForText(t, server, chatID, fmt.Sprintf(UndoSuccessTemplate, fmt.Sprintf(MergeOperationTemplate, "carl", "Carol_Ann")))
+	server.SendCommand(chatID, testAlice, "/redo")
+	waitForText(t, server, chatID, fmt.Sprintf(RedoSuccessTemplate, fmt.Sprintf(MergeOperationTemplate, "carl", "Carol_Ann")))
+
+	// the aliases are resolved too
+	server.SendCommand(chatID, testAlice, "/participants alias @alice Ali")
+	waitForText(t, server, chatID, fmt.Sprintf(AliasAddedTemplate, "@alice", "Ali"))
+	server.SendCommand(chatID, testBob, "/paid ali 1")
+	waitForText(t, server, chatID, "Ok, so Bob paid 1.00 EUR to @alice.")
+	server.SendCommand(chatID, testAlice, "/participants")
+	waitForText(t, server, chatID, strings.Join([]string{
+		ParticipantsHeader,
+		" - @alice, also known as Ali",
+		" - Bob",
+		" - Carol_Ann (Carol Ann), also known as carl",
+	}, "\n"))
+}
+
+func TestAddInline(t *testing.T) {
+	server := startTestBot(t)
+	chatID := int64(113)
+
+	// every required argument is provided, so the expense is added at once
+	server.SendCommand(chatID, testAlice, `/add @alice,@bob 12.5 "Lunch" exact:5,7.5`)
+	waitForText(t, server, chatID, "Ok, so @alice paid 12.50 EUR for @alice (5.00 EUR), @bob (7.50 EUR).")
+	server.SendCommand(chatID, testAlice, "/add @alice,@bob 12.5.3")
+	waitForText(t, server, chatID, fmt.Sprintf(ErrAddArgumentTemplate, "12.5.3", 2, ArgInvalidAmount))
+
+	// the wizard only asks for the missing arguments
+	server.SendCommand(chatID, testAlice, "/addfor @bob 30")
+	pickParticipants(t, server, testAlice, chatID, []string{"@bob"}, "")
+	describeExpense(t, server, testAlice, chatID, "Taxi", NoCategoryButton)
+	pressButton(t, server, testAlice, waitForMenu(t, server, chatID, RequestSplitMessage), SplitEqualButton)
+	waitForText(t, server, chatID, "Ok, so @bob paid 30.00 EUR for @bob.")
+	for _, msg := range server.Messages(chatID) {
+		if strings.Contains(msg.Text, RequestAmountMessage) {
+			t.Errorf("expected the amount not to be asked, got '%s'", msg.Text)
+		}
+	}
+
+	server.SendCommand(chatID, testAlice, "/expenses")
+	list := waitForText(t, server, chatID, ListExpensesHeader)
+	if !strings.Contains(list.Text, "Lunch") || !strings.Contains(list.Text, "Taxi") {
+		t.Errorf("expected both expenses listed, got:\n%s", list.Text)
+	}
+}
+
+func TestAsOf(t *testing.T) {
+	server := startTestBot(t)
+	chatID := int64(114)
+
+	server.SendCommand(chatID, testAlice, "/asof yesterday")
+	waitForText(t, server, chatID, ErrAsOfInvalidArguments)
+
+	server.SendCommand(chatID, testAlice, `/add @alice,@bob 12 "Lunch"`)
+	waitForText(t, server, chatID, "Ok, so @alice paid 12.00 EUR for @alice, @bob.")
+	server.SendCommand(chatID, testAlice, "/asof 2000-01-01")
+	waitForText(t, server, chatID, fmt.Sprintf(ErrAsOfNoExpensesTemplate, "2000-01-01"))
+
+	// the balances of today are the current ones, even after undoing the
+	// expense
+	today := time.Now().Format("2006-01-02")
+	server.SendCommand(chatID, testAlice, "/asof "+today)
+	waitForText(t, server, chatID, " - @bob: -6.00 EUR")
+	server.SendCommand(chatID, testAlice, "/undo")
+	waitForText(t, server, chatID, fmt.Sprintf(UndoSuccessTemplate, fmt.Sprintf(AddOperationTemplate, "expense", 1)))
+	server.SendCommand(chatID, testBob, "/asof "+today)
+	waitForText(t, server, chatID, fmt.Sprintf(ErrAsOfNoExpensesTemplate, today))
+}
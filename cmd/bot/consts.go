@@ -1,5 +1,7 @@
 package main
 
+import "github.com/lucasmenendez/expensesbot/settler"
+
 const (
 	// commands
 	START_CMD           = "start"
@@ -10,59 +12,257 @@ const (
 	SUMMARY_CMD         = "summary"
 	IMPORT_CMD          = "import"
 	EXPORT_CMD          = "export"
+	CURRENCY_CMD        = "currency"
+	RATE_CMD            = "rate"
+	PAID_CMD            = "paid"
+	CANCEL_CMD          = "cancel"
+	EDIT_CMD            = "edit"
+	UNDO_CMD            = "undo"
+	REDO_CMD            = "redo"
+	HISTORY_CMD         = "history"
+	LEDGER_CMD          = "ledger"
+	STRATEGY_CMD        = "strategy"
+	CONSTRAINTS_CMD     = "constraints"
+	PARTICIPANTS_CMD    = "participants"
+	MERGE_CMD           = "merge"
+	ASOF_CMD            = "asof"
 	ADD_USER_CMD        = "adduser"
 	REMOVE_USER_CMD     = "removeuser"
 	LIST_USERS_CMD      = "listusers"
 	// descriptions
 	HELP_DESC            = "Shows this help."
-	ADD_EXPENSE_DESC     = "Adds an expense for you."
-	ADD_FOR_EXPENSE_DESC = "Adds an expense for another user."
+	ADD_EXPENSE_DESC     = "Adds an expense for you, step by step or in one line, e.g.: /add @alice,@bob 12.5 \"Lunch\""
+	ADD_FOR_EXPENSE_DESC = "Adds an expense for another user, step by step or in one line, e.g.: /addfor @bob @alice,@bob 12.5 \"Lunch\""
 	LIST_EXPENSES_DESC   = "Lists all the expenses with their IDs and allows to remove them."
-	SUMMARY_DESC         = "Shows a summary of current debs and allows to settle them."
-	EXPORT_DESC          = "Exports the current list of expenses to a file."
+	SUMMARY_DESC         = "Shows a summary of current debs and allows to settle them and archive the period, optionally with a label, e.g.: /summary Trip to Rome"
+	EXPORT_DESC          = "Exports the current list of expenses to a file, or an archived period, e.g.: /export 2"
 	IMPORT_DESC          = "Imports a list of expenses from a file."
+	CURRENCY_DESC        = "Shows or sets the base currency of the expenses, e.g.: /currency EUR"
+	RATE_DESC            = "Lists or sets the exchange rates to the base currency, e.g.: /rate USD 0.92"
+	PAID_DESC            = "Records that you paid back an amount to another user, e.g.: /paid @alice 25"
+	CANCEL_DESC          = "Cancels the command in progress."
+	EDIT_DESC            = "Changes the payer, participants, amount or description of an expense."
+	UNDO_DESC            = "Undoes the last change of the list of expenses."
+	REDO_DESC            = "Redoes the last change undone."
+	HISTORY_DESC         = "Lists the archived periods and shows their details."
+	LEDGER_DESC          = "Manages the ledgers of the chat, e.g.: /ledger new Lisbon trip, /ledger switch, /ledger list or /ledger close"
+	STRATEGY_DESC        = "Shows or sets how the debts are settled: greedy (fast) or exact (fewest transfers), e.g.: /strategy exact"
+	CONSTRAINTS_DESC     = "Lists or sets the restrictions to settle the debts, e.g.: /constraints forbid @alice @bob, /constraints via @alice @bob @carol, /constraints household @alice @bob, /constraints remove 1 or /constraints clear"
+	PARTICIPANTS_DESC    = "Lists the participants with their aliases or adds an alias to one, e.g.: /participants alias @alice Ali"
+	MERGE_DESC           = "Joins two participants that are the same person, moving the expenses of the first one to the second one, e.g.: /merge alice @alice"
+	ASOF_DESC            = "Shows the balances of the active ledger at a past date and time, e.g.: /asof 2024-03-03 or /asof 2024-03-03 18:30"
 	// messages
-	WelcomeMessage              = "👋🏻 Hello, I'm SettlerBot 🤖💶! Use /help to see the available commands."
-	RequestPayerPrompt          = "Type the payer username"
-	RequestParticipantsPrompt   = "Type the participants usernames"
-	RequestAmountMessage        = "How much was the expense? 💶"
-	SuccessInternalMessage      = "🎉 Done!"
-	ConfirmClearExpensesMessage = "Do you want to clear the list of expenses? 🗑️ 💸"
-	ExpensesClearedMessage      = "🎉 Ok, the list of expenses has been cleared."
-	RemoveExpenseMessage        = "Do you want to remove any expense? 🗑️ 💸"
-	SelectExpenseMessage        = "Select the expense to remove ➡️ 🗑️"
-	ExportFileMessage           = "Here is your export file 📄"
-	ImportAlertMessage          = "⚠️ Importing a file will overwrite the current list of expenses. Do you want to continue? ⚠️"
-	ImportFilePrompt            = "Send the .csv file to import."
+	WelcomeMessage            = "👋🏻 Hello, I'm SettlerBot 🤖💶! Use /help to see the available commands."
+	RequestPayerPrompt        = "Type the payer username"
+	RequestParticipantsPrompt = "Type the participants usernames"
+	RequestAmountMessage      = "How much was the expense? 💶"
+	RequestSplitMessage       = "How is the expense split? ➗"
+	RequestCurrencyMessage    = "Which currency was the expense in? 💱"
+	RequestSplitValuesPrompt  = "Type a value per participant"
+	RequestDescriptionPrompt  = "Type a short description"
+	RequestCategoryMessage    = "Which category is the expense? 🏷️"
+	SuccessInternalMessage    = "🎉 Done!"
+	ConfirmClosePeriodMessage = "Do you want to close this period? The expenses will be archived and a new list will start. 🗄️ 💸"
+	SelectPeriodMessage       = "Select a period to see its details 🔍"
+	SelectLedgerMessage       = "Select the ledger to use 📒"
+	RemoveExpenseMessage      = "Do you want to remove any expense? 🗑️ 💸"
+	SelectExpenseMessage      = "Select the expense to remove ➡️ 🗑️"
+	ExportFileMessage         = "Here is your export file 📄"
+	ImportAlertMessage        = "⚠️ Importing a file will overwrite the current list of expenses. Do you want to continue? ⚠️"
+	ImportFilePrompt          = "Send the .csv file to import."
+	CancelledMessage          = "Ok, cancelled. 👍🏻"
+	NothingToCancelMessage    = "There is nothing to cancel. 🤷🏻"
+	AllSettledMessage         = "🎉 All debts are settled!"
+	ConstraintsClearedMessage = "Ok, the debts are settled without constraints from now on. 👍🏻"
+	SelectEditExpenseMessage  = "Which expense do you want to edit? ✏️"
+	SelectEditFieldMessage    = "What do you want to change? ✏️"
+	EditSplitResetMessage     = "⚠️ The split does not fit the change, so it was reset to equal. Remove the expense and add it again to split it otherwise."
 	// headers
-	HelpHeader         = "Available commands ❓:"
-	ListExpensesHeader = "Current list of expenses 💸:"
-	BalancesHeader     = "Current participant balances 💰:"
-	SummaryHeader      = "\nSuggestions for debt settlement transactions 🔄:"
-	UserListHeader     = "Allowed users:"
+	HelpHeader            = "Available commands ❓:"
+	ListExpensesHeader    = "Current list of expenses 💸:"
+	BalancesHeader        = "Current participant balances 💰:"
+	SummaryHeader         = "\nSuggestions for debt settlement transactions 🔄:"
+	UserListHeader        = "Allowed users:"
+	RatesHeader           = "Current exchange rates 💱:"
+	PaymentsHeader        = "\nPayments made 💸:"
+	HistoryHeader         = "Archived periods 🗄️:"
+	PeriodExpensesHeader  = "Expenses 💸:"
+	PeriodBalancesHeader  = "\nFinal balances 💰:"
+	PeriodTransfersHeader = "\nSuggested transfers 🔄:"
+	LedgersHeader         = "Ledgers of this chat 📒:"
+	ConstraintsHeader     = "Settlement constraints 🚧:"
+	ParticipantsHeader    = "Participants 👥:"
 	// templates
-	ImportFileTemplate          = "@%s, send me the file to import, please! 📄"
-	ImportDoneTemplate          = "%d expense(s) imported succesfully 📄✅"
-	RequestPayerTemplate        = "@%s, Who paid the expense? 🤔"
-	RequestParticipantsTemplate = "@%s, Who participated in the expense? 🤔"
-	HelperCommandTemplate       = " /%s: %s"
-	AddSuccessTemplate          = "Ok, so %s paid %.2f for %s. 👍🏻"
-	RemoveSuccessTemplate       = "Ok, expense %d removed. 👍🏻"
-	BalanceItemTemplate         = " - %s: %.2f"
-	ExpenseItemTemplate         = " %d. %s paid %.2f for %s"
-	SummaryItemTemplate         = " - %s must pay %.2f to %s"
-	UserItemTemplate            = " - %s (%d)"
+	ImportFileTemplate               = "@%s, send me the file to import, please! 📄"
+	ImportDoneTemplate               = "%d expense(s) imported succesfully 📄✅"
+	RequestPayerTemplate             = "@%s, Who paid the expense? 🤔"
+	RequestParticipantsTemplate      = "@%s, Who participated in the expense? 🤔"
+	RequestOtherParticipantsTemplate = "@%s, Who else participated in the expense? 🤔"
+	RequestDescriptionTemplate       = "@%s, What was the expense for? 📝"
+	RequestSplitValuesTemplate       = "@%s, type the %s of each participant in this order, separated by spaces: %s"
+	HelperCommandTemplate            = " /%s: %s"
+	AddSuccessTemplate               = "Ok, so %s paid %s for %s. 👍🏻"
+	RemoveSuccessTemplate            = "Ok, expense %d removed. 👍🏻"
+	BalanceItemTemplate              = " - %s: %s"
+	ExpenseItemTemplate              = " %d. %s paid %s for %s"
+	ExpenseDetailsTemplate           = "\n      %s"
+	SummaryItemTemplate              = " - %s must pay %s to %s"
+	PaymentItemTemplate              = " - %s paid %s to %s"
+	PaidSuccessTemplate              = "Ok, so %s paid %s to %s. 👍🏻"
+	UserItemTemplate                 = " - %s (%d)"
+	ParticipantShareTemplate         = "%s (%s)"
+	OriginalBalanceTemplate          = " (%s)"
+	RateItemTemplate                 = " - 1 %s = %s %s"
+	RateSetTemplate                  = "Ok, 1 %s = %s %s from now on. 💱"
+	CurrentCurrencyTemplate          = "The base currency is %s. 💱"
+	CurrencySetTemplate              = "Ok, the base currency is %s from now on. 💱"
+	EditSuccessTemplate              = "✏️ @%s edited the expense %d:"
+	EditDiffItemTemplate             = " - %s: %s ➡️ %s"
+	EditExpenseButtonTemplate        = "%d. %s (%s)"
+	UndoSuccessTemplate              = "↩️ Ok, undone: %s."
+	RedoSuccessTemplate              = "↪️ Ok, redone: %s."
+	AddOperationTemplate             = "%s %d added"
+	RemoveOperationTemplate          = "%s %d removed"
+	EditOperationTemplate            = "expense %d edited"
+	CleanOperationTemplate           = "list of %d transaction(s) cleared"
+	CloseOperationTemplate           = "closing of the period \"%s\""
+	PeriodClosedTemplate             = "🎉 Ok, the period \"%s\" has been archived. Use /history to see it or /undo to reopen it."
+	HistoryItemTemplate              = " %d. %s, closed on %s: %d expense(s), %d payment(s)"
+	PeriodHeaderTemplate             = "🗄️ %s, closed on %s\n"
+	PeriodExportTemplate             = "\nUse /export %d to download it. 📄"
+	LedgerItemTemplate               = " - %s"
+	ActiveLedgerItemTemplate         = " - %s ✅"
+	LedgerCreatedTemplate            = "📒 Ok, the ledger \"%s\" has been created and it is the active one now."
+	LedgerSwitchedTemplate           = "📒 Ok, the active ledger is \"%s\" now."
+	ConfirmCloseLedgerTemplate       = "Do you want to close the ledger \"%s\"? Its expenses will be deleted, use /export before to keep them. 🗑️"
+	LedgerClosedTemplate             = "🗑️ Ok, the ledger \"%s\" has been closed."
+	CurrentStrategyTemplate          = "The debts are settled with the %s strategy. 🔄"
+	StrategySetTemplate              = "Ok, the debts are settled with the %s strategy from now on. 🔄"
+	ConstraintItemTemplate           = " %d. %s"
+	ForbiddenConstraintTemplate      = "%s can't pay %s directly"
+	IntermediaryConstraintTemplate   = "%s pays %s through %s"
+	HouseholdConstraintTemplate      = "%s settle as a household"
+	ConstraintAddedTemplate          = "🚧 Ok, from now on %s."
+	ConstraintRemovedTemplate        = "Ok, constraint %d removed. 👍🏻"
+	ParticipantItemTemplate          = " - %s"
+	ParticipantDisplayNameTemplate   = " (%s)"
+	ParticipantAliasesTemplate       = ", also known as %s"
+	AliasAddedTemplate               = "👥 Ok, %s is also known as %s from now on."
+	MergeSuccessTemplate             = "🔀 Ok, %s and %s are the same person now, %d transaction(s) updated. Use /undo to revert it."
+	MergeOperationTemplate           = "merge of %s into %s"
+	ImportOperationTemplate          = "import of %d transaction(s)"
+	AsOfHeaderTemplate               = "🕰️ As of %s:\n"
 	// buttons
 	ConfirmYesButton = "✅ Yes"
 	ConfirmNoButton  = "❌ No"
 	CancelButton     = "❌ Cancel"
+	// MarkAsPaidButtonTemplate is the label of the buttons to mark a suggested
+	// transaction as paid
+	MarkAsPaidButtonTemplate = "✅ %s paid %s"
+	// split buttons
+	SplitEqualButton      = "🟰 Equally"
+	SplitSharesButton     = "🍰 By shares"
+	SplitPercentageButton = "💯 By percentage"
+	SplitExactButton      = "🎯 Exact amounts"
+	// category buttons
+	NoCategoryButton = "➖ No category"
+	// participant picker buttons
+	OtherParticipantsButton = "✏️ Others"
+	AllParticipantsButton   = "👥 All"
+	DoneParticipantsButton  = "➡️ Done"
+	// edit buttons, also used as the names of the fields in the edit diffs
+	EditPayerButton        = "💳 Payer"
+	EditParticipantsButton = "👥 Participants"
+	EditAmountButton       = "💶 Amount"
+	EditDescriptionButton  = "📝 Description"
+	EditSplitLabel         = "➗ Split"
 	// errors
-	ErrInvalidArguments         = "❌ Invalid arguments."
-	ErrInternalProcess          = "☠️ Internal process error."
-	ErrAddInvalidArguments      = "Sorry 😕, I can understand your message. Please use the format: /add @participant1,@participant2 12.5"
-	ErrAddForInvalidArguments   = "Sorry 😕, I can understand your message. Please use the format: /addfor @payer @participant1,@participant2 12.5"
-	ErrRemoveInvalidArguments   = "Sorry 😕, I can understand your message. Please use the format: /remove 29"
-	ErrProcesingRequestTemplate = "Sorry 😕, I can't process your request right now. Please try again later: %s"
-	ErrNoExpenses               = "Sorry 😕, there are no expenses yet. Use /add or /addfor to add a new expense."
-	ErrInvalidImportFile        = "❌ Invalid import file."
+	ErrInvalidArguments                 = "❌ Invalid arguments."
+	ErrInternalProcess                  = "☠️ Internal process error."
+	ErrAddArgumentTemplate              = "Sorry 😕, I can't understand \"%s\" (argument %d): %s. Please use the format: /add @participant1,@participant2 12.5 \"Lunch\" shares:1,2"
+	ErrAddForArgumentTemplate           = "Sorry 😕, I can't understand \"%s\" (argument %d): %s. Please use the format: /addfor @payer @participant1,@participant2 12.5 \"Lunch\" shares:1,2"
+	ErrRemoveInvalidArguments           = "Sorry 😕, I can understand your message. Please use the format: /remove 29"
+	ErrProcesingRequestTemplate         = "Sorry 😕, I can't process your request right now. Please try again later: %s"
+	ErrNoExpenses                       = "Sorry 😕, there are no expenses yet. Use /add or /addfor to add a new expense."
+	ErrInvalidImportFile                = "❌ Invalid import file."
+	ErrExpenseNotFound                  = "Sorry 😕, that expense does not exist anymore."
+	ErrNothingToUndo                    = "There is nothing to undo. 🤷🏻"
+	ErrNothingToRedo                    = "There is nothing to redo. 🤷🏻"
+	ErrNoHistory                        = "There are no archived periods yet. Close one after the /summary to archive it. 🗄️"
+	ErrPeriodNotFound                   = "Sorry 😕, that period does not exist. Use /history to see the archived ones."
+	ErrExportInvalidArguments           = "Sorry 😕, I can understand your message. Please use the format: /export or /export 2"
+	ErrHistoryInvalidArguments          = "Sorry 😕, I can understand your message. Please use the format: /history or /history 2"
+	ErrLedgerInvalidArguments           = "Sorry 😕, I can understand your message. Please use the format: /ledger new Lisbon trip, /ledger switch Lisbon trip, /ledger list or /ledger close Lisbon trip"
+	ErrInvalidLedgerNameTemplate        = "Sorry 😕, the name of the ledger must have up to %d characters."
+	ErrLedgerExistsTemplate             = "Sorry 😕, there is already a ledger called \"%s\"."
+	ErrLedgerNotFoundTemplate           = "Sorry 😕, there is no ledger called \"%s\". Use /ledger list to see them."
+	ErrStrategyInvalidArguments         = "Sorry 😕, I can understand your message. Please use the format: /strategy greedy or /strategy exact"
+	ErrConstraintsInvalidArguments      = "Sorry 😕, I can understand your message. Please use the format: /constraints forbid @alice @bob, /constraints via @alice @bob @carol, /constraints household @alice @bob, /constraints remove 1 or /constraints clear"
+	ErrNoConstraints                    = "There are no settlement constraints. Use /constraints forbid @alice @bob to add one. 🚧"
+	ErrConstraintNotFound               = "Sorry 😕, that constraint does not exist. Use /constraints to see them."
+	ErrInvalidConstraintTemplate        = "Sorry 😕, the constraint is not valid: %s"
+	ErrUnsatisfiableConstraintsTemplate = "Sorry 😕, I can't settle the debts: %s. Use /constraints to change them."
+	ErrNoParticipants                   = "There are no participants yet. Use /add to add an expense. 👥"
+	ErrParticipantsInvalidArguments     = "Sorry 😕, I can understand your message. Please use the format: /participants or /participants alias @alice Ali"
+	ErrAliasTemplate                    = "Sorry 😕, I can't add the alias: %s"
+	ErrMergeInvalidArguments            = "Sorry 😕, I can understand your message. Please use the format: /merge alice @alice"
+	ErrMergeTemplate                    = "Sorry 😕, I can't merge the participants: %s"
+	ErrInvalidPayer                     = "Sorry 😕, type the username of a single payer."
+	ErrInvalidParticipants              = "Sorry 😕, type the usernames of the participants separated by spaces."
+	ErrNoParticipantsSelected           = "Sorry 😕, select at least one participant."
+	ErrInvalidAmount                    = "Sorry 😕, that is not a valid amount, try again."
+	ErrInvalidDescriptionTemplate       = "Sorry 😕, type a description of up to %d characters."
+	ErrInvalidSplitTemplate             = "Sorry 😕, I can't understand the split: %s"
+	ErrInvalidExpenseTemplate           = "Sorry 😕, the expense is not valid: %s"
+	ErrMissingRateTemplate              = "Sorry 😕, I can't convert the balances: %s. Use /rate to set it."
+	ErrNoRates                          = "There are no exchange rates yet. Use /rate USD 0.92 to set one."
+	ErrCurrencyInvalidArguments         = "Sorry 😕, I can understand your message. Please use the format: /currency EUR"
+	ErrPaidInvalidArguments             = "Sorry 😕, I can understand your message. Please use the format: /paid @participant 25"
+	ErrInvalidPaymentTemplate           = "Sorry 😕, the payment is not valid: %s"
+	ErrRateInvalidArguments             = "Sorry 😕, I can understand your message. Please use the format: /rate USD 0.92 or /rate USD GBP 0.79"
+	ErrAsOfInvalidArguments             = "Sorry 😕, I can understand your message. Please use the format: /asof 2024-03-03 or /asof 2024-03-03 18:30"
+	ErrAsOfDisabled                     = "Sorry 😕, the past balances are not available because the event log is disabled."
+	ErrAsOfNoExpensesTemplate           = "There were no expenses as of %s. 🤷🏻"
+)
+
+// reasons of the errors of the arguments of /add and /addfor
+const (
+	ArgUnclosedQuote               = "the quote is not closed"
+	ArgRepeatedDescription         = "there is already a description"
+	ArgInvalidDescriptionTemplate  = "the description must have up to %d characters"
+	ArgUnknownSplitMode            = "the split must be equal, shares, percentage or exact"
+	ArgRepeatedSplit               = "there is already a split"
+	ArgEqualSplitValues            = "the equal split has no values"
+	ArgSplitWithoutParticipants    = "the split needs the participants"
+	ArgRepeatedAmount              = "there is already an amount"
+	ArgInvalidAmount               = "it is not a valid amount"
+	ArgRepeatedParticipantTemplate = "%s is repeated"
+)
+
+// names of the values of each split mode used in the messages
+var splitValuesNames = map[settler.SplitMode]string{
+	settler.SplitShares:     "shares",
+	settler.SplitPercentage: "percentage",
+	settler.SplitExact:      "exact amount",
+}
+
+// labels of each split mode used in the messages
+var splitModeLabels = map[settler.SplitMode]string{
+	settler.SplitEqual:      SplitEqualButton,
+	settler.SplitShares:     SplitSharesButton,
+	settler.SplitPercentage: SplitPercentageButton,
+	settler.SplitExact:      SplitExactButton,
+}
+
+// categories of the expenses and their labels
+var (
+	expenseCategories = []string{"food", "housing", "transport", "leisure", "shopping", "other"}
+	categoryLabels    = map[string]string{
+		"food":      "🍽️ Food",
+		"housing":   "🏠 Housing",
+		"transport": "🚗 Transport",
+		"leisure":   "🎉 Leisure",
+		"shopping":  "🛍️ Shopping",
+		"other":     "📦 Other",
+	}
 )
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucasmenendez/expensesbot/bot"
+	"github.com/lucasmenendez/expensesbot/settler"
+)
+
+const (
+	// conversation flows
+	addExpenseFlow    = "add"
+	addForExpenseFlow = "addfor"
+	importFlow        = "import"
+	editFlow          = "edit"
+	// states of the add expense flows, also used as keys of their values
+	payerState             = "payer"
+	participantState       = "participants"
+	otherParticipantsState = "other_participants"
+	amountState            = "amount"
+	currencyState          = "currency"
+	descriptionState       = "description"
+	categoryState          = "category"
+	splitState             = "split"
+	splitValuesState       = "split_values"
+	// states of the import flow
+	fileState    = "file"
+	confirmState = "confirm"
+	// states of the edit flow
+	expenseState = "expense"
+	fieldState   = "field"
+	// keys of other values of the flows
+	csvKey                = "csv"
+	participantOptionsKey = "participant_options"
+	pickOthersKey         = "pick_others"
+	// values of the confirmation buttons
+	confirmYes = "1"
+	confirmNo  = "0"
+	// value of the button to skip the category
+	noCategory = "none"
+	// value of the button to type other participants in the participant
+	// picker
+	otherParticipants = "other"
+	// maxPickerParticipants is the maximum number of persons shown in the
+	// participant picker, the rest can be typed
+	maxPickerParticipants = 24
+	// maxDescriptionLength is the maximum number of characters of the
+	// descriptions of the expenses
+	maxDescriptionLength = 100
+	// maxLedgerNameLength is the maximum number of characters of the names of
+	// the ledgers
+	maxLedgerNameLength = 32
+)
+
+// registerFlows registers the conversation flows of the commands in the bot
+// provided.
+func registerFlows(b *bot.Bot) {
+	b.AddFlow(newAddExpenseFlow(addExpenseFlow, participantState))
+	b.AddFlow(newAddExpenseFlow(addForExpenseFlow, payerState))
+	b.AddFlow(newImportFlow())
+	b.AddFlow(newEditFlow())
+}
+
+// chatSettler returns the settler of the chat provided.
+func chatSettler(b *bot.Bot, chatID int64) (*settler.Settler, error) {
+	s, ok := b.GetChatSession(chatID, newSettler()).(*settler.Settler)
+	if !ok {
+		return nil, fmt.Errorf("error getting settler")
+	}
+	return s, nil
+}
+
+// goTo returns a Next function of a step that always goes to the state
+// provided.
+func goTo(state string) func(*bot.Bot, *bot.Conversation) string {
+	return func(*bot.Bot, *bot.Conversation) string { return state }
+}
+
+// skipIfSet sets the step provided to be skipped when the conversation
+// already has a value for the state provided, even if it is empty, and
+// returns it.
+func skipIfSet(state string, step *bot.Step) *bot.Step {
+	step.Skip = func(_ *bot.Bot, c *bot.Conversation) bool {
+		_, ok := c.Values[state]
+		return ok
+	}
+	return step
+}
+
+// payerStep returns the step that asks for the payer of an expense and goes
+// to the state provided.
+func payerStep(next string) *bot.Step {
+	return &bot.Step{
+		Input:       bot.InputText,
+		Placeholder: RequestPayerPrompt,
+		Prompt: func(_ *bot.Bot, c *bot.Conversation) string {
+			return fmt.Sprintf(RequestPayerTemplate, c.Username)
+		},
+		Validate: func(b *bot.Bot, c *bot.Conversation, input bot.Input) error {
+			s, err := chatSettler(b, c.ChatID)
+			if err != nil {
+				return err
+			}
+			fields := messageFields(s, input.Message, input.Text)
+			if len(fields) != 1 {
+				return errors.New(ErrInvalidPayer)
+			}
+			c.Set(payerState, s.ResolveParticipant(fields[0]))
+			return nil
+		},
+		Next: goTo(next),
+	}
+}
+
+// participantsStep returns the step that asks for the participants of an
+// expense with the prompt template provided and goes to the state provided.
+// The typed participants are added to the ones already selected, if any.
+func participantsStep(template, next string) *bot.Step {
+	return &bot.Step{
+		Input:       bot.InputText,
+		Placeholder: RequestParticipantsPrompt,
+		Prompt: func(_ *bot.Bot, c *bot.Conversation) string {
+			return fmt.Sprintf(template, c.Username)
+		},
+		Validate: func(b *bot.Bot, c *bot.Conversation, input bot.Input) error {
+			s, err := chatSettler(b, c.ChatID)
+			if err != nil {
+				return err
+			}
+			typed := messageFields(s, input.Message, input.Text)
+			if len(typed) == 0 {
+				return errors.New(ErrInvalidParticipants)
+			}
+			participants := strings.Fields(c.Get(participantState))
+			for _, participant := range resolveParticipants(s, typed) {
+				if !slices.Contains(participants, participant) {
+					participants = append(participants, participant)
+				}
+			}
+			c.Set(participantState, strings.Join(participants, " "))
+			return nil
+		},
+		Next: goTo(next),
+	}
+}
+
+// participantPickerStep returns the step that asks for the participants of
+// an expense with a menu of the persons known by the chat and goes to the
+// state provided, or to the state that asks for other participants if the
+// option to type them is selected.
+func participantPickerStep(next string) *bot.Step {
+	return &bot.Step{
+		Input: bot.InputMultiChoice,
+		Prompt: func(_ *bot.Bot, c *bot.Conversation) string {
+			return fmt.Sprintf(RequestParticipantsTemplate, c.Username)
+		},
+		Options: func(b *bot.Bot, c *bot.Conversation) ([][]string, [][]string, error) {
+			persons, err := pickerPersons(b, c)
+			if err != nil {
+				return nil, nil, err
+			}
+			// the values are the indexes of the persons, their names can be
+			// longer than the data of the buttons allows
+			buttonsPerRow := 3
+			labels, values := [][]string{}, [][]string{}
+			for i, person := range persons {
+				if i%buttonsPerRow == 0 {
+					labels = append(labels, []string{})
+					values = append(values, []string{})
+				}
+				labels[len(labels)-1] = append(labels[len(labels)-1], person)
+				values[len(values)-1] = append(values[len(values)-1], strconv.Itoa(i))
+			}
+			labels = append(labels, []string{OtherParticipantsButton, AllParticipantsButton, DoneParticipantsButton})
+			values = append(values, []string{otherParticipants, bot.MultiChoiceAll, bot.MultiChoiceDone})
+			return labels, values, nil
+		},
+		Validate: func(b *bot.Bot, c *bot.Conversation, input bot.Input) error {
+			persons, err := pickerPersons(b, c)
+			if err != nil {
+				return err
+			}
+			participants, others := []string{}, false
+			for _, value := range strings.Split(input.Text, bot.MultiChoiceSeparator) {
+				if value == otherParticipants {
+					others = true
+					continue
+				}
+				if i, err := strconv.Atoi(value); err == nil && i >= 0 && i < len(persons) {
+					participants = append(participants, persons[i])
+				}
+			}
+			if len(participants) == 0 && !others {
+				return errors.New(ErrNoParticipantsSelected)
+			}
+			c.Set(participantState, strings.Join(participants, " "))
+			c.Set(pickOthersKey, strconv.FormatBool(others))
+			return nil
+		},
+		Next: func(_ *bot.Bot, c *bot.Conversation) string {
+			if c.Get(pickOthersKey) == strconv.FormatBool(true) {
+				return otherParticipantsState
+			}
+			return next
+		},
+	}
+}
+
+// pickerPersons returns the persons of the participant picker of the
+// conversation provided: the sender first, who is registered in the
+// directory of the chat, and the rest of known persons sorted, up to
+// maxPickerParticipants. They are stored in the conversation the first time,
+// so the options of the menu do not change while it is open.
+func pickerPersons(b *bot.Bot, c *bot.Conversation) ([]string, error) {
+	if persons := c.Get(participantOptionsKey); persons != "" {
+		return strings.Fields(persons), nil
+	}
+	s, err := chatSettler(b, c.ChatID)
+	if err != nil {
+		return nil, err
+	}
+	sender := s.RegisterUser(c.UserID, c.Username, c.FirstName)
+	persons := []string{sender}
+	for _, person := range s.ListPersons() {
+		if person != sender && len(persons) < maxPickerParticipants {
+			persons = append(persons, person)
+		}
+	}
+	c.Set(participantOptionsKey, strings.Join(persons, " "))
+	return persons, nil
+}
+
+// amountStep returns the step that asks for the amount of an expense with a
+// numpad and goes to the state provided.
+func amountStep(next string) *bot.Step {
+	return &bot.Step{
+		Input: bot.InputKeypad,
+		Prompt: func(*bot.Bot, *bot.Conversation) string {
+			return RequestAmountMessage
+		},
+		Options: func(*bot.Bot, *bot.Conversation) ([][]string, [][]string, error) {
+			labels, values := numPad()
+			return labels, values, nil
+		},
+		Validate: func(_ *bot.Bot, c *bot.Conversation, input bot.Input) error {
+			amount, err := settler.ParseMoney(input.Text)
+			if err != nil || amount.Units <= 0 {
+				return errors.New(ErrInvalidAmount)
+			}
+			c.Set(amountState, input.Text)
+			return nil
+		},
+		Next: goTo(next),
+	}
+}
+
+// descriptionStep returns the step that asks for the description of an
+// expense and goes to the state provided.
+func descriptionStep(next string) *bot.Step {
+	return &bot.Step{
+		Input:       bot.InputText,
+		Placeholder: RequestDescriptionPrompt,
+		Prompt: func(_ *bot.Bot, c *bot.Conversation) string {
+			return fmt.Sprintf(RequestDescriptionTemplate, c.Username)
+		},
+		Validate: func(_ *bot.Bot, c *bot.Conversation, input bot.Input) error {
+			description := strings.TrimSpace(input.Text)
+			if description == "" || len([]rune(description)) > maxDescriptionLength {
+				return fmt.Errorf(ErrInvalidDescriptionTemplate, maxDescriptionLength)
+			}
+			c.Set(descriptionState, description)
+			return nil
+		},
+		Next: goTo(next),
+	}
+}
+
+// newAddExpenseFlow returns the flow that asks for the payer, if it starts
+// with it, the participants, the amount, the currency, the description, the
+// category and the split of an expense and adds it to the settler of the
+// chat. The currency is only asked if the settler has exchange rates. The
+// values provided when the conversation starts are not asked.
+func newAddExpenseFlow(name, start string) *bot.Flow {
+	return &bot.Flow{
+		Name:  name,
+		Start: start,
+		Steps: map[string]*bot.Step{
+			payerState:             skipIfSet(payerState, payerStep(participantState)),
+			participantState:       skipIfSet(participantState, participantPickerStep(amountState)),
+			otherParticipantsState: participantsStep(RequestOtherParticipantsTemplate, amountState),
+			amountState:            skipIfSet(amountState, amountStep(currencyState)),
+			currencyState: {
+				Input: bot.InputChoice,
+				Prompt: func(*bot.Bot, *bot.Conversation) string {
+					return RequestCurrencyMessage
+				},
+				Options: func(b *bot.Bot, c *bot.Conversation) ([][]string, [][]string, error) {
+					s, err := chatSettler(b, c.ChatID)
+					if err != nil {
+						return nil, nil, err
+					}
+					buttonsPerRow := 4
+					labels := [][]string{}
+					for i, currency := range s.Currencies() {
+						if i%buttonsPerRow == 0 {
+							labels = append(labels, []string{})
+						}
+						labels[len(labels)-1] = append(labels[len(labels)-1], currency)
+					}
+					return labels, labels, nil
+				},
+				Next: goTo(descriptionState),
+				// skip the currency if it is provided or there is only one
+				Skip: func(b *bot.Bot, c *bot.Conversation) bool {
+					if _, ok := c.Values[currencyState]; ok {
+						return true
+					}
+					if s, err := chatSettler(b, c.ChatID); err == nil {
+						if currencies := s.Currencies(); len(currencies) == 1 {
+							c.Set(currencyState, currencies[0])
+							return true
+						}
+					}
+					return false
+				},
+			},
+			descriptionState: skipIfSet(descriptionState, descriptionStep(categoryState)),
+			categoryState: skipIfSet(categoryState, &bot.Step{
+				Input: bot.InputChoice,
+				Prompt: func(*bot.Bot, *bot.Conversation) string {
+					return RequestCategoryMessage
+				},
+				Options: func(*bot.Bot, *bot.Conversation) ([][]string, [][]string, error) {
+					buttonsPerRow := 3
+					labels, values := [][]string{}, [][]string{}
+					for i, category := range expenseCategories {
+						if i%buttonsPerRow == 0 {
+							labels = append(labels, []string{})
+							values = append(values, []string{})
+						}
+						labels[len(labels)-1] = append(labels[len(labels)-1], categoryLabels[category])
+						values[len(values)-1] = append(values[len(values)-1], category)
+					}
+					labels = append(labels, []string{NoCategoryButton})
+					values = append(values, []string{noCategory})
+					return labels, values, nil
+				},
+				Next: goTo(splitState),
+			}),
+			splitState: skipIfSet(splitState, &bot.Step{
+				Input: bot.InputChoice,
+				Prompt: func(*bot.Bot, *bot.Conversation) string {
+					return RequestSplitMessage
+				},
+				Options: func(*bot.Bot, *bot.Conversation) ([][]string, [][]string, error) {
+					labels := [][]string{
+						{SplitEqualButton, SplitSharesButton},
+						{SplitPercentageButton, SplitExactButton},
+					}
+					values := [][]string{
+						{string(settler.SplitEqual), string(settler.SplitShares)},
+						{string(settler.SplitPercentage), string(settler.SplitExact)},
+					}
+					return labels, values, nil
+				},
+				Validate: func(_ *bot.Bot, c *bot.Conversation, input bot.Input) error {
+					if _, err := settler.ParseSplitMode(input.Text); err != nil {
+						return fmt.Errorf(ErrInvalidSplitTemplate, err)
+					}
+					c.Set(splitState, input.Text)
+					return nil
+				},
+				Next: func(_ *bot.Bot, c *bot.Conversation) string {
+					if settler.SplitMode(c.Get(splitState)) == settler.SplitEqual {
+						return bot.ConversationEnd
+					}
+					return splitValuesState
+				},
+			}),
+			splitValuesState: skipIfSet(splitValuesState, &bot.Step{
+				Input:       bot.InputText,
+				Placeholder: RequestSplitValuesPrompt,
+				Prompt: func(_ *bot.Bot, c *bot.Conversation) string {
+					mode := settler.SplitMode(c.Get(splitState))
+					return fmt.Sprintf(RequestSplitValuesTemplate, c.Username,
+						splitValuesNames[mode], c.Get(participantState))
+				},
+				Validate: func(_ *bot.Bot, c *bot.Conversation, input bot.Input) error {
+					mode := settler.SplitMode(c.Get(splitState))
+					participants := strings.Fields(c.Get(participantState))
+					if _, err := parseSplitValues(mode, participants, input.Text); err != nil {
+						return fmt.Errorf(ErrInvalidSplitTemplate, err)
+					}
+					c.Set(splitValuesState, input.Text)
+					return nil
+				},
+			}),
+		},
+		Done: func(b *bot.Bot, c *bot.Conversation) error {
+			amount, err := settler.ParseMoney(c.Get(amountState))
+			if err != nil {
+				return err
+			}
+			amount.Currency = c.Get(currencyState)
+			participants := strings.Fields(c.Get(participantState))
+			var split *settler.Split
+			if mode := settler.SplitMode(c.Get(splitState)); mode != settler.SplitEqual {
+				if split, err = parseSplitValues(mode, participants, c.Get(splitValuesState)); err != nil {
+					return err
+				}
+			}
+			s, err := chatSettler(b, c.ChatID)
+			if err != nil {
+				return err
+			}
+			// the sender is the payer if no other is provided
+			sender := s.RegisterUser(c.UserID, c.Username, c.FirstName)
+			payer := c.Get(payerState)
+			if payer == "" {
+				payer = sender
+			}
+			category := c.Get(categoryState)
+			if category == noCategory {
+				category = ""
+			}
+			addExpense(b, c.ChatID, &settler.Transaction{
+				Payer:        payer,
+				Participants: participants,
+				Amount:       amount,
+				Split:        split,
+				Description:  c.Get(descriptionState),
+				Date:         time.Now(),
+				Category:     category,
+				CreatedBy:    sender,
+			})
+			return nil
+		},
+	}
+}
+
+// newImportFlow returns the flow that asks for a CSV file of expenses and
+// imports it into the settler of the chat. If the settler is not empty, it
+// asks for confirmation before overwriting its transactions.
+func newImportFlow() *bot.Flow {
+	return &bot.Flow{
+		Name:  importFlow,
+		Start: fileState,
+		Steps: map[string]*bot.Step{
+			fileState: {
+				Input:       bot.InputDocument,
+				Placeholder: ImportFilePrompt,
+				Prompt: func(_ *bot.Bot, c *bot.Conversation) string {
+					return fmt.Sprintf(ImportFileTemplate, c.Username)
+				},
+				Validate: func(b *bot.Bot, c *bot.Conversation, input bot.Input) error {
+					if input.Document == nil {
+						return errors.New(ErrInvalidImportFile)
+					}
+					content, err := b.DownloadFile(input.Document.ID)
+					if err != nil {
+						return errors.New(ErrInvalidImportFile)
+					}
+					if _, err := settler.DecodeCSV(content); err != nil {
+						return errors.New(ErrInvalidImportFile)
+					}
+					c.Set(csvKey, string(content))
+					return nil
+				},
+				Next: func(b *bot.Bot, c *bot.Conversation) string {
+					s, err := chatSettler(b, c.ChatID)
+					if err != nil {
+						return bot.ConversationEnd
+					}
+					if !s.IsEmpty() {
+						return confirmState
+					}
+					return bot.ConversationEnd
+				},
+			},
+			confirmState: {
+				Input: bot.InputChoice,
+				Prompt: func(*bot.Bot, *bot.Conversation) string {
+					return ImportAlertMessage
+				},
+				Options: func(*bot.Bot, *bot.Conversation) ([][]string, [][]string, error) {
+					labels := [][]string{{ConfirmYesButton, ConfirmNoButton}}
+					values := [][]string{{confirmYes, confirmNo}}
+					return labels, values, nil
+				},
+			},
+		},
+		Done: func(b *bot.Bot, c *bot.Conversation) error {
+			if c.Get(confirmState) == confirmNo {
+				return nil
+			}
+			expenses, err := settler.DecodeCSV([]byte(c.Get(csvKey)))
+			if err != nil {
+				return err
+			}
+			s, err := chatSettler(b, c.ChatID)
+			if err != nil {
+				return err
+			}
+			if err := s.Import(expenses); err != nil {
+				_, err := b.SendMessage(c.ChatID, 0, fmt.Sprintf(ErrInvalidExpenseTemplate, err))
+				return err
+			}
+			_, err = b.SendMessage(c.ChatID, 0, fmt.Sprintf(ImportDoneTemplate, len(expenses)))
+			return err
+		},
+	}
+}
+
+// newEditFlow returns the flow that asks for an expense of the chat, the
+// field to change and its new value, and updates the expense in the settler
+// of the chat announcing the changes.
+func newEditFlow() *bot.Flow {
+	return &bot.Flow{
+		Name:  editFlow,
+		Start: expenseState,
+		Steps: map[string]*bot.Step{
+			expenseState: {
+				Input: bot.InputChoice,
+				Prompt: func(*bot.Bot, *bot.Conversation) string {
+					return SelectEditExpenseMessage
+				},
+				Options: func(b *bot.Bot, c *bot.Conversation) ([][]string, [][]string, error) {
+					s, err := chatSettler(b, c.ChatID)
+					if err != nil {
+						return nil, nil, err
+					}
+					expenses, ids := s.ListExpenses()
+					labels, values := [][]string{}, [][]string{}
+					for i, expense := range expenses {
+						label := fmt.Sprintf(EditExpenseButtonTemplate, ids[i], expense.Payer, expense.Amount)
+						if expense.Description != "" {
+							label = fmt.Sprintf(EditExpenseButtonTemplate, ids[i], expense.Description, expense.Amount)
+						}
+						labels = append(labels, []string{label})
+						values = append(values, []string{strconv.Itoa(ids[i])})
+					}
+					return labels, values, nil
+				},
+				Validate: func(b *bot.Bot, c *bot.Conversation, input bot.Input) error {
+					s, err := chatSettler(b, c.ChatID)
+					if err != nil {
+						return err
+					}
+					id, err := strconv.Atoi(input.Text)
+					if err != nil {
+						return errors.New(ErrExpenseNotFound)
+					}
+					if _, ok := s.GetExpense(id); !ok {
+						return errors.New(ErrExpenseNotFound)
+					}
+					c.Set(expenseState, input.Text)
+					return nil
+				},
+				Next: goTo(fieldState),
+			},
+			fieldState: {
+				Input: bot.InputChoice,
+				Prompt: func(*bot.Bot, *bot.Conversation) string {
+					return SelectEditFieldMessage
+				},
+				Options: func(*bot.Bot, *bot.Conversation) ([][]string, [][]string, error) {
+					labels := [][]string{
+						{EditPayerButton, EditParticipantsButton},
+						{EditAmountButton, EditDescriptionButton},
+					}
+					values := [][]string{
+						{payerState, participantState},
+						{amountState, descriptionState},
+					}
+					return labels, values, nil
+				},
+				Next: func(_ *bot.Bot, c *bot.Conversation) string {
+					return c.Get(fieldState)
+				},
+			},
+			payerState:       payerStep(bot.ConversationEnd),
+			participantState: participantsStep(RequestParticipantsTemplate, bot.ConversationEnd),
+			amountState:      amountStep(bot.ConversationEnd),
+			descriptionState: descriptionStep(bot.ConversationEnd),
+		},
+		Done: func(b *bot.Bot, c *bot.Conversation) error {
+			id, err := strconv.Atoi(c.Get(expenseState))
+			if err != nil {
+				return err
+			}
+			s, err := chatSettler(b, c.ChatID)
+			if err != nil {
+				return err
+			}
+			before, ok := s.GetExpense(id)
+			if !ok {
+				_, err := b.SendMessage(c.ChatID, 0, ErrExpenseNotFound)
+				return err
+			}
+			after := before.Copy()
+			switch c.Get(fieldState) {
+			case payerState:
+				after.Payer = c.Get(payerState)
+			case participantState:
+				after.Participants = strings.Fields(c.Get(participantState))
+				// the values of the split belong to the old participants
+				if !after.Split.IsEqual() {
+					after.Split = nil
+				}
+			case amountState:
+				amount, err := settler.ParseMoney(c.Get(amountState))
+				if err != nil {
+					return err
+				}
+				if amount.Currency == "" {
+					amount.Currency = before.Amount.Currency
+				}
+				after.Amount = amount
+				// the exact amounts do not sum the new amount anymore
+				if after.Split != nil && after.Split.Mode == settler.SplitExact {
+					after.Split = nil
+				}
+			case descriptionState:
+				after.Description = c.Get(descriptionState)
+			default:
+				return fmt.Errorf("unknown field %s", c.Get(fieldState))
+			}
+			if err := s.UpdateExpense(id, after); err != nil {
+				_, err := b.SendMessage(c.ChatID, 0, fmt.Sprintf(ErrInvalidExpenseTemplate, err))
+				return err
+			}
+			texts := []string{fmt.Sprintf(EditSuccessTemplate, c.Username, id)}
+			texts = append(texts, formatExpenseDiff(before, after)...)
+			// warn that the split was lost, it is not one of the fields
+			// that can be edited
+			if !before.Split.IsEqual() && after.Split.IsEqual() {
+				texts = append(texts, EditSplitResetMessage)
+			}
+			_, err = b.SendMessage(c.ChatID, 0, strings.Join(texts, "\n"))
+			return err
+		},
+	}
+}
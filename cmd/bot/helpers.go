@@ -0,0 +1,423 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/lucasmenendez/expensesbot/bot"
+	"github.com/lucasmenendez/expensesbot/settler"
+)
+
+// addExpense adds the expense to the settler of the chat provided and sends
+// the result to the chat.
+func addExpense(b *bot.Bot, chatID int64, expense *settler.Transaction) {
+	// get the settler of the chat and add the expense
+	s, err := chatSettler(b, chatID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if _, err := s.AddExpense(expense); err != nil {
+		if _, err := b.SendMessage(chatID, 0, fmt.Sprintf(ErrInvalidExpenseTemplate, err)); err != nil {
+			log.Printf("error sending message: %s\n", err)
+		}
+		return
+	}
+	// send the message
+	msg := fmt.Sprintf(AddSuccessTemplate, expense.Payer, expense.Amount, formatParticipants(expense))
+	if _, err := b.SendMessage(chatID, 0, msg); err != nil {
+		log.Printf("error sending message: %s\n", err)
+	}
+}
+
+// userParticipant registers the user provided in the directory of
+// participants of the settler and returns the name of its participant.
+func userParticipant(s *settler.Settler, user *bot.User) string {
+	return s.RegisterUser(user.ID, user.Username, user.FirstName)
+}
+
+// messageFields returns the words of the text of the message provided, with
+// the mentions of users without username replaced by the names of their
+// participants in the directory of the settler. If there is no message, it
+// returns the words of the text provided.
+func messageFields(s *settler.Settler, msg *bot.Message, text string) []string {
+	if msg == nil {
+		return strings.Fields(text)
+	}
+	return strings.Fields(msg.ReplaceTextMentions(func(user *bot.User) string {
+		return userParticipant(s, user)
+	}))
+}
+
+// commandFields returns the arguments of the command of the update provided
+// like messageFields.
+func commandFields(s *settler.Settler, update *bot.Update) []string {
+	fields := messageFields(s, update.Message, update.Message.Text)
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields[1:]
+}
+
+// commandText returns the text of the arguments of the command of the update
+// provided, with the mentions of users without username replaced like
+// messageFields.
+func commandText(s *settler.Settler, update *bot.Update) string {
+	text := strings.TrimSpace(update.Message.ReplaceTextMentions(func(user *bot.User) string {
+		return userParticipant(s, user)
+	}))
+	if end := strings.IndexFunc(text, unicode.IsSpace); end >= 0 {
+		return strings.TrimSpace(text[end:])
+	}
+	return ""
+}
+
+// resolveParticipants returns the names of the participants that the names
+// provided refer to in the directory of the settler, so the different ways
+// to write the name of a person, such as "@bob" and "Bob", are the same.
+func resolveParticipants(s *settler.Settler, names []string) []string {
+	resolved := make([]string, 0, len(names))
+	for _, name := range names {
+		resolved = append(resolved, s.ResolveParticipant(name))
+	}
+	return resolved
+}
+
+// formatParticipant returns the name of the participant provided with its
+// display name and its aliases, if it has them.
+func formatParticipant(participant *settler.Participant) string {
+	text := participant.Name
+	if participant.DisplayName != "" && participant.DisplayName != participant.Name {
+		text += fmt.Sprintf(ParticipantDisplayNameTemplate, participant.DisplayName)
+	}
+	if len(participant.Aliases) > 0 {
+		text += fmt.Sprintf(ParticipantAliasesTemplate, strings.Join(participant.Aliases, ", "))
+	}
+	return text
+}
+
+// formatExpenseDetails returns the description, the category, the date and
+// the creator of the expense, the ones that it has, or an empty string if it
+// has none of them.
+func formatExpenseDetails(expense *settler.Transaction) string {
+	details := []string{}
+	if expense.Description != "" {
+		details = append(details, expense.Description)
+	}
+	if expense.Category != "" {
+		label, ok := categoryLabels[expense.Category]
+		if !ok {
+			label = expense.Category
+		}
+		details = append(details, label)
+	}
+	if !expense.Date.IsZero() {
+		details = append(details, expense.Date.Format(time.DateOnly))
+	}
+	if expense.CreatedBy != "" {
+		details = append(details, "by "+expense.CreatedBy)
+	}
+	return strings.Join(details, " · ")
+}
+
+// formatParticipants returns the list of participants of the expense. If the
+// expense is not split evenly, it includes the amount of each participant.
+func formatParticipants(expense *settler.Transaction) string {
+	if expense.Split.IsEqual() {
+		return strings.Join(expense.Participants, ", ")
+	}
+	shares, err := expense.Shares()
+	if err != nil {
+		return strings.Join(expense.Participants, ", ")
+	}
+	items := []string{}
+	for _, participant := range expense.Participants {
+		items = append(items, fmt.Sprintf(ParticipantShareTemplate, participant, shares[participant]))
+	}
+	return strings.Join(items, ", ")
+}
+
+// parseSplitValues parses the values of the split from the text provided. It
+// expects a value per participant, in the same order, separated by spaces.
+// Percentage symbols are ignored.
+func parseSplitValues(mode settler.SplitMode, participants []string, text string) (*settler.Split, error) {
+	rawValues := strings.Fields(strings.ReplaceAll(text, "%", ""))
+	if len(rawValues) != len(participants) {
+		return nil, fmt.Errorf("expected %d values, got %d", len(participants), len(rawValues))
+	}
+	split := &settler.Split{Mode: mode, Values: map[string]int64{}}
+	for i, rawValue := range rawValues {
+		value, err := settler.ParseSplitValue(mode, rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value '%s'", rawValue)
+		}
+		split.Values[participants[i]] = value
+	}
+	return split, nil
+}
+
+// formatExpenseDiff returns a line per field that changed between the
+// expenses provided with its value before and after the change.
+func formatExpenseDiff(before, after *settler.Transaction) []string {
+	type field struct {
+		name          string
+		before, after string
+	}
+	fields := []field{
+		{EditPayerButton, before.Payer, after.Payer},
+		{EditParticipantsButton, formatParticipants(before), formatParticipants(after)},
+		{EditAmountButton, before.Amount.String(), after.Amount.String()},
+		{EditDescriptionButton, before.Description, after.Description},
+		{EditSplitLabel, formatSplitMode(before.Split), formatSplitMode(after.Split)},
+	}
+	lines := []string{}
+	for _, f := range fields {
+		if f.before != f.after {
+			lines = append(lines, fmt.Sprintf(EditDiffItemTemplate, f.name, f.before, f.after))
+		}
+	}
+	return lines
+}
+
+// formatSplitMode returns the label of the mode of the split provided.
+func formatSplitMode(split *settler.Split) string {
+	if split.IsEqual() {
+		return splitModeLabels[settler.SplitEqual]
+	}
+	return splitModeLabels[split.Mode]
+}
+
+// formatJournalEntry returns a short description of the operation of the
+// journal entry provided.
+func formatJournalEntry(entry *settler.JournalEntry) string {
+	switch entry.Operation {
+	case settler.OpAdd, settler.OpRemove:
+		// the transaction added or removed
+		change := entry.Changes[0]
+		transaction := change.After
+		if transaction == nil {
+			transaction = change.Before
+		}
+		kind := "expense"
+		if transaction.IsPayment() {
+			kind = "payment"
+		}
+		if entry.Operation == settler.OpAdd {
+			return fmt.Sprintf(AddOperationTemplate, kind, change.ID)
+		}
+		return fmt.Sprintf(RemoveOperationTemplate, kind, change.ID)
+	case settler.OpEdit:
+		return fmt.Sprintf(EditOperationTemplate, entry.Changes[0].ID)
+	case settler.OpClean:
+		return fmt.Sprintf(CleanOperationTemplate, len(entry.Changes))
+	case settler.OpClose:
+		if entry.Period != nil {
+			return fmt.Sprintf(CloseOperationTemplate, entry.Period.Label)
+		}
+	case settler.OpImport:
+		imported := 0
+		for _, change := range entry.Changes {
+			if change.After != nil {
+				imported++
+			}
+		}
+		return fmt.Sprintf(ImportOperationTemplate, imported)
+	case settler.OpMerge:
+		if entry.Merge != nil {
+			return fmt.Sprintf(MergeOperationTemplate, entry.Merge.From, entry.Merge.Into)
+		}
+	}
+	return string(entry.Operation)
+}
+
+// formatConstraint returns the description of the settlement constraint
+// provided.
+func formatConstraint(constraint *settler.Constraint) string {
+	switch constraint.Kind {
+	case settler.ConstraintForbidden:
+		return fmt.Sprintf(ForbiddenConstraintTemplate, constraint.Payer, constraint.Receiver)
+	case settler.ConstraintIntermediary:
+		return fmt.Sprintf(IntermediaryConstraintTemplate, constraint.Payer, constraint.Receiver, constraint.Intermediary)
+	case settler.ConstraintHousehold:
+		return fmt.Sprintf(HouseholdConstraintTemplate, strings.Join(constraint.Members, ", "))
+	}
+	return string(constraint.Kind)
+}
+
+// summaryErrorMessage returns the message to send when the summary of a
+// settler can not be composed because of the error provided.
+func summaryErrorMessage(err error) string {
+	if errors.Is(err, settler.ErrUnsatisfiableConstraints) {
+		return fmt.Sprintf(ErrUnsatisfiableConstraintsTemplate, err)
+	}
+	return fmt.Sprintf(ErrMissingRateTemplate, err)
+}
+
+// formatPeriod returns the details of the archived period provided: its
+// expenses, payments, final balances and suggested transfers.
+func formatPeriod(number int, period *settler.Period) string {
+	texts := []string{
+		fmt.Sprintf(PeriodHeaderTemplate, period.Label, period.ClosedAt.Format(time.DateOnly)),
+		PeriodExpensesHeader,
+	}
+	expenses, ids := period.ListExpenses()
+	for i, expense := range expenses {
+		text := fmt.Sprintf(ExpenseItemTemplate, ids[i], expense.Payer, expense.Amount, formatParticipants(expense))
+		if details := formatExpenseDetails(expense); details != "" {
+			text += fmt.Sprintf(ExpenseDetailsTemplate, details)
+		}
+		texts = append(texts, text)
+	}
+	if payments, _ := period.ListPayments(); len(payments) > 0 {
+		texts = append(texts, PaymentsHeader)
+		for _, payment := range payments {
+			texts = append(texts, fmt.Sprintf(PaymentItemTemplate, payment.Payer, payment.Amount, payment.Participants[0]))
+		}
+	}
+	texts = append(texts, PeriodBalancesHeader)
+	participants := []string{}
+	for participant := range period.Balances {
+		participants = append(participants, participant)
+	}
+	sort.Strings(participants)
+	for _, participant := range participants {
+		texts = append(texts, fmt.Sprintf(BalanceItemTemplate, participant, period.Balances[participant]))
+	}
+	if len(period.Transfers) > 0 {
+		texts = append(texts, PeriodTransfersHeader)
+		for _, transfer := range period.Transfers {
+			texts = append(texts, fmt.Sprintf(SummaryItemTemplate, transfer.Payer, transfer.Amount, transfer.Participants[0]))
+		}
+	}
+	texts = append(texts, fmt.Sprintf(PeriodExportTemplate, number))
+	return strings.Join(texts, "\n")
+}
+
+// formatOriginalBalance returns the amounts of the balance in each currency,
+// sorted by currency, or an empty string if the balance only has amounts in
+// the base currency provided.
+func formatOriginalBalance(balance settler.Balance, base string) string {
+	currencies := []string{}
+	for currency := range balance {
+		currencies = append(currencies, currency)
+	}
+	if len(currencies) == 0 || (len(currencies) == 1 && currencies[0] == base) {
+		return ""
+	}
+	sort.Strings(currencies)
+	amounts := []string{}
+	for _, currency := range currencies {
+		amounts = append(amounts, balance[currency].String())
+	}
+	return strings.Join(amounts, ", ")
+}
+
+// composeSummary returns the summary of the settler provided: the balances of
+// the participants, including their original currencies if they are not only
+// in the base one, the payments made and the suggested transactions to settle
+// the debts, that are also returned. It returns an error if the balances can
+// not be converted to the base currency.
+func composeSummary(s *settler.Settler) (string, []*settler.Transaction, error) {
+	balances, err := s.ListBalances()
+	if err != nil {
+		return "", nil, err
+	}
+	transactions, err := s.Settle(false)
+	if err != nil {
+		return "", nil, err
+	}
+	originalBalances := s.ListOriginalBalances()
+	// list the balances by name to show them always in the same order
+	participants := []string{}
+	for participant := range balances {
+		participants = append(participants, participant)
+	}
+	sort.Strings(participants)
+	texts := []string{BalancesHeader}
+	for _, participant := range participants {
+		text := fmt.Sprintf(BalanceItemTemplate, participant, balances[participant])
+		if original := formatOriginalBalance(originalBalances[participant], s.Currency); original != "" {
+			text += fmt.Sprintf(OriginalBalanceTemplate, original)
+		}
+		texts = append(texts, text)
+	}
+	if payments, _ := s.ListPayments(); len(payments) > 0 {
+		texts = append(texts, PaymentsHeader)
+		for _, payment := range payments {
+			texts = append(texts, fmt.Sprintf(PaymentItemTemplate,
+				payment.Payer,
+				payment.Amount,
+				payment.Participants[0],
+			))
+		}
+	}
+	texts = append(texts, SummaryHeader)
+	for _, transaction := range transactions {
+		texts = append(texts, fmt.Sprintf(SummaryItemTemplate,
+			transaction.Payer,
+			transaction.Amount,
+			transaction.Participants[0],
+		))
+	}
+	return strings.Join(texts, "\n"), transactions, nil
+}
+
+// sendSummary sends the summary text provided to the chat, or edits the
+// message provided with it, with a button to mark each suggested transaction
+// as paid. When a button is pressed, the payment is recorded and the summary
+// is updated with the remaining suggestions.
+func sendSummary(b *bot.Bot, chatID, messageID int64, s *settler.Settler, text string, transactions []*settler.Transaction) error {
+	labels := [][]string{}
+	values := [][]string{}
+	for i, transaction := range transactions {
+		labels = append(labels, []string{fmt.Sprintf(MarkAsPaidButtonTemplate,
+			transaction.Payer, transaction.Participants[0])})
+		values = append(values, []string{strconv.Itoa(i)})
+	}
+	// only the first button pressed is processed, the next ones belong to an
+	// outdated summary
+	var pressed sync.Once
+	_, err := b.InlineMenu(chatID, messageID, text, labels, values, func(menuID int64, data string) {
+		pressed.Do(func() {
+			i, err := strconv.Atoi(data)
+			if err != nil || i < 0 || i >= len(transactions) {
+				log.Println("invalid summary transaction", data)
+				return
+			}
+			transaction := transactions[i]
+			if _, err := s.AddPayment(&settler.Transaction{
+				Payer:        transaction.Payer,
+				Participants: transaction.Participants,
+				Amount:       transaction.Amount,
+				Date:         time.Now(),
+			}); err != nil {
+				log.Println(err)
+				return
+			}
+			msg := fmt.Sprintf(PaidSuccessTemplate, transaction.Payer, transaction.Amount, transaction.Participants[0])
+			if _, err := b.SendMessage(chatID, 0, msg); err != nil {
+				log.Println(err)
+			}
+			// update the summary with the remaining suggestions
+			text, transactions, err := composeSummary(s)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if len(transactions) == 0 {
+				text = AllSettledMessage
+			}
+			if err := sendSummary(b, chatID, menuID, s, text, transactions); err != nil {
+				log.Println(err)
+			}
+		})
+	})
+	return err
+}
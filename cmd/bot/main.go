@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -31,6 +33,72 @@ func parseIDs(ids string) ([]int64, error) {
 	return parsedIDs, nil
 }
 
+var (
+	// journalDepth is the number of operations of each chat that can be
+	// undone, it can be set with the JOURNAL_DEPTH env variable
+	journalDepth = settler.DefaultJournalDepth
+	// exactLimit is the maximum number of persons that the exact settlement
+	// strategy settles, it can be set with the EXACT_SETTLE_LIMIT env variable
+	exactLimit = settler.DefaultExactLimit
+)
+
+// newSettler returns an empty settler with the journal depth and the exact
+// strategy limit configured.
+func newSettler() *settler.Settler {
+	return configureSettler(settler.NewSettler())
+}
+
+// configureSettler sets the journal depth and the exact strategy limit
+// configured in the settler provided and returns it.
+func configureSettler(s *settler.Settler) *settler.Settler {
+	s.SetJournalDepth(journalDepth)
+	s.SetExactLimit(exactLimit)
+	return s
+}
+
+// registerCommands registers the session importer and the handlers of every
+// command in the bot provided.
+func registerCommands(b *bot.Bot) {
+	// register a function to import the settle data when the bot starts
+	b.AddSessionImporter(func(encoded []byte) (bot.Data, error) {
+		s, err := settler.ImportSettle(encoded)
+		if errors.Is(err, settler.ErrUnsupportedVersion) {
+			return nil, fmt.Errorf("%w: %w", bot.ErrUnsupportedVersion, err)
+		} else if err != nil {
+			return nil, err
+		}
+		return configureSettler(s), nil
+	})
+	// register the conversation flows and the commands
+	registerFlows(b)
+	b.AddCommand(START_CMD, handleStart)
+	b.AddCommand(HELP_CMD, handleHelp)
+	b.AddCommand(ADD_EXPENSE_CMD, handleAddExpense)
+	b.AddCommand(ADD_FOR_EXPENSE_CMD, handleAddForExpense)
+	b.AddCommand(LIST_EXPENSES_CMD, handleListExpenses)
+	b.AddCommand(SUMMARY_CMD, handleSummary)
+	b.AddCommand(IMPORT_CMD, handleImport)
+	b.AddCommand(EXPORT_CMD, handleExport)
+	b.AddCommand(CURRENCY_CMD, handleCurrency)
+	b.AddCommand(RATE_CMD, handleRate)
+	b.AddCommand(PAID_CMD, handlePaid)
+	b.AddCommand(CANCEL_CMD, handleCancel)
+	b.AddCommand(EDIT_CMD, handleEdit)
+	b.AddCommand(UNDO_CMD, handleUndo)
+	b.AddCommand(REDO_CMD, handleRedo)
+	b.AddCommand(HISTORY_CMD, handleHistory)
+	b.AddCommand(LEDGER_CMD, handleLedger)
+	b.AddCommand(STRATEGY_CMD, handleStrategy)
+	b.AddCommand(CONSTRAINTS_CMD, handleConstraints)
+	b.AddCommand(PARTICIPANTS_CMD, handleParticipants)
+	b.AddCommand(MERGE_CMD, handleMerge)
+	b.AddCommand(ASOF_CMD, handleAsOf)
+	// register the admin commands
+	b.AddAdminCommand(ADD_USER_CMD, handleAddUser)
+	b.AddAdminCommand(REMOVE_USER_CMD, handleRemoveUser)
+	b.AddAdminCommand(LIST_USERS_CMD, handleListUsers)
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	// parse env variables
@@ -42,6 +110,84 @@ func main() {
 	if snapshotPath == "" {
 		snapshotPath = "./snapshot.json"
 	}
+	// the snapshots are saved every 5 minutes and the last 5 are kept by
+	// default
+	snapshotInterval := bot.DefaultSnapshotInterval
+	if interval := os.Getenv("SNAPSHOT_INTERVAL"); interval != "" {
+		parsedInterval, err := time.ParseDuration(interval)
+		if err != nil || parsedInterval <= 0 {
+			fmt.Println("invalid snapshot interval:", interval)
+			return
+		}
+		snapshotInterval = parsedInterval
+	}
+	snapshotRetention := bot.DefaultSnapshotRetention
+	if retention := os.Getenv("SNAPSHOT_RETENTION"); retention != "" {
+		parsedRetention, err := strconv.Atoi(retention)
+		if err != nil || parsedRetention < 1 {
+			fmt.Println("invalid snapshot retention:", retention)
+			return
+		}
+		snapshotRetention = parsedRetention
+	}
+	// the chats are saved in the snapshot by default, or in a file per chat
+	// or in a key-value file, next to the snapshot if no path is provided
+	var store bot.Store
+	switch storeKind := os.Getenv("STORE"); storeKind {
+	case "", bot.SnapshotStoreKind:
+		store = bot.NewSnapshotStore(snapshotPath, snapshotRetention)
+	default:
+		storePath := os.Getenv("STORE_PATH")
+		if storePath == "" {
+			storePath = filepath.Join(filepath.Dir(snapshotPath), "chats")
+			if storeKind == bot.KVStoreKind {
+				storePath += ".db"
+			}
+		}
+		var err error
+		if store, err = bot.OpenStore(storeKind, storePath); err != nil {
+			fmt.Println("invalid store:", err)
+			return
+		}
+	}
+	// the event log of the chats is optional, it is disabled by default
+	eventLogPath := os.Getenv("EVENT_LOG_PATH")
+	// the chats are encrypted at rest if a key is provided, in the env or in
+	// a file, the first one is the current and the rest the previous ones
+	cipher, err := bot.LoadCipher(os.Getenv("ENCRYPTION_KEY"), os.Getenv("ENCRYPTION_KEY_FILE"))
+	if err != nil {
+		fmt.Println("invalid encryption key:", err)
+		return
+	}
+	// by default, store the allowed users next to the snapshot
+	authPath := os.Getenv("AUTH_PATH")
+	if authPath == "" {
+		authPath = filepath.Join(filepath.Dir(snapshotPath), "auth.json")
+	}
+	// webhook mode is optional, the bot polls the api by default
+	webhookURL := os.Getenv("WEBHOOK_URL")
+	webhookListenAddr := os.Getenv("WEBHOOK_LISTEN_ADDR")
+	if webhookListenAddr == "" {
+		webhookListenAddr = ":8080"
+	}
+	// the journal depth and the exact settle limit are optional, they have
+	// default values
+	if depth := os.Getenv("JOURNAL_DEPTH"); depth != "" {
+		parsedDepth, err := strconv.Atoi(depth)
+		if err != nil || parsedDepth < 0 {
+			fmt.Println("invalid journal depth:", depth)
+			return
+		}
+		journalDepth = parsedDepth
+	}
+	if limit := os.Getenv("EXACT_SETTLE_LIMIT"); limit != "" {
+		parsedLimit, err := strconv.Atoi(limit)
+		if err != nil || parsedLimit < 0 || parsedLimit > settler.MaxExactLimit {
+			fmt.Printf("invalid exact settle limit: %s, it must be up to %d\n", limit, settler.MaxExactLimit)
+			return
+		}
+		exactLimit = parsedLimit
+	}
 	// parse admin users
 	adminUsersIDs, err := parseIDs(os.Getenv("ADMIN_USER_IDS"))
 	if err != nil {
@@ -63,28 +209,18 @@ func main() {
 	}
 	// create and start the bot
 	b := bot.New(context.Background(), bot.BotConfig{
-		Token:          telegramToken,
-		SnapshotPath:   snapshotPath,
-		ExpirationDays: 120,
-		AuthManager:    InitAuth(admins),
-	})
-	// register a function to import the settle data when the bot starts
-	b.AddSessionImporter(func(encoded []byte) (bot.Data, error) {
-		return settler.ImportSettle(encoded)
+		Token:             telegramToken,
+		Store:             store,
+		EventLogPath:      eventLogPath,
+		Cipher:            cipher,
+		SnapshotInterval:  snapshotInterval,
+		ExpirationDays:    120,
+		AuthManager:       InitAuth(admins, authPath),
+		WebhookURL:        webhookURL,
+		WebhookListenAddr: webhookListenAddr,
+		WebhookSecret:     os.Getenv("WEBHOOK_SECRET"),
 	})
-	// register the commands
-	b.AddCommand(START_CMD, handleStart)
-	b.AddCommand(HELP_CMD, handleHelp)
-	b.AddCommand(ADD_EXPENSE_CMD, handleAddExpense)
-	b.AddCommand(ADD_FOR_EXPENSE_CMD, handleAddForExpense)
-	b.AddCommand(LIST_EXPENSES_CMD, handleListExpenses)
-	b.AddCommand(SUMMARY_CMD, handleSummary)
-	b.AddCommand(IMPORT_CMD, handleImport)
-	b.AddCommand(EXPORT_CMD, handleExport)
-	// register the admin commands
-	b.AddAdminCommand(ADD_USER_CMD, handleAddUser)
-	b.AddAdminCommand(REMOVE_USER_CMD, handleRemoveUser)
-	b.AddAdminCommand(LIST_USERS_CMD, handleListUsers)
+	registerCommands(b)
 	// start the bot
 	if err := b.Start(); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,43 @@
+// Command migrate copies the chats of a snapshot file of the bot, also in the
+// formats of its previous versions, to a file per chat store or to a
+// key-value store, so the bot can be started with STORE and STORE_PATH. If
+// ENCRYPTION_KEY or ENCRYPTION_KEY_FILE are defined, the snapshot can be
+// encrypted and the chats are encrypted in the destination store.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/lucasmenendez/expensesbot/bot"
+)
+
+func main() {
+	snapshotPath := flag.String("snapshot", "./snapshot.json", "path of the snapshot to migrate")
+	storeKind := flag.String("store", bot.KVStoreKind, "kind of the destination store: files or kv")
+	storePath := flag.String("path", "./chats.db", "path of the destination store, a directory for files")
+	flag.Parse()
+
+	if *storeKind == bot.SnapshotStoreKind {
+		log.Fatal("the destination store must be files or kv")
+	}
+	cipher, err := bot.LoadCipher(os.Getenv("ENCRYPTION_KEY"), os.Getenv("ENCRYPTION_KEY_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var src bot.Store = bot.NewSnapshotStore(*snapshotPath, bot.DefaultSnapshotRetention)
+	dst, err := bot.OpenStore(*storeKind, *storePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cipher != nil {
+		src, dst = bot.NewEncryptedStore(src, cipher), bot.NewEncryptedStore(dst, cipher)
+	}
+	defer dst.Close()
+	copied, err := bot.CopyStore(dst, src)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%d chats copied from %s to %s", copied, *snapshotPath, *storePath)
+}
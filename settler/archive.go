@@ -0,0 +1,109 @@
+package settler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrPeriodNotFound = errors.New("period not found")
+	ErrEmptyPeriod    = errors.New("there are no expenses or payments to archive")
+)
+
+// Period struct represents a closed settlement period. It freezes the
+// expenses and the payments of the period, the final balances and the
+// suggested transfers to settle them, in the base currency of the settler
+// when it was closed.
+type Period struct {
+	Label     string               `json:"label"`
+	ClosedAt  time.Time            `json:"closedAt"`
+	Currency  string               `json:"currency"`
+	Expenses  map[int]*Transaction `json:"expenses"`
+	Payments  map[int]*Transaction `json:"payments,omitempty"`
+	Balances  map[string]Money     `json:"balances"`
+	Transfers []*Transaction       `json:"transfers"`
+}
+
+// ListExpenses method returns the expenses of the period and their IDs,
+// sorted by ID.
+func (p *Period) ListExpenses() ([]*Transaction, []int) {
+	return sortedTransactions(p.Expenses)
+}
+
+// ListPayments method returns the payments of the period and their IDs,
+// sorted by ID.
+func (p *Period) ListPayments() ([]*Transaction, []int) {
+	return sortedTransactions(p.Payments)
+}
+
+// ClosePeriod method settles the current expenses and payments and archives
+// them with the resulting balances and transfers as a period with the label
+// and the close date provided. If the label is empty, the period is labeled
+// with its number. The settler is cleaned after it, so a new period starts,
+// and the operation is recorded in the journal, so it can be undone. It
+// returns an error if there is nothing to archive or any exchange rate is
+// missing.
+func (s *Settler) ClosePeriod(label string, closedAt time.Time) (*Period, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(s.Expenses) == 0 && len(s.Payments) == 0 {
+		return nil, ErrEmptyPeriod
+	}
+	// the balances and the transfers are calculated with the settler locked,
+	// so they match the expenses and the payments archived
+	balances, err := convertBalances(s.Rates, s.Balances, s.Currency)
+	if err != nil {
+		return nil, err
+	}
+	transfers, err := s.settle()
+	if err != nil {
+		return nil, err
+	}
+	if label == "" {
+		label = fmt.Sprintf("Period %d", len(s.Archive)+1)
+	}
+	period := &Period{
+		Label:     label,
+		ClosedAt:  closedAt,
+		Currency:  s.Currency,
+		Expenses:  s.Expenses,
+		Payments:  s.Payments,
+		Balances:  balances,
+		Transfers: transfers,
+	}
+	lastID := s.lastID
+	changes := s.removalChanges()
+	s.Expenses = make(map[int]*Transaction)
+	s.Payments = make(map[int]*Transaction)
+	s.Balances = make(map[string]Balance)
+	s.lastID = 0
+	s.Archive = append(s.Archive, period)
+	if entry := s.record(OpClose, lastID, changes...); entry != nil {
+		entry.Period = period
+		s.emitEntry(EventOperation, entry)
+	}
+	return period, nil
+}
+
+// ListPeriods method returns the archived periods, from the oldest to the
+// newest. Their numbers are their positions in the list starting from 1.
+func (s *Settler) ListPeriods() []*Period {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return append([]*Period{}, s.Archive...)
+}
+
+// GetPeriod method returns the archived period with the number provided,
+// starting from 1, or ErrPeriodNotFound if it does not exist.
+func (s *Settler) GetPeriod(number int) (*Period, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if number < 1 || number > len(s.Archive) {
+		return nil, fmt.Errorf("%w: %d", ErrPeriodNotFound, number)
+	}
+	return s.Archive[number-1], nil
+}
@@ -0,0 +1,334 @@
+package settler
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ConstraintKind type defines the kind of a settlement constraint.
+type ConstraintKind string
+
+const (
+	// ConstraintForbidden constraints forbid the payer to pay the receiver
+	// directly, the transfers between them are made through another person.
+	ConstraintForbidden ConstraintKind = "forbidden"
+	// ConstraintIntermediary constraints require the transfers from the payer
+	// to the receiver to be made through the intermediary.
+	ConstraintIntermediary ConstraintKind = "intermediary"
+	// ConstraintHousehold constraints merge the balances of the members of
+	// the household to settle them as one unit, then the transfers of the
+	// household are split between its members. The debts between the members
+	// are not settled, they are settled inside the household.
+	ConstraintHousehold ConstraintKind = "household"
+)
+
+var (
+	ErrInvalidConstraint        = errors.New("invalid constraint")
+	ErrConstraintNotFound       = errors.New("constraint not found")
+	ErrUnsatisfiableConstraints = errors.New("the constraints cannot be satisfied")
+)
+
+// Constraint struct defines a restriction to the transfers that settle the
+// balances. The fields used depend on its kind: the payer and the receiver
+// for forbidden pairs, also the intermediary for the required ones, and the
+// members for households.
+type Constraint struct {
+	Kind         ConstraintKind `json:"kind"`
+	Payer        string         `json:"payer,omitempty"`
+	Receiver     string         `json:"receiver,omitempty"`
+	Intermediary string         `json:"intermediary,omitempty"`
+	Members      []string       `json:"members,omitempty"`
+}
+
+// Validate method checks that the constraint has the fields required by its
+// kind and that the persons involved are different.
+func (c *Constraint) Validate() error {
+	persons := []string{}
+	switch c.Kind {
+	case ConstraintForbidden:
+		persons = append(persons, c.Payer, c.Receiver)
+	case ConstraintIntermediary:
+		persons = append(persons, c.Payer, c.Receiver, c.Intermediary)
+	case ConstraintHousehold:
+		if len(c.Members) < 2 {
+			return fmt.Errorf("%w: a household needs at least two members", ErrInvalidConstraint)
+		}
+		persons = append(persons, c.Members...)
+	default:
+		return fmt.Errorf("%w: unknown kind %s", ErrInvalidConstraint, c.Kind)
+	}
+	seen := map[string]bool{}
+	for _, person := range persons {
+		if person == "" {
+			return fmt.Errorf("%w: missing person", ErrInvalidConstraint)
+		}
+		if seen[person] {
+			return fmt.Errorf("%w: %s is repeated", ErrInvalidConstraint, person)
+		}
+		seen[person] = true
+	}
+	return nil
+}
+
+// householdKey method returns the name of the unit that represents the
+// household when its balances are merged. It starts with a control character,
+// so it can not be the name of a participant.
+func (c *Constraint) householdKey() string {
+	return "\x00" + strings.Join(c.Members, "\x00")
+}
+
+// AddConstraint method adds a constraint to the settlement of the settler.
+// It returns an error if the constraint is not valid or if it is a household
+// with a member that already belongs to another one.
+func (s *Settler) AddConstraint(constraint *Constraint) error {
+	if err := constraint.Validate(); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if constraint.Kind == ConstraintHousehold {
+		for _, current := range s.Constraints {
+			if current.Kind != ConstraintHousehold {
+				continue
+			}
+			for _, member := range constraint.Members {
+				for _, other := range current.Members {
+					if member == other {
+						return fmt.Errorf("%w: %s already belongs to a household", ErrInvalidConstraint, member)
+					}
+				}
+			}
+		}
+	}
+	s.Constraints = append(s.Constraints, constraint)
+	s.emitSettings()
+	return nil
+}
+
+// ListConstraints method returns the constraints of the settlement of the
+// settler in the order they were added.
+func (s *Settler) ListConstraints() []*Constraint {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return append([]*Constraint{}, s.Constraints...)
+}
+
+// RemoveConstraint method removes the constraint in the position provided,
+// starting from 0, of the list of constraints of the settler.
+func (s *Settler) RemoveConstraint(index int) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if index < 0 || index >= len(s.Constraints) {
+		return fmt.Errorf("%w: %d", ErrConstraintNotFound, index)
+	}
+	s.Constraints = append(s.Constraints[:index:index], s.Constraints[index+1:]...)
+	s.emitSettings()
+	return nil
+}
+
+// ClearConstraints method removes every constraint of the settler.
+func (s *Settler) ClearConstraints() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.Constraints = nil
+	s.emitSettings()
+}
+
+// SettleConstrained function settles the balances provided with the strategy
+// provided satisfying the constraints provided. The balances of the members
+// of each household are merged before settling them and the transfers of
+// the household are split between its members after it, and then the debts
+// left between them are settled too. Then the transfers between a payer and
+// a receiver with a required intermediary are made through it and the
+// forbidden ones through any other person that can receive from the payer
+// and pay to the receiver. Finally, the transfers between the same persons
+// are merged. It returns ErrUnsatisfiableConstraints if a forbidden transfer
+// cannot be made through anyone.
+func SettleConstrained(strategy Strategy, balances map[string]Money, constraints []*Constraint) ([]*Transaction, error) {
+	if len(constraints) == 0 {
+		return strategy.Settle(balances), nil
+	}
+	units, currency := balanceUnits(balances)
+	// merge the balances of the households
+	households := []*Constraint{}
+	householdOf := map[string]string{}
+	for _, constraint := range constraints {
+		if constraint.Kind == ConstraintHousehold {
+			households = append(households, constraint)
+			for _, member := range constraint.Members {
+				householdOf[member] = constraint.householdKey()
+			}
+		}
+	}
+	merged := map[string]Money{}
+	for person, balance := range units {
+		unit := person
+		if key, ok := householdOf[person]; ok {
+			unit = key
+		}
+		merged[unit] = NewMoney(merged[unit].Units+balance, currency)
+	}
+	transfers := strategy.Settle(merged)
+	for _, household := range households {
+		transfers = splitHousehold(transfers, household, units, currency)
+	}
+	// apply the required intermediaries and the forbidden pairs
+	forbidden := map[[2]string]bool{}
+	intermediaries := map[[2]string]string{}
+	for _, constraint := range constraints {
+		pair := [2]string{constraint.Payer, constraint.Receiver}
+		switch constraint.Kind {
+		case ConstraintForbidden:
+			forbidden[pair] = true
+		case ConstraintIntermediary:
+			intermediaries[pair] = constraint.Intermediary
+		}
+	}
+	persons := []string{}
+	for person := range units {
+		persons = append(persons, person)
+	}
+	for _, via := range intermediaries {
+		if _, ok := units[via]; !ok {
+			persons = append(persons, via)
+		}
+	}
+	sort.Strings(persons)
+	result := []*Transaction{}
+	for _, transfer := range transfers {
+		payer, receiver := transfer.Payer, transfer.Participants[0]
+		pair := [2]string{payer, receiver}
+		via, ok := intermediaries[pair]
+		if !ok && forbidden[pair] {
+			for _, person := range persons {
+				if person != payer && person != receiver &&
+					!forbidden[[2]string{payer, person}] && !forbidden[[2]string{person, receiver}] {
+					via, ok = person, true
+					break
+				}
+			}
+			if !ok {
+				return nil, fmt.Errorf("%w: %s cannot pay %s", ErrUnsatisfiableConstraints, payer, receiver)
+			}
+		}
+		if !ok {
+			result = append(result, transfer)
+			continue
+		}
+		result = append(result,
+			&Transaction{Payer: payer, Participants: []string{via}, Amount: transfer.Amount},
+			&Transaction{Payer: via, Participants: []string{receiver}, Amount: transfer.Amount},
+		)
+	}
+	result = mergeTransfers(result, currency)
+	for _, transfer := range result {
+		if forbidden[[2]string{transfer.Payer, transfer.Participants[0]}] {
+			return nil, fmt.Errorf("%w: %s cannot pay %s", ErrUnsatisfiableConstraints, transfer.Payer, transfer.Participants[0])
+		}
+	}
+	return result, nil
+}
+
+// splitHousehold function replaces the transfers of the household provided
+// by transfers of its members. The transfers to the household are received
+// by the members that are owed money and the transfers from it are paid by
+// the members that owe money, starting by the ones with the largest
+// balances. The balances left between the members are settled among them,
+// so no debt inside the household is lost.
+func splitHousehold(transfers []*Transaction, household *Constraint, balances map[string]int64, currency string) []*Transaction {
+	key := household.householdKey()
+	remaining := map[string]int64{}
+	for _, member := range household.Members {
+		remaining[member] = balances[member]
+	}
+	// pick returns the member with the largest remaining balance, or the
+	// smallest one if debtor is true
+	pick := func(debtor bool) string {
+		picked := ""
+		for _, member := range household.Members {
+			if picked == "" || (!debtor && remaining[member] > remaining[picked]) ||
+				(debtor && remaining[member] < remaining[picked]) {
+				picked = member
+			}
+		}
+		return picked
+	}
+	result := []*Transaction{}
+	for _, transfer := range transfers {
+		incoming := transfer.Participants[0] == key
+		if transfer.Payer != key && !incoming {
+			result = append(result, transfer)
+			continue
+		}
+		for amount := transfer.Amount.Units; amount > 0; {
+			member := pick(!incoming)
+			share := amount
+			if incoming && remaining[member] > 0 {
+				share = min(amount, remaining[member])
+			} else if !incoming && remaining[member] < 0 {
+				share = min(amount, -remaining[member])
+			}
+			amount -= share
+			if incoming {
+				remaining[member] -= share
+				result = append(result, &Transaction{
+					Payer:        transfer.Payer,
+					Participants: []string{member},
+					Amount:       NewMoney(share, currency),
+				})
+			} else {
+				remaining[member] += share
+				result = append(result, &Transaction{
+					Payer:        member,
+					Participants: transfer.Participants,
+					Amount:       NewMoney(share, currency),
+				})
+			}
+		}
+	}
+	// the transfers of the household settle its merged balance, so the
+	// balances left sum zero
+	return append(result, greedySettle(remaining, currency)...)
+}
+
+// mergeTransfers function merges the transfers between the same persons,
+// netting the ones in opposite directions, keeping the order of their first
+// appearance and removing the ones that become zero.
+func mergeTransfers(transfers []*Transaction, currency string) []*Transaction {
+	amounts := map[[2]string]int64{}
+	order := [][2]string{}
+	for _, transfer := range transfers {
+		pair := [2]string{transfer.Payer, transfer.Participants[0]}
+		reverse := [2]string{pair[1], pair[0]}
+		if _, ok := amounts[reverse]; ok {
+			amounts[reverse] -= transfer.Amount.Units
+			continue
+		}
+		if _, ok := amounts[pair]; !ok {
+			order = append(order, pair)
+		}
+		amounts[pair] += transfer.Amount.Units
+	}
+	result := []*Transaction{}
+	for _, pair := range order {
+		amount := amounts[pair]
+		if amount < 0 {
+			pair, amount = [2]string{pair[1], pair[0]}, -amount
+		}
+		if amount == 0 || pair[0] == pair[1] {
+			continue
+		}
+		result = append(result, &Transaction{
+			Payer:        pair[0],
+			Participants: []string{pair[1]},
+			Amount:       NewMoney(amount, currency),
+		})
+	}
+	return result
+}
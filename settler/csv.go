@@ -0,0 +1,128 @@
+package settler
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const csvListSep = ";"
+
+// csvDateLayout is the format of the dates of the CSV records
+const csvDateLayout = time.RFC3339
+
+var ErrInvalidRecord = errors.New("invalid csv record")
+
+// EncodeCSV function encodes the list of expenses provided as CSV. Each record
+// contains the payer, the participants separated by semicolons, the amount
+// with its currency, the split mode and the split values of the participants,
+// in the same order and separated by semicolons, the description, the date,
+// the category and the user that created the expense. The split mode and
+// values are empty if the expense is split evenly. Payments have a single
+// participant and "payment" instead of the split mode, with no split values.
+func EncodeCSV(expenses []*Transaction) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	csvWriter := csv.NewWriter(&buffer)
+	for _, expense := range expenses {
+		record := []string{
+			expense.Payer,
+			strings.Join(expense.Participants, csvListSep),
+			expense.Amount.String(),
+		}
+		if expense.IsPayment() {
+			record = append(record, string(KindPayment), "")
+		} else if !expense.Split.IsEqual() {
+			values := []string{}
+			for _, participant := range expense.Participants {
+				value := expense.Split.Values[participant]
+				values = append(values, FormatSplitValue(expense.Split.Mode, value))
+			}
+			record = append(record, string(expense.Split.Mode), strings.Join(values, csvListSep))
+		} else {
+			record = append(record, "", "")
+		}
+		date := ""
+		if !expense.Date.IsZero() {
+			date = expense.Date.Format(csvDateLayout)
+		}
+		record = append(record, expense.Description, date, expense.Category, expense.CreatedBy)
+		if err := csvWriter.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// DecodeCSV function decodes the list of expenses from the CSV content
+// provided, following the format of EncodeCSV. Records of previous versions,
+// without the split or the details of the expense, are also supported. It
+// returns an error if any record is malformed or any expense is not valid.
+func DecodeCSV(content []byte) ([]*Transaction, error) {
+	csvReader := csv.NewReader(bytes.NewReader(content))
+	// the number of fields depends on the split of each expense
+	csvReader.FieldsPerRecord = -1
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	expenses := []*Transaction{}
+	for i, record := range records {
+		if len(record) != 3 && len(record) != 5 && len(record) != 9 {
+			return nil, fmt.Errorf("%w %d: unexpected number of fields", ErrInvalidRecord, i+1)
+		}
+		amount, err := ParseMoney(record[2])
+		if err != nil {
+			return nil, fmt.Errorf("%w %d: %w", ErrInvalidRecord, i+1, err)
+		}
+		expense := &Transaction{
+			Payer:        record[0],
+			Participants: strings.Split(record[1], csvListSep),
+			Amount:       amount,
+		}
+		if len(record) >= 5 && TransactionKind(record[3]) == KindPayment {
+			if record[4] != "" {
+				return nil, fmt.Errorf("%w %d: payments have no split values", ErrInvalidRecord, i+1)
+			}
+			expense.Kind = KindPayment
+		} else if len(record) >= 5 && record[3] != "" {
+			mode, err := ParseSplitMode(record[3])
+			if err != nil {
+				return nil, fmt.Errorf("%w %d: %w", ErrInvalidRecord, i+1, err)
+			}
+			rawValues := strings.Split(record[4], csvListSep)
+			if len(rawValues) != len(expense.Participants) {
+				return nil, fmt.Errorf("%w %d: unexpected number of split values", ErrInvalidRecord, i+1)
+			}
+			expense.Split = &Split{Mode: mode, Values: map[string]int64{}}
+			for j, rawValue := range rawValues {
+				value, err := ParseSplitValue(mode, rawValue)
+				if err != nil {
+					return nil, fmt.Errorf("%w %d: %w", ErrInvalidRecord, i+1, err)
+				}
+				expense.Split.Values[expense.Participants[j]] = value
+			}
+		}
+		if len(record) == 9 {
+			expense.Description = record[5]
+			if record[6] != "" {
+				if expense.Date, err = time.Parse(csvDateLayout, record[6]); err != nil {
+					return nil, fmt.Errorf("%w %d: %w", ErrInvalidRecord, i+1, err)
+				}
+			}
+			expense.Category = record[7]
+			expense.CreatedBy = record[8]
+		}
+		if err := expense.Validate(); err != nil {
+			return nil, fmt.Errorf("%w %d: %w", ErrInvalidRecord, i+1, err)
+		}
+		expenses = append(expenses, expense)
+	}
+	return expenses, nil
+}
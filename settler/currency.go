@@ -0,0 +1,178 @@
+package settler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// rateDecimals is the number of decimals of the exchange rates
+const rateDecimals = 6
+
+var (
+	ErrInvalidCurrency = errors.New("invalid currency code")
+	ErrInvalidRate     = errors.New("invalid exchange rate")
+	ErrMissingRate     = errors.New("missing exchange rate")
+)
+
+// Rate type represents an exchange rate between two currencies as a fixed
+// point number with six decimals, so 0.92 is stored as 920000.
+type Rate int64
+
+// ParseCurrency function returns the currency code provided in upper case or
+// an error if it is not a valid ISO 4217 like code of three letters.
+func ParseCurrency(str string) (string, error) {
+	currency := strings.ToUpper(strings.TrimSpace(str))
+	if len(currency) != 3 {
+		return "", fmt.Errorf("%w: '%s'", ErrInvalidCurrency, str)
+	}
+	for _, c := range currency {
+		if c < 'A' || c > 'Z' {
+			return "", fmt.Errorf("%w: '%s'", ErrInvalidCurrency, str)
+		}
+	}
+	return currency, nil
+}
+
+// ParseRate function parses an exchange rate from its decimal representation,
+// such as "0.92". The rate must be greater than zero.
+func ParseRate(str string) (Rate, error) {
+	value, err := parseDecimal(str, rateDecimals)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("%w: '%s'", ErrInvalidRate, str)
+	}
+	return Rate(value), nil
+}
+
+// String method returns the decimal representation of the rate without
+// trailing zeros, such as "0.92".
+func (r Rate) String() string {
+	str := strings.TrimRight(formatDecimal(int64(r), rateDecimals), "0")
+	return strings.TrimSuffix(str, ".")
+}
+
+// MarshalJSON method encodes the rate as its decimal representation.
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// UnmarshalJSON method decodes the rate from its decimal representation.
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRate, string(data))
+	}
+	rate, err := ParseRate(str)
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
+
+// rateKey returns the key of the exchange rate from a currency to another in
+// the rates table.
+func rateKey(from, to string) string {
+	return from + "/" + to
+}
+
+// Balance type contains the balance of a person in each currency.
+type Balance map[string]Money
+
+// convert function converts the amount of money provided to the currency
+// provided using the rates table. A rate can be defined in any direction, if
+// only the opposite one is defined, it is inverted. The result is rounded to
+// the nearest minor unit, away from zero in case of a tie.
+func convert(rates map[string]Rate, money Money, to string) (Money, error) {
+	if money.Currency == to {
+		return money, nil
+	}
+	numerator, denominator := big.NewInt(money.Units), big.NewInt(1)
+	if rate, ok := rates[rateKey(money.Currency, to)]; ok {
+		numerator.Mul(numerator, big.NewInt(int64(rate)))
+		denominator.Exp(big.NewInt(10), big.NewInt(rateDecimals), nil)
+	} else if rate, ok := rates[rateKey(to, money.Currency)]; ok {
+		numerator.Mul(numerator, new(big.Int).Exp(big.NewInt(10), big.NewInt(rateDecimals), nil))
+		denominator.SetInt64(int64(rate))
+	} else {
+		return Money{}, fmt.Errorf("%w: %s to %s", ErrMissingRate, money.Currency, to)
+	}
+	// round half away from zero: (2n + sign(n)·d) / 2d truncated
+	numerator.Mul(numerator, big.NewInt(2))
+	if numerator.Sign() < 0 {
+		numerator.Sub(numerator, denominator)
+	} else {
+		numerator.Add(numerator, denominator)
+	}
+	denominator.Mul(denominator, big.NewInt(2))
+	result := numerator.Quo(numerator, denominator)
+	if !result.IsInt64() {
+		return Money{}, fmt.Errorf("%w: %s overflows", ErrInvalidMoney, money)
+	}
+	return NewMoney(result.Int64(), to), nil
+}
+
+// convertBalances function converts the balances of every person to the
+// currency provided. The balances in each currency sum zero, so after
+// converting them, the rounding difference of each currency is assigned to
+// the person with the largest converted balance of that currency, breaking
+// ties by name, to keep the converted balances summing zero.
+func convertBalances(rates map[string]Rate, balances map[string]Balance, to string) (map[string]Money, error) {
+	// group the balances by currency
+	byCurrency := map[string]map[string]Money{}
+	for person, balance := range balances {
+		for currency, money := range balance {
+			if money.IsZero() {
+				continue
+			}
+			if _, ok := byCurrency[currency]; !ok {
+				byCurrency[currency] = map[string]Money{}
+			}
+			byCurrency[currency][person] = money
+		}
+	}
+	// convert the currencies in order to always report the same missing rate
+	currencies := make([]string, 0, len(byCurrency))
+	for currency := range byCurrency {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	result := map[string]Money{}
+	for _, currency := range currencies {
+		currencyBalances := byCurrency[currency]
+		persons := make([]string, 0, len(currencyBalances))
+		for person := range currencyBalances {
+			persons = append(persons, person)
+		}
+		sort.Strings(persons)
+		total := int64(0)
+		largest := ""
+		converted := map[string]Money{}
+		for _, person := range persons {
+			money, err := convert(rates, currencyBalances[person], to)
+			if err != nil {
+				return nil, err
+			}
+			converted[person] = money
+			total += money.Units
+			if largest == "" || money.Abs().Units > converted[largest].Abs().Units {
+				largest = person
+			}
+		}
+		if largest != "" {
+			converted[largest] = converted[largest].Sub(NewMoney(total, to))
+		}
+		for person, money := range converted {
+			result[person] = money.Add(result[person])
+		}
+	}
+	for person, money := range result {
+		if money.IsZero() {
+			delete(result, person)
+		}
+	}
+	return result, nil
+}
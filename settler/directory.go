@@ -0,0 +1,462 @@
+package settler
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrParticipantNotFound = errors.New("participant not found")
+	ErrSameParticipant     = errors.New("the participants are the same")
+	ErrAliasInUse          = errors.New("the alias refers to other participant")
+)
+
+// Participant struct represents a person of the directory of the settler.
+// Name is the name used in the transactions, UserID the ID of the Telegram
+// user, if it is known, DisplayName the name to show and Aliases other names
+// that refer to the same person, such as their previous usernames.
+type Participant struct {
+	Name        string   `json:"name"`
+	UserID      int64    `json:"userID,omitempty"`
+	DisplayName string   `json:"displayName,omitempty"`
+	Aliases     []string `json:"aliases,omitempty"`
+}
+
+// MergeChange struct contains the participants merged by an OpMerge
+// operation and the directory of participants and the constraints before and
+// after it, to restore them when it is undone or redone.
+type MergeChange struct {
+	From               string         `json:"from"`
+	Into               string         `json:"into"`
+	ParticipantsBefore []*Participant `json:"participantsBefore,omitempty"`
+	ParticipantsAfter  []*Participant `json:"participantsAfter,omitempty"`
+	ConstraintsBefore  []*Constraint  `json:"constraintsBefore,omitempty"`
+	ConstraintsAfter   []*Constraint  `json:"constraintsAfter,omitempty"`
+}
+
+// matches method returns if the name provided refers to the participant, by
+// its name or any of its aliases.
+func (p *Participant) matches(key string) bool {
+	if participantKey(p.Name) == key {
+		return true
+	}
+	for _, alias := range p.Aliases {
+		if participantKey(alias) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// participantKey function returns the key used to compare names of
+// participants, which ignores the case and the leading @ of usernames, so
+// "@bob", "bob" and "Bob" are the same person.
+func participantKey(name string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "@"))
+}
+
+// RegisterUser method adds the Telegram user provided to the directory of the
+// settler, or updates it if it is already there, and returns the name of the
+// participant that represents it. The name of a new user is its username
+// with a leading @, or its display name without spaces if it has no
+// username, unless another participant without user already has that name,
+// then that participant is assigned to the user. If the username of a known
+// user changes, the new one is added as an alias, so the balance of the user
+// is not split.
+func (s *Settler) RegisterUser(userID int64, username, displayName string) string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	defer s.emitSettings()
+
+	name := strings.Join(strings.Fields(displayName), "_")
+	if username != "" {
+		name = "@" + username
+	} else if name == "" {
+		name = fmt.Sprintf("user%d", userID)
+	}
+	for _, participant := range s.Participants {
+		if participant.UserID != userID {
+			continue
+		}
+		if displayName != "" {
+			participant.DisplayName = displayName
+		}
+		if username != "" && !participant.matches(participantKey(name)) {
+			participant.Aliases = append(participant.Aliases, name)
+		}
+		return participant.Name
+	}
+	// the user can be a participant already mentioned by others
+	key := participantKey(name)
+	for _, participant := range s.Participants {
+		if participant.UserID == 0 && participant.matches(key) {
+			participant.UserID = userID
+			participant.DisplayName = displayName
+			return participant.Name
+		}
+	}
+	if known := s.knownName(key); known != "" {
+		name = known
+	} else if s.participantByKey(key) != nil {
+		// other user has the same display name
+		name = fmt.Sprintf("%s_%d", name, userID)
+	}
+	s.Participants = append(s.Participants, &Participant{
+		Name:        name,
+		UserID:      userID,
+		DisplayName: displayName,
+	})
+	return name
+}
+
+// ResolveParticipant method returns the name of the participant that the name
+// provided refers to: the participant of the directory with that name or
+// alias, or the person of the transactions with the same name ignoring the
+// case and the leading @. If the name is unknown, it is returned as it is.
+func (s *Settler) ResolveParticipant(name string) string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	key := participantKey(name)
+	if participant := s.participantByKey(key); participant != nil {
+		return participant.Name
+	}
+	if known := s.knownName(key); known != "" {
+		return known
+	}
+	return strings.TrimSpace(name)
+}
+
+// ParticipantByUserID method returns the participant of the directory of the
+// Telegram user with the ID provided, or nil if it is unknown.
+func (s *Settler) ParticipantByUserID(userID int64) *Participant {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	for _, participant := range s.Participants {
+		if participant.UserID == userID {
+			copied := *participant
+			copied.Aliases = append([]string{}, participant.Aliases...)
+			return &copied
+		}
+	}
+	return nil
+}
+
+// AddAlias method adds an alias to the participant with the name provided,
+// creating it in the directory if it is only in the transactions. It returns
+// an error if the alias already refers to another participant.
+func (s *Settler) AddAlias(name, alias string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	defer s.emitSettings()
+
+	key := participantKey(name)
+	participant := s.participantByKey(key)
+	if participant == nil {
+		known := s.knownName(key)
+		if known == "" {
+			return fmt.Errorf("%w: %s", ErrParticipantNotFound, name)
+		}
+		participant = &Participant{Name: known}
+		s.Participants = append(s.Participants, participant)
+	}
+	aliasKey := participantKey(alias)
+	if participant.matches(aliasKey) {
+		return nil
+	}
+	if other := s.participantByKey(aliasKey); other != nil || s.knownName(aliasKey) != "" {
+		return fmt.Errorf("%w: %s", ErrAliasInUse, alias)
+	}
+	participant.Aliases = append(participant.Aliases, strings.TrimSpace(alias))
+	return nil
+}
+
+// ListParticipants method returns a copy of the participants of the
+// directory, sorted by name.
+func (s *Settler) ListParticipants() []*Participant {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	participants := copyParticipants(s.Participants)
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].Name < participants[j].Name
+	})
+	return participants
+}
+
+// ListPersons method returns the names of every person known by the settler,
+// sorted: the participants of the directory and the payers and participants
+// of the current transactions and of the archived periods.
+func (s *Settler) ListPersons() []string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	known := map[string]bool{}
+	for _, participant := range s.Participants {
+		known[participant.Name] = true
+	}
+	addPersons := func(transactions map[int]*Transaction) {
+		for _, transaction := range transactions {
+			known[transaction.Payer] = true
+			for _, participant := range transaction.Participants {
+				known[participant] = true
+			}
+		}
+	}
+	addPersons(s.Expenses)
+	addPersons(s.Payments)
+	for _, period := range s.Archive {
+		addPersons(period.Expenses)
+		addPersons(period.Payments)
+	}
+	persons := make([]string, 0, len(known))
+	for person := range known {
+		persons = append(persons, person)
+	}
+	sort.Strings(persons)
+	return persons
+}
+
+// SetParticipants method replaces the directory of the settler by a copy of
+// the participants provided, for example, to share it with a new ledger.
+func (s *Settler) SetParticipants(participants []*Participant) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.Participants = copyParticipants(participants)
+	s.emitSettings()
+}
+
+// MergeParticipants method replaces the participant from by the participant
+// into in every expense and payment, so the balance of the first one is moved
+// to the second one, and returns the number of transactions changed. The
+// expenses shared by both are split in exact amounts to keep the balances,
+// and the payments between them are removed. The name and the aliases of the
+// first one become aliases of the second one, and the constraints that
+// mention it are updated. The operation is recorded in the journal with the
+// directory and the constraints, so it can be undone. It returns an error if
+// any of them is unknown or both are the same.
+func (s *Settler) MergeParticipants(from, into string) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	fromName, intoName := s.resolve(from), s.resolve(into)
+	if fromName == "" {
+		return 0, fmt.Errorf("%w: %s", ErrParticipantNotFound, from)
+	}
+	if intoName == "" {
+		return 0, fmt.Errorf("%w: %s", ErrParticipantNotFound, into)
+	}
+	if fromName == intoName {
+		return 0, fmt.Errorf("%w: %s", ErrSameParticipant, fromName)
+	}
+	merge := &MergeChange{
+		From:               fromName,
+		Into:               intoName,
+		ParticipantsBefore: copyParticipants(s.Participants),
+		ConstraintsBefore:  copyConstraints(s.Constraints),
+	}
+	// replace the participant in the transactions in order of ID
+	changes := []Change{}
+	for _, transactions := range []map[int]*Transaction{s.Expenses, s.Payments} {
+		ids := make([]int, 0, len(transactions))
+		for id := range transactions {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			current := transactions[id]
+			merged, changed := mergeTransaction(current, fromName, intoName)
+			if !changed {
+				continue
+			}
+			s.setTransaction(id, merged)
+			changes = append(changes, Change{ID: id, Before: current, After: merged})
+		}
+	}
+	// merge the entries of the directory
+	var fromParticipant, intoParticipant *Participant
+	participants := []*Participant{}
+	for _, participant := range s.Participants {
+		switch participant.Name {
+		case fromName:
+			fromParticipant = participant
+			continue
+		case intoName:
+			intoParticipant = participant
+		}
+		participants = append(participants, participant)
+	}
+	if intoParticipant == nil {
+		intoParticipant = &Participant{Name: intoName}
+		participants = append(participants, intoParticipant)
+	}
+	intoParticipant.Aliases = append(intoParticipant.Aliases, fromName)
+	if fromParticipant != nil {
+		intoParticipant.Aliases = append(intoParticipant.Aliases, fromParticipant.Aliases...)
+		if intoParticipant.UserID == 0 {
+			intoParticipant.UserID = fromParticipant.UserID
+			intoParticipant.DisplayName = fromParticipant.DisplayName
+		}
+	}
+	s.Participants = participants
+	// rename the participant in the constraints, removing the ones that are
+	// not valid anymore, such as the forbidden pairs between both
+	constraints := []*Constraint{}
+	for _, constraint := range copyConstraints(s.Constraints) {
+		for _, person := range []*string{&constraint.Payer, &constraint.Receiver, &constraint.Intermediary} {
+			if *person == fromName {
+				*person = intoName
+			}
+		}
+		members := []string{}
+		for _, member := range constraint.Members {
+			if member == fromName {
+				member = intoName
+			}
+			if !slices.Contains(members, member) {
+				members = append(members, member)
+			}
+		}
+		if len(constraint.Members) > 0 {
+			constraint.Members = members
+		}
+		if constraint.Validate() == nil {
+			constraints = append(constraints, constraint)
+		}
+	}
+	s.Constraints = constraints
+	// the directory changes even if no transaction does, for example, if
+	// the participant is only in the directory or in the archived periods,
+	// so the operation is always recorded
+	entry := s.record(OpMerge, s.lastID, changes...)
+	if entry == nil {
+		entry = s.push(&JournalEntry{Operation: OpMerge, LastIDBefore: s.lastID, LastIDAfter: s.lastID})
+	}
+	merge.ParticipantsAfter = copyParticipants(s.Participants)
+	merge.ConstraintsAfter = copyConstraints(s.Constraints)
+	entry.Merge = merge
+	s.emitEntry(EventOperation, entry)
+	return len(changes), nil
+}
+
+// copyParticipants function returns a deep copy of the participants
+// provided.
+func copyParticipants(participants []*Participant) []*Participant {
+	var copied []*Participant
+	for _, participant := range participants {
+		participantCopy := *participant
+		participantCopy.Aliases = append([]string{}, participant.Aliases...)
+		copied = append(copied, &participantCopy)
+	}
+	return copied
+}
+
+// copyConstraints function returns a deep copy of the constraints provided.
+func copyConstraints(constraints []*Constraint) []*Constraint {
+	var copied []*Constraint
+	for _, constraint := range constraints {
+		constraintCopy := *constraint
+		if constraint.Members != nil {
+			constraintCopy.Members = append([]string{}, constraint.Members...)
+		}
+		copied = append(copied, &constraintCopy)
+	}
+	return copied
+}
+
+// mergeTransaction function returns a copy of the transaction provided with
+// the participant from replaced by the participant into and if it changed. If
+// both participate in an expense, it is split in the exact amounts that they
+// owed, so the balances do not change. If the transaction is a payment
+// between them, it returns nil to remove it.
+func mergeTransaction(transaction *Transaction, from, into string) (*Transaction, bool) {
+	hasFrom, hasInto := false, false
+	for _, participant := range transaction.Participants {
+		hasFrom = hasFrom || participant == from
+		hasInto = hasInto || participant == into
+	}
+	if transaction.Payer != from && !hasFrom {
+		return nil, false
+	}
+	merged := transaction.Copy()
+	if merged.Payer == from {
+		merged.Payer = into
+	}
+	if merged.IsPayment() && merged.Payer == into && (hasFrom || hasInto) {
+		return nil, true
+	}
+	if !hasFrom {
+		return merged, true
+	}
+	if !hasInto {
+		for i, participant := range merged.Participants {
+			if participant == from {
+				merged.Participants[i] = into
+			}
+		}
+		if !merged.Split.IsEqual() {
+			merged.Split.Values[into] = merged.Split.Values[from]
+			delete(merged.Split.Values, from)
+		}
+		return merged, true
+	}
+	// the transaction was validated when it was added
+	shares, _ := transaction.Shares()
+	values := map[string]int64{}
+	participants := []string{}
+	for _, participant := range transaction.Participants {
+		share := shares[participant].Units
+		if participant == from {
+			participant = into
+		}
+		if _, ok := values[participant]; !ok {
+			participants = append(participants, participant)
+		}
+		values[participant] += share
+	}
+	merged.Participants = participants
+	merged.Split = &Split{Mode: SplitExact, Values: values}
+	return merged, true
+}
+
+// participantByKey method returns the participant of the directory that the
+// key provided refers to, or nil if there is none. It must be called with the
+// settler locked.
+func (s *Settler) participantByKey(key string) *Participant {
+	for _, participant := range s.Participants {
+		if participant.matches(key) {
+			return participant
+		}
+	}
+	return nil
+}
+
+// knownName method returns the name of the person of the transactions that
+// the key provided refers to, the first one in alphabetical order if there
+// are many, or an empty string if there is none. It must be called with the
+// settler locked.
+func (s *Settler) knownName(key string) string {
+	known := ""
+	for person := range s.Balances {
+		if participantKey(person) == key && (known == "" || person < known) {
+			known = person
+		}
+	}
+	return known
+}
+
+// resolve method returns the name of the participant of the directory or the
+// person of the transactions that the name provided refers to, or an empty
+// string if it is unknown. It must be called with the settler locked.
+func (s *Settler) resolve(name string) string {
+	key := participantKey(name)
+	if participant := s.participantByKey(key); participant != nil {
+		return participant.Name
+	}
+	return s.knownName(key)
+}
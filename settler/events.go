@@ -0,0 +1,276 @@
+package settler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// EventKind type defines the kind of change of an event of the settler.
+type EventKind string
+
+const (
+	// EventOperation events record an operation of the journal: an expense
+	// or a payment added, removed or edited, or the expenses cleaned,
+	// imported, archived in a period or merged.
+	EventOperation EventKind = "operation"
+	// EventUndo events record an operation undone.
+	EventUndo EventKind = "undo"
+	// EventRedo events record an operation redone.
+	EventRedo EventKind = "redo"
+	// EventSettings events record a change of the settings: the currency,
+	// the rates, the strategy, the constraints or the directory.
+	EventSettings EventKind = "settings"
+	// EventCheckpoint events record the whole state of the settler, that
+	// replaces the events before it.
+	EventCheckpoint EventKind = "checkpoint"
+)
+
+var (
+	ErrInvalidEvent = errors.New("invalid event")
+	ErrEventGap     = errors.New("missing events")
+)
+
+// Settings struct contains the settings of a settler, that are recorded
+// together in the EventSettings events.
+type Settings struct {
+	Currency     string          `json:"currency"`
+	Rates        map[string]Rate `json:"rates,omitempty"`
+	Strategy     StrategyName    `json:"strategy,omitempty"`
+	Constraints  []*Constraint   `json:"constraints,omitempty"`
+	Participants []*Participant  `json:"participants,omitempty"`
+}
+
+// Event struct represents a change of the settler recorded in its event log,
+// with its sequence number, starting from 1, and the time it was made. The
+// operations, undone or redone, include their journal entry, the settings
+// events the new settings and the checkpoints the exported state.
+type Event struct {
+	Seq      int             `json:"seq"`
+	Time     time.Time       `json:"time"`
+	Kind     EventKind       `json:"kind"`
+	Entry    *JournalEntry   `json:"entry,omitempty"`
+	Settings *Settings       `json:"settings,omitempty"`
+	State    json.RawMessage `json:"state,omitempty"`
+}
+
+// DecodeEvent function decodes an event of the log of a settler.
+func DecodeEvent(data []byte) (*Event, error) {
+	event := &Event{}
+	if err := json.Unmarshal(data, event); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEvent, err)
+	}
+	return event, nil
+}
+
+// ReplayEvents function rebuilds a settler from an empty one applying the
+// events provided in order. If until is not zero, the events after it are
+// not applied, so the settler is the one at that time.
+func ReplayEvents(events []*Event, until time.Time) (*Settler, error) {
+	s := NewSettler()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, event := range events {
+		if !until.IsZero() && event.Time.After(until) {
+			break
+		}
+		if err := s.applyEvent(event); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// SetEventLog method sets the function that appends every change of the
+// settler to its event log, encoded as an Event, so the settler can be
+// rebuilt replaying them, see ApplyEvent. If the settler has no events yet,
+// a checkpoint with its current state is appended first. If an event can not
+// be appended, the next one is a checkpoint, which also includes the change
+// lost. A nil function disables the log.
+func (s *Settler) SetEventLog(appendEvent func(event []byte) error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.eventLog = appendEvent
+	s.lastSettings, _ = json.Marshal(s.settings())
+	if s.EventSeq == 0 {
+		s.emit(&Event{Kind: EventCheckpoint})
+	}
+}
+
+// CheckpointEvent method returns a checkpoint event with the current state
+// of the settler and the sequence number of its last event, that can replace
+// every event of the log until it.
+func (s *Settler) CheckpointEvent() ([]byte, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	state, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&Event{
+		Seq:   s.EventSeq,
+		Time:  time.Now(),
+		Kind:  EventCheckpoint,
+		State: state,
+	})
+}
+
+// ApplyEvent method applies an encoded event of the log of the settler. The
+// events already applied, with a sequence number that is not greater than
+// the one of the last event of the settler, are ignored, so a settler
+// restored from a snapshot can replay the whole log. It returns ErrEventGap
+// if the event is not the next one, unless it is a checkpoint.
+func (s *Settler) ApplyEvent(data []byte) error {
+	event, err := DecodeEvent(data)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.applyEvent(event)
+}
+
+// applyEvent method applies the event provided without recording it again.
+// It must be called with the settler locked.
+func (s *Settler) applyEvent(event *Event) error {
+	if event.Seq <= s.EventSeq {
+		return nil
+	}
+	if event.Kind != EventCheckpoint && event.Seq != s.EventSeq+1 {
+		return fmt.Errorf("%w: expected event %d, got %d", ErrEventGap, s.EventSeq+1, event.Seq)
+	}
+	if event.Entry == nil && (event.Kind == EventOperation || event.Kind == EventUndo || event.Kind == EventRedo) {
+		return fmt.Errorf("%w: %s event %d without entry", ErrInvalidEvent, event.Kind, event.Seq)
+	}
+	switch event.Kind {
+	case EventOperation:
+		s.applyEntry(event.Entry)
+		s.Journal.Undo = append(s.Journal.Undo, event.Entry)
+		s.Journal.Redo = nil
+	case EventUndo:
+		s.revertEntry(event.Entry)
+		if len(s.Journal.Undo) > 0 {
+			s.Journal.Undo = s.Journal.Undo[:len(s.Journal.Undo)-1]
+		}
+		s.Journal.Redo = append(s.Journal.Redo, event.Entry)
+	case EventRedo:
+		s.applyEntry(event.Entry)
+		if len(s.Journal.Redo) > 0 {
+			s.Journal.Redo = s.Journal.Redo[:len(s.Journal.Redo)-1]
+		}
+		s.Journal.Undo = append(s.Journal.Undo, event.Entry)
+	case EventSettings:
+		if event.Settings == nil {
+			return fmt.Errorf("%w: settings event %d without settings", ErrInvalidEvent, event.Seq)
+		}
+		s.setSettings(event.Settings)
+	case EventCheckpoint:
+		restored, err := ImportSettle(event.State)
+		if err != nil {
+			return fmt.Errorf("%w: checkpoint %d: %w", ErrInvalidEvent, event.Seq, err)
+		}
+		s.Currency = restored.Currency
+		s.Rates = restored.Rates
+		s.Balances = restored.Balances
+		s.Expenses = restored.Expenses
+		s.Payments = restored.Payments
+		s.Journal.Undo = restored.Journal.Undo
+		s.Journal.Redo = restored.Journal.Redo
+		s.Archive = restored.Archive
+		s.Strategy = restored.Strategy
+		s.Constraints = restored.Constraints
+		s.Participants = restored.Participants
+		s.lastID = restored.lastID
+	default:
+		return fmt.Errorf("%w: unknown kind '%s' of event %d", ErrInvalidEvent, event.Kind, event.Seq)
+	}
+	s.Journal.trim()
+	s.EventSeq = event.Seq
+	return nil
+}
+
+// settings method returns the current settings of the settler. It must be
+// called with the settler locked.
+func (s *Settler) settings() *Settings {
+	return &Settings{
+		Currency:     s.Currency,
+		Rates:        s.Rates,
+		Strategy:     s.Strategy,
+		Constraints:  s.Constraints,
+		Participants: s.Participants,
+	}
+}
+
+// setSettings method replaces the settings of the settler by a copy of the
+// settings provided. It must be called with the settler locked.
+func (s *Settler) setSettings(settings *Settings) {
+	s.Currency = settings.Currency
+	s.Rates = make(map[string]Rate, len(settings.Rates))
+	for pair, rate := range settings.Rates {
+		s.Rates[pair] = rate
+	}
+	s.Strategy = settings.Strategy
+	s.Constraints = copyConstraints(settings.Constraints)
+	s.Participants = copyParticipants(settings.Participants)
+}
+
+// emit method appends the event provided to the event log of the settler,
+// if any, with the next sequence number and the current time. If the
+// previous event could not be appended, it appends a checkpoint instead. It
+// must be called with the settler locked and after the change is applied.
+func (s *Settler) emit(event *Event) {
+	if s.eventLog == nil {
+		return
+	}
+	if s.eventsLost {
+		event = &Event{Kind: EventCheckpoint}
+	}
+	event.Seq = s.EventSeq + 1
+	event.Time = time.Now()
+	var err error
+	if event.Kind == EventCheckpoint {
+		event.State, err = json.Marshal(s)
+	}
+	var encoded []byte
+	if err == nil {
+		encoded, err = json.Marshal(event)
+	}
+	if err == nil {
+		err = s.eventLog(encoded)
+	}
+	if err != nil {
+		s.eventsLost = true
+		return
+	}
+	s.EventSeq = event.Seq
+	s.eventsLost = false
+	s.lastSettings, _ = json.Marshal(s.settings())
+}
+
+// emitEntry method appends an event of the kind provided with the journal
+// entry provided, if it is not nil. It must be called with the settler
+// locked.
+func (s *Settler) emitEntry(kind EventKind, entry *JournalEntry) {
+	if entry != nil {
+		s.emit(&Event{Kind: kind, Entry: entry})
+	}
+}
+
+// emitSettings method appends a settings event if the settings changed since
+// the last event. It must be called with the settler locked.
+func (s *Settler) emitSettings() {
+	if s.eventLog == nil {
+		return
+	}
+	settings := s.settings()
+	if encoded, err := json.Marshal(settings); err == nil && bytes.Equal(encoded, s.lastSettings) {
+		return
+	}
+	s.emit(&Event{Kind: EventSettings, Settings: settings})
+}
@@ -0,0 +1,238 @@
+package settler
+
+import "errors"
+
+// DefaultJournalDepth is the default number of operations that can be undone.
+const DefaultJournalDepth = 20
+
+// Operation type defines the kind of change recorded in the journal.
+type Operation string
+
+const (
+	// OpAdd operations add an expense or a payment.
+	OpAdd Operation = "add"
+	// OpRemove operations remove an expense or a payment.
+	OpRemove Operation = "remove"
+	// OpEdit operations replace an expense by an updated version of it.
+	OpEdit Operation = "edit"
+	// OpClean operations remove every expense and payment.
+	OpClean Operation = "clean"
+	// OpImport operations replace every expense and payment by the imported
+	// ones.
+	OpImport Operation = "import"
+	// OpClose operations archive every expense and payment in a period and
+	// remove them.
+	OpClose Operation = "close"
+	// OpMerge operations replace a participant by another one in every
+	// transaction, see MergeParticipants.
+	OpMerge Operation = "merge"
+)
+
+var (
+	ErrNothingToUndo = errors.New("nothing to undo")
+	ErrNothingToRedo = errors.New("nothing to redo")
+)
+
+// Change struct represents the change of a single transaction: its state
+// before and after the operation. If Before is nil, the transaction was
+// added, and if After is nil, it was removed.
+type Change struct {
+	ID     int          `json:"id"`
+	Before *Transaction `json:"before,omitempty"`
+	After  *Transaction `json:"after,omitempty"`
+}
+
+// JournalEntry struct represents an operation recorded in the journal, with
+// the changes of the transactions that it made and the last ID of the
+// settler before and after it. The entries of OpClose operations also
+// include the period archived and the ones of OpMerge operations the
+// participants merged.
+type JournalEntry struct {
+	Operation    Operation    `json:"operation"`
+	Changes      []Change     `json:"changes"`
+	LastIDBefore int          `json:"lastIDBefore"`
+	LastIDAfter  int          `json:"lastIDAfter"`
+	Period       *Period      `json:"period,omitempty"`
+	Merge        *MergeChange `json:"merge,omitempty"`
+}
+
+// Journal struct contains the operations that can be undone and the undone
+// ones that can be redone, from the oldest to the newest. It keeps up to
+// Depth operations of each kind, the oldest ones are discarded first.
+type Journal struct {
+	Undo  []*JournalEntry `json:"undo,omitempty"`
+	Redo  []*JournalEntry `json:"redo,omitempty"`
+	Depth int             `json:"-"`
+}
+
+// newJournal function creates an empty journal of the depth provided.
+func newJournal(depth int) *Journal {
+	return &Journal{Depth: depth}
+}
+
+// trim method discards the oldest entries of the journal that exceed its
+// depth.
+func (j *Journal) trim() {
+	depth := max(j.Depth, 0)
+	if len(j.Undo) > depth {
+		j.Undo = append([]*JournalEntry{}, j.Undo[len(j.Undo)-depth:]...)
+	}
+	if len(j.Redo) > depth {
+		j.Redo = append([]*JournalEntry{}, j.Redo[len(j.Redo)-depth:]...)
+	}
+}
+
+// SetJournalDepth method sets the number of operations that can be undone,
+// discarding the oldest ones that exceed it. A depth of zero disables the
+// journal.
+func (s *Settler) SetJournalDepth(depth int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.Journal.Depth = depth
+	s.Journal.trim()
+}
+
+// JournalLen method returns the number of operations that can be undone and
+// redone.
+func (s *Settler) JournalLen() (int, int) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return len(s.Journal.Undo), len(s.Journal.Redo)
+}
+
+// Undo method reverts the last operation recorded in the journal, restoring
+// the transactions that it changed and their balances, and returns it. The
+// operation can be redone until a new one is recorded. It returns
+// ErrNothingToUndo if the journal is empty.
+func (s *Settler) Undo() (*JournalEntry, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(s.Journal.Undo) == 0 {
+		return nil, ErrNothingToUndo
+	}
+	entry := s.Journal.Undo[len(s.Journal.Undo)-1]
+	s.Journal.Undo = s.Journal.Undo[:len(s.Journal.Undo)-1]
+	s.revertEntry(entry)
+	s.Journal.Redo = append(s.Journal.Redo, entry)
+	s.Journal.trim()
+	s.emitEntry(EventUndo, entry)
+	return entry, nil
+}
+
+// Redo method applies again the last operation undone and returns it. It
+// returns ErrNothingToRedo if there is no operation undone or a new one has
+// been recorded after undoing it.
+func (s *Settler) Redo() (*JournalEntry, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(s.Journal.Redo) == 0 {
+		return nil, ErrNothingToRedo
+	}
+	entry := s.Journal.Redo[len(s.Journal.Redo)-1]
+	s.Journal.Redo = s.Journal.Redo[:len(s.Journal.Redo)-1]
+	s.applyEntry(entry)
+	s.Journal.Undo = append(s.Journal.Undo, entry)
+	s.Journal.trim()
+	s.emitEntry(EventRedo, entry)
+	return entry, nil
+}
+
+// revertEntry method reverts the changes of the journal entry provided,
+// restoring the transactions, the last ID, the archive and the directory
+// before it. It must be called with the settler locked.
+func (s *Settler) revertEntry(entry *JournalEntry) {
+	// revert the changes in the reverse order
+	for i := len(entry.Changes) - 1; i >= 0; i-- {
+		change := entry.Changes[i]
+		s.setTransaction(change.ID, change.Before)
+	}
+	s.lastID = entry.LastIDBefore
+	// the period closed is always the last one archived
+	if entry.Operation == OpClose && len(s.Archive) > 0 {
+		s.Archive = s.Archive[:len(s.Archive)-1]
+	}
+	if entry.Merge != nil {
+		s.Participants = copyParticipants(entry.Merge.ParticipantsBefore)
+		s.Constraints = copyConstraints(entry.Merge.ConstraintsBefore)
+	}
+}
+
+// applyEntry method applies again the changes of the journal entry provided.
+// It must be called with the settler locked.
+func (s *Settler) applyEntry(entry *JournalEntry) {
+	for _, change := range entry.Changes {
+		s.setTransaction(change.ID, change.After)
+	}
+	s.lastID = entry.LastIDAfter
+	if entry.Operation == OpClose && entry.Period != nil {
+		s.Archive = append(s.Archive, entry.Period)
+	}
+	if entry.Merge != nil {
+		s.Participants = copyParticipants(entry.Merge.ParticipantsAfter)
+		s.Constraints = copyConstraints(entry.Merge.ConstraintsAfter)
+	}
+}
+
+// record method adds the operation provided to the journal and discards the
+// operations undone, that cannot be redone anymore. The transactions of the
+// changes are copied, so they are not affected by later modifications. It
+// must be called with the settler locked and after the operation is applied.
+// It returns the entry recorded, or nil if the operation changed nothing.
+func (s *Settler) record(op Operation, lastIDBefore int, changes ...Change) *JournalEntry {
+	if len(changes) == 0 {
+		return nil
+	}
+	for i, change := range changes {
+		if change.Before != nil {
+			changes[i].Before = change.Before.Copy()
+		}
+		if change.After != nil {
+			changes[i].After = change.After.Copy()
+		}
+	}
+	return s.push(&JournalEntry{
+		Operation:    op,
+		Changes:      changes,
+		LastIDBefore: lastIDBefore,
+		LastIDAfter:  s.lastID,
+	})
+}
+
+// push method appends the entry provided to the operations that can be
+// undone, discarding the ones undone, and returns it. It must be called with
+// the settler locked.
+func (s *Settler) push(entry *JournalEntry) *JournalEntry {
+	s.Journal.Undo = append(s.Journal.Undo, entry)
+	s.Journal.Redo = nil
+	s.Journal.trim()
+	return entry
+}
+
+// setTransaction method replaces the transaction with the ID provided by a
+// copy of the transaction provided, or removes it if it is nil, updating the
+// balances. It must be called with the settler locked.
+func (s *Settler) setTransaction(id int, transaction *Transaction) {
+	for _, transactions := range []map[int]*Transaction{s.Expenses, s.Payments} {
+		if current, exist := transactions[id]; exist {
+			// the transaction was validated when it was added
+			shares, _ := current.Shares()
+			s.applyTransaction(current, shares, true)
+			delete(transactions, id)
+		}
+	}
+	if transaction == nil {
+		return
+	}
+	transaction = transaction.Copy()
+	shares, _ := transaction.Shares()
+	s.applyTransaction(transaction, shares, false)
+	if transaction.IsPayment() {
+		s.Payments[id] = transaction
+	} else {
+		s.Expenses[id] = transaction
+	}
+}
@@ -0,0 +1,222 @@
+package settler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultCurrency is the currency used when no other is provided.
+	DefaultCurrency = "EUR"
+	// moneyDecimals is the number of decimals of the minor units of every
+	// currency, so one unit of a currency is 100 minor units.
+	moneyDecimals = 2
+)
+
+var ErrInvalidMoney = errors.New("invalid money amount")
+
+// Money struct represents an amount of money of a currency. It is stored as
+// an integer number of minor units (for example, cents) to avoid rounding
+// errors, so 12.30 EUR is stored as 1230 units of EUR.
+type Money struct {
+	Units    int64
+	Currency string
+}
+
+// NewMoney function returns a Money with the provided minor units and
+// currency.
+func NewMoney(units int64, currency string) Money {
+	return Money{Units: units, Currency: currency}
+}
+
+// ParseMoney function parses a decimal amount of money, optionally followed
+// by its currency code separated by a space, such as "12.30" or "12.30 EUR".
+// Both dot and comma are accepted as decimal separator, but the amount can
+// not have more decimals than the minor units of the currency. If no
+// currency is provided, the resulting money has no currency.
+func ParseMoney(str string) (Money, error) {
+	fields := strings.Fields(str)
+	if len(fields) == 0 || len(fields) > 2 {
+		return Money{}, fmt.Errorf("%w: '%s'", ErrInvalidMoney, str)
+	}
+	units, err := parseDecimal(fields[0], moneyDecimals)
+	if err != nil {
+		return Money{}, fmt.Errorf("%w: '%s'", ErrInvalidMoney, str)
+	}
+	money := Money{Units: units}
+	if len(fields) == 2 {
+		money.Currency = strings.ToUpper(fields[1])
+	}
+	return money, nil
+}
+
+// Decimal method returns the amount of money as a decimal number without the
+// currency, such as "12.30".
+func (m Money) Decimal() string {
+	return formatDecimal(m.Units, moneyDecimals)
+}
+
+// String method returns the amount of money as a decimal number followed by
+// its currency, such as "12.30 EUR".
+func (m Money) String() string {
+	if m.Currency == "" {
+		return m.Decimal()
+	}
+	return m.Decimal() + " " + m.Currency
+}
+
+// IsZero method returns if the amount of money is zero.
+func (m Money) IsZero() bool {
+	return m.Units == 0
+}
+
+// Add method returns the sum of both amounts of money. Both amounts must be
+// of the same currency, the result keeps the currency of the receiver.
+func (m Money) Add(other Money) Money {
+	return Money{Units: m.Units + other.Units, Currency: m.Currency}
+}
+
+// Sub method returns the difference of both amounts of money. Both amounts
+// must be of the same currency, the result keeps the currency of the
+// receiver.
+func (m Money) Sub(other Money) Money {
+	return Money{Units: m.Units - other.Units, Currency: m.Currency}
+}
+
+// Neg method returns the opposite amount of money.
+func (m Money) Neg() Money {
+	return Money{Units: -m.Units, Currency: m.Currency}
+}
+
+// Abs method returns the absolute amount of money.
+func (m Money) Abs() Money {
+	if m.Units < 0 {
+		return m.Neg()
+	}
+	return m
+}
+
+// Allocate method divides the amount of money proportionally to the weights
+// provided, returning a part per weight that always sum the whole amount. Each
+// part gets the integer division of its proportional amount, and the minor
+// units that remain are assigned one by one to the parts with the largest
+// remainder, breaking ties by the order of the weights. The weights must be
+// non negative and sum more than zero.
+func (m Money) Allocate(weights []int64) ([]Money, error) {
+	total := int64(0)
+	for _, weight := range weights {
+		if weight < 0 {
+			return nil, fmt.Errorf("negative weight %d", weight)
+		}
+		total += weight
+	}
+	if total <= 0 {
+		return nil, fmt.Errorf("weights must sum more than zero")
+	}
+	parts := make([]Money, len(weights))
+	remainders := make([]int64, len(weights))
+	allocated := int64(0)
+	for i, weight := range weights {
+		parts[i] = Money{Units: m.Units * weight / total, Currency: m.Currency}
+		remainders[i] = m.Units * weight % total
+		allocated += parts[i].Units
+	}
+	// assign the remaining units to the parts with the largest remainders, if
+	// two parts have the same remainder, the first one goes first
+	for left := m.Units - allocated; left > 0; left-- {
+		selected := -1
+		for i, remainder := range remainders {
+			if weights[i] == 0 {
+				continue
+			}
+			if selected == -1 || remainder > remainders[selected] {
+				selected = i
+			}
+		}
+		parts[selected].Units++
+		// the selected part can not receive another unit until the rest do
+		remainders[selected] = -1
+	}
+	return parts, nil
+}
+
+// MarshalJSON method encodes the money as a string like "12.30 EUR" to keep
+// it readable and lossless.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// UnmarshalJSON method decodes the money from a string like "12.30 EUR". It
+// also accepts plain numbers, as they were stored by previous versions, which
+// are rounded to the nearest minor unit.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		var number float64
+		if err := json.Unmarshal(data, &number); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidMoney, string(data))
+		}
+		*m = Money{Units: int64(math.Round(number * math.Pow10(moneyDecimals)))}
+		return nil
+	}
+	money, err := ParseMoney(str)
+	if err != nil {
+		return err
+	}
+	*m = money
+	return nil
+}
+
+// parseDecimal parses a decimal number as an integer scaled by the number of
+// decimals provided, so "12.3" with two decimals results in 1230. It fails if
+// the number has more decimals than the provided ones.
+func parseDecimal(str string, decimals int) (int64, error) {
+	str = strings.TrimSpace(str)
+	// accept both dot and comma as decimal separator
+	if !strings.Contains(str, ".") {
+		str = strings.Replace(str, ",", ".", 1)
+	}
+	negative := strings.HasPrefix(str, "-")
+	str = strings.TrimPrefix(strings.TrimPrefix(str, "-"), "+")
+	intPart, fracPart, _ := strings.Cut(str, ".")
+	if intPart == "" && fracPart == "" {
+		return 0, fmt.Errorf("empty number")
+	}
+	if len(fracPart) > decimals {
+		return 0, fmt.Errorf("too many decimals in %s", str)
+	}
+	fracPart += strings.Repeat("0", decimals-len(fracPart))
+	digits := intPart + fracPart
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("invalid number %s", str)
+		}
+	}
+	value, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if negative {
+		value = -value
+	}
+	return value, nil
+}
+
+// formatDecimal formats an integer scaled by the number of decimals provided
+// as a decimal number, so 1230 with two decimals results in "12.30".
+func formatDecimal(value int64, decimals int) string {
+	if decimals == 0 {
+		return strconv.FormatInt(value, 10)
+	}
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	scale := int64(math.Pow10(decimals))
+	return fmt.Sprintf("%s%d.%0*d", sign, value/scale, decimals, value%scale)
+}
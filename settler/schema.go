@@ -0,0 +1,107 @@
+package settler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// SchemaVersion is the version of the format of the settlers exported. The
+// settlers exported by the previous versions are upgraded when they are
+// imported, see ImportSettle.
+const SchemaVersion = 1
+
+// ErrUnsupportedVersion is returned when a settler was exported by a newer
+// version, whose format is not known.
+var ErrUnsupportedVersion = errors.New("unsupported schema version")
+
+// schemaMigrations are the functions that upgrade an exported settler of
+// each version, by position, to the next one.
+var schemaMigrations = []func(fields map[string]json.RawMessage) error{
+	// version 0 did not store the version nor the last ID, so it is
+	// recovered from the IDs of the transactions and the last operation of
+	// the journal, that recorded it, so the IDs of the transactions removed
+	// are not reused
+	func(fields map[string]json.RawMessage) error {
+		legacy := struct {
+			Expenses map[int]json.RawMessage `json:"expenses"`
+			Payments map[int]json.RawMessage `json:"payments"`
+			Journal  *struct {
+				Undo []*JournalEntry `json:"undo"`
+			} `json:"journal"`
+		}{}
+		encoded, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(encoded, &legacy); err != nil {
+			return err
+		}
+		lastID := 0
+		for _, transactions := range []map[int]json.RawMessage{legacy.Expenses, legacy.Payments} {
+			for id := range transactions {
+				lastID = max(lastID, id)
+			}
+		}
+		if legacy.Journal != nil && len(legacy.Journal.Undo) > 0 {
+			lastID = max(lastID, legacy.Journal.Undo[len(legacy.Journal.Undo)-1].LastIDAfter)
+		}
+		fields["lastID"], _ = json.Marshal(lastID)
+		return nil
+	},
+}
+
+// migrateSchema function upgrades the exported settler provided to the
+// current SchemaVersion, applying the migrations of every version since the
+// one that exported it.
+func migrateSchema(encoded []byte) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, err
+	}
+	version := 0
+	if raw, ok := fields["version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, fmt.Errorf("invalid schema version: %w", err)
+		}
+	}
+	if version == SchemaVersion {
+		return encoded, nil
+	}
+	if version < 0 || version > SchemaVersion {
+		return nil, fmt.Errorf("%w: %d, expected up to %d", ErrUnsupportedVersion, version, SchemaVersion)
+	}
+	for ; version < SchemaVersion; version++ {
+		if err := schemaMigrations[version](fields); err != nil {
+			return nil, fmt.Errorf("error migrating schema version %d: %w", version, err)
+		}
+	}
+	fields["version"], _ = json.Marshal(SchemaVersion)
+	return json.Marshal(fields)
+}
+
+// MarshalJSON method encodes the settler with the current SchemaVersion and
+// its last ID.
+func (s *Settler) MarshalJSON() ([]byte, error) {
+	type plain Settler
+	return json.Marshal(&struct {
+		Version int `json:"version"`
+		*plain
+		LastID int `json:"lastID"`
+	}{SchemaVersion, (*plain)(s), s.lastID})
+}
+
+// UnmarshalJSON method decodes a settler encoded with the current
+// SchemaVersion, including its last ID.
+func (s *Settler) UnmarshalJSON(data []byte) error {
+	type plain Settler
+	decoded := &struct {
+		*plain
+		LastID int `json:"lastID"`
+	}{plain: (*plain)(s)}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		return err
+	}
+	s.lastID = decoded.LastID
+	return nil
+}
@@ -2,50 +2,280 @@ package settler
 
 import (
 	"encoding/json"
-	"math"
+	"fmt"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
-// Transaction struct represents an expense transaction.
+// TransactionKind type defines if a transaction is a shared expense or a
+// payment between two persons.
+type TransactionKind string
+
+const (
+	// KindExpense transactions are expenses shared between the participants,
+	// it is the default kind.
+	KindExpense TransactionKind = ""
+	// KindPayment transactions are payments from the payer to the only
+	// participant, that settle part of the debts between them.
+	KindPayment TransactionKind = "payment"
+)
+
+// Transaction struct represents an expense transaction. The split defines how
+// the amount is divided between the participants, if it is not defined, the
+// amount is divided evenly. Payments are transactions of KindPayment, where
+// the payer gives the amount to the only participant. The description, the
+// date, the category and the user that created the transaction are optional
+// and they are only informative, they do not affect the balances.
 type Transaction struct {
-	Payer        string   `json:"payer"`
-	Participants []string `json:"participants"`
-	Amount       float64  `json:"amount"`
+	Kind         TransactionKind `json:"kind,omitempty"`
+	Payer        string          `json:"payer"`
+	Participants []string        `json:"participants"`
+	Amount       Money           `json:"amount"`
+	Split        *Split          `json:"split,omitempty"`
+	Description  string          `json:"description,omitempty"`
+	Date         time.Time       `json:"date"`
+	Category     string          `json:"category,omitempty"`
+	CreatedBy    string          `json:"createdBy,omitempty"`
 }
 
-// Settler struct contains the list of expenses. They can be settled and
-// cleaned, or just settled.
+// IsPayment method returns if the transaction is a payment.
+func (t *Transaction) IsPayment() bool {
+	return t.Kind == KindPayment
+}
+
+// Copy method returns a deep copy of the transaction.
+func (t *Transaction) Copy() *Transaction {
+	copied := *t
+	copied.Participants = append([]string{}, t.Participants...)
+	if t.Split != nil {
+		copied.Split = &Split{Mode: t.Split.Mode}
+		if t.Split.Values != nil {
+			copied.Split.Values = make(map[string]int64, len(t.Split.Values))
+			for participant, value := range t.Split.Values {
+				copied.Split.Values[participant] = value
+			}
+		}
+	}
+	return &copied
+}
+
+// Settler struct contains the list of expenses and the payments made to
+// settle them. They can be settled and cleaned, or just settled. Every change
+// of the expenses and the payments is recorded in the journal, so it can be
+// undone and redone. Expenses can be in any currency, the balances keep the
+// amounts in their original currency and they are converted to the base
+// currency of the settler using its exchange rates table when they are listed
+// or settled. The directory of participants maps the Telegram users and the
+// aliases to the names used in the transactions.
 type Settler struct {
-	Balances map[string]float64   `json:"balances"`
-	Expenses map[int]*Transaction `json:"expenses"`
-	mtx      sync.RWMutex
-	lastID   int
+	Currency     string               `json:"currency"`
+	Rates        map[string]Rate      `json:"rates,omitempty"`
+	Balances     map[string]Balance   `json:"-"`
+	Expenses     map[int]*Transaction `json:"expenses"`
+	Payments     map[int]*Transaction `json:"payments,omitempty"`
+	Journal      *Journal             `json:"journal,omitempty"`
+	Archive      []*Period            `json:"archive,omitempty"`
+	Strategy     StrategyName         `json:"strategy,omitempty"`
+	Constraints  []*Constraint        `json:"constraints,omitempty"`
+	Participants []*Participant       `json:"participants,omitempty"`
+	// EventSeq is the sequence number of the last event of the event log
+	// included in the settler, see SetEventLog
+	EventSeq int `json:"eventSeq,omitempty"`
+	// ExactLimit is the maximum number of persons that the exact strategy
+	// settles before falling back to the greedy one
+	ExactLimit int `json:"-"`
+	mtx        sync.RWMutex
+	lastID     int
+	// eventLog appends the events of the changes, eventsLost is true if the
+	// last one could not be appended, and lastSettings are the encoded
+	// settings of the last event
+	eventLog     func([]byte) error
+	eventsLost   bool
+	lastSettings []byte
 }
 
 // NewSettler creates a new Settler instance.
 func NewSettler() *Settler {
 	return &Settler{
-		Balances: make(map[string]float64),
-		Expenses: make(map[int]*Transaction),
-		mtx:      sync.RWMutex{},
-		lastID:   0,
+		Currency:   DefaultCurrency,
+		Rates:      make(map[string]Rate),
+		Balances:   make(map[string]Balance),
+		Expenses:   make(map[int]*Transaction),
+		Payments:   make(map[int]*Transaction),
+		Journal:    newJournal(DefaultJournalDepth),
+		Strategy:   StrategyGreedy,
+		ExactLimit: DefaultExactLimit,
+		mtx:        sync.RWMutex{},
+		lastID:     0,
 	}
 }
 
-// AddExpense method adds an expense to the list of expenses.
-func (s *Settler) AddExpense(payer string, participants []string, amount float64) int {
+// SetCurrency method sets the base currency of the settler, which is used to
+// list and settle the balances and as the default currency of new expenses.
+func (s *Settler) SetCurrency(currency string) error {
+	currency, err := ParseCurrency(currency)
+	if err != nil {
+		return err
+	}
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
+	s.Currency = currency
+	s.emitSettings()
+	return nil
+}
+
+// SetRate method sets or overrides the exchange rate from a currency to
+// another, where one unit of the first currency is worth the rate provided of
+// the second one. The opposite rate is removed to keep the table consistent.
+func (s *Settler) SetRate(from, to string, rate Rate) error {
+	from, err := ParseCurrency(from)
+	if err != nil {
+		return err
+	}
+	if to, err = ParseCurrency(to); err != nil {
+		return err
+	}
+	if from == to || rate <= 0 {
+		return fmt.Errorf("%w: %s %s to %s", ErrInvalidRate, rate, from, to)
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.Rates[rateKey(from, to)] = rate
+	delete(s.Rates, rateKey(to, from))
+	s.emitSettings()
+	return nil
+}
 
+// SetStrategy method sets the strategy used to settle the balances. It
+// returns an error if the strategy is unknown.
+func (s *Settler) SetStrategy(name string) error {
+	strategy, err := ParseStrategyName(name)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.Strategy = strategy
+	s.emitSettings()
+	return nil
+}
+
+// SetExactLimit method sets the maximum number of persons that the exact
+// strategy settles before falling back to the greedy one, up to
+// MaxExactLimit.
+func (s *Settler) SetExactLimit(limit int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.ExactLimit = min(limit, MaxExactLimit)
+}
+
+// ListRates method returns a copy of the exchange rates table, indexed by
+// pairs of currencies like "USD/EUR".
+func (s *Settler) ListRates() map[string]Rate {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	rates := make(map[string]Rate, len(s.Rates))
+	for pair, rate := range s.Rates {
+		rates[pair] = rate
+	}
+	return rates
+}
+
+// Currencies method returns the base currency of the settler followed by the
+// rest of currencies of its exchange rates table, sorted alphabetically.
+func (s *Settler) Currencies() []string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	others := map[string]bool{}
+	for pair := range s.Rates {
+		from, to, _ := strings.Cut(pair, "/")
+		others[from], others[to] = true, true
+	}
+	delete(others, s.Currency)
+	currencies := []string{}
+	for currency := range others {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	return append([]string{s.Currency}, currencies...)
+}
+
+// AddExpense method adds an expense to the list of expenses and updates the
+// balances of the payer and the participants according to its split. It
+// returns the ID of the new expense or an error if the expense is not valid.
+// If the amount of the expense has no currency, it takes the base currency of
+// the settler.
+func (s *Settler) AddExpense(expense *Transaction) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if expense.IsPayment() {
+		return 0, fmt.Errorf("%w: it is a payment", ErrInvalidPayment)
+	}
+	if expense.Amount.Currency == "" {
+		expense.Amount.Currency = s.Currency
+	} else if _, err := ParseCurrency(expense.Amount.Currency); err != nil {
+		return 0, err
+	}
+	shares, err := expense.Shares()
+	if err != nil {
+		return 0, err
+	}
 	s.lastID++
-	s.Expenses[s.lastID] = &Transaction{payer, participants, amount}
-	s.Balances[payer] += amount
-	amountByParticipant := amount / float64(len(participants))
-	for _, participant := range participants {
-		s.Balances[participant] -= amountByParticipant
+	s.Expenses[s.lastID] = expense
+	s.applyTransaction(expense, shares, false)
+	s.emitEntry(EventOperation, s.record(OpAdd, s.lastID-1, Change{ID: s.lastID, After: expense}))
+	return s.lastID, nil
+}
+
+// GetExpense method returns a copy of the expense with the ID provided, or
+// false if it does not exist.
+func (s *Settler) GetExpense(id int) (*Transaction, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	expense, exist := s.Expenses[id]
+	if !exist {
+		return nil, false
+	}
+	return expense.Copy(), true
+}
+
+// UpdateExpense method replaces the expense with the ID provided by the
+// expense provided, keeping its ID, and updates the balances to reflect the
+// change. The expense is validated before changing anything, so if it is not
+// valid or the ID does not exist, it returns an error and the settler is not
+// modified. If the amount of the expense has no currency, it takes the base
+// currency of the settler.
+func (s *Settler) UpdateExpense(id int, expense *Transaction) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	current, exist := s.Expenses[id]
+	if !exist {
+		return fmt.Errorf("%w: %d", ErrExpenseNotFound, id)
 	}
-	return s.lastID
+	if expense.IsPayment() {
+		return fmt.Errorf("%w: it is a payment", ErrInvalidPayment)
+	}
+	if expense.Amount.Currency == "" {
+		expense.Amount.Currency = s.Currency
+	} else if _, err := ParseCurrency(expense.Amount.Currency); err != nil {
+		return err
+	}
+	shares, err := expense.Shares()
+	if err != nil {
+		return err
+	}
+	// the current expense was validated when it was added
+	currentShares, _ := current.Shares()
+	s.applyTransaction(current, currentShares, true)
+	s.applyTransaction(expense, shares, false)
+	s.Expenses[id] = expense
+	s.emitEntry(EventOperation, s.record(OpEdit, s.lastID, Change{ID: id, Before: current, After: expense}))
+	return nil
 }
 
 // RemoveExpense method removes an expense from the list of expenses.
@@ -54,13 +284,61 @@ func (s *Settler) RemoveExpense(id int) {
 	defer s.mtx.Unlock()
 
 	if expense, exist := s.Expenses[id]; exist {
-		s.Balances[expense.Payer] -= expense.Amount
-		amountByParticipant := expense.Amount / float64(len(expense.Participants))
-		for _, participant := range expense.Participants {
-			s.Balances[participant] += amountByParticipant
-		}
+		// the expense was validated when it was added, so its shares can be
+		// calculated again
+		shares, _ := expense.Shares()
+		s.applyTransaction(expense, shares, true)
+		delete(s.Expenses, id)
+		s.emitEntry(EventOperation, s.record(OpRemove, s.lastID, Change{ID: id, Before: expense}))
+	}
+}
+
+// AddPayment method records a payment from its payer to its only
+// participant, which moves the balance between them without being a shared
+// expense. It returns the ID of the payment, that shares the sequence of IDs
+// with the expenses, or an error if the payment is not valid. If the amount
+// has no currency, it takes the base currency of the settler.
+func (s *Settler) AddPayment(payment *Transaction) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	payment.Kind = KindPayment
+	if payment.Amount.Currency == "" {
+		payment.Amount.Currency = s.Currency
+	} else if _, err := ParseCurrency(payment.Amount.Currency); err != nil {
+		return 0, err
+	}
+	shares, err := payment.Shares()
+	if err != nil {
+		return 0, err
+	}
+	s.lastID++
+	s.Payments[s.lastID] = payment
+	s.applyTransaction(payment, shares, false)
+	s.emitEntry(EventOperation, s.record(OpAdd, s.lastID-1, Change{ID: s.lastID, After: payment}))
+	return s.lastID, nil
+}
+
+// RemovePayment method removes a payment from the list of payments.
+func (s *Settler) RemovePayment(id int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if payment, exist := s.Payments[id]; exist {
+		shares, _ := payment.Shares()
+		s.applyTransaction(payment, shares, true)
+		delete(s.Payments, id)
+		s.emitEntry(EventOperation, s.record(OpRemove, s.lastID, Change{ID: id, Before: payment}))
 	}
-	delete(s.Expenses, id)
+}
+
+// ListPayments method returns the list of payments and their IDs, sorted by
+// ID.
+func (s *Settler) ListPayments() ([]*Transaction, []int) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return sortedTransactions(s.Payments)
 }
 
 // Expenses method returns the map of expenses with their IDs.
@@ -68,120 +346,294 @@ func (s *Settler) ListExpenses() ([]*Transaction, []int) {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 
-	ids := sort.IntSlice{}
-	for id := range s.Expenses {
-		ids = append(ids, id)
-	}
-	// sort the IDs
-	sort.Sort(ids)
-	// create the list of expenses
-	expenses := []*Transaction{}
-	for _, id := range ids {
-		expenses = append(expenses, s.Expenses[id])
-	}
-	return expenses, ids
+	return sortedTransactions(s.Expenses)
 }
 
-// Balances method returns the map of balances for each person. If the balance
-// is positive, the person is owed money, if it is negative, the person owes
-// money.
-func (s *Settler) ListBalances() map[string]float64 {
+// ListBalances method returns the map of balances for each person in the base
+// currency of the settler. If the balance is positive, the person is owed
+// money, if it is negative, the person owes money. It returns an error if the
+// exchange rate of any currency of the expenses is missing.
+func (s *Settler) ListBalances() (map[string]Money, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return convertBalances(s.Rates, s.Balances, s.Currency)
+}
+
+// ListOriginalBalances method returns the map of balances for each person in
+// the original currencies of the expenses, without converting them.
+func (s *Settler) ListOriginalBalances() map[string]Balance {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 	// create a copy of the balances map
-	balances := make(map[string]float64)
+	balances := make(map[string]Balance)
 	for person, balance := range s.Balances {
-		if balance == 0 {
-			continue
+		for currency, money := range balance {
+			if money.IsZero() {
+				continue
+			}
+			if _, ok := balances[person]; !ok {
+				balances[person] = Balance{}
+			}
+			balances[person][currency] = money
 		}
-		balances[person] = balance
 	}
 	return balances
 }
 
-// Settle method returns the list of transactions resulting from the settlement.
-// It does not clean the list of expenses. The settlement algorithm consists in
-// minimizing the number of transactions needed to settle shared expenses. It
-// calculates the balance for each person and then settles the debts by finding
-// the person who has paid the most and the person who has paid the least and
-// the amounts. It then settles the debt getting the minimum between the amount
-// owed and the amount owed. It repeats this process until all debts are
-// settled.
-func (s *Settler) Settle(clean bool) []*Transaction {
-	// clean the list of expenses and balances if requested
+// Settle method returns the list of transactions resulting from the
+// settlement. If clean is true, the expenses are archived in a new period,
+// see ClosePeriod, otherwise they are kept. The balances are converted to the
+// base currency of the settler before settling them, so it returns an error
+// if any exchange rate is missing. The transactions are calculated by the
+// strategy of the settler, see StrategyGreedy and StrategyExact, satisfying
+// its constraints, see SettleConstrained, so it also returns an error if they
+// cannot be satisfied.
+func (s *Settler) Settle(clean bool) ([]*Transaction, error) {
+	// archive the expenses and the balances in a period if requested
 	if clean {
-		defer s.Clean()
+		period, err := s.ClosePeriod("", time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return period.Transfers, nil
 	}
-	// get a copy of current balances of the participants
-	balances := s.ListBalances()
-	// lock read access to the settler
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
-	// initialize the transactions list
-	result := []*Transaction{}
-	for {
-		maxCreditor := ""
-		maxDebtor := ""
-		maxAmount := 0.0
-		minAmount := 0.0
-		// find the person who has paid the most and the person who has paid
-		// the least and the amounts
-		for person, balance := range balances {
-			if balance > maxAmount {
-				maxCreditor = person
-				maxAmount = balance
-			}
-			if balance < minAmount {
-				maxDebtor = person
-				minAmount = balance
+	return s.settle()
+}
+
+// settle method returns the transactions that settle the current balances
+// with the strategy and the constraints of the settler. It must be called
+// with the settler locked.
+func (s *Settler) settle() ([]*Transaction, error) {
+	balances, err := convertBalances(s.Rates, s.Balances, s.Currency)
+	if err != nil {
+		return nil, err
+	}
+	strategy := newStrategy(s.Strategy, s.ExactLimit)
+	return SettleConstrained(strategy, balances, s.Constraints)
+}
+
+// applyTransaction method updates the balances of the payer and the
+// participants of the transaction according to the shares provided. If revert
+// is true, it undoes the transaction instead.
+func (s *Settler) applyTransaction(t *Transaction, shares map[string]Money, revert bool) {
+	amount := t.Amount
+	if revert {
+		amount = amount.Neg()
+	}
+	s.updateBalance(t.Payer, amount)
+	for participant, share := range shares {
+		if !revert {
+			share = share.Neg()
+		}
+		s.updateBalance(participant, share)
+	}
+}
+
+// updateBalance method adds the amount provided to the balance of the person
+// in the currency of the amount.
+func (s *Settler) updateBalance(person string, amount Money) {
+	if _, ok := s.Balances[person]; !ok {
+		s.Balances[person] = Balance{}
+	}
+	balance := s.Balances[person]
+	balance[amount.Currency] = amount.Add(balance[amount.Currency])
+}
+
+// rebuildBalances method calculates the balances of every person from the
+// current list of expenses and payments.
+func (s *Settler) rebuildBalances() {
+	s.Balances = make(map[string]Balance)
+	for _, transactions := range []map[int]*Transaction{s.Expenses, s.Payments} {
+		for _, transaction := range transactions {
+			shares, err := transaction.Shares()
+			if err != nil {
+				continue
 			}
+			s.applyTransaction(transaction, shares, false)
+		}
+	}
+}
+
+// Clean method cleans the list of expenses, payments and balances of the
+// settler.
+func (s *Settler) Clean() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	lastID := s.lastID
+	changes := s.removalChanges()
+	s.Expenses = make(map[int]*Transaction)
+	s.Payments = make(map[int]*Transaction)
+	s.Balances = make(map[string]Balance)
+	s.lastID = 0
+	s.emitEntry(EventOperation, s.record(OpClean, lastID, changes...))
+}
+
+// Import method replaces the expenses and the payments of the settler by the
+// transactions provided, that get new IDs in the same order. The transactions
+// are validated before changing anything, so if any of them is not valid, it
+// returns an error and the settler is not modified. If the amount of a
+// transaction has no currency, it takes the base currency of the settler.
+func (s *Settler) Import(transactions []*Transaction) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for i, transaction := range transactions {
+		if transaction.Amount.Currency == "" {
+			transaction.Amount.Currency = s.Currency
+		} else if _, err := ParseCurrency(transaction.Amount.Currency); err != nil {
+			return fmt.Errorf("transaction %d: %w", i+1, err)
 		}
-		// if no one owes the most or is owed the most, debts are settled
-		if maxAmount <= 0.001 && minAmount <= 0.001 {
-			break
+		if err := transaction.Validate(); err != nil {
+			return fmt.Errorf("transaction %d: %w", i+1, err)
 		}
-		if maxCreditor == "" && maxDebtor == "" {
-			break
+	}
+	lastID := s.lastID
+	changes := s.removalChanges()
+	s.Expenses = make(map[int]*Transaction)
+	s.Payments = make(map[int]*Transaction)
+	s.Balances = make(map[string]Balance)
+	for i, transaction := range transactions {
+		id := i + 1
+		if transaction.IsPayment() {
+			s.Payments[id] = transaction
+		} else {
+			s.Expenses[id] = transaction
 		}
-		// settle the debt getting the minimum between the amount owed and the
-		// amount owed
-		settleAmount := math.Min(maxAmount, math.Abs(minAmount))
-		// update the balances
-		balances[maxCreditor] -= settleAmount
-		balances[maxDebtor] += settleAmount
-		// add this transaction to the result
-		result = append(result, &Transaction{
-			Payer:        maxDebtor,
-			Participants: []string{maxCreditor},
-			Amount:       settleAmount,
-		})
-	}
-	return result
-}
-
-// Clean method cleans the list of expenses and balances of the settler.
-func (b *Settler) Clean() {
-	b.Expenses = make(map[int]*Transaction)
-	b.Balances = make(map[string]float64)
-	b.lastID = 0
-}
-
-func (b *Settler) Export() ([]byte, error) {
-	if len(b.Expenses) == 0 {
+		changes = append(changes, Change{ID: id, After: transaction})
+	}
+	s.rebuildBalances()
+	s.lastID = len(transactions)
+	s.emitEntry(EventOperation, s.record(OpImport, lastID, changes...))
+	return nil
+}
+
+// removalChanges method returns the changes that remove every expense and
+// payment of the settler, sorted by ID. It must be called with the settler
+// locked.
+func (s *Settler) removalChanges() []Change {
+	changes := []Change{}
+	for _, transactions := range []map[int]*Transaction{s.Expenses, s.Payments} {
+		list, ids := sortedTransactions(transactions)
+		for i, transaction := range list {
+			changes = append(changes, Change{ID: ids[i], Before: transaction})
+		}
+	}
+	return changes
+}
+
+func (s *Settler) Export() ([]byte, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.isEmpty() && s.EventSeq == 0 {
 		return []byte{}, nil
 	}
-	return json.Marshal(b)
+	return json.Marshal(s)
 }
 
+// IsEmpty method returns if the settler has no data: no expenses, payments,
+// rates, journal, archived periods, constraints nor participants, and the
+// default settings. The sequence number of its event log is not data, so a
+// settler with only a checkpoint in its log is empty.
+func (s *Settler) IsEmpty() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.isEmpty()
+}
+
+// isEmpty method returns if the settler is empty, see IsEmpty. It must be
+// called with the settler locked.
+func (s *Settler) isEmpty() bool {
+	return len(s.Expenses) == 0 && len(s.Payments) == 0 && len(s.Rates) == 0 &&
+		s.Currency == DefaultCurrency && len(s.Journal.Undo) == 0 && len(s.Journal.Redo) == 0 &&
+		len(s.Archive) == 0 && (s.Strategy == "" || s.Strategy == StrategyGreedy) &&
+		len(s.Constraints) == 0 && len(s.Participants) == 0
+}
+
+// ImportSettle function decodes a settler exported with Export, upgrading it
+// from the schema version that exported it to the current one. An empty
+// export is an empty settler.
 func ImportSettle(encoded []byte) (*Settler, error) {
 	if len(encoded) == 0 {
 		return NewSettler(), nil
 	}
+	// upgrade the settlers exported by the previous versions
+	encoded, err := migrateSchema(encoded)
+	if err != nil {
+		return nil, err
+	}
 	newSettler := &Settler{}
 	if err := json.Unmarshal(encoded, newSettler); err != nil {
 		return nil, err
 	}
+	// previous versions did not store the currency, so the default one is
+	// assumed for the settler and every amount without currency
+	if newSettler.Currency == "" {
+		newSettler.Currency = DefaultCurrency
+	}
+	if newSettler.Rates == nil {
+		newSettler.Rates = make(map[string]Rate)
+	}
+	if newSettler.Payments == nil {
+		newSettler.Payments = make(map[int]*Transaction)
+	}
+	if newSettler.Strategy == "" {
+		newSettler.Strategy = StrategyGreedy
+	}
+	newSettler.ExactLimit = DefaultExactLimit
+	if newSettler.Journal == nil {
+		newSettler.Journal = newJournal(DefaultJournalDepth)
+	}
+	// the depth is not exported, it keeps every entry saved until it is set
+	// with SetJournalDepth, that discards the ones that exceed it
+	newSettler.Journal.Depth = max(DefaultJournalDepth, len(newSettler.Journal.Undo), len(newSettler.Journal.Redo))
+	for id, expense := range newSettler.Expenses {
+		if expense.Amount.Currency == "" {
+			expense.Amount.Currency = newSettler.Currency
+		}
+		if err := expense.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid expense %d: %w", id, err)
+		} else if expense.IsPayment() {
+			return nil, fmt.Errorf("invalid expense %d: it is a payment", id)
+		}
+	}
+	for id, payment := range newSettler.Payments {
+		if err := payment.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid payment %d: %w", id, err)
+		} else if !payment.IsPayment() {
+			return nil, fmt.Errorf("invalid payment %d: it is not a payment", id)
+		}
+	}
+	// the balances are not stored, calculate them again from the expenses and
+	// the payments
+	newSettler.rebuildBalances()
 	newSettler.mtx = sync.RWMutex{}
-	newSettler.lastID = len(newSettler.Expenses)
+	// expenses and payments share the sequence of IDs, that is never behind
+	// the IDs in use
+	for _, transactions := range []map[int]*Transaction{newSettler.Expenses, newSettler.Payments} {
+		for id := range transactions {
+			newSettler.lastID = max(newSettler.lastID, id)
+		}
+	}
 	return newSettler, nil
 }
+
+// sortedTransactions function returns the transactions of the map provided
+// and their IDs, sorted by ID.
+func sortedTransactions(transactions map[int]*Transaction) ([]*Transaction, []int) {
+	ids := sort.IntSlice{}
+	for id := range transactions {
+		ids = append(ids, id)
+	}
+	// sort the IDs
+	sort.Sort(ids)
+	// create the list of transactions
+	result := []*Transaction{}
+	for _, id := range ids {
+		result = append(result, transactions[id])
+	}
+	return result, ids
+}
@@ -1,25 +1,47 @@
 package settler
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// update flag rewrites the golden files of the tests with the current results
+// instead of comparing them, use it with: go test ./settler -update
+var update = flag.Bool("update", false, "update the golden files")
+
 func TestSettler(t *testing.T) {
 	// initialize settler with transactions
 	transactions := []*Transaction{
-		{Payer: "Alice", Participants: []string{"Bob", "Carol"}, Amount: 30.0},
-		{Payer: "Carol", Participants: []string{"Bob"}, Amount: 20.0},
-		{Payer: "Bob", Participants: []string{"Alice"}, Amount: 10.0},
+		{Payer: "Alice", Participants: []string{"Bob", "Carol"}, Amount: NewMoney(3000, DefaultCurrency)},
+		{Payer: "Carol", Participants: []string{"Bob"}, Amount: NewMoney(2000, DefaultCurrency)},
+		{Payer: "Bob", Participants: []string{"Alice"}, Amount: NewMoney(1000, DefaultCurrency)},
 	}
 	settler := NewSettler()
 	for _, transaction := range transactions {
-		settler.AddExpense(transaction.Payer, transaction.Participants, transaction.Amount)
+		if _, err := settler.AddExpense(transaction); err != nil {
+			t.Fatal(err)
+		}
 	}
 	// settle transactions and check results with expected results
-	settledTransactions := settler.Settle(false)
+	settledTransactions, err := settler.Settle(false)
+	if err != nil {
+		t.Fatal(err)
+	}
 	expectedTransactions := []*Transaction{
-		{Payer: "Bob", Participants: []string{"Alice"}, Amount: 20.0},
-		{Payer: "Bob", Participants: []string{"Carol"}, Amount: 5.0},
+		{Payer: "Bob", Participants: []string{"Alice"}, Amount: NewMoney(2000, DefaultCurrency)},
+		{Payer: "Bob", Participants: []string{"Carol"}, Amount: NewMoney(500, DefaultCurrency)},
 	}
 	// check if the number of transactions is the same
 	if len(settledTransactions) != len(expectedTransactions) {
@@ -41,12 +63,21 @@ func TestSettler(t *testing.T) {
 		t.Errorf("Expected %d transactions, got %d", len(expectedTransactions), founded)
 	}
 	// add a new expense and settle transactions again
-	lastAdded := settler.AddExpense("Bob", []string{"Carol", "Alice"}, 10.0)
-	settledTransactions = settler.Settle(false)
+	lastAdded, err := settler.AddExpense(&Transaction{
+		Payer:        "Bob",
+		Participants: []string{"Carol", "Alice"},
+		Amount:       NewMoney(1000, DefaultCurrency),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settledTransactions, err = settler.Settle(false); err != nil {
+		t.Fatal(err)
+	}
 	// check if the number of transactions is the same as expected and check
 	// again if the transactions are the same
 	expectedTransactions2 := []*Transaction{
-		{Payer: "Bob", Participants: []string{"Alice"}, Amount: 15.0},
+		{Payer: "Bob", Participants: []string{"Alice"}, Amount: NewMoney(1500, DefaultCurrency)},
 	}
 	if len(settledTransactions) != len(expectedTransactions2) {
 		t.Errorf("Expected 2 transactions, got %d", len(settledTransactions))
@@ -66,7 +97,9 @@ func TestSettler(t *testing.T) {
 	}
 	// remove the last added expense and settle transactions again
 	settler.RemoveExpense(lastAdded)
-	settledTransactions = settler.Settle(false)
+	if settledTransactions, err = settler.Settle(false); err != nil {
+		t.Fatal(err)
+	}
 	// check if the number of transactions is the same as expected and check
 	// again if the transactions are the same of the first settlement
 	if len(settledTransactions) != len(expectedTransactions) {
@@ -86,3 +119,1536 @@ func TestSettler(t *testing.T) {
 		t.Errorf("Expected %d transactions, got %d", len(expectedTransactions), founded)
 	}
 }
+
+func TestSplit(t *testing.T) {
+	participants := []string{"Alice", "Bob", "Carol"}
+	tests := []struct {
+		name     string
+		amount   int64
+		split    *Split
+		expected map[string]int64
+		err      error
+	}{
+		{
+			name:     "equal",
+			amount:   3000,
+			expected: map[string]int64{"Alice": 1000, "Bob": 1000, "Carol": 1000},
+		},
+		{
+			name:     "equal with remainder",
+			amount:   1000,
+			expected: map[string]int64{"Alice": 334, "Bob": 333, "Carol": 333},
+		},
+		{
+			name:     "shares",
+			amount:   4000,
+			split:    &Split{Mode: SplitShares, Values: map[string]int64{"Alice": 2, "Bob": 1, "Carol": 1}},
+			expected: map[string]int64{"Alice": 2000, "Bob": 1000, "Carol": 1000},
+		},
+		{
+			name:     "shares with remainder",
+			amount:   1001,
+			split:    &Split{Mode: SplitShares, Values: map[string]int64{"Alice": 1, "Bob": 2, "Carol": 2}},
+			expected: map[string]int64{"Alice": 200, "Bob": 401, "Carol": 400},
+		},
+		{
+			name:     "percentage",
+			amount:   5000,
+			split:    &Split{Mode: SplitPercentage, Values: map[string]int64{"Alice": 6000, "Bob": 4000, "Carol": 0}},
+			expected: map[string]int64{"Alice": 3000, "Bob": 2000, "Carol": 0},
+		},
+		{
+			name:     "exact",
+			amount:   2000,
+			split:    &Split{Mode: SplitExact, Values: map[string]int64{"Alice": 770, "Bob": 1230, "Carol": 0}},
+			expected: map[string]int64{"Alice": 770, "Bob": 1230, "Carol": 0},
+		},
+		{
+			name:   "percentages do not sum 100",
+			amount: 5000,
+			split:  &Split{Mode: SplitPercentage, Values: map[string]int64{"Alice": 6000, "Bob": 3000, "Carol": 0}},
+			err:    ErrInvalidSplit,
+		},
+		{
+			name:   "exact amounts do not sum the total",
+			amount: 2000,
+			split:  &Split{Mode: SplitExact, Values: map[string]int64{"Alice": 770, "Bob": 1000, "Carol": 0}},
+			err:    ErrInvalidSplit,
+		},
+		{
+			name:   "missing participant value",
+			amount: 2000,
+			split:  &Split{Mode: SplitShares, Values: map[string]int64{"Alice": 1, "Bob": 1}},
+			err:    ErrInvalidSplit,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settler := NewSettler()
+			expense := &Transaction{
+				Payer:        "Dave",
+				Participants: participants,
+				Amount:       NewMoney(test.amount, DefaultCurrency),
+				Split:        test.split,
+			}
+			id, err := settler.AddExpense(expense)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("expected error %v, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			balances, err := settler.ListBalances()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if balances["Dave"].Units != test.amount {
+				t.Errorf("expected balance %d for Dave, got %d", test.amount, balances["Dave"].Units)
+			}
+			for participant, share := range test.expected {
+				if balances[participant].Units != -share {
+					t.Errorf("expected balance %d for %s, got %d", -share, participant, balances[participant].Units)
+				}
+			}
+			// removing the expense must restore the balances
+			settler.RemoveExpense(id)
+			if balances, _ := settler.ListBalances(); len(balances) != 0 {
+				t.Errorf("expected empty balances, got %v", balances)
+			}
+		})
+	}
+	// an expense without participants is not valid
+	if _, err := NewSettler().AddExpense(&Transaction{Payer: "Alice", Amount: NewMoney(100, "")}); !errors.Is(err, ErrNoParticipants) {
+		t.Errorf("expected error %v, got %v", ErrNoParticipants, err)
+	}
+}
+
+func TestMoney(t *testing.T) {
+	for input, expected := range map[string]Money{
+		"12.3":      NewMoney(1230, ""),
+		"12,30":     NewMoney(1230, ""),
+		"0.05 usd":  NewMoney(5, "USD"),
+		"-1.5 EUR":  NewMoney(-150, "EUR"),
+		"1000":      NewMoney(100000, ""),
+		"12.345":    {},
+		"12.3.4":    {},
+		"twelve":    {},
+		"12 EUR 13": {},
+	} {
+		money, err := ParseMoney(input)
+		if expected == (Money{}) {
+			if err == nil {
+				t.Errorf("expected error parsing '%s', got %v", input, money)
+			}
+			continue
+		}
+		if err != nil || money != expected {
+			t.Errorf("expected %v parsing '%s', got %v (%v)", expected, input, money, err)
+		}
+	}
+	if str := NewMoney(-5, "EUR").String(); str != "-0.05 EUR" {
+		t.Errorf("expected -0.05 EUR, got %s", str)
+	}
+	// the parts of an allocation always sum the total
+	parts, err := NewMoney(1000, "EUR").Allocate([]int64{1, 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := int64(0)
+	for _, part := range parts {
+		total += part.Units
+	}
+	if total != 1000 {
+		t.Errorf("expected parts to sum 1000, got %d", total)
+	}
+}
+
+func TestCSV(t *testing.T) {
+	expenses := []*Transaction{
+		{Payer: "Alice", Participants: []string{"Bob", "Carol"}, Amount: NewMoney(1001, "EUR")},
+		{Payer: "Bob", Participants: []string{"Alice", "Carol"}, Amount: NewMoney(5000, "EUR"),
+			Split: &Split{Mode: SplitPercentage, Values: map[string]int64{"Alice": 3333, "Carol": 6667}}},
+		{Payer: "Carol", Participants: []string{"Alice", "Bob"}, Amount: NewMoney(2000, "EUR"),
+			Split: &Split{Mode: SplitExact, Values: map[string]int64{"Alice": 770, "Bob": 1230}}},
+		{Kind: KindPayment, Payer: "Bob", Participants: []string{"Alice"}, Amount: NewMoney(500, "EUR")},
+		{Payer: "Alice", Participants: []string{"Alice", "Bob"}, Amount: NewMoney(1200, "EUR"),
+			Description: "Dinner, drinks", Date: time.Date(2026, 10, 1, 20, 0, 0, 0, time.UTC),
+			Category: "food", CreatedBy: "Alice"},
+	}
+	content, err := EncodeCSV(expenses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeCSV(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// encoding the decoded expenses must result in the same content
+	reencoded, err := EncodeCSV(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, reencoded) {
+		t.Errorf("expected the same content, got:\n%s\n%s", content, reencoded)
+	}
+	for i, expense := range decoded {
+		if expense.Amount != expenses[i].Amount {
+			t.Errorf("expected amount %s, got %s", expenses[i].Amount, expense.Amount)
+		}
+		if expense.Kind != expenses[i].Kind {
+			t.Errorf("expected kind '%s', got '%s'", expenses[i].Kind, expense.Kind)
+		}
+		if expense.Description != expenses[i].Description || !expense.Date.Equal(expenses[i].Date) ||
+			expense.Category != expenses[i].Category || expense.CreatedBy != expenses[i].CreatedBy {
+			t.Errorf("expected details %v, got %v", expenses[i], expense)
+		}
+	}
+	// records of previous versions have no details
+	legacy, err := DecodeCSV([]byte("Alice,Bob;Carol,10.01\nBob,Alice;Carol,50.00,percentage,33.33;66.67\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(legacy) != 2 || !legacy[0].Date.IsZero() || legacy[1].Split.Mode != SplitPercentage {
+		t.Errorf("unexpected legacy expenses: %v", legacy)
+	}
+}
+
+func TestPayments(t *testing.T) {
+	settler := NewSettler()
+	if _, err := settler.AddExpense(&Transaction{
+		Payer:        "Alice",
+		Participants: []string{"Alice", "Bob", "Carol"},
+		Amount:       NewMoney(3000, "EUR"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// a payment to oneself or with a negative amount is not valid
+	if _, err := settler.AddPayment(&Transaction{Payer: "Bob", Participants: []string{"Bob"}, Amount: NewMoney(500, "")}); !errors.Is(err, ErrInvalidPayment) {
+		t.Errorf("expected ErrInvalidPayment, got %v", err)
+	}
+	if _, err := settler.AddPayment(&Transaction{Payer: "Bob", Participants: []string{"Alice"}, Amount: NewMoney(-500, "")}); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("expected ErrInvalidAmount, got %v", err)
+	}
+	// bob pays back part of his debt
+	id, err := settler.AddPayment(&Transaction{Payer: "Bob", Participants: []string{"Alice"}, Amount: NewMoney(400, "")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expenses, _ := settler.ListExpenses(); len(expenses) != 1 {
+		t.Errorf("expected payments not to be listed as expenses, got %d expenses", len(expenses))
+	}
+	balances, err := settler.ListBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{"Alice": 1600, "Bob": -600, "Carol": -1000}
+	for person, units := range expected {
+		if balances[person].Units != units {
+			t.Errorf("expected %s balance %d, got %d", person, units, balances[person].Units)
+		}
+	}
+	transactions, err := settler.Settle(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transactions) != 2 {
+		t.Fatalf("expected 2 transactions, got %d", len(transactions))
+	}
+	// the payments survive an export and import, and they share the ids with
+	// the expenses
+	exported, err := settler.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportSettle(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, ids := imported.ListPayments()
+	if len(payments) != 1 || ids[0] != id || payments[0].Amount != NewMoney(400, "EUR") {
+		t.Fatalf("unexpected imported payments: %v %v", payments, ids)
+	}
+	if nextID, err := imported.AddPayment(&Transaction{Payer: "Carol", Participants: []string{"Alice"}, Amount: NewMoney(1000, "")}); err != nil || nextID != id+1 {
+		t.Errorf("expected next id %d, got %d (%v)", id+1, nextID, err)
+	}
+	imported.RemovePayment(id)
+	balances, err = imported.ListBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balances["Bob"].Units != -1000 || balances["Carol"].Units != 0 {
+		t.Errorf("unexpected balances after removing the payment: %v", balances)
+	}
+}
+
+func TestImportSettle(t *testing.T) {
+	// previous versions stored the amounts and balances as floats
+	legacy := []byte(`{"balances":{"Alice":6.67,"Bob":-3.33,"Carol":-3.33},` +
+		`"expenses":{"1":{"payer":"Alice","participants":["Alice","Bob","Carol"],"amount":10}}}`)
+	settler, err := ImportSettle(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balances, err := settler.ListBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := int64(0)
+	for _, balance := range balances {
+		total += balance.Units
+	}
+	if total != 0 {
+		t.Errorf("expected balances to sum zero, got %d", total)
+	}
+	// export and import again must keep the amounts
+	encoded, err := settler.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportSettle(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Expenses[1].Amount != NewMoney(1000, DefaultCurrency) {
+		t.Errorf("expected amount 10.00 EUR, got %s", imported.Expenses[1].Amount)
+	}
+	// the transactions stored with the wrong kind are not imported
+	for name, content := range map[string]string{
+		"payment as expense": `{"expenses":{"1":{"kind":"payment","payer":"Alice","participants":["Bob"],"amount":1000}}}`,
+		"expense as payment": `{"payments":{"1":{"payer":"Alice","participants":["Bob"],"amount":1000}}}`,
+	} {
+		if _, err := ImportSettle([]byte(content)); err == nil || strings.Contains(err.Error(), "%!") {
+			t.Errorf("%s: expected a kind error, got %v", name, err)
+		}
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	settler := NewSettler()
+	if !settler.IsEmpty() {
+		t.Errorf("expected a new settler to be empty")
+	}
+	// a payment is exported although there are no expenses
+	if _, err := settler.AddPayment(&Transaction{Payer: "Bob", Participants: []string{"Alice"}, Amount: NewMoney(400, "")}); err != nil {
+		t.Fatal(err)
+	}
+	if settler.IsEmpty() {
+		t.Errorf("expected a settler with a payment not to be empty")
+	}
+	// the archived periods and the journal are exported too
+	if _, err := settler.ClosePeriod("Trip", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ids := settler.ListPayments(); len(ids) != 0 || settler.IsEmpty() {
+		t.Errorf("expected an archived period, got %d payments (empty %v)", len(ids), settler.IsEmpty())
+	}
+	// the settings are exported as well
+	settler = NewSettler()
+	if err := settler.SetCurrency("USD"); err != nil {
+		t.Fatal(err)
+	}
+	if settler.IsEmpty() {
+		t.Errorf("expected a settler with other currency not to be empty")
+	}
+}
+
+func TestCurrencies(t *testing.T) {
+	settler := NewSettler()
+	expenses := []*Transaction{
+		{Payer: "Alice", Participants: []string{"Alice", "Bob", "Carol"}, Amount: NewMoney(1000, "USD")},
+		{Payer: "Bob", Participants: []string{"Alice", "Bob"}, Amount: NewMoney(3000, "")},
+	}
+	for _, expense := range expenses {
+		if _, err := settler.AddExpense(expense); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the expense without currency takes the base one
+	if settler.Expenses[2].Amount.Currency != DefaultCurrency {
+		t.Errorf("expected currency %s, got %s", DefaultCurrency, settler.Expenses[2].Amount.Currency)
+	}
+	// without the rate of USD it can not be settled
+	if _, err := settler.Settle(false); !errors.Is(err, ErrMissingRate) {
+		t.Fatalf("expected error %v, got %v", ErrMissingRate, err)
+	}
+	rate, err := ParseRate("0.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := settler.SetRate("usd", "eur", rate); err != nil {
+		t.Fatal(err)
+	}
+	balances, err := settler.ListBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Alice: +6.66 USD - 15 EUR, Bob: -3.33 USD + 15 EUR, Carol: -3.33 USD,
+	// the rounding difference of USD goes to Alice
+	expected := map[string]int64{"Alice": 600 - 1500, "Bob": -300 + 1500, "Carol": -300}
+	total := int64(0)
+	for person, units := range expected {
+		if balances[person].Units != units {
+			t.Errorf("expected balance %d for %s, got %d", units, person, balances[person].Units)
+		}
+		total += balances[person].Units
+	}
+	if total != 0 {
+		t.Errorf("expected balances to sum zero, got %d", total)
+	}
+	// the original balances keep the currency of the expenses
+	if original := settler.ListOriginalBalances(); original["Carol"]["USD"].Units != -333 {
+		t.Errorf("expected original balance -333 USD for Carol, got %v", original["Carol"])
+	}
+	// changing the base currency uses the inverse rate
+	if err := settler.SetCurrency("usd"); err != nil {
+		t.Fatal(err)
+	}
+	if balances, err = settler.ListBalances(); err != nil {
+		t.Fatal(err)
+	}
+	if balances["Bob"].Currency != "USD" || balances["Bob"].Units != -333+1667 {
+		t.Errorf("expected balance 13.34 USD for Bob, got %s", balances["Bob"])
+	}
+	// the rates are kept in the export
+	encoded, err := settler.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportSettle(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Currency != "USD" || imported.ListRates()["USD/EUR"] != rate {
+		t.Errorf("expected base currency USD and rate %s, got %s and %v", rate, imported.Currency, imported.ListRates())
+	}
+}
+
+func TestUpdateExpense(t *testing.T) {
+	settler := NewSettler()
+	id, err := settler.AddExpense(&Transaction{
+		Payer:        "Alice",
+		Participants: []string{"Alice", "Bob"},
+		Amount:       NewMoney(1000, ""),
+		Description:  "Dinner",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settler.AddExpense(&Transaction{
+		Payer:        "Bob",
+		Participants: []string{"Bob", "Carol"},
+		Amount:       NewMoney(600, ""),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// changes to the copy do not affect the settler until it is updated
+	expense, ok := settler.GetExpense(id)
+	if !ok {
+		t.Fatal("expected the expense to exist")
+	}
+	expense.Payer = "Carol"
+	expense.Participants[1] = "Carol"
+	if current, _ := settler.GetExpense(id); current.Payer != "Alice" || current.Participants[1] != "Bob" {
+		t.Fatalf("expected the expense not to change, got %v", current)
+	}
+	// invalid expenses and unknown ids do not modify the settler
+	invalid := expense.Copy()
+	invalid.Amount = NewMoney(0, "")
+	if err := settler.UpdateExpense(id, invalid); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("expected ErrInvalidAmount, got %v", err)
+	}
+	if err := settler.UpdateExpense(id+10, expense); !errors.Is(err, ErrExpenseNotFound) {
+		t.Errorf("expected ErrExpenseNotFound, got %v", err)
+	}
+	if err := settler.UpdateExpense(id, expense); err != nil {
+		t.Fatal(err)
+	}
+	if updated, _ := settler.GetExpense(id); updated.Payer != "Carol" || updated.Description != "Dinner" {
+		t.Errorf("unexpected updated expense: %v", updated)
+	}
+	// Alice: -500, Bob: +600 - 300, Carol: +1000 - 500 - 300
+	balances, err := settler.ListBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{"Alice": -500, "Bob": 300, "Carol": 200}
+	for person, units := range expected {
+		if balances[person].Units != units {
+			t.Errorf("expected %s balance %d, got %d", person, units, balances[person].Units)
+		}
+	}
+}
+
+func TestJournal(t *testing.T) {
+	settler := NewSettler()
+	if _, err := settler.Undo(); !errors.Is(err, ErrNothingToUndo) {
+		t.Fatalf("expected ErrNothingToUndo, got %v", err)
+	}
+	checkBalances := func(expected map[string]int64) {
+		t.Helper()
+		balances, err := settler.ListBalances()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for person, units := range expected {
+			if balances[person].Units != units {
+				t.Errorf("expected %s balance %d, got %d", person, units, balances[person].Units)
+			}
+		}
+	}
+	dinner, _ := settler.AddExpense(&Transaction{
+		Payer:        "Alice",
+		Participants: []string{"Alice", "Bob"},
+		Amount:       NewMoney(1000, ""),
+	})
+	taxi, _ := settler.AddExpense(&Transaction{
+		Payer:        "Bob",
+		Participants: []string{"Alice", "Bob"},
+		Amount:       NewMoney(400, ""),
+	})
+	if _, err := settler.AddPayment(&Transaction{
+		Payer:        "Bob",
+		Participants: []string{"Alice"},
+		Amount:       NewMoney(100, ""),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	edited, _ := settler.GetExpense(dinner)
+	edited.Amount = NewMoney(2000, "")
+	if err := settler.UpdateExpense(dinner, edited); err != nil {
+		t.Fatal(err)
+	}
+	settler.RemoveExpense(taxi)
+	checkBalances(map[string]int64{"Alice": 900, "Bob": -900})
+	// clean and undo everything step by step
+	settler.Clean()
+	checkBalances(map[string]int64{"Alice": 0, "Bob": 0})
+	for _, step := range []struct {
+		op       Operation
+		balances map[string]int64
+	}{
+		{OpClean, map[string]int64{"Alice": 900, "Bob": -900}},
+		{OpRemove, map[string]int64{"Alice": 700, "Bob": -700}},
+		{OpEdit, map[string]int64{"Alice": 200, "Bob": -200}},
+		{OpAdd, map[string]int64{"Alice": 300, "Bob": -300}},
+	} {
+		entry, err := settler.Undo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Operation != step.op {
+			t.Errorf("expected %s undone, got %s", step.op, entry.Operation)
+		}
+		checkBalances(step.balances)
+	}
+	// redo the payment and the edit
+	for _, op := range []Operation{OpAdd, OpEdit} {
+		if entry, err := settler.Redo(); err != nil || entry.Operation != op {
+			t.Fatalf("expected %s redone, got %v (%v)", op, entry, err)
+		}
+	}
+	checkBalances(map[string]int64{"Alice": 700, "Bob": -700})
+	// a new operation discards the undone ones and reuses the next id
+	id, _ := settler.AddExpense(&Transaction{
+		Payer:        "Alice",
+		Participants: []string{"Bob"},
+		Amount:       NewMoney(100, ""),
+	})
+	if id != 4 {
+		t.Errorf("expected id 4, got %d", id)
+	}
+	if _, err := settler.Redo(); !errors.Is(err, ErrNothingToRedo) {
+		t.Errorf("expected ErrNothingToRedo, got %v", err)
+	}
+	// the journal is kept in the export
+	encoded, err := settler.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportSettle(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if undo, _ := imported.JournalLen(); undo != 5 {
+		t.Fatalf("expected 5 operations to undo, got %d", undo)
+	}
+	if entry, err := imported.Undo(); err != nil || entry.Operation != OpAdd {
+		t.Fatalf("expected the last expense undone, got %v (%v)", entry, err)
+	}
+	if _, exist := imported.GetExpense(id); exist {
+		t.Error("expected the last expense to be removed")
+	}
+	// the depth limits the operations kept
+	imported.SetJournalDepth(1)
+	if undo, redo := imported.JournalLen(); undo != 1 || redo != 1 {
+		t.Errorf("expected 1 operation of each kind, got %d and %d", undo, redo)
+	}
+	imported.SetJournalDepth(0)
+	imported.RemoveExpense(dinner)
+	if _, err := imported.Undo(); !errors.Is(err, ErrNothingToUndo) {
+		t.Errorf("expected ErrNothingToUndo with the journal disabled, got %v", err)
+	}
+}
+
+func TestJournalDepthRoundTrip(t *testing.T) {
+	settler := NewSettler()
+	settler.SetJournalDepth(DefaultJournalDepth + 10)
+	for i := 0; i < DefaultJournalDepth+5; i++ {
+		if _, err := settler.AddExpense(&Transaction{
+			Payer:        "Alice",
+			Participants: []string{"Alice", "Bob"},
+			Amount:       NewMoney(100, ""),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encoded, err := settler.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportSettle(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the import keeps every operation, also the ones above the default depth
+	if undo, _ := imported.JournalLen(); undo != DefaultJournalDepth+5 {
+		t.Errorf("expected %d operations after the import, got %d", DefaultJournalDepth+5, undo)
+	}
+	imported.SetJournalDepth(DefaultJournalDepth + 10)
+	if undo, _ := imported.JournalLen(); undo != DefaultJournalDepth+5 {
+		t.Errorf("expected %d operations with the configured depth, got %d", DefaultJournalDepth+5, undo)
+	}
+	// setting a lower depth discards the oldest ones
+	imported.SetJournalDepth(DefaultJournalDepth)
+	if undo, _ := imported.JournalLen(); undo != DefaultJournalDepth {
+		t.Errorf("expected %d operations with the default depth, got %d", DefaultJournalDepth, undo)
+	}
+}
+
+func TestImport(t *testing.T) {
+	settler := NewSettler()
+	if _, err := settler.AddExpense(&Transaction{
+		Payer:        "Alice",
+		Participants: []string{"Alice", "Bob"},
+		Amount:       NewMoney(1000, ""),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// an invalid transaction does not modify the settler
+	err := settler.Import([]*Transaction{
+		{Payer: "Carol", Participants: []string{"Dave"}, Amount: NewMoney(500, "")},
+		{Payer: "Carol", Participants: []string{}, Amount: NewMoney(500, "")},
+	})
+	if !errors.Is(err, ErrNoParticipants) {
+		t.Fatalf("expected ErrNoParticipants, got %v", err)
+	}
+	if expenses, _ := settler.ListExpenses(); len(expenses) != 1 || expenses[0].Payer != "Alice" {
+		t.Fatalf("expected the settler not to change, got %v", expenses)
+	}
+	if err := settler.Import([]*Transaction{
+		{Payer: "Carol", Participants: []string{"Dave"}, Amount: NewMoney(500, "")},
+		{Kind: KindPayment, Payer: "Dave", Participants: []string{"Carol"}, Amount: NewMoney(200, "")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if balances, _ := settler.ListBalances(); balances["Carol"].Units != 300 || !balances["Alice"].IsZero() {
+		t.Errorf("unexpected balances after import: %v", balances)
+	}
+	// the import is undone as a single operation
+	if _, err := settler.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	if balances, _ := settler.ListBalances(); balances["Alice"].Units != 500 || !balances["Carol"].IsZero() {
+		t.Errorf("unexpected balances after undoing the import: %v", balances)
+	}
+}
+
+func TestClosePeriod(t *testing.T) {
+	settler := NewSettler()
+	if _, err := settler.ClosePeriod("", time.Now()); !errors.Is(err, ErrEmptyPeriod) {
+		t.Fatalf("expected ErrEmptyPeriod, got %v", err)
+	}
+	if _, err := settler.AddExpense(&Transaction{
+		Payer:        "Alice",
+		Participants: []string{"Alice", "Bob"},
+		Amount:       NewMoney(1000, ""),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settler.AddPayment(&Transaction{
+		Payer:        "Bob",
+		Participants: []string{"Alice"},
+		Amount:       NewMoney(200, ""),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	closedAt := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	period, err := settler.ClosePeriod("Rome", closedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if period.Label != "Rome" || !period.ClosedAt.Equal(closedAt) || period.Currency != DefaultCurrency {
+		t.Errorf("unexpected period: %v", period)
+	}
+	if expenses, _ := period.ListExpenses(); len(expenses) != 1 {
+		t.Errorf("expected 1 archived expense, got %d", len(expenses))
+	}
+	if payments, _ := period.ListPayments(); len(payments) != 1 {
+		t.Errorf("expected 1 archived payment, got %d", len(payments))
+	}
+	if period.Balances["Alice"].Units != 300 || period.Balances["Bob"].Units != -300 {
+		t.Errorf("unexpected archived balances: %v", period.Balances)
+	}
+	if len(period.Transfers) != 1 || period.Transfers[0].Payer != "Bob" || period.Transfers[0].Amount.Units != 300 {
+		t.Errorf("unexpected archived transfers: %v", period.Transfers)
+	}
+	// a new period starts
+	if expenses, _ := settler.ListExpenses(); len(expenses) != 0 {
+		t.Errorf("expected no expenses after closing the period, got %d", len(expenses))
+	}
+	// settling with clean archives the period with the default label
+	if _, err := settler.AddExpense(&Transaction{
+		Payer:        "Bob",
+		Participants: []string{"Alice"},
+		Amount:       NewMoney(500, ""),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settler.Settle(true); err != nil {
+		t.Fatal(err)
+	}
+	if second, err := settler.GetPeriod(2); err != nil || second.Label != "Period 2" {
+		t.Errorf("expected the second period, got %v (%v)", second, err)
+	}
+	if _, err := settler.GetPeriod(3); !errors.Is(err, ErrPeriodNotFound) {
+		t.Errorf("expected ErrPeriodNotFound, got %v", err)
+	}
+	// the archive is kept in the export and closing can be undone
+	encoded, err := settler.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportSettle(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := imported.Undo(); err != nil || entry.Operation != OpClose {
+		t.Fatalf("expected the period closing undone, got %v (%v)", entry, err)
+	}
+	if periods := imported.ListPeriods(); len(periods) != 1 || periods[0].Label != "Rome" {
+		t.Errorf("expected only the first period archived, got %v", periods)
+	}
+	if balances, _ := imported.ListBalances(); balances["Bob"].Units != 500 {
+		t.Errorf("expected the expenses of the period restored, got %v", balances)
+	}
+	if _, err := imported.Redo(); err != nil {
+		t.Fatal(err)
+	}
+	if periods := imported.ListPeriods(); len(periods) != 2 {
+		t.Errorf("expected the period archived again, got %d periods", len(periods))
+	}
+}
+
+// checkSettlement fails if the transfers provided do not settle the balances
+// provided.
+func checkSettlement(t *testing.T, balances map[string]Money, transfers []*Transaction) {
+	t.Helper()
+	remaining := map[string]int64{}
+	for person, balance := range balances {
+		remaining[person] = balance.Units
+	}
+	for _, transfer := range transfers {
+		if transfer.Amount.Units <= 0 {
+			t.Errorf("unexpected transfer amount: %v", transfer.Amount)
+		}
+		remaining[transfer.Payer] += transfer.Amount.Units
+		remaining[transfer.Participants[0]] -= transfer.Amount.Units
+	}
+	for person, units := range remaining {
+		if units != 0 {
+			t.Errorf("expected %s to be settled, got %d", person, units)
+		}
+	}
+}
+
+// testBalances returns the balances in euros of the values provided, named
+// from A onwards.
+func testBalances(values ...int64) map[string]Money {
+	balances := map[string]Money{}
+	for i, value := range values {
+		balances[string(rune('A'+i))] = NewMoney(value*100, "EUR")
+	}
+	return balances
+}
+
+func TestClosePeriodConcurrently(t *testing.T) {
+	settler := NewSettler()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := settler.AddExpense(&Transaction{
+				Payer:        []string{"Alice", "Bob", "Carol"}[i%3],
+				Participants: []string{"Alice", "Bob", "Carol"},
+				Amount:       NewMoney(int64(100+i), ""),
+			}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		// closing the same period twice archives it once
+		for j := 0; j < 2; j++ {
+			go func() {
+				defer wg.Done()
+				if _, err := settler.ClosePeriod("", time.Now()); err != nil && !errors.Is(err, ErrEmptyPeriod) {
+					t.Error(err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	// the balances archived are the ones of the expenses archived
+	for _, period := range settler.ListPeriods() {
+		expenses, _ := period.ListExpenses()
+		if len(expenses) == 0 {
+			t.Errorf("expected the period %s to have expenses", period.Label)
+		}
+		replayed := NewSettler()
+		for _, expense := range expenses {
+			if _, err := replayed.AddExpense(expense.Copy()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		balances, err := replayed.ListBalances()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for person, balance := range balances {
+			if period.Balances[person] != balance {
+				t.Errorf("expected the balance of %s in %s to be %s, got %s", person, period.Label, balance, period.Balances[person])
+			}
+		}
+	}
+}
+
+func TestStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		balances map[string]Money
+		limit    int
+		greedy   int
+		exact    int
+	}{
+		{"empty", testBalances(), DefaultExactLimit, 0, 0},
+		{"settled", testBalances(0, 0), DefaultExactLimit, 0, 0},
+		{"single debt", testBalances(10, -10), DefaultExactLimit, 1, 1},
+		{"one creditor", testBalances(30, -10, -10, -10), DefaultExactLimit, 3, 3},
+		{"zero-sum pairs", testBalances(3, -3, 2, -2), DefaultExactLimit, 2, 2},
+		// greedy matches 4 with -6 and misses the pair of 4 and -4
+		{"hidden pair", testBalances(3, 3, 4, -4, -6), DefaultExactLimit, 4, 3},
+		{"hidden pair above limit", testBalances(3, 3, 4, -4, -6), 4, 4, 4},
+		{"two groups", testBalances(5, 5, -10, 7, -3, -4), DefaultExactLimit, 5, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			greedy := GreedyStrategy{}.Settle(test.balances)
+			checkSettlement(t, test.balances, greedy)
+			if len(greedy) != test.greedy {
+				t.Errorf("expected %d greedy transfers, got %d", test.greedy, len(greedy))
+			}
+			exact := ExactStrategy{Limit: test.limit}.Settle(test.balances)
+			checkSettlement(t, test.balances, exact)
+			if len(exact) != test.exact {
+				t.Errorf("expected %d exact transfers, got %d", test.exact, len(exact))
+			}
+		})
+	}
+
+	// a limit above the maximum falls back to the greedy strategy above it
+	balances := benchmarkBalances(MaxExactLimit + 1)
+	greedy := GreedyStrategy{}.Settle(balances)
+	if exact := (ExactStrategy{Limit: 40}).Settle(balances); !reflect.DeepEqual(exact, greedy) {
+		t.Errorf("expected the greedy transfers above MaxExactLimit, got %d instead of %d", len(exact), len(greedy))
+	}
+	limited := NewSettler()
+	if limited.SetExactLimit(40); limited.ExactLimit != MaxExactLimit {
+		t.Errorf("expected the limit lowered to %d, got %d", MaxExactLimit, limited.ExactLimit)
+	}
+	if strategy := newStrategy(StrategyExact, 40).(ExactStrategy); strategy.Limit != MaxExactLimit {
+		t.Errorf("expected the limit of the strategy lowered to %d, got %d", MaxExactLimit, strategy.Limit)
+	}
+
+	// the strategy of the settler is used to settle it
+	settler := NewSettler()
+	if err := settler.SetStrategy("unknown"); !errors.Is(err, ErrInvalidStrategy) {
+		t.Errorf("expected ErrInvalidStrategy, got %v", err)
+	}
+	for _, expense := range []*Transaction{
+		{Payer: "A", Participants: []string{"D"}, Amount: NewMoney(300, "")},
+		{Payer: "B", Participants: []string{"E"}, Amount: NewMoney(300, "")},
+		{Payer: "C", Participants: []string{"D"}, Amount: NewMoney(400, "")},
+		{Payer: "C", Participants: []string{"E"}, Amount: NewMoney(300, "")},
+		{Payer: "D", Participants: []string{"C"}, Amount: NewMoney(300, "")},
+	} {
+		if _, err := settler.AddExpense(expense); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A: 3, B: 3, C: 4, D: -4, E: -6
+	for _, strategy := range []struct {
+		name     string
+		expected int
+	}{{"greedy", 4}, {"exact", 3}} {
+		if err := settler.SetStrategy(strategy.name); err != nil {
+			t.Fatal(err)
+		}
+		if transfers, err := settler.Settle(false); err != nil || len(transfers) != strategy.expected {
+			t.Errorf("expected %d %s transfers, got %d (%v)", strategy.expected, strategy.name, len(transfers), err)
+		}
+	}
+	encoded, err := settler.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported, err := ImportSettle(encoded); err != nil || imported.Strategy != StrategyExact {
+		t.Errorf("expected the exact strategy to be imported, got %v", err)
+	}
+}
+
+// benchmarkBalances returns random balances of the number of persons
+// provided that sum zero.
+func benchmarkBalances(persons int) map[string]Money {
+	rng := rand.New(rand.NewSource(1))
+	values := make([]int64, persons)
+	total := int64(0)
+	for i := 0; i < persons-1; i++ {
+		values[i] = rng.Int63n(200) - 100
+		total += values[i]
+	}
+	values[persons-1] = -total
+	return testBalances(values...)
+}
+
+func BenchmarkGreedyStrategy(b *testing.B) {
+	balances := benchmarkBalances(DefaultExactLimit)
+	for i := 0; i < b.N; i++ {
+		GreedyStrategy{}.Settle(balances)
+	}
+}
+
+func BenchmarkExactStrategy(b *testing.B) {
+	balances := benchmarkBalances(DefaultExactLimit)
+	for i := 0; i < b.N; i++ {
+		ExactStrategy{Limit: DefaultExactLimit}.Settle(balances)
+	}
+}
+
+func TestConstraints(t *testing.T) {
+	tests := []struct {
+		name        string
+		balances    map[string]Money
+		constraints []*Constraint
+		expected    []string
+		err         error
+	}{
+		{
+			name:     "forbidden pair through another person",
+			balances: testBalances(10, -10, 0),
+			constraints: []*Constraint{
+				{Kind: ConstraintForbidden, Payer: "B", Receiver: "A"},
+			},
+			expected: []string{"B->C 10.00 EUR", "C->A 10.00 EUR"},
+		},
+		{
+			name:     "forbidden pair without anyone else",
+			balances: testBalances(10, -10),
+			constraints: []*Constraint{
+				{Kind: ConstraintForbidden, Payer: "B", Receiver: "A"},
+			},
+			err: ErrUnsatisfiableConstraints,
+		},
+		{
+			name:     "required intermediary",
+			balances: testBalances(10, -10),
+			constraints: []*Constraint{
+				{Kind: ConstraintIntermediary, Payer: "B", Receiver: "A", Intermediary: "Z"},
+			},
+			expected: []string{"B->Z 10.00 EUR", "Z->A 10.00 EUR"},
+		},
+		{
+			name:     "household owed money",
+			balances: testBalances(10, -4, -6),
+			constraints: []*Constraint{
+				{Kind: ConstraintHousehold, Members: []string{"A", "B"}},
+			},
+			expected: []string{"C->A 6.00 EUR", "B->A 4.00 EUR"},
+		},
+		{
+			name:     "debt inside a household",
+			balances: testBalances(10, -10),
+			constraints: []*Constraint{
+				{Kind: ConstraintHousehold, Members: []string{"A", "B"}},
+			},
+			expected: []string{"B->A 10.00 EUR"},
+		},
+		{
+			name:     "participant named as a household",
+			balances: map[string]Money{"A": NewMoney(1000, "EUR"), "B": NewMoney(-400, "EUR"), "A+B": NewMoney(-600, "EUR")},
+			constraints: []*Constraint{
+				{Kind: ConstraintHousehold, Members: []string{"A", "B"}},
+			},
+			expected: []string{"A+B->A 6.00 EUR", "B->A 4.00 EUR"},
+		},
+		{
+			name:     "household owing money",
+			balances: testBalances(-5, -5, 10),
+			constraints: []*Constraint{
+				{Kind: ConstraintHousehold, Members: []string{"A", "B"}},
+			},
+			expected: []string{"A->C 5.00 EUR", "B->C 5.00 EUR"},
+		},
+		{
+			name:     "transfers between households",
+			balances: testBalances(6, 4, -3, -7),
+			constraints: []*Constraint{
+				{Kind: ConstraintHousehold, Members: []string{"A", "B"}},
+				{Kind: ConstraintHousehold, Members: []string{"C", "D"}},
+			},
+			expected: []string{"D->A 6.00 EUR", "C->B 3.00 EUR", "D->B 1.00 EUR"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transfers, err := SettleConstrained(GreedyStrategy{}, test.balances, test.constraints)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("expected %v, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := []string{}
+			for _, transfer := range transfers {
+				result = append(result, fmt.Sprintf("%s->%s %s", transfer.Payer, transfer.Participants[0], transfer.Amount))
+			}
+			if strings.Join(result, ", ") != strings.Join(test.expected, ", ") {
+				t.Errorf("expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+	// every person is settled when there are no households
+	balances := testBalances(10, -4, -6, 0)
+	transfers, err := SettleConstrained(GreedyStrategy{}, balances, []*Constraint{
+		{Kind: ConstraintForbidden, Payer: "C", Receiver: "A"},
+		{Kind: ConstraintIntermediary, Payer: "B", Receiver: "A", Intermediary: "D"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSettlement(t, balances, transfers)
+
+	settler := NewSettler()
+	for _, invalid := range []*Constraint{
+		{Kind: ConstraintForbidden, Payer: "A", Receiver: "A"},
+		{Kind: ConstraintIntermediary, Payer: "A", Receiver: "B"},
+		{Kind: ConstraintHousehold, Members: []string{"A"}},
+		{Kind: "unknown"},
+	} {
+		if err := settler.AddConstraint(invalid); !errors.Is(err, ErrInvalidConstraint) {
+			t.Errorf("expected ErrInvalidConstraint for %v, got %v", invalid, err)
+		}
+	}
+	if err := settler.AddConstraint(&Constraint{Kind: ConstraintHousehold, Members: []string{"A", "B"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := settler.AddConstraint(&Constraint{Kind: ConstraintHousehold, Members: []string{"B", "C"}}); !errors.Is(err, ErrInvalidConstraint) {
+		t.Errorf("expected ErrInvalidConstraint for overlapping households, got %v", err)
+	}
+	if err := settler.AddConstraint(&Constraint{Kind: ConstraintForbidden, Payer: "B", Receiver: "A"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settler.AddExpense(&Transaction{
+		Payer:        "A",
+		Participants: []string{"B"},
+		Amount:       NewMoney(1000, ""),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the debts inside the household are settled too, so B must pay A,
+	// which is forbidden
+	if _, err := settler.Settle(false); !errors.Is(err, ErrUnsatisfiableConstraints) {
+		t.Errorf("expected ErrUnsatisfiableConstraints, got %v", err)
+	}
+	if err := settler.RemoveConstraint(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := settler.RemoveConstraint(1); !errors.Is(err, ErrConstraintNotFound) {
+		t.Errorf("expected ErrConstraintNotFound, got %v", err)
+	}
+	if _, err := settler.Settle(false); !errors.Is(err, ErrUnsatisfiableConstraints) {
+		t.Errorf("expected ErrUnsatisfiableConstraints, got %v", err)
+	}
+	encoded, err := settler.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported, err := ImportSettle(encoded); err != nil || len(imported.ListConstraints()) != 1 {
+		t.Errorf("expected the constraint to be imported, got %v", err)
+	}
+}
+
+func TestGoldenSettlements(t *testing.T) {
+	ledgers, err := filepath.Glob(filepath.Join("testdata", "settle", "*.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ledgers) == 0 {
+		t.Fatal("expected ledgers in testdata/settle")
+	}
+	for _, ledger := range ledgers {
+		name := strings.TrimSuffix(filepath.Base(ledger), ".csv")
+		t.Run(name, func(t *testing.T) {
+			content, err := os.ReadFile(ledger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transactions, err := DecodeCSV(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			settler := NewSettler()
+			if err := settler.Import(transactions); err != nil {
+				t.Fatal(err)
+			}
+			result, err := settlementPlan(settler)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the maps are iterated in a different order every time, so the
+			// plan must be the same in every run
+			for i := 0; i < 20; i++ {
+				if again, err := settlementPlan(settler); err != nil || again != result {
+					t.Fatalf("expected the same plan every time, got:\n%s\n%s (%v)", result, again, err)
+				}
+			}
+			golden := filepath.Join("testdata", "settle", name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(result), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(expected) != result {
+				t.Errorf("expected plan:\n%s\ngot:\n%s", expected, result)
+			}
+		})
+	}
+}
+
+// settlementPlan returns the balances of the settler provided, sorted by
+// name, and the transfers that settle them with each strategy as text.
+func settlementPlan(settler *Settler) (string, error) {
+	balances, err := settler.ListBalances()
+	if err != nil {
+		return "", err
+	}
+	persons := []string{}
+	for person := range balances {
+		persons = append(persons, person)
+	}
+	sort.Strings(persons)
+	lines := []string{"# balances"}
+	for _, person := range persons {
+		lines = append(lines, fmt.Sprintf("%s: %s", person, balances[person]))
+	}
+	for _, strategy := range []StrategyName{StrategyGreedy, StrategyExact} {
+		if err := settler.SetStrategy(string(strategy)); err != nil {
+			return "", err
+		}
+		transfers, err := settler.Settle(false)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, fmt.Sprintf("# %s", strategy))
+		for _, transfer := range transfers {
+			lines = append(lines, fmt.Sprintf("%s -> %s: %s", transfer.Payer, transfer.Participants[0], transfer.Amount))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+func TestDirectory(t *testing.T) {
+	settler := NewSettler()
+	// the persons of the transactions are resolved ignoring the case and the
+	// leading @
+	if _, err := settler.AddExpense(&Transaction{
+		Payer:        "Bob",
+		Participants: []string{"Bob", "Alice"},
+		Amount:       NewMoney(1000, "EUR"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if name := settler.ResolveParticipant("@bob"); name != "Bob" {
+		t.Errorf("expected Bob, got %s", name)
+	}
+	if name := settler.ResolveParticipant("Carol"); name != "Carol" {
+		t.Errorf("expected unknown names as they are, got %s", name)
+	}
+	// the users are assigned to the known persons and keep their names when
+	// their usernames change
+	if name := settler.RegisterUser(2, "bob", "Bob"); name != "Bob" {
+		t.Errorf("expected Bob, got %s", name)
+	}
+	if name := settler.RegisterUser(2, "robert", "Bob"); name != "Bob" {
+		t.Errorf("expected Bob after the username change, got %s", name)
+	}
+	if name := settler.ResolveParticipant("@Robert"); name != "Bob" {
+		t.Errorf("expected the new username to be an alias, got %s", name)
+	}
+	// the users without username get their display name
+	if name := settler.RegisterUser(3, "", "Carol Ann"); name != "Carol_Ann" {
+		t.Errorf("expected Carol_Ann, got %s", name)
+	}
+	if name := settler.RegisterUser(4, "", "Carol Ann"); name != "Carol_Ann_4" {
+		t.Errorf("expected Carol_Ann_4, got %s", name)
+	}
+	if err := settler.AddAlias("alice", "Ali"); err != nil {
+		t.Fatal(err)
+	}
+	if err := settler.AddAlias("Carol_Ann", "bob"); !errors.Is(err, ErrAliasInUse) {
+		t.Errorf("expected ErrAliasInUse, got %v", err)
+	}
+	if err := settler.AddAlias("Dave", "D"); !errors.Is(err, ErrParticipantNotFound) {
+		t.Errorf("expected ErrParticipantNotFound, got %v", err)
+	}
+
+	// merging moves the balance of a participant to the other one, keeping
+	// the shares of the expenses of both and removing the payments between
+	// them
+	if _, err := settler.AddExpense(&Transaction{
+		Payer:        "Alice",
+		Participants: []string{"Carol_Ann", "Alice", "Bob"},
+		Amount:       NewMoney(1000, "EUR"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settler.AddPayment(&Transaction{
+		Kind:         KindPayment,
+		Payer:        "Carol_Ann",
+		Participants: []string{"Alice"},
+		Amount:       NewMoney(100, "EUR"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := settler.AddConstraint(&Constraint{Kind: ConstraintForbidden, Payer: "Alice", Receiver: "Carol_Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := settler.ListBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settler.MergeParticipants("Bob", "@robert"); !errors.Is(err, ErrSameParticipant) {
+		t.Errorf("expected ErrSameParticipant, got %v", err)
+	}
+	if _, err := settler.MergeParticipants("Dave", "Bob"); !errors.Is(err, ErrParticipantNotFound) {
+		t.Errorf("expected ErrParticipantNotFound, got %v", err)
+	}
+	changed, err := settler.MergeParticipants("carol_ann", "ALI")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != 2 {
+		t.Errorf("expected 2 transactions changed, got %d", changed)
+	}
+	after, err := settler.ListBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := after["Carol_Ann"]; ok || len(after) != 2 ||
+		after["Alice"].Units != before["Alice"].Units+before["Carol_Ann"].Units ||
+		after["Bob"] != before["Bob"] {
+		t.Errorf("expected the balance moved, got %v from %v", after, before)
+	}
+	if name := settler.ResolveParticipant("Carol_Ann"); name != "Alice" {
+		t.Errorf("expected the merged participant to be an alias, got %s", name)
+	}
+	if constraints := settler.ListConstraints(); len(constraints) != 0 {
+		t.Errorf("expected the constraint between both removed, got %v", constraints)
+	}
+	// undoing the merge restores the transactions and the directory
+	if _, err := settler.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	if balances, _ := settler.ListBalances(); balances["Carol_Ann"] != before["Carol_Ann"] {
+		t.Errorf("expected the balance restored, got %v", balances)
+	}
+	if name := settler.ResolveParticipant("Carol_Ann"); name != "Carol_Ann" {
+		t.Errorf("expected the participant restored, got %s", name)
+	}
+	if constraints := settler.ListConstraints(); len(constraints) != 1 {
+		t.Errorf("expected the constraint restored, got %v", constraints)
+	}
+	if _, err := settler.Redo(); err != nil {
+		t.Fatal(err)
+	}
+	if name := settler.ResolveParticipant("Carol_Ann"); name != "Alice" {
+		t.Errorf("expected the merge redone, got %s", name)
+	}
+	// the persons are the participants of the directory and the transactions
+	if persons := settler.ListPersons(); strings.Join(persons, " ") != "Alice Bob Carol_Ann_4" {
+		t.Errorf("expected Alice, Bob and Carol_Ann_4, got %v", persons)
+	}
+
+	// the directory is kept in the export
+	encoded, err := settler.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportSettle(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := imported.ResolveParticipant("@robert"); name != "Bob" {
+		t.Errorf("expected the aliases imported, got %s", name)
+	}
+	if participant := imported.ParticipantByUserID(3); participant == nil || participant.Name != "Alice" {
+		t.Errorf("expected the user of the merged participant, got %v", participant)
+	}
+}
+
+func TestMergeDirectoryParticipants(t *testing.T) {
+	events := []*Event{}
+	s := NewSettler()
+	s.SetEventLog(func(encoded []byte) error {
+		event, err := DecodeEvent(encoded)
+		if err != nil {
+			return err
+		}
+		events = append(events, event)
+		return nil
+	})
+	alice := s.RegisterUser(1, "alice", "Alice")
+	robert := s.RegisterUser(2, "", "Robert")
+	// no transaction mentions them, but the directory changes
+	if changed, err := s.MergeParticipants(robert, alice); err != nil || changed != 0 {
+		t.Fatalf("expected no transaction changed, got %d (%v)", changed, err)
+	}
+	if s.ResolveParticipant("Robert") != alice {
+		t.Errorf("expected Robert to be an alias of %s", alice)
+	}
+	merged, err := s.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the log rebuilds the directory merged
+	replayed, err := ReplayEvents(events, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := replayed.Export(); err != nil || !bytes.Equal(result, merged) {
+		t.Errorf("expected the replayed settler to be\n%s\ngot\n%s (%v)", merged, result, err)
+	}
+	// and the merge can be undone
+	entry, err := s.Undo()
+	if err != nil || entry.Operation != OpMerge {
+		t.Fatalf("expected the merge undone, got %v (%v)", entry, err)
+	}
+	if s.ResolveParticipant("Robert") != robert {
+		t.Errorf("expected Robert back in the directory, got %s", s.ResolveParticipant("Robert"))
+	}
+	replayed, err = ReplayEvents(events, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.ResolveParticipant("Robert") != robert || len(replayed.ListParticipants()) != 2 {
+		t.Errorf("expected the replayed directory undone, got %v", replayed.ListParticipants())
+	}
+}
+
+func TestEvents(t *testing.T) {
+	// the log fails once, so the next event is a checkpoint with the change
+	// lost
+	log := [][]byte{}
+	fail := false
+	s := NewSettler()
+	s.SetEventLog(func(event []byte) error {
+		if fail {
+			fail = false
+			return errors.New("disk full")
+		}
+		log = append(log, event)
+		return nil
+	})
+	alice := s.RegisterUser(1, "alice", "Alice")
+	id, err := s.AddExpense(&Transaction{Payer: alice, Participants: []string{alice, "Bob"}, Amount: NewMoney(3000, "EUR")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddPayment(&Transaction{Payer: "Bob", Participants: []string{alice}, Amount: NewMoney(500, "EUR")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetRate("USD", "EUR", 9000); err != nil {
+		t.Fatal(err)
+	}
+	// the state in the middle of the log
+	middle, err := s.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleLen := len(log)
+	if err := s.UpdateExpense(id, &Transaction{Payer: alice, Participants: []string{alice, "Bob", "Carol"}, Amount: NewMoney(3000, "USD")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Redo(); err != nil {
+		t.Fatal(err)
+	}
+	fail = true
+	if err := s.SetStrategy(string(StrategyExact)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.MergeParticipants("Carol", "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ClosePeriod("March", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveExpense(id)
+	// registering a known user changes nothing
+	s.RegisterUser(1, "alice", "Alice")
+	kinds := []EventKind{}
+	events := []*Event{}
+	for _, encoded := range log {
+		event, err := DecodeEvent(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, event.Kind)
+		events = append(events, event)
+	}
+	expectedKinds := []EventKind{
+		EventCheckpoint, EventSettings, EventOperation, EventOperation, EventSettings,
+		EventOperation, EventUndo, EventRedo, EventCheckpoint, EventOperation,
+	}
+	if fmt.Sprint(kinds) != fmt.Sprint(expectedKinds) {
+		t.Errorf("expected events %v, got %v", expectedKinds, kinds)
+	}
+	expected, err := s.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replaying the whole log rebuilds the settler
+	replayed, err := ReplayEvents(events, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := replayed.Export(); err != nil || !bytes.Equal(result, expected) {
+		t.Errorf("expected the replayed settler to be\n%s\ngot\n%s (%v)", expected, result, err)
+	}
+	// a settler restored from a snapshot ignores the events before it
+	restored, err := ImportSettle(middle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, encoded := range log {
+		if err := restored.ApplyEvent(encoded); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if result, err := restored.Export(); err != nil || !bytes.Equal(result, expected) {
+		t.Errorf("expected the restored settler to be\n%s\ngot\n%s (%v)", expected, result, err)
+	}
+	// the settler at a point in time only includes the events until it
+	for i, event := range events {
+		event.Time = time.Date(2024, 3, 1+i, 12, 0, 0, 0, time.UTC)
+	}
+	past, err := ReplayEvents(events, events[middleLen-1].Time)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := past.Export(); err != nil || !bytes.Equal(result, middle) {
+		t.Errorf("expected the past settler to be\n%s\ngot\n%s (%v)", middle, result, err)
+	}
+	// a missing event is detected
+	if _, err := ReplayEvents(append(events[:2:2], events[3:]...), time.Time{}); !errors.Is(err, ErrEventGap) {
+		t.Errorf("expected ErrEventGap, got %v", err)
+	}
+}
+
+func TestSchemaMigrations(t *testing.T) {
+	newExpense := func() *Transaction {
+		return &Transaction{
+			Payer:        "Alice",
+			Participants: []string{"Alice", "Bob"},
+			Amount:       NewMoney(1000, ""),
+		}
+	}
+	// exportWithout adds three expenses to a settler with the journal depth
+	// provided, removes the last one and returns its export without the
+	// fields provided
+	exportWithout := func(depth int, fields ...string) []byte {
+		t.Helper()
+		settler := NewSettler()
+		settler.SetJournalDepth(depth)
+		for i := 0; i < 3; i++ {
+			if _, err := settler.AddExpense(newExpense()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		settler.RemoveExpense(3)
+		encoded, err := settler.Export()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := map[string]json.RawMessage{}
+		if err := json.Unmarshal(encoded, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range fields {
+			delete(decoded, field)
+		}
+		if encoded, err = json.Marshal(decoded); err != nil {
+			t.Fatal(err)
+		}
+		return encoded
+	}
+	checkNextID := func(encoded []byte, expected int) {
+		t.Helper()
+		imported, err := ImportSettle(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, err := imported.AddExpense(newExpense()); err != nil || id != expected {
+			t.Errorf("expected the next expense to be %d, got %d (%v)", expected, id, err)
+		}
+	}
+
+	// version 0 did not store the last ID, it is recovered from the journal
+	// or, without it, from the IDs in use
+	checkNextID(exportWithout(DefaultJournalDepth, "version", "lastID"), 4)
+	checkNextID(exportWithout(0, "version", "lastID"), 3)
+
+	// version 1 stores the last ID, so the ID of the expense removed is not
+	// reused even without journal
+	encoded := exportWithout(0)
+	if !strings.Contains(string(encoded), `"version":1`) || !strings.Contains(string(encoded), `"lastID":3`) {
+		t.Errorf("expected the version and the last ID in the export, got %s", encoded)
+	}
+	checkNextID(encoded, 4)
+
+	// the versions after the current one are not supported
+	if _, err := ImportSettle([]byte(`{"version":2,"expenses":{}}`)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
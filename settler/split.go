@@ -0,0 +1,191 @@
+package settler
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SplitMode type defines how the amount of an expense is divided between its
+// participants.
+type SplitMode string
+
+const (
+	// SplitEqual mode divides the amount evenly between the participants.
+	SplitEqual SplitMode = "equal"
+	// SplitShares mode divides the amount proportionally to the number of
+	// shares of each participant.
+	SplitShares SplitMode = "shares"
+	// SplitPercentage mode assigns a percentage of the amount to each
+	// participant. The percentages must sum 100.
+	SplitPercentage SplitMode = "percentage"
+	// SplitExact mode assigns an exact amount to each participant. The amounts
+	// must sum the total amount of the expense.
+	SplitExact SplitMode = "exact"
+)
+
+// decimals of the values of each split mode: shares are integers, percentages
+// are stored in hundredths of percent and exact amounts in minor units
+var splitDecimals = map[SplitMode]int{
+	SplitShares:     0,
+	SplitPercentage: 2,
+	SplitExact:      moneyDecimals,
+}
+
+// fullPercentage is 100% in hundredths of percent
+const fullPercentage = 100_00
+
+var (
+	ErrNoParticipants   = errors.New("the expense has no participants")
+	ErrInvalidAmount    = errors.New("the amount must be greater than zero")
+	ErrInvalidSplit     = errors.New("invalid split")
+	ErrInvalidSplitMode = errors.New("unknown split mode")
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	ErrInvalidPayment   = errors.New("invalid payment")
+	ErrExpenseNotFound  = errors.New("expense not found")
+)
+
+// Split struct defines how an expense is divided between its participants.
+// Values contains the value of each participant depending on the mode: the
+// number of shares, the percentage in hundredths of percent (6000 is 60%) or
+// the exact amount in minor units of the currency of the expense. It is not
+// used in equal mode.
+type Split struct {
+	Mode   SplitMode        `json:"mode"`
+	Values map[string]int64 `json:"values,omitempty"`
+}
+
+// ParseSplitMode function returns the SplitMode that matches the provided
+// string or an error if it is unknown.
+func ParseSplitMode(mode string) (SplitMode, error) {
+	switch m := SplitMode(mode); m {
+	case SplitEqual, SplitShares, SplitPercentage, SplitExact:
+		return m, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrInvalidSplitMode, mode)
+}
+
+// ParseSplitValue function parses a value of a split of the provided mode
+// from its decimal representation, for example, "60" or "33.33" for a
+// percentage split or "12.30" for an exact split.
+func ParseSplitValue(mode SplitMode, str string) (int64, error) {
+	decimals, ok := splitDecimals[mode]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidSplitMode, mode)
+	}
+	value, err := parseDecimal(str, decimals)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrInvalidSplit, err)
+	}
+	return value, nil
+}
+
+// FormatSplitValue function returns the decimal representation of a value of
+// a split of the provided mode. It is the inverse of ParseSplitValue.
+func FormatSplitValue(mode SplitMode, value int64) string {
+	return formatDecimal(value, splitDecimals[mode])
+}
+
+// IsEqual method returns if the split divides the amount evenly, which is the
+// default behaviour when no split is defined.
+func (sp *Split) IsEqual() bool {
+	return sp == nil || sp.Mode == "" || sp.Mode == SplitEqual
+}
+
+// Validate method checks that the transaction has a payer, at least one
+// participant and a positive amount, and that its split is consistent with
+// them: every participant must have a value, the values must be positive,
+// the percentages must sum 100 and the exact amounts must sum the total
+// amount. Payments must have a single participant other than the payer and
+// no split.
+func (t *Transaction) Validate() error {
+	if len(t.Participants) == 0 {
+		return ErrNoParticipants
+	}
+	if t.Amount.Units <= 0 {
+		return ErrInvalidAmount
+	}
+	switch t.Kind {
+	case KindExpense:
+	case KindPayment:
+		if len(t.Participants) != 1 || t.Participants[0] == t.Payer || !t.Split.IsEqual() {
+			return fmt.Errorf("%w: it must be from a person to another", ErrInvalidPayment)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown kind %s", ErrInvalidPayment, t.Kind)
+	}
+	if t.Split.IsEqual() {
+		return nil
+	}
+	if _, err := ParseSplitMode(string(t.Split.Mode)); err != nil {
+		return err
+	}
+	if len(t.Split.Values) != len(t.Participants) {
+		return fmt.Errorf("%w: expected %d values, got %d", ErrInvalidSplit,
+			len(t.Participants), len(t.Split.Values))
+	}
+	total := int64(0)
+	for _, participant := range t.Participants {
+		value, ok := t.Split.Values[participant]
+		if !ok {
+			return fmt.Errorf("%w: no value for %s", ErrInvalidSplit, participant)
+		}
+		if value < 0 {
+			return fmt.Errorf("%w: negative value for %s", ErrInvalidSplit, participant)
+		}
+		total += value
+	}
+	switch t.Split.Mode {
+	case SplitShares:
+		if total <= 0 {
+			return fmt.Errorf("%w: shares must sum more than zero", ErrInvalidSplit)
+		}
+	case SplitPercentage:
+		if total != fullPercentage {
+			return fmt.Errorf("%w: percentages sum %s instead of 100", ErrInvalidSplit,
+				FormatSplitValue(SplitPercentage, total))
+		}
+	case SplitExact:
+		if total != t.Amount.Units {
+			return fmt.Errorf("%w: amounts sum %s instead of %s", ErrInvalidSplit,
+				FormatSplitValue(SplitExact, total), t.Amount.Decimal())
+		}
+	}
+	return nil
+}
+
+// Shares method returns the amount that each participant owes according to
+// the split of the transaction. The shares always sum the total amount, the
+// minor units that can not be divided are assigned following the rule of
+// Money.Allocate, in the order of the participants. It returns an error if
+// the transaction is not valid.
+func (t *Transaction) Shares() (map[string]Money, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	weights := make([]int64, len(t.Participants))
+	for i, participant := range t.Participants {
+		weights[i] = 1
+		if !t.Split.IsEqual() {
+			weights[i] = t.Split.Values[participant]
+		}
+	}
+	// exact amounts do not need to be allocated, they are already in minor
+	// units and they sum the total amount
+	parts := make([]Money, len(weights))
+	if !t.Split.IsEqual() && t.Split.Mode == SplitExact {
+		for i, weight := range weights {
+			parts[i] = NewMoney(weight, t.Amount.Currency)
+		}
+	} else {
+		var err error
+		if parts, err = t.Amount.Allocate(weights); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidSplit, err)
+		}
+	}
+	shares := make(map[string]Money, len(t.Participants))
+	for i, participant := range t.Participants {
+		shares[participant] = parts[i].Add(shares[participant])
+	}
+	return shares, nil
+}
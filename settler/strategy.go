@@ -0,0 +1,201 @@
+package settler
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// DefaultExactLimit is the default maximum number of persons with debts or
+// credits that the exact strategy settles, above it, it falls back to the
+// greedy one.
+const DefaultExactLimit = 16
+
+// MaxExactLimit is the maximum limit of the exact strategy, its memory grows
+// exponentially with the number of persons, so any higher limit is lowered
+// to it.
+const MaxExactLimit = 20
+
+// StrategyName type identifies a settlement strategy.
+type StrategyName string
+
+const (
+	// StrategyGreedy settles the debts of the person who owes the most with
+	// the person who is owed the most until every debt is settled. It is fast
+	// but it does not always find the fewest transfers. It is the default
+	// strategy.
+	StrategyGreedy StrategyName = "greedy"
+	// StrategyExact finds the fewest transfers by splitting the persons in
+	// as many groups whose balances sum zero as possible. Its cost grows
+	// exponentially with the number of persons, so it falls back to the
+	// greedy strategy above a limit.
+	StrategyExact StrategyName = "exact"
+)
+
+var ErrInvalidStrategy = errors.New("unknown settlement strategy")
+
+// Strategy interface defines an algorithm to settle balances. It receives the
+// balance of each person in the same currency, positive if the person is owed
+// money and negative if they owe it, that sum zero, and returns the
+// transfers that settle them. Each transfer is a transaction from its payer
+// to its only participant. It must not modify the balances provided.
+type Strategy interface {
+	Settle(balances map[string]Money) []*Transaction
+}
+
+// ParseStrategyName function returns the StrategyName that matches the
+// provided string or an error if it is unknown.
+func ParseStrategyName(name string) (StrategyName, error) {
+	switch n := StrategyName(name); n {
+	case StrategyGreedy, StrategyExact:
+		return n, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrInvalidStrategy, name)
+}
+
+// GreedyStrategy settles the balances matching the person who has paid the
+// most with the person who has paid the least, settling the minimum between
+// the amount owed to the first and the amount owed by the second, until
+// every debt is settled. It needs at most one transfer less than the number
+// of persons with a balance.
+type GreedyStrategy struct{}
+
+// Settle method returns the transfers that settle the balances provided.
+func (GreedyStrategy) Settle(balances map[string]Money) []*Transaction {
+	units, currency := balanceUnits(balances)
+	return greedySettle(units, currency)
+}
+
+// ExactStrategy settles the balances with the fewest transfers possible. A
+// group of persons whose balances sum zero can be settled on its own with a
+// transfer less than its size, so the fewest transfers are the number of
+// persons minus the maximum number of groups that sum zero in which they can
+// be split. It finds them with a dynamic programming over the subsets of
+// persons and settles each group with the greedy strategy. If there are more
+// persons than Limit or MaxExactLimit, or Limit is not positive, it uses the
+// greedy strategy for all of them.
+type ExactStrategy struct {
+	Limit int
+}
+
+// Settle method returns the transfers that settle the balances provided.
+func (e ExactStrategy) Settle(balances map[string]Money) []*Transaction {
+	units, currency := balanceUnits(balances)
+	persons := []string{}
+	for person, balance := range units {
+		if balance != 0 {
+			persons = append(persons, person)
+		}
+	}
+	if len(persons) > min(e.Limit, MaxExactLimit) {
+		return greedySettle(units, currency)
+	}
+	sort.Strings(persons)
+	// sums[mask] is the sum of the balances of the persons of the subset
+	// mask and groups[mask] is the maximum number of groups that sum zero in
+	// which the subset can be split, ignoring the rest of persons that do not
+	// belong to any group
+	size := 1 << len(persons)
+	sums := make([]int64, size)
+	groups := make([]int, size)
+	for mask := 1; mask < size; mask++ {
+		lowest := bits.TrailingZeros(uint(mask))
+		sums[mask] = sums[mask&(mask-1)] + units[persons[lowest]]
+		for i := range persons {
+			if mask&(1<<i) != 0 {
+				groups[mask] = max(groups[mask], groups[mask&^(1<<i)])
+			}
+		}
+		if sums[mask] == 0 {
+			groups[mask]++
+		}
+	}
+	// rebuild the groups removing the persons one by one keeping the
+	// maximum, every time the remaining subset sums zero, the persons
+	// removed since the previous one form a group
+	result := []*Transaction{}
+	group := map[string]int64{}
+	for mask := size - 1; mask > 0; {
+		target := groups[mask]
+		if sums[mask] == 0 {
+			target--
+		}
+		for i := range persons {
+			if next := mask &^ (1 << i); mask&(1<<i) != 0 && groups[next] == target {
+				group[persons[i]] = units[persons[i]]
+				mask = next
+				break
+			}
+		}
+		if sums[mask] == 0 {
+			result = append(result, greedySettle(group, currency)...)
+			group = map[string]int64{}
+		}
+	}
+	return result
+}
+
+// newStrategy function returns the strategy with the name provided, the
+// greedy one if it is unknown. The exact strategy gets the limit provided, up
+// to MaxExactLimit.
+func newStrategy(name StrategyName, exactLimit int) Strategy {
+	if name == StrategyExact {
+		return ExactStrategy{Limit: min(exactLimit, MaxExactLimit)}
+	}
+	return GreedyStrategy{}
+}
+
+// balanceUnits function returns a copy of the balances provided in minor
+// units and their currency.
+func balanceUnits(balances map[string]Money) (map[string]int64, string) {
+	units := make(map[string]int64, len(balances))
+	currency := ""
+	for person, balance := range balances {
+		units[person] = balance.Units
+		currency = balance.Currency
+	}
+	return units, currency
+}
+
+// greedySettle function settles the balances provided, in minor units of the
+// currency provided, with the greedy strategy. It modifies the balances. The
+// result does not depend on the order of the map, the persons with the same
+// balance are picked by name.
+func greedySettle(balances map[string]int64, currency string) []*Transaction {
+	result := []*Transaction{}
+	for {
+		maxCreditor := ""
+		maxDebtor := ""
+		maxAmount := int64(0)
+		minAmount := int64(0)
+		// find the person who has paid the most and the person who has paid
+		// the least and the amounts, breaking ties by name to get the same
+		// transfers every time
+		for person, balance := range balances {
+			if balance > maxAmount || (balance > 0 && balance == maxAmount && person < maxCreditor) {
+				maxCreditor = person
+				maxAmount = balance
+			}
+			if balance < minAmount || (balance < 0 && balance == minAmount && person < maxDebtor) {
+				maxDebtor = person
+				minAmount = balance
+			}
+		}
+		// if no one is owed or no one owes, debts are settled, the balances
+		// always sum zero so both conditions happen at the same time
+		if maxCreditor == "" || maxDebtor == "" {
+			return result
+		}
+		// settle the debt getting the minimum between the amount owed to the
+		// creditor and the amount owed by the debtor
+		settleAmount := min(maxAmount, -minAmount)
+		balances[maxCreditor] -= settleAmount
+		balances[maxDebtor] += settleAmount
+		result = append(result, &Transaction{
+			Payer:        maxDebtor,
+			Participants: []string{maxCreditor},
+			Amount:       NewMoney(settleAmount, currency),
+		})
+	}
+}